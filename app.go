@@ -2,6 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/wailsapp/wails/v2/pkg/runtime"
 
 	"zero/internal/chat"
 )
@@ -9,6 +15,15 @@ import (
 type App struct {
 	ctx  context.Context
 	mgr  *chat.Manager
+	once sync.Once // Initialise + Worker nach dem ersten Entsperren
+}
+
+// AttachmentData ist ein entschlüsselter Anhang für die UI; Data ist
+// Base64, damit er sich direkt als data:-URL verwenden lässt.
+type AttachmentData struct {
+	Name string `json:"name"`
+	Mime string `json:"mime"`
+	Data string `json:"data"`
 }
 
 func NewApp() *App { return &App{} }
@@ -16,24 +31,294 @@ func NewApp() *App { return &App{} }
 func (a *App) startup(ctx context.Context) {
 	a.ctx = ctx
 
-	mgr, err := chat.NewManager("./data", "Alice")
+	mgr, err := newManager(ctx)
 	if err != nil { panic(err) }
 
-	if err = mgr.Initialise(); err != nil { panic(err) }
+	// Empfangsfehler (manipulierte/kaputte Nachrichten) an die UI melden
+	mgr.SetErrorHandler(func(id string, err error) {
+		runtime.EventsEmit(a.ctx, "chat:error", id, err.Error())
+	})
+
+	// Identity-Key eines Kontakts hat sich geändert → Warnung anzeigen
+	mgr.SetKeyChangeHandler(func(id string) {
+		runtime.EventsEmit(a.ctx, "chat:keychange", id)
+	})
+
+	// Ausgang geändert (eingereiht, zugestellt, aufgegeben) → Verlauf neu laden
+	mgr.SetOutboxHandler(func(id string) {
+		runtime.EventsEmit(a.ctx, "chat:outbox", id)
+	})
+
+	// neue Nachricht oder Quittung → Verlauf neu laden
+	mgr.SetHistoryHandler(func(id string) {
+		runtime.EventsEmit(a.ctx, "chat:history", id)
+	})
+
+	// Gruppennachricht oder Mitgliederliste geändert
+	mgr.SetGroupHandler(func(id string) {
+		runtime.EventsEmit(a.ctx, "chat:group", id)
+	})
+
+	// eigene oder fremde Geräteliste geändert, Gerät verknüpft
+	mgr.SetDeviceHandler(func() {
+		runtime.EventsEmit(a.ctx, "chat:devices")
+	})
+
+	// gesperrt (Auto-Lock oder von Hand) → Entsperr-Bildschirm
+	mgr.SetLockHandler(func() {
+		runtime.EventsEmit(a.ctx, "chat:locked")
+	})
+
+	// Fortschritt beim Umschlüsseln des Stores
+	mgr.SetRekeyHandler(func(done, total int) {
+		runtime.EventsEmit(a.ctx, "chat:rekey", done, total)
+	})
+
+	// Initialise erst, wenn die UI entsperrt bzw. eine Passphrase gesetzt hat
 	a.mgr = mgr
 }
 
+// open startet den Manager einmalig, sobald die Schlüssel da sind.
+func (a *App) open() error {
+	var err error
+	a.once.Do(func() {
+		if err = a.mgr.Initialise(); err != nil {
+			return
+		}
+		a.mgr.StartOutbox(a.ctx)
+	})
+	return err
+}
+
+// ZERO_TOR=1 → echter Onion-Service statt In-Process-Demo
+func newManager(ctx context.Context) (*chat.Manager, error) {
+	if os.Getenv("ZERO_TOR") == "" {
+		return chat.NewManager("./data", "Alice")
+	}
+	if err := os.MkdirAll("./data/tor", 0o700); err != nil {
+		return nil, err
+	}
+	tp := chat.NewTorTransport(chat.NewTorNetwork("./data/tor", "./data/onion_ed25519.key"))
+	if err := tp.Start(ctx); err != nil {
+		return nil, err
+	}
+	log.Printf("[App] reachable at %s.onion", tp.Address())
+	return chat.NewManagerWithTransport("./data", "Alice", tp)
+}
+
 /* --------- exportierte Wails-Methoden --------- */
 
+// IsProtected: false → die UI fragt zuerst nach einer neuen Passphrase.
+func (a *App) IsProtected() bool { return a.mgr.Protected() }
+
+func (a *App) IsLocked() bool { return a.mgr.Locked() }
+
+func (a *App) Unlock(pass string) error {
+	if err := a.mgr.Unlock(pass); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+// SetPassphrase schützt den Store beim ersten Start oder ändert die
+// Passphrase später.
+func (a *App) SetPassphrase(pass string) error {
+	if err := a.mgr.SetPassphrase(pass); err != nil {
+		return err
+	}
+	return a.open()
+}
+
+func (a *App) Lock() error {
+	return a.mgr.Lock()
+}
+
+// Touch meldet Nutzeraktivität; die UI ruft es gedrosselt auf.
+func (a *App) Touch() {
+	a.mgr.Touch()
+}
+
+func (a *App) SetAutoLock(minutes int) error {
+	return a.mgr.SetAutoLock(minutes)
+}
+
+// Rekey verschlüsselt den Store mit einem neuen Master-Key; next ersetzt
+// die Passphrase (leer = bleibt).
+func (a *App) Rekey(current, next string) error {
+	return a.mgr.Rekey(current, next)
+}
+
 func (a *App) GetContacts() ([]*chat.Contact, error) {
 	return a.mgr.Contacts()
 }
 
-func (a *App) GetMessages(id string, since int64) ([]chat.PlainMessage, error) {
-	return a.mgr.Messages(id, since)
+// GetMessages blättert durch den Verlauf: direction "older" liefert die
+// limit Nachrichten vor cursor (0 = die neuesten), "newer" die danach.
+func (a *App) GetMessages(id string, cursor uint64, limit int, direction string) (*chat.MessagePage, error) {
+	return a.mgr.MessagesPage(id, cursor, limit, direction)
 }
 
 func (a *App) SendMessage(id, text string) error {
 	return a.mgr.Send(id, text)
 }
 
+
+func (a *App) GetFingerprint(id string) (*chat.Fingerprint, error) {
+	return a.mgr.Fingerprint(id)
+}
+
+func (a *App) VerifyContact(id string) error {
+	return a.mgr.SetVerified(id, true)
+}
+
+func (a *App) UnverifyContact(id string) error {
+	return a.mgr.SetVerified(id, false)
+}
+
+func (a *App) VerifyContactQR(id, payload string) error {
+	return a.mgr.VerifyQR(id, payload)
+}
+
+func (a *App) AcknowledgeKeyChange(id string) (string, error) {
+	return a.mgr.AcknowledgeKeyChange(id)
+}
+
+func (a *App) RejectKeyChange(id string) error {
+	return a.mgr.RejectKeyChange(id)
+}
+
+// DeleteContact löscht den Kontakt und vernichtet seinen Verlauf.
+func (a *App) DeleteContact(id string) error {
+	return a.mgr.DeleteContact(id)
+}
+
+func (a *App) GetPending(id string) ([]chat.PendingMessage, error) {
+	return a.mgr.Pending(id)
+}
+
+// SendReply antwortet auf msgID und zitiert sie.
+func (a *App) SendReply(id, msgID, text string) error {
+	return a.mgr.Reply(id, msgID, text)
+}
+
+// React setzt die eigene Reaktion; ein leeres Emoji nimmt sie zurück.
+func (a *App) React(id, msgID, emoji string) error {
+	if emoji == "" {
+		return a.mgr.RemoveReaction(id, msgID)
+	}
+	return a.mgr.React(id, msgID, emoji)
+}
+
+// EditMessage und DeleteMessage gelten nur für eigene Nachrichten.
+func (a *App) EditMessage(id, msgID, text string) error {
+	return a.mgr.EditMessage(id, msgID, text)
+}
+
+func (a *App) DeleteMessage(id, msgID string) error {
+	return a.mgr.DeleteMessage(id, msgID)
+}
+
+func (a *App) CancelMessage(id, msgID string) error {
+	return a.mgr.CancelMessage(id, msgID)
+}
+
+func (a *App) RetryMessage(id, msgID string) error {
+	return a.mgr.RetryMessage(id, msgID)
+}
+
+// MarkRead wird aufgerufen, sobald die UI eine Unterhaltung anzeigt.
+func (a *App) MarkRead(id string) error {
+	return a.mgr.MarkRead(id)
+}
+
+func (a *App) GetSettings() (*chat.Settings, error) {
+	return a.mgr.Settings()
+}
+
+func (a *App) SetReadReceipts(enabled bool) error {
+	return a.mgr.SetReadReceipts(enabled)
+}
+
+// SetLogSync: "always", "batch" oder "none".
+func (a *App) SetLogSync(policy string) error {
+	return a.mgr.SetLogSync(policy)
+}
+
+func (a *App) SetContactReadReceipts(id string, enabled bool) error {
+	return a.mgr.SetContactReadReceipts(id, enabled)
+}
+
+// SetExpireTimer stellt verschwindende Nachrichten ein (Sekunden, 0 = aus).
+func (a *App) SetExpireTimer(id string, seconds uint32) error {
+	return a.mgr.SetExpireTimer(id, seconds)
+}
+
+// SendAttachment nimmt die Datei Base64-kodiert entgegen.
+func (a *App) SendAttachment(id, name, mime, data string) error {
+	raw, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return err
+	}
+	return a.mgr.SendAttachment(id, name, mime, raw)
+}
+
+func (a *App) GetAttachment(blob string) (*AttachmentData, error) {
+	info, data, err := a.mgr.Attachment(blob)
+	if err != nil {
+		return nil, err
+	}
+	return &AttachmentData{Name: info.Name, Mime: info.Mime, Data: base64.StdEncoding.EncodeToString(data)}, nil
+}
+
+func (a *App) DeleteAttachment(blob string) error {
+	return a.mgr.DeleteAttachment(blob)
+}
+
+func (a *App) SetMaxAttachmentSize(n int64) error {
+	return a.mgr.SetMaxAttachmentSize(n)
+}
+
+func (a *App) GetGroups() ([]*chat.GroupInfo, error) {
+	return a.mgr.Groups()
+}
+
+func (a *App) CreateGroup(name string, members []string) (*chat.GroupInfo, error) {
+	return a.mgr.CreateGroup(name, members)
+}
+
+func (a *App) AddGroupMember(groupID, id string) error {
+	return a.mgr.AddGroupMember(groupID, id)
+}
+
+func (a *App) RemoveGroupMember(groupID, id string) error {
+	return a.mgr.RemoveGroupMember(groupID, id)
+}
+
+func (a *App) LeaveGroup(groupID string) error {
+	return a.mgr.LeaveGroup(groupID)
+}
+
+func (a *App) GetGroupMessages(groupID string, since int64) ([]chat.PlainMessage, error) {
+	return a.mgr.GroupMessages(groupID, since)
+}
+
+func (a *App) SendGroupMessage(groupID, text string) error {
+	return a.mgr.SendGroup(groupID, text)
+}
+
+func (a *App) GetDevices() ([]*chat.DeviceInfo, error) {
+	return a.mgr.Devices()
+}
+
+// GetLinkCode liefert den Code (bzw. QR-Payload) zum Verknüpfen dieses Geräts.
+func (a *App) GetLinkCode(name string) (string, error) {
+	return a.mgr.LinkCode(name)
+}
+
+func (a *App) LinkDevice(code string) error {
+	return a.mgr.LinkDevice(code)
+}
+
+func (a *App) UnlinkDevice(id string) error {
+	return a.mgr.UnlinkDevice(id)
+}
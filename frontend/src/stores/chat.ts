@@ -1,33 +1,214 @@
 import { reactive, ref } from 'vue'
 import { defineStore } from 'pinia'
 import {
-  GetContacts, GetMessages, SendMessage
+  GetContacts, GetMessages, SendMessage,
+  GetFingerprint, VerifyContact, UnverifyContact, AcknowledgeKeyChange, RejectKeyChange, DeleteContact,
+  CancelMessage, RetryMessage, EditMessage, DeleteMessage, SendReply, React,
+  MarkRead, GetSettings, SetReadReceipts, SetContactReadReceipts, SetExpireTimer,
+  SendAttachment, GetAttachment, DeleteAttachment,
+  GetGroups, CreateGroup, AddGroupMember, RemoveGroupMember, LeaveGroup,
+  GetGroupMessages, SendGroupMessage,
+  GetDevices, GetLinkCode, LinkDevice, UnlinkDevice,
+  IsLocked, IsProtected, Unlock, SetPassphrase, Lock, Touch, SetAutoLock, Rekey,
+  SetLogSync
 } from '../../wailsjs/go/main/App'
+import { EventsOn } from '../../wailsjs/runtime/runtime'
 import type {
-  Contact, Message
+  Contact, Device, Fingerprint, Group, Message
 } from '../types'
 
 export const useChat = defineStore('chat', () => {
 
   /* ───────── state ───────── */
   const contacts = ref<Contact[]>([])
+  const groups   = ref<Group[]>([])
+  const devices  = ref<Device[]>([])
+  const linkCode = ref('')             // offener Code dieses Geräts
   const messages = reactive<Record<string, Message[]>>({})
+  const errors   = reactive<Record<string, string>>({})
+  const readReceipts = ref(true)
+  const locked     = ref(true)           // bis IsLocked() geantwortet hat
+  const protectedStore = ref(true)       // false → erst Passphrase setzen
+  const autoLock   = ref(15)             // Minuten, 0 = nie
+  const logSync    = ref('always')       // always | batch | none
+  const rekeyProgress = ref<{ done: number, total: number } | null>(null)
+
+  /* Backend meldet Nachrichten, die nicht entschlüsselt werden konnten */
+  EventsOn('chat:error', (contactId: string, msg: string) => {
+    console.error('[Pinia] receive error', contactId, msg)
+    errors[contactId] = msg
+  })
+
+  /* Ausgang hat sich geändert → Verlauf (mit Status) neu laden */
+  EventsOn('chat:outbox', (contactId: string) => {
+    if (messages[contactId]) loadHistory(contactId)
+  })
+
+  /* Neue Nachricht, Quittung oder abgelaufene Nachricht → Verlauf neu
+     laden; der Kontakt kann dabei auch den Timer geändert haben */
+  EventsOn('chat:history', (contactId: string) => {
+    if (messages[contactId]) loadHistory(contactId)
+    loadContacts()
+  })
+
+  /* Gruppennachricht oder Mitgliederliste geändert */
+  EventsOn('chat:group', (groupId: string) => {
+    loadGroups()
+    if (messages[groupId]) loadGroupHistory(groupId)
+  })
+
+  /* Geräteliste geändert oder dieses Gerät verknüpft (bringt Kontakte mit) */
+  EventsOn('chat:devices', () => {
+    loadDevices()
+    loadContacts()
+  })
+
+  /* Identity-Key eines Kontakts hat sich geändert → Liste neu laden */
+  EventsOn('chat:keychange', (contactId: string) => {
+    console.warn('[Pinia] safety number changed', contactId)
+    loadContacts()
+  })
+
+  /* Gesperrt (von Hand oder nach Leerlauf) → Klartext aus der UI werfen */
+  EventsOn('chat:locked', () => {
+    locked.value = true
+    for (const id of Object.keys(messages)) delete messages[id]
+    for (const id of Object.keys(errors)) delete errors[id]
+    contacts.value = []
+    groups.value = []
+    devices.value = []
+    linkCode.value = ''
+  })
+
+  /* Fortschritt beim Umschlüsseln (Dateien) */
+  EventsOn('chat:rekey', (done: number, total: number) => {
+    rekeyProgress.value = { done, total }
+  })
 
   /* ───────── actions ─────── */
+  async function checkLock() {
+    [locked.value, protectedStore.value] = await Promise.all([IsLocked(), IsProtected()])
+  }
+
+  async function unlock(pass: string) {
+    await Unlock(pass)
+    locked.value = false
+  }
+
+  /* erster Start: Store mit Passphrase schützen */
+  async function setPassphrase(pass: string) {
+    await SetPassphrase(pass)
+    protectedStore.value = true
+    locked.value = false
+  }
+
+  async function lock() {
+    await Lock()
+  }
+
+  /* Nutzeraktivität höchstens alle 10 s melden */
+  let lastTouch = 0
+  function touch() {
+    const now = Date.now()
+    if (locked.value || now - lastTouch < 10_000) return
+    lastTouch = now
+    Touch().catch(e => console.error('Touch failed', e))
+  }
+
+  async function rekey(current: string, next: string) {
+    rekeyProgress.value = { done: 0, total: 0 }
+    try {
+      await Rekey(current, next)
+    } finally {
+      rekeyProgress.value = null
+    }
+  }
+
+  async function setAutoLock(minutes: number) {
+    await SetAutoLock(minutes)
+    autoLock.value = minutes
+  }
+
+  async function setLogSync(policy: string) {
+    await SetLogSync(policy)
+    logSync.value = policy
+  }
+
   async function loadContacts() {
     const list = await GetContacts()
     contacts.value = list.map(c => ({
       id: c.id,
       name: c.name,
       unread: 0,
-      last: ''
+      last: '',
+      verified: c.verified,
+      keyChanged: c.key_changed,
+      pendingKey: !!c.pending_key,
+      readReceipts: !c.no_read_receipts,
+      expireTimer: c.expire_timer ?? 0
     }))
   }
 
+  async function loadSettings() {
+    const s = await GetSettings()
+    readReceipts.value = s.read_receipts
+    autoLock.value = s.auto_lock_minutes
+    logSync.value = s.log_sync || 'always'
+  }
+
+  /* Unterhaltung wird angezeigt → gelesen (und ggf. Lesebestätigung) */
+  async function markRead(id: string) {
+    await MarkRead(id)
+  }
+
+  async function setReadReceipts(enabled: boolean) {
+    await SetReadReceipts(enabled)
+    readReceipts.value = enabled
+  }
+
+  async function setContactReadReceipts(id: string, enabled: boolean) {
+    await SetContactReadReceipts(id, enabled)
+    const c = contacts.value.find(c => c.id === id)
+    if (c) c.readReceipts = enabled
+  }
+
+  async function setExpireTimer(id: string, seconds: number) {
+    await SetExpireTimer(id, seconds)
+    const c = contacts.value.find(c => c.id === id)
+    if (c) c.expireTimer = seconds
+  }
+
+  /* Verlauf wird seitenweise geladen; je Kontakt merken wir uns den
+     Cursor der ältesten geladenen Nachricht */
+  const PAGE_SIZE = 50
+  const older = reactive<Record<string, { first: number, more: boolean }>>({})
+  const loadingOlder = new Set<string>()
+
+  /* neueste Nachrichten frisch holen; schon nachgeladene ältere bleiben
+     sichtbar, deshalb mindestens so viele wie bisher */
   async function loadHistory(contactId: string) {
-    const raw = await GetMessages(contactId, 0)
+    const limit = Math.max(PAGE_SIZE, messages[contactId]?.length ?? 0)
+    const page = await GetMessages(contactId, 0, limit, 'older')
+    messages[contactId] = toMessages(contactId, page.messages ?? [])
+    older[contactId] = { first: page.first, more: page.more }
+  }
+
+  /* nächste ältere Seite vorne anhängen (Scrollen nach oben) */
+  async function loadOlder(contactId: string) {
+    const o = older[contactId]
+    if (!o?.more || loadingOlder.has(contactId)) return
+    loadingOlder.add(contactId)
+    try {
+      const page = await GetMessages(contactId, o.first, PAGE_SIZE, 'older')
+      messages[contactId] = [...toMessages(contactId, page.messages ?? []), ...(messages[contactId] ?? [])]
+      older[contactId] = { first: page.first, more: page.more }
+    } finally {
+      loadingOlder.delete(contactId)
+    }
+  }
 
-    messages[contactId] = raw.map((m: any) => {
+  function toMessages(contactId: string, raw: any[]): Message[] {
+    return raw.map((m: any) => {
       // Date-String → Date-Objekt
       const ts = typeof m.at === 'string'
         ? new Date(m.at)            // ISO-String → Date
@@ -36,9 +217,21 @@ export const useChat = defineStore('chat', () => {
       return {
         id: m.id,
         contactId,
+        type: m.type,
         text: m.text,
         mine: m.out,
-        timestamp: ts
+        timestamp: ts,
+        sent: m.sent ? new Date(m.sent) : undefined,
+        status: m.status,
+        unsupported: m.unsupported,
+        attachment: m.attachment,
+        from: m.from,
+        expires: m.expires ? new Date(m.expires) : undefined,
+        edited: m.edited,
+        history: m.history?.map((h: any) => ({ text: h.text, at: new Date(h.at) })),
+        deleted: m.deleted,
+        quote: m.quote,
+        reactions: m.reactions
       }
     })
   }
@@ -52,5 +245,170 @@ export const useChat = defineStore('chat', () => {
     }
   }
 
-  return { contacts, messages, loadContacts, loadHistory, send }
+  /* Datei lesen und Base64-kodiert ans Backend geben */
+  async function sendFile(id: string, file: File) {
+    const buf = new Uint8Array(await file.arrayBuffer())
+    let bin = ''
+    for (let i = 0; i < buf.length; i += 0x8000) {
+      bin += String.fromCharCode(...buf.subarray(i, i + 0x8000))
+    }
+    await SendAttachment(id, file.name, file.type, btoa(bin))
+  }
+
+  /* Entschlüsselten Anhang als data:-URL */
+  async function openAttachment(blobId: string): Promise<{ name: string; url: string }> {
+    const a = await GetAttachment(blobId)
+    return { name: a.name, url: `data:${a.mime};base64,${a.data}` }
+  }
+
+  async function deleteAttachment(id: string, blobId: string) {
+    await DeleteAttachment(blobId)
+    await loadHistory(id)
+  }
+
+  /* ───────── Gruppen ─────── */
+  async function loadGroups() {
+    groups.value = await GetGroups()
+  }
+
+  async function loadGroupHistory(groupId: string) {
+    messages[groupId] = toMessages(groupId, await GetGroupMessages(groupId, 0))
+  }
+
+  async function createGroup(name: string, members: string[]) {
+    const g = await CreateGroup(name, members)
+    await loadGroups()
+    return g.id
+  }
+
+  async function sendGroup(groupId: string, text: string) {
+    await SendGroupMessage(groupId, text)
+    await loadGroupHistory(groupId)
+  }
+
+  async function addGroupMember(groupId: string, contactId: string) {
+    await AddGroupMember(groupId, contactId)
+    await loadGroups()
+  }
+
+  async function removeGroupMember(groupId: string, contactId: string) {
+    await RemoveGroupMember(groupId, contactId)
+    await loadGroups()
+  }
+
+  async function leaveGroup(groupId: string) {
+    await LeaveGroup(groupId)
+    await loadGroups()
+  }
+
+  /* ───────── Geräte ─────── */
+  async function loadDevices() {
+    devices.value = await GetDevices()
+    if (devices.value.length > 1) linkCode.value = ''
+  }
+
+  /* Code (bzw. QR-Payload), den das Primärgerät einliest */
+  async function requestLinkCode(name: string) {
+    linkCode.value = await GetLinkCode(name)
+  }
+
+  async function linkDevice(code: string) {
+    await LinkDevice(code)
+    await loadDevices()
+  }
+
+  async function unlinkDevice(id: string) {
+    await UnlinkDevice(id)
+    await loadDevices()
+  }
+
+  /* Sicherheitsnummer zum Vergleichen (vorlesen oder QR-Code) */
+  async function fingerprint(id: string): Promise<Fingerprint> {
+    const fp = await GetFingerprint(id)
+    return {
+      safetyNumber: fp.safety_number,
+      emoji: fp.emoji,
+      qrPayload: fp.qr_payload,
+      verified: fp.verified
+    }
+  }
+
+  async function setVerified(id: string, verified: boolean) {
+    await (verified ? VerifyContact(id) : UnverifyContact(id))
+    const c = contacts.value.find(c => c.id === id)
+    if (c) {
+      c.verified = verified
+      if (verified && !c.pendingKey) c.keyChanged = false
+    }
+  }
+
+  async function cancel(id: string, msgId: string) {
+    await CancelMessage(id, msgId)
+    await loadHistory(id)
+  }
+
+  async function retry(id: string, msgId: string) {
+    await RetryMessage(id, msgId)
+    await loadHistory(id)
+  }
+
+  async function editMessage(id: string, msgId: string, text: string) {
+    await EditMessage(id, msgId, text)
+    await loadHistory(id)
+  }
+
+  async function deleteMessage(id: string, msgId: string) {
+    await DeleteMessage(id, msgId)
+    await loadHistory(id)
+  }
+
+  async function reply(id: string, msgId: string, text: string) {
+    await SendReply(id, msgId, text)
+    await loadHistory(id)
+  }
+
+  /* leeres Emoji nimmt die eigene Reaktion zurück */
+  async function react(id: string, msgId: string, emoji: string) {
+    await React(id, msgId, emoji)
+    await loadHistory(id)
+  }
+
+  /* neuen Key annehmen; der Kontakt bekommt damit eine neue ID */
+  async function acknowledgeKeyChange(id: string): Promise<string> {
+    const next = await AcknowledgeKeyChange(id)
+    if (next !== id) {
+      delete messages[id]
+      delete older[id]
+    }
+    await loadContacts()
+    return next
+  }
+
+  /* alten Key behalten, was unter dem neuen kam, wird verworfen */
+  async function rejectKeyChange(id: string) {
+    await RejectKeyChange(id)
+    await loadContacts()
+  }
+
+  /* vernichtet den Verlauf unwiderruflich, siehe Store.ShredContact */
+  async function deleteContact(id: string) {
+    await DeleteContact(id)
+    delete messages[id]
+    delete errors[id]
+    delete older[id]
+    await loadContacts()
+  }
+
+  return {
+    contacts, groups, messages, errors, readReceipts,
+    loadContacts, loadHistory, loadOlder, send, fingerprint, setVerified,
+    acknowledgeKeyChange, rejectKeyChange, deleteContact, cancel, retry, editMessage, deleteMessage, reply, react,
+    loadSettings, markRead, setReadReceipts, setContactReadReceipts, setExpireTimer,
+    sendFile, openAttachment, deleteAttachment,
+    loadGroups, loadGroupHistory, createGroup, sendGroup,
+    addGroupMember, removeGroupMember, leaveGroup,
+    devices, linkCode, loadDevices, requestLinkCode, linkDevice, unlinkDevice,
+    locked, protectedStore, autoLock, checkLock, unlock, setPassphrase, lock, touch, setAutoLock,
+    rekeyProgress, rekey, logSync, setLogSync
+  }
 })
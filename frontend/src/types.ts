@@ -3,13 +3,73 @@ export interface Contact {
   name: string
   unread: number
   last: string
+  verified: boolean       // Sicherheitsnummer bestätigt
+  keyChanged: boolean     // neuer Identity-Key, Senden gesperrt
+  pendingKey: boolean     // neuer Key nur vorgemerkt, annehmen oder ablehnen
+  readReceipts: boolean   // Lesebestätigungen an diesen Kontakt
+  expireTimer: number     // verschwindende Nachrichten, Sekunden (0 = aus)
+}
+
+export interface Fingerprint {
+  safetyNumber: string
+  emoji: string[]
+  qrPayload: string
+  verified: boolean
 }
 
 export interface Message {
   id: string
   contactId: string
+  type: string            // text | … (unbekannte Typen: unsupported)
   text: string
   mine: boolean
   timestamp: Date
+  sent?: Date             // Uhr des Absenders
+  unsupported?: boolean   // Text ist nur ein Platzhalter
+  attachment?: Attachment
+  from?: string           // Absender in Gruppen (Kontakt-ID)
+  status?: string         // queued | failed | cancelled | delivered | read (leer = gesendet)
+  expires?: Date          // verschwindet zu diesem Zeitpunkt
+  edited?: boolean
+  history?: { text: string; at: Date }[]  // frühere Fassungen, älteste zuerst
+  deleted?: boolean       // für alle gelöscht
+  quote?: Quote           // Antwort auf eine frühere Nachricht
+  reactions?: Reaction[]
+}
+
+export interface Quote {
+  id: string
+  text: string            // Ausschnitt
+  out: boolean            // zitierte Nachricht ist von uns
+  deleted?: boolean
+}
+
+export interface Reaction {
+  emoji: string
+  count: number
+  mine: boolean           // eine davon ist unsere
+}
+
+export interface Attachment {
+  id: string
+  name: string
+  mime: string
+  size: number
+  state: string           // uploading | uploaded | downloading | complete | failed
+  done: number            // übertragene Chunks
+  chunks: number
 }
 
+export interface Group {
+  id: string
+  name: string
+  members: string[]       // Kontakt-IDs, ohne uns selbst
+  left: boolean           // ausgetreten oder entfernt
+}
+
+export interface Device {
+  id: string
+  name: string
+  primary: boolean        // Primärgerät = Konto
+  current: boolean        // dieses Gerät
+}
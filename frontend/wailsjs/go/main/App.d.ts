@@ -1,9 +1,97 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 import {chat} from '../models';
+import {main} from '../models';
+
+export function AcknowledgeKeyChange(arg1:string):Promise<string>;
+
+export function AddGroupMember(arg1:string,arg2:string):Promise<void>;
+
+export function CancelMessage(arg1:string,arg2:string):Promise<void>;
+
+export function CreateGroup(arg1:string,arg2:Array<string>):Promise<chat.GroupInfo>;
+
+export function DeleteAttachment(arg1:string):Promise<void>;
+
+export function DeleteContact(arg1:string):Promise<void>;
+
+export function DeleteMessage(arg1:string,arg2:string):Promise<void>;
+
+export function EditMessage(arg1:string,arg2:string,arg3:string):Promise<void>;
+
+export function GetAttachment(arg1:string):Promise<main.AttachmentData>;
 
 export function GetContacts():Promise<Array<chat.Contact>>;
 
-export function GetMessages(arg1:string,arg2:number):Promise<Array<chat.PlainMessage>>;
+export function GetDevices():Promise<Array<chat.DeviceInfo>>;
+
+export function GetFingerprint(arg1:string):Promise<chat.Fingerprint>;
+
+export function GetGroupMessages(arg1:string,arg2:number):Promise<Array<chat.PlainMessage>>;
+
+export function GetGroups():Promise<Array<chat.GroupInfo>>;
+
+export function GetLinkCode(arg1:string):Promise<string>;
+
+export function GetMessages(arg1:string,arg2:number,arg3:number,arg4:string):Promise<chat.MessagePage>;
+
+export function GetPending(arg1:string):Promise<Array<chat.PendingMessage>>;
+
+export function GetSettings():Promise<chat.Settings>;
+
+export function IsLocked():Promise<boolean>;
+
+export function IsProtected():Promise<boolean>;
+
+export function LeaveGroup(arg1:string):Promise<void>;
+
+export function LinkDevice(arg1:string):Promise<void>;
+
+export function Lock():Promise<void>;
+
+export function MarkRead(arg1:string):Promise<void>;
+
+export function React(arg1:string,arg2:string,arg3:string):Promise<void>;
+
+export function RejectKeyChange(arg1:string):Promise<void>;
+
+export function Rekey(arg1:string,arg2:string):Promise<void>;
+
+export function RemoveGroupMember(arg1:string,arg2:string):Promise<void>;
+
+export function RetryMessage(arg1:string,arg2:string):Promise<void>;
+
+export function SendAttachment(arg1:string,arg2:string,arg3:string,arg4:string):Promise<void>;
+
+export function SendGroupMessage(arg1:string,arg2:string):Promise<void>;
 
 export function SendMessage(arg1:string,arg2:string):Promise<void>;
+
+export function SendReply(arg1:string,arg2:string,arg3:string):Promise<void>;
+
+export function SetAutoLock(arg1:number):Promise<void>;
+
+export function SetContactReadReceipts(arg1:string,arg2:boolean):Promise<void>;
+
+export function SetExpireTimer(arg1:string,arg2:number):Promise<void>;
+
+export function SetLogSync(arg1:string):Promise<void>;
+
+export function SetMaxAttachmentSize(arg1:number):Promise<void>;
+
+export function SetPassphrase(arg1:string):Promise<void>;
+
+export function SetReadReceipts(arg1:boolean):Promise<void>;
+
+export function Touch():Promise<void>;
+
+export function UnlinkDevice(arg1:string):Promise<void>;
+
+export function Unlock(arg1:string):Promise<void>;
+
+export function UnverifyContact(arg1:string):Promise<void>;
+
+export function VerifyContact(arg1:string):Promise<void>;
+
+export function VerifyContactQR(arg1:string,arg2:string):Promise<void>;
+
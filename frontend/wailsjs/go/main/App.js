@@ -2,14 +2,186 @@
 // Cynhyrchwyd y ffeil hon yn awtomatig. PEIDIWCH Â MODIWL
 // This file is automatically generated. DO NOT EDIT
 
+export function AcknowledgeKeyChange(arg1) {
+  return window['go']['main']['App']['AcknowledgeKeyChange'](arg1);
+}
+
+export function AddGroupMember(arg1, arg2) {
+  return window['go']['main']['App']['AddGroupMember'](arg1, arg2);
+}
+
+export function CancelMessage(arg1, arg2) {
+  return window['go']['main']['App']['CancelMessage'](arg1, arg2);
+}
+
+export function CreateGroup(arg1, arg2) {
+  return window['go']['main']['App']['CreateGroup'](arg1, arg2);
+}
+
+export function DeleteAttachment(arg1) {
+  return window['go']['main']['App']['DeleteAttachment'](arg1);
+}
+
+export function DeleteContact(arg1) {
+  return window['go']['main']['App']['DeleteContact'](arg1);
+}
+
+export function DeleteMessage(arg1, arg2) {
+  return window['go']['main']['App']['DeleteMessage'](arg1, arg2);
+}
+
+export function EditMessage(arg1, arg2, arg3) {
+  return window['go']['main']['App']['EditMessage'](arg1, arg2, arg3);
+}
+
+export function GetAttachment(arg1) {
+  return window['go']['main']['App']['GetAttachment'](arg1);
+}
+
 export function GetContacts() {
   return window['go']['main']['App']['GetContacts']();
 }
 
-export function GetMessages(arg1, arg2) {
-  return window['go']['main']['App']['GetMessages'](arg1, arg2);
+export function GetDevices() {
+  return window['go']['main']['App']['GetDevices']();
+}
+
+export function GetFingerprint(arg1) {
+  return window['go']['main']['App']['GetFingerprint'](arg1);
+}
+
+export function GetGroupMessages(arg1, arg2) {
+  return window['go']['main']['App']['GetGroupMessages'](arg1, arg2);
+}
+
+export function GetGroups() {
+  return window['go']['main']['App']['GetGroups']();
+}
+
+export function GetLinkCode(arg1) {
+  return window['go']['main']['App']['GetLinkCode'](arg1);
+}
+
+export function GetMessages(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['GetMessages'](arg1, arg2, arg3, arg4);
+}
+
+export function GetPending(arg1) {
+  return window['go']['main']['App']['GetPending'](arg1);
+}
+
+export function GetSettings() {
+  return window['go']['main']['App']['GetSettings']();
+}
+
+export function IsLocked() {
+  return window['go']['main']['App']['IsLocked']();
+}
+
+export function IsProtected() {
+  return window['go']['main']['App']['IsProtected']();
+}
+
+export function LeaveGroup(arg1) {
+  return window['go']['main']['App']['LeaveGroup'](arg1);
+}
+
+export function LinkDevice(arg1) {
+  return window['go']['main']['App']['LinkDevice'](arg1);
+}
+
+export function Lock() {
+  return window['go']['main']['App']['Lock']();
+}
+
+export function MarkRead(arg1) {
+  return window['go']['main']['App']['MarkRead'](arg1);
+}
+
+export function React(arg1, arg2, arg3) {
+  return window['go']['main']['App']['React'](arg1, arg2, arg3);
+}
+
+export function RejectKeyChange(arg1) {
+  return window['go']['main']['App']['RejectKeyChange'](arg1);
+}
+
+export function Rekey(arg1, arg2) {
+  return window['go']['main']['App']['Rekey'](arg1, arg2);
+}
+
+export function RemoveGroupMember(arg1, arg2) {
+  return window['go']['main']['App']['RemoveGroupMember'](arg1, arg2);
+}
+
+export function RetryMessage(arg1, arg2) {
+  return window['go']['main']['App']['RetryMessage'](arg1, arg2);
+}
+
+export function SendAttachment(arg1, arg2, arg3, arg4) {
+  return window['go']['main']['App']['SendAttachment'](arg1, arg2, arg3, arg4);
+}
+
+export function SendGroupMessage(arg1, arg2) {
+  return window['go']['main']['App']['SendGroupMessage'](arg1, arg2);
 }
 
 export function SendMessage(arg1, arg2) {
   return window['go']['main']['App']['SendMessage'](arg1, arg2);
 }
+
+export function SendReply(arg1, arg2, arg3) {
+  return window['go']['main']['App']['SendReply'](arg1, arg2, arg3);
+}
+
+export function SetAutoLock(arg1) {
+  return window['go']['main']['App']['SetAutoLock'](arg1);
+}
+
+export function SetContactReadReceipts(arg1, arg2) {
+  return window['go']['main']['App']['SetContactReadReceipts'](arg1, arg2);
+}
+
+export function SetExpireTimer(arg1, arg2) {
+  return window['go']['main']['App']['SetExpireTimer'](arg1, arg2);
+}
+
+export function SetLogSync(arg1) {
+  return window['go']['main']['App']['SetLogSync'](arg1);
+}
+
+export function SetMaxAttachmentSize(arg1) {
+  return window['go']['main']['App']['SetMaxAttachmentSize'](arg1);
+}
+
+export function SetPassphrase(arg1) {
+  return window['go']['main']['App']['SetPassphrase'](arg1);
+}
+
+export function SetReadReceipts(arg1) {
+  return window['go']['main']['App']['SetReadReceipts'](arg1);
+}
+
+export function Touch() {
+  return window['go']['main']['App']['Touch']();
+}
+
+export function UnlinkDevice(arg1) {
+  return window['go']['main']['App']['UnlinkDevice'](arg1);
+}
+
+export function Unlock(arg1) {
+  return window['go']['main']['App']['Unlock'](arg1);
+}
+
+export function UnverifyContact(arg1) {
+  return window['go']['main']['App']['UnverifyContact'](arg1);
+}
+
+export function VerifyContact(arg1) {
+  return window['go']['main']['App']['VerifyContact'](arg1);
+}
+
+export function VerifyContactQR(arg1, arg2) {
+  return window['go']['main']['App']['VerifyContactQR'](arg1, arg2);
+}
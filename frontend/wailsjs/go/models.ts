@@ -1,11 +1,126 @@
 export namespace chat {
 	
+	export class KeyRecord {
+	    id_pub: number[];
+	    // Go type: time
+	    replaced: any;
+	    verified: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new KeyRecord(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id_pub = source["id_pub"];
+	        this.replaced = this.convertValues(source["replaced"], null);
+	        this.verified = source["verified"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class Bundle {
+	    IdentityPub: number[];
+	    SignedPreKeyID: number;
+	    SignedPreKey: number[];
+	    SignedPreKeySig: number[];
+	    KEMPreKey: number[];
+	    KEMPreKeySig: number[];
+	    OneTimePreKeyID: number;
+	    OneTimePreKey: number[];
+	    Versions: number[];
+	    Suites: number[];
+	
+	    static createFrom(source: any = {}) {
+	        return new Bundle(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.IdentityPub = source["IdentityPub"];
+	        this.SignedPreKeyID = source["SignedPreKeyID"];
+	        this.SignedPreKey = source["SignedPreKey"];
+	        this.SignedPreKeySig = source["SignedPreKeySig"];
+	        this.KEMPreKey = source["KEMPreKey"];
+	        this.KEMPreKeySig = source["KEMPreKeySig"];
+	        this.OneTimePreKeyID = source["OneTimePreKeyID"];
+	        this.OneTimePreKey = source["OneTimePreKey"];
+	        this.Versions = source["Versions"];
+	        this.Suites = source["Suites"];
+	    }
+	}
+	export class Device {
+	    id_pub: number[];
+	    name: string;
+	    bundle: Bundle;
+	    addr?: string;
+	    // Go type: time
+	    linked?: any;
+	
+	    static createFrom(source: any = {}) {
+	        return new Device(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id_pub = source["id_pub"];
+	        this.name = source["name"];
+	        this.bundle = this.convertValues(source["bundle"], Bundle);
+	        this.addr = source["addr"];
+	        this.linked = this.convertValues(source["linked"], null);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
 	export class Contact {
 	    id: string;
 	    id_pub: number[];
 	    name: string;
 	    // Go type: time
 	    created: any;
+	    verified: boolean;
+	    // Go type: time
+	    verified_at: any;
+	    key_changed: boolean;
+	    pending_key?: number[];
+	    key_history: KeyRecord[];
+	    no_read_receipts?: boolean;
+	    expire_timer?: number;
+	    devices?: Device[];
+	    device_version?: number;
+	    device_key?: number[];
 	
 	    static createFrom(source: any = {}) {
 	        return new Contact(source);
@@ -17,6 +132,222 @@ export namespace chat {
 	        this.id_pub = source["id_pub"];
 	        this.name = source["name"];
 	        this.created = this.convertValues(source["created"], null);
+	        this.verified = source["verified"];
+	        this.verified_at = this.convertValues(source["verified_at"], null);
+	        this.key_changed = source["key_changed"];
+	        this.pending_key = source["pending_key"];
+	        this.key_history = this.convertValues(source["key_history"], KeyRecord);
+	        this.no_read_receipts = source["no_read_receipts"];
+	        this.expire_timer = source["expire_timer"];
+	        this.devices = this.convertValues(source["devices"], Device);
+	        this.device_version = source["device_version"];
+	        this.device_key = source["device_key"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class DeviceInfo {
+	    id: string;
+	    name: string;
+	    primary: boolean;
+	    current: boolean;
+	    // Go type: time
+	    linked?: any;
+	
+	    static createFrom(source: any = {}) {
+	        return new DeviceInfo(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.name = source["name"];
+	        this.primary = source["primary"];
+	        this.current = source["current"];
+	        this.linked = this.convertValues(source["linked"], null);
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+	export class Fingerprint {
+	    safety_number: string;
+	    emoji: string[];
+	    qr_payload: string;
+	    verified: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new Fingerprint(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.safety_number = source["safety_number"];
+	        this.emoji = source["emoji"];
+	        this.qr_payload = source["qr_payload"];
+	        this.verified = source["verified"];
+	    }
+	}
+	export class GroupInfo {
+	    id: string;
+	    name: string;
+	    members: string[];
+	    left: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new GroupInfo(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.name = source["name"];
+	        this.members = source["members"];
+	        this.left = source["left"];
+	    }
+	}
+	export class PendingMessage {
+	    id: string;
+	    state: string;
+	    attempts: number;
+	    // Go type: time
+	    next_try: any;
+	    last_err?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new PendingMessage(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.state = source["state"];
+	        this.attempts = source["attempts"];
+	        this.next_try = this.convertValues(source["next_try"], null);
+	        this.last_err = source["last_err"];
+	    }
+	
+	convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	export class AttachmentInfo {
+	    id: string;
+	    name: string;
+	    mime: string;
+	    size: number;
+	    state: string;
+	    done: number;
+	    chunks: number;
+	
+	    static createFrom(source: any = {}) {
+	        return new AttachmentInfo(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.name = source["name"];
+	        this.mime = source["mime"];
+	        this.size = source["size"];
+	        this.state = source["state"];
+	        this.done = source["done"];
+	        this.chunks = source["chunks"];
+	    }
+	}
+	export class Quote {
+	    id: string;
+	    text: string;
+	    out: boolean;
+	    deleted?: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new Quote(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.id = source["id"];
+	        this.text = source["text"];
+	        this.out = source["out"];
+	        this.deleted = source["deleted"];
+	        this.quote = this.convertValues(source["quote"], Quote);
+	        this.reactions = this.convertValues(source["reactions"], Reaction);
+	    }
+	}
+	export class Reaction {
+	    emoji: string;
+	    count: number;
+	    mine: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new Reaction(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.emoji = source["emoji"];
+	        this.count = source["count"];
+	        this.mine = source["mine"];
+	    }
+	}
+	export class MessageEdit {
+	    text: string;
+	    // Go type: time
+	    at: any;
+	
+	    static createFrom(source: any = {}) {
+	        return new MessageEdit(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.text = source["text"];
+	        this.at = this.convertValues(source["at"], null);
 	    }
 	
 		convertValues(a: any, classs: any, asMap: boolean = false): any {
@@ -39,10 +370,26 @@ export namespace chat {
 	}
 	export class PlainMessage {
 	    id: string;
+	    type: string;
 	    // Go type: time
 	    at: any;
+	    // Go type: time
+	    sent: any;
 	    out: boolean;
 	    text: string;
+	    status?: string;
+	    from?: string;
+	    unsupported?: boolean;
+	    attachment?: AttachmentInfo;
+	    // Go type: time
+	    expires: any;
+	    edited?: boolean;
+	    // Go type: time
+	    edited_at: any;
+	    history?: MessageEdit[];
+	    deleted?: boolean;
+	    quote?: Quote;
+	    reactions?: Reaction[];
 	
 	    static createFrom(source: any = {}) {
 	        return new PlainMessage(source);
@@ -51,9 +398,57 @@ export namespace chat {
 	    constructor(source: any = {}) {
 	        if ('string' === typeof source) source = JSON.parse(source);
 	        this.id = source["id"];
+	        this.type = source["type"];
 	        this.at = this.convertValues(source["at"], null);
+	        this.sent = this.convertValues(source["sent"], null);
 	        this.out = source["out"];
 	        this.text = source["text"];
+	        this.status = source["status"];
+	        this.from = source["from"];
+	        this.unsupported = source["unsupported"];
+	        this.attachment = this.convertValues(source["attachment"], AttachmentInfo);
+	        this.expires = this.convertValues(source["expires"], null);
+	        this.edited = source["edited"];
+	        this.edited_at = this.convertValues(source["edited_at"], null);
+	        this.history = this.convertValues(source["history"], MessageEdit);
+	        this.deleted = source["deleted"];
+	    }
+	
+		convertValues(a: any, classs: any, asMap: boolean = false): any {
+		    if (!a) {
+		        return a;
+		    }
+		    if (a.slice && a.map) {
+		        return (a as any[]).map(elem => this.convertValues(elem, classs));
+		    } else if ("object" === typeof a) {
+		        if (asMap) {
+		            for (const key of Object.keys(a)) {
+		                a[key] = new classs(a[key]);
+		            }
+		            return a;
+		        }
+		        return new classs(a);
+		    }
+		    return a;
+		}
+	}
+
+	export class MessagePage {
+	    messages: PlainMessage[];
+	    first: number;
+	    last: number;
+	    more: boolean;
+	
+	    static createFrom(source: any = {}) {
+	        return new MessagePage(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.messages = this.convertValues(source["messages"], PlainMessage);
+	        this.first = source["first"];
+	        this.last = source["last"];
+	        this.more = source["more"];
 	    }
 	
 		convertValues(a: any, classs: any, asMap: boolean = false): any {
@@ -75,5 +470,45 @@ export namespace chat {
 		}
 	}
 
+	export class Settings {
+	    read_receipts: boolean;
+	    max_attachment_size: number;
+	    auto_lock_minutes: number;
+	    log_sync?: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new Settings(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.read_receipts = source["read_receipts"];
+	        this.max_attachment_size = source["max_attachment_size"];
+	        this.auto_lock_minutes = source["auto_lock_minutes"];
+	        this.log_sync = source["log_sync"];
+	    }
+	}
+
+}
+
+export namespace main {
+	
+	export class AttachmentData {
+	    name: string;
+	    mime: string;
+	    data: string;
+	
+	    static createFrom(source: any = {}) {
+	        return new AttachmentData(source);
+	    }
+	
+	    constructor(source: any = {}) {
+	        if ('string' === typeof source) source = JSON.parse(source);
+	        this.name = source["name"];
+	        this.mime = source["mime"];
+	        this.data = source["data"];
+	    }
+	}
+
 }
 
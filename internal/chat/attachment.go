@@ -0,0 +1,502 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Anhänge laufen nicht durch den Ratchet. Die Datei wird mit einem
+// zufälligen Schlüssel in Chunks verschlüsselt und per FrameChunk
+// übertragen; nur Schlüssel, Digest und Metadaten stehen in einer
+// normalen ContentAttachment-Nachricht.
+//
+//	Chunk i = AES-256-GCM(key, nonce = 0⁸ ‖ u32 i, AD = Blob-ID ‖ u32 i ‖ u32 n)
+//	Digest  = SHA-256(Chunk 0 ‖ … ‖ Chunk n-1)
+//
+// Auf der Platte liegen nur die verschlüsselten Chunks; Schlüssel und
+// Metadaten stehen im mit dem Master-Key gewrappten meta.bin.
+const (
+	attachmentsDir       = "attachments"
+	attachmentMetaFile   = "meta.bin"
+	attachmentChunkSize  = 64 << 10
+	attachmentStaleAfter = 7 * 24 * time.Hour // halbe Downloads werden verworfen
+
+	defaultMaxAttachmentSize = 25 << 20
+)
+
+// Zustände eines Anhangs.
+const (
+	AttachmentUploading   = "uploading"   // Chunks werden noch gesendet
+	AttachmentUploaded    = "uploaded"    // alle Chunks beim Transport angekommen
+	AttachmentDownloading = "downloading" // Zeiger da, Chunks fehlen noch
+	AttachmentComplete    = "complete"    // vollständig und Digest geprüft
+	AttachmentFailed      = "failed"      // Digest falsch, zu groß oder abgelehnt
+)
+
+var (
+	ErrAttachmentTooLarge = errors.New("attachment exceeds size limit")
+	ErrNoAttachment       = errors.New("attachment not found")
+	ErrAttachmentPending  = errors.New("attachment not complete yet")
+	ErrBadChunk           = errors.New("unexpected attachment chunk")
+	ErrNoChunkTransport   = errors.New("transport cannot carry attachments")
+)
+
+// Chunk ist ein verschlüsseltes Stück eines Anhangs auf der Leitung.
+type Chunk struct {
+	Blob  string // Blob-ID aus der Zeiger-Nachricht
+	Index uint32
+	Total uint32
+	Data  []byte
+}
+
+// chunkSender sind Transports, die Anhänge übertragen können.
+type chunkSender interface {
+	SendChunk(toID []byte, c Chunk) error
+}
+
+// attachmentBody ist der Body einer ContentAttachment-Nachricht.
+type attachmentBody struct {
+	Blob   string `json:"blob"`
+	Name   string `json:"name"`
+	Mime   string `json:"mime"`
+	Size   int64  `json:"size"`
+	Chunks int    `json:"chunks"`
+	Key    []byte `json:"key"`
+	Digest []byte `json:"digest"`
+}
+
+// Attachment ist der lokale Zustand eines Anhangs (meta.bin).
+type Attachment struct {
+	attachmentBody
+	Contact []byte    `json:"contact"` // Identity-Key des Gegenübers
+	Out     bool      `json:"out"`
+	State   string    `json:"state"`
+	Done    int       `json:"done"` // gesendete bzw. empfangene Chunks
+	Created time.Time `json:"created"`
+}
+
+// AttachmentInfo ist die Sicht der UI auf einen Anhang.
+type AttachmentInfo struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Mime   string `json:"mime"`
+	Size   int64  `json:"size"`
+	State  string `json:"state"`
+	Done   int    `json:"done"`
+	Chunks int    `json:"chunks"`
+}
+
+func (a *Attachment) info() *AttachmentInfo {
+	return &AttachmentInfo{
+		ID: a.Blob, Name: a.Name, Mime: a.Mime, Size: a.Size,
+		State: a.State, Done: a.Done, Chunks: a.Chunks,
+	}
+}
+
+func (b *attachmentBody) validate(maxSize int64) error {
+	if uuid.Validate(b.Blob) != nil || len(b.Key) != 32 || len(b.Digest) != sha256.Size {
+		return fmt.Errorf("%w: attachment pointer", ErrBadEnvelope)
+	}
+	want := (b.Size + attachmentChunkSize - 1) / attachmentChunkSize
+	if b.Size < 0 || int64(b.Chunks) != max(want, 1) {
+		return fmt.Errorf("%w: attachment of %d bytes in %d chunks", ErrBadEnvelope, b.Size, b.Chunks)
+	}
+	if b.Size > maxSize {
+		return ErrAttachmentTooLarge
+	}
+	return nil
+}
+
+// ───────────────────────── Kryptografie ──────────────────────────
+
+// sealAttachment verschlüsselt data in Chunks unter einem frischen Schlüssel.
+func sealAttachment(name, mime string, data []byte) (*attachmentBody, [][]byte, error) {
+	b := &attachmentBody{
+		Blob: uuid.NewString(),
+		Name: name,
+		Mime: mime,
+		Size: int64(len(data)),
+		Key:  make([]byte, 32),
+	}
+	if _, err := rand.Read(b.Key); err != nil {
+		return nil, nil, err
+	}
+	b.Chunks = max((len(data)+attachmentChunkSize-1)/attachmentChunkSize, 1)
+
+	aead, err := newGCM(b.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	chunks := make([][]byte, b.Chunks)
+	digest := sha256.New()
+	for i := range chunks {
+		part := data[min(i*attachmentChunkSize, len(data)):min((i+1)*attachmentChunkSize, len(data))]
+		chunks[i] = aead.Seal(nil, chunkNonce(i), part, chunkAD(b.Blob, i, b.Chunks))
+		digest.Write(chunks[i])
+	}
+	b.Digest = digest.Sum(nil)
+	return b, chunks, nil
+}
+
+func chunkNonce(i int) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint32(n[8:], uint32(i))
+	return n
+}
+
+func chunkAD(blob string, i, n int) []byte {
+	ad := binary.BigEndian.AppendUint32([]byte(blob), uint32(i))
+	return binary.BigEndian.AppendUint32(ad, uint32(n))
+}
+
+// ───────────────────────── Store ─────────────────────────────────
+
+// attachmentDir prüft die Blob-ID, bevor sie zum Pfad wird – sie kommt
+// vom Gegenüber.
+func (s *Store) attachmentDir(blob string) (string, error) {
+	if uuid.Validate(blob) != nil {
+		return "", ErrNoAttachment
+	}
+	return filepath.Join(s.basePath, attachmentsDir, blob), nil
+}
+
+func (s *Store) SaveAttachment(a *Attachment) error {
+	dir, err := s.attachmentDir(a.Blob)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	raw, _ := json.Marshal(a)
+	path := filepath.Join(dir, attachmentMetaFile)
+	buf, err := s.wrap(path, raw)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf)
+}
+
+func (s *Store) LoadAttachment(blob string) (*Attachment, error) {
+	dir, err := s.attachmentDir(blob)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, attachmentMetaFile)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNoAttachment
+	} else if err != nil {
+		return nil, err
+	}
+	plain, err := s.unwrap(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	var a Attachment
+	if err := json.Unmarshal(plain, &a); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func (s *Store) ListAttachments() ([]*Attachment, error) {
+	entries, err := os.ReadDir(filepath.Join(s.basePath, attachmentsDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var out []*Attachment
+	for _, e := range entries {
+		a, err := s.LoadAttachment(e.Name())
+		if err != nil {
+			log.Printf("[Store] skipping attachment %s: %v", e.Name(), err)
+			continue
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+func (s *Store) DeleteAttachment(blob string) error {
+	dir, err := s.attachmentDir(blob)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// PruneAttachments verwirft Downloads, die seit attachmentStaleAfter
+// nicht fertig geworden sind, und solche mit falschem Digest.
+func (s *Store) PruneAttachments(now time.Time) error {
+	list, err := s.ListAttachments()
+	if err != nil {
+		return err
+	}
+	for _, a := range list {
+		stale := a.State == AttachmentDownloading && now.Sub(a.Created) > attachmentStaleAfter
+		if stale || (a.State == AttachmentFailed && !a.Out) {
+			log.Printf("[Store] pruning attachment %s (%s)", a.Blob, a.State)
+			err = errors.Join(err, s.DeleteAttachment(a.Blob))
+		}
+	}
+	return err
+}
+
+func (s *Store) writeChunk(blob string, i int, data []byte) error {
+	dir, err := s.attachmentDir(blob)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, strconv.Itoa(i)+".chunk"), data)
+}
+
+// dropChunks löscht die ersten n Chunks eines Anhangs; meta.bin bleibt.
+func (s *Store) dropChunks(blob string, n int) error {
+	dir, err := s.attachmentDir(blob)
+	if err != nil {
+		return err
+	}
+	for i := range n {
+		if err := os.Remove(filepath.Join(dir, strconv.Itoa(i)+".chunk")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) readChunk(blob string, i int) ([]byte, error) {
+	dir, err := s.attachmentDir(blob)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(dir, strconv.Itoa(i)+".chunk"))
+}
+
+// checkDigest vergleicht die gespeicherten Chunks mit dem Digest aus
+// der Zeiger-Nachricht.
+func (s *Store) checkDigest(a *Attachment) error {
+	h := sha256.New()
+	for i := range a.Chunks {
+		c, err := s.readChunk(a.Blob, i)
+		if err != nil {
+			return err
+		}
+		h.Write(c)
+	}
+	if !bytes.Equal(h.Sum(nil), a.Digest) {
+		return fmt.Errorf("%w: attachment digest mismatch", ErrAuthFailed)
+	}
+	return nil
+}
+
+// OpenAttachment prüft und entschlüsselt einen vollständigen Anhang.
+func (s *Store) OpenAttachment(blob string) (*Attachment, []byte, error) {
+	a, err := s.LoadAttachment(blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !a.Out && a.State != AttachmentComplete {
+		return nil, nil, ErrAttachmentPending
+	}
+	if err := s.checkDigest(a); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(a.Key)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := make([]byte, 0, a.Size)
+	for i := range a.Chunks {
+		c, err := s.readChunk(a.Blob, i)
+		if err != nil {
+			return nil, nil, err
+		}
+		part, err := aead.Open(nil, chunkNonce(i), c, chunkAD(a.Blob, i, a.Chunks))
+		if err != nil {
+			return nil, nil, ErrAuthFailed
+		}
+		data = append(data, part...)
+	}
+	if int64(len(data)) != a.Size {
+		return nil, nil, ErrAuthFailed
+	}
+	return a, data, nil
+}
+
+// ───────────────────────── Session ───────────────────────────────
+
+// SendAttachment entfernt Bild-Metadaten, verschlüsselt die Datei,
+// schickt den Zeiger durch den Ratchet und danach die Chunks. Scheitert
+// der Transport, setzt der Ausgangs-Worker des Managers den Upload fort.
+func (s *Session) SendAttachment(name, mime string, data []byte) error {
+	settings, err := s.store.LoadSettings()
+	if err != nil {
+		return err
+	}
+	if mime == "" {
+		mime = http.DetectContentType(data)
+	}
+	if data, err = stripMetadata(mime, data); err != nil {
+		return err
+	}
+	if int64(len(data)) > settings.MaxAttachmentSize {
+		return fmt.Errorf("%w (%d > %d bytes)", ErrAttachmentTooLarge, len(data), settings.MaxAttachmentSize)
+	}
+	log.Printf("[Session:%s] SendAttachment %q %s %dB → %s", s.Name, name, mime, len(data), b64(s.remoteID)[:8])
+
+	body, chunks, err := sealAttachment(name, mime, data)
+	if err != nil {
+		return err
+	}
+	a := &Attachment{
+		attachmentBody: *body,
+		Contact:        s.remoteID,
+		Out:            true,
+		State:          AttachmentUploading,
+		Created:        time.Now().UTC(),
+	}
+	if err := s.store.SaveAttachment(a); err != nil {
+		return err
+	}
+	for i, c := range chunks {
+		if err := s.store.writeChunk(a.Blob, i, c); err != nil {
+			return err
+		}
+	}
+
+	env, err := newEnvelope(ContentAttachment, body)
+	if err != nil {
+		return err
+	}
+	if err := s.send(env); err != nil {
+		// Zeiger wartet im Ausgang; die Chunks folgen, wenn er raus ist
+		return err
+	}
+	return s.store.upload(s.transport, a)
+}
+
+// upload schickt die noch fehlenden Chunks eines eigenen Anhangs. Der
+// Fortschritt steht in meta.bin; nach einem Abbruch geht es dort weiter.
+func (s *Store) upload(t Transport, a *Attachment) error {
+	cs, ok := t.(chunkSender)
+	if !ok {
+		return ErrNoChunkTransport
+	}
+	for ; a.Done < a.Chunks; a.Done++ {
+		data, err := s.readChunk(a.Blob, a.Done)
+		if err != nil {
+			return err
+		}
+		c := Chunk{Blob: a.Blob, Index: uint32(a.Done), Total: uint32(a.Chunks), Data: data}
+		if err := cs.SendChunk(a.Contact, c); err != nil {
+			log.Printf("[Store] chunk %d/%d of %s failed: %v", a.Done, a.Chunks, a.Blob, err)
+			rejected := !retryable(err)
+			if rejected {
+				a.State = AttachmentFailed // z. B. über dem Limit des Empfängers
+			}
+			if serr := s.SaveAttachment(a); serr != nil {
+				return serr
+			}
+			if rejected {
+				return err
+			}
+			return fmt.Errorf("%w: %v", ErrQueued, err)
+		}
+	}
+	a.State = AttachmentUploaded
+	return s.SaveAttachment(a)
+}
+
+// expectAttachment legt beim Empfang eines Zeigers den Download an.
+func (s *Session) expectAttachment(env *Envelope) error {
+	var body attachmentBody
+	if err := env.decodeBody(&body); err != nil {
+		return err
+	}
+	settings, err := s.store.LoadSettings()
+	if err != nil {
+		return err
+	}
+	a := &Attachment{
+		attachmentBody: body,
+		Contact:        s.remoteID,
+		State:          AttachmentDownloading,
+		Created:        time.Now().UTC(),
+	}
+	if err := body.validate(settings.MaxAttachmentSize); errors.Is(err, ErrAttachmentTooLarge) {
+		log.Printf("  attachment %s too large (%d bytes), not downloading", body.Blob, body.Size)
+		a.State = AttachmentFailed
+	} else if err != nil {
+		return err
+	}
+	if _, err := s.store.LoadAttachment(body.Blob); err == nil {
+		return fmt.Errorf("%w: duplicate attachment %s", ErrBadEnvelope, body.Blob)
+	}
+	return s.store.SaveAttachment(a)
+}
+
+// ReceiveChunk nimmt einen Chunk eines angekündigten Anhangs an. Chunks
+// kommen in Reihenfolge; Wiederholungen nach einem verlorenen Ack sind
+// erlaubt und werden ignoriert.
+func (s *Session) ReceiveChunk(c Chunk) error {
+	if s.locked() {
+		return ErrLocked
+	}
+	a, err := s.store.LoadAttachment(c.Blob)
+	switch {
+	case err != nil:
+		return fmt.Errorf("%w: %v", ErrBadChunk, err)
+	case a.Out || !bytes.Equal(a.Contact, s.remoteID):
+		return ErrBadChunk
+	case a.State == AttachmentFailed:
+		return fmt.Errorf("%w: %s refused", ErrBadChunk, c.Blob)
+	case int(c.Total) != a.Chunks || int(c.Index) > a.Done:
+		return fmt.Errorf("%w: %d/%d, have %d/%d", ErrBadChunk, c.Index, c.Total, a.Done, a.Chunks)
+	case int(c.Index) < a.Done:
+		return nil // schon da
+	}
+
+	if err := s.store.writeChunk(a.Blob, a.Done, c.Data); err != nil {
+		return err
+	}
+	a.Done++
+	if a.Done == a.Chunks {
+		a.State = AttachmentComplete
+		if err := s.store.checkDigest(a); err != nil {
+			// manipulierte Daten nicht bis zum nächsten Prune liegen lassen
+			log.Printf("[Session:%s] !! attachment %s: %v", s.Name, a.Blob, err)
+			a.State = AttachmentFailed
+			if err := s.store.dropChunks(a.Blob, a.Chunks); err != nil {
+				log.Printf("[Session:%s] !! drop chunks of %s: %v", s.Name, a.Blob, err)
+			}
+		}
+	}
+	if err := s.store.SaveAttachment(a); err != nil {
+		return err
+	}
+	// der Anhang steht im Verlauf: fertig oder fehlgeschlagen ist eine
+	// Zustandsänderung, kein Empfangsfehler
+	if a.Done == a.Chunks && s.OnUpdate != nil {
+		s.OnUpdate(s.remoteID)
+	}
+	if a.State == AttachmentFailed {
+		return fmt.Errorf("attachment %s: %w", a.Name, ErrAuthFailed) // lehnt beim Absender ab
+	}
+	return nil
+}
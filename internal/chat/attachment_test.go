@@ -0,0 +1,184 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io/fs"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// flakyTransport lässt Chunks nach failAfter Stück scheitern bzw. kippt
+// ein Bit, um Abbruch und Manipulation zu simulieren.
+type flakyTransport struct {
+	*DummyTransport
+	failAfter int // < 0 = nie
+	sent      int
+	tamper    bool
+}
+
+func (f *flakyTransport) SendChunk(id []byte, c Chunk) error {
+	if f.failAfter >= 0 && f.sent >= f.failAfter {
+		return ErrPeerUnreachable
+	}
+	f.sent++
+	if f.tamper {
+		c.Data = bytes.Clone(c.Data)
+		c.Data[0] ^= 1
+	}
+	return f.DummyTransport.SendChunk(id, c)
+}
+
+var _ = Describe("Anhänge", func() {
+	var (
+		tp             *flakyTransport
+		aStore, bStore *Store
+		aSess, bSess   *Session
+		aliceID        []byte
+		data           []byte
+	)
+
+	BeforeEach(func() {
+		aStore, _ = NewStore(GinkgoT().TempDir())
+		bStore, _ = NewStore(GinkgoT().TempDir())
+		tp = &flakyTransport{DummyTransport: NewDummyTransport(), failAfter: -1}
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		aSess = NewSessionFromPeer(alice, tp, aStore)
+		bSess = NewSessionFromPeer(bob, tp, bStore)
+		Expect(aSess.StartHandshake(bob.Bundle())).To(Succeed())
+		aliceID = alice.IdentityPublicKey()
+
+		data = make([]byte, 2*attachmentChunkSize+123)
+		rand.Read(data)
+	})
+
+	received := func() *AttachmentInfo {
+		msgs, err := bSess.LoadPlainMessages(aliceID, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).To(HaveLen(1))
+		Expect(msgs[0].Type).To(Equal(ContentAttachment))
+		return msgs[0].Attachment
+	}
+
+	It("überträgt eine Datei in Chunks und legt sie verschlüsselt ab", func() {
+		Expect(aSess.SendAttachment("bericht.bin", "application/octet-stream", data)).To(Succeed())
+
+		info := received()
+		Expect(info.Name).To(Equal("bericht.bin"))
+		Expect(info.State).To(Equal(AttachmentComplete))
+		Expect(info.Chunks).To(Equal(3))
+
+		_, got, err := bStore.OpenAttachment(info.ID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(data))
+
+		// auf der Platte steht kein Klartext
+		c, _ := bStore.readChunk(info.ID, 0)
+		Expect(bytes.Contains(c, data[:64])).To(BeFalse())
+
+		a, _ := aStore.LoadAttachment(info.ID)
+		Expect(a.State).To(Equal(AttachmentUploaded))
+	})
+
+	It("setzt einen abgebrochenen Upload fort", func() {
+		tp.failAfter = 1
+		Expect(aSess.SendAttachment("gross.bin", "", data)).To(MatchError(ErrQueued))
+
+		info := received()
+		Expect(info.State).To(Equal(AttachmentDownloading))
+		Expect(info.Done).To(Equal(1))
+		_, _, err := bStore.OpenAttachment(info.ID)
+		Expect(err).To(MatchError(ErrAttachmentPending))
+
+		tp.failAfter = -1
+		a, _ := aStore.LoadAttachment(info.ID)
+		Expect(a.Done).To(Equal(1))
+		Expect(aStore.upload(tp, a)).To(Succeed())
+
+		Expect(received().State).To(Equal(AttachmentComplete))
+		_, got, _ := bStore.OpenAttachment(info.ID)
+		Expect(got).To(Equal(data))
+	})
+
+	It("verwirft manipulierte Chunks", func() {
+		var updated []byte
+		bSess.OnError = func(_ []byte, err error) { Fail(err.Error()) }
+		bSess.OnUpdate = func(id []byte) { updated = id }
+		tp.tamper = true
+
+		Expect(aSess.SendAttachment("x.bin", "", data)).To(MatchError(ErrRejected))
+		Expect(updated).To(Equal(aliceID))
+		info := received()
+		Expect(info.State).To(Equal(AttachmentFailed))
+		for i := range info.Chunks {
+			_, err := bStore.readChunk(info.ID, i)
+			Expect(err).To(MatchError(fs.ErrNotExist))
+		}
+		a, _ := aStore.LoadAttachment(info.ID)
+		Expect(a.State).To(Equal(AttachmentFailed))
+	})
+
+	It("hält sich an das Größenlimit beider Seiten", func() {
+		Expect(aStore.SaveSettings(&Settings{MaxAttachmentSize: 100})).To(Succeed())
+		Expect(aSess.SendAttachment("x.bin", "", data)).To(MatchError(ErrAttachmentTooLarge))
+
+		Expect(aStore.SaveSettings(defaultSettings())).To(Succeed())
+		Expect(bStore.SaveSettings(&Settings{MaxAttachmentSize: 100})).To(Succeed())
+		Expect(aSess.SendAttachment("x.bin", "", data)).To(MatchError(ErrRejected))
+		Expect(received().State).To(Equal(AttachmentFailed))
+
+		Expect(bStore.PruneAttachments(time.Now())).To(Succeed())
+		Expect(bStore.ListAttachments()).To(BeEmpty())
+	})
+
+	It("nimmt keine Chunks für unbekannte oder unsinnige Blob-IDs an", func() {
+		Expect(bSess.ReceiveChunk(Chunk{Blob: "../../identity.id", Total: 1})).To(MatchError(ErrBadChunk))
+		Expect(bSess.ReceiveChunk(Chunk{Blob: "6f1c4a52-2b8e-4d3a-9a57-3c1f4b7e2d10", Total: 1})).
+			To(MatchError(ErrBadChunk))
+	})
+})
+
+var _ = Describe("Bild-Metadaten", func() {
+	img := image.NewGray(image.Rect(0, 0, 4, 4))
+
+	It("entfernt EXIF aus JPEG, ohne das Bild anzufassen", func() {
+		var clean bytes.Buffer
+		Expect(jpeg.Encode(&clean, img, nil)).To(Succeed())
+
+		exif := append([]byte("Exif\x00\x00"), []byte("GPS 52.52N 13.40E")...)
+		seg := binary.BigEndian.AppendUint16([]byte{0xFF, 0xE1}, uint16(len(exif)+2))
+		tagged := append(append(clean.Bytes()[:2:2], append(seg, exif...)...), clean.Bytes()[2:]...)
+
+		out, err := stripMetadata("image/jpeg", tagged)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(Equal(clean.Bytes()))
+		_, err = jpeg.Decode(bytes.NewReader(out))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("entfernt Text-Chunks aus PNG", func() {
+		var clean bytes.Buffer
+		Expect(png.Encode(&clean, img)).To(Succeed())
+
+		txt := []byte("Comment\x00geheim")
+		chunk := binary.BigEndian.AppendUint32(nil, uint32(len(txt)))
+		chunk = append(append(append(chunk, "tEXt"...), txt...), 0, 0, 0, 0)
+		tagged := append(append(clean.Bytes()[:8:8], chunk...), clean.Bytes()[8:]...)
+
+		out, err := stripMetadata("image/png", tagged)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(Equal(clean.Bytes()))
+	})
+
+	It("lehnt kaputte Bilder ab und lässt andere Typen in Ruhe", func() {
+		_, err := stripMetadata("image/jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF})
+		Expect(err).To(MatchError(ErrBadImage))
+		Expect(stripMetadata("text/plain", []byte("hallo"))).To(Equal([]byte("hallo")))
+	})
+})
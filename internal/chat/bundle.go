@@ -1,5 +1,19 @@
 package chat
 
+// Bundle ist das veröffentlichte Pre-Key-Bundle eines Peers (X3DH).
 type Bundle struct {
-	IdentityPub []byte
+	IdentityPub []byte // signiert SPK und KEM-Pre-Key (XEdDSA)
+
+	SignedPreKeyID  uint32
+	SignedPreKey    []byte
+	SignedPreKeySig []byte
+
+	KEMPreKey    []byte // ML-KEM-768-Encapsulation-Key zum SPK (leer = nur X3DH)
+	KEMPreKeySig []byte
+
+	OneTimePreKeyID uint32 // 0 = Pool leer, Handshake ohne OPK
+	OneTimePreKey   []byte
+
+	Versions []byte // unterstützte Protokollversionen (leer = nur v1)
+	Suites   []byte // unterstützte AEAD-Suites
 }
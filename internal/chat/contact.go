@@ -3,8 +3,39 @@ package chat
 import "time"
 
 type Contact struct {
-	ID       string    `json:"id"`
+	ID         string    `json:"id"`
+	IDPub      []byte    `json:"id_pub"`
+	Name       string    `json:"name"`
+	Created    time.Time `json:"created"`
+	Verified   bool      `json:"verified"` // Sicherheitsnummer out-of-band bestätigt
+	VerifiedAt time.Time `json:"verified_at,omitzero"`
+
+	// Trust-on-first-use: der erste gesehene Key gilt. Meldet sich jemand
+	// unter dem Namen des Kontakts mit einem neuen Key, wird dieser nur als
+	// PendingKey vorgemerkt – der Name im Init ist nicht authentisiert.
+	// KeyChanged blockiert das Senden, bis der Nutzer den Wechsel annimmt
+	// (erst dann wandert der alte Key in die Historie) oder ablehnt.
+	KeyChanged bool        `json:"key_changed"`
+	PendingKey []byte      `json:"pending_key,omitempty"`
+	KeyHistory []KeyRecord `json:"key_history,omitempty"`
+
+	// NoReadReceipts schaltet Lesebestätigungen nur für diesen Kontakt ab.
+	NoReadReceipts bool `json:"no_read_receipts,omitempty"`
+
+	// ExpireTimer ist die Lebensdauer neuer Nachrichten in Sekunden
+	// (0 = aus); beide Seiten einigen sich per ContentTimer darauf.
+	ExpireTimer uint32 `json:"expire_timer,omitempty"`
+
+	// Weitere Geräte laut der signierten Geräteliste des Kontakts;
+	// DeviceKey ist der Signaturschlüssel aus der ersten Liste.
+	Devices       []Device `json:"devices,omitempty"`
+	DeviceVersion uint32   `json:"device_version,omitempty"`
+	DeviceKey     []byte   `json:"device_key,omitempty"`
+}
+
+// KeyRecord ist ein früherer Identity-Key eines Kontakts.
+type KeyRecord struct {
 	IDPub    []byte    `json:"id_pub"`
-	Name     string    `json:"name"`
-	Created  time.Time `json:"created"`
+	Replaced time.Time `json:"replaced"`
+	Verified bool      `json:"verified"` // war der alte Key verifiziert?
 }
@@ -2,7 +2,6 @@ package chat_test
 
 import (
 	"encoding/base64"
-	"encoding/binary"
 	"os"
 	"time"
 
@@ -48,8 +47,8 @@ var _ = Describe("Store contacts", func() {
 		raw, err := os.ReadFile(path)
 		Expect(err).NotTo(HaveOccurred())
 
-		nonceLen := int(binary.BigEndian.Uint16(raw[:2]))
-		ciphertext := raw[2+nonceLen:]
+		Expect(raw[0]).To(Equal(byte('Z')))
+		ciphertext := raw[2+12:] // Magic, Version, Nonce überspringen
 		Expect(string(ciphertext)).NotTo(ContainSubstring("\"Bob\""))
 	})
 })
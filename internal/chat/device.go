@@ -0,0 +1,439 @@
+package chat
+
+// Mehrere Geräte pro Identität:
+//
+// Das Primärgerät ist das Konto – sein Identity-Key ist die ID, unter der
+// Kontakte uns kennen. Weitere Geräte haben eigene Identity-Keys; das
+// Primärgerät nimmt sie in eine signierte, versionierte Geräteliste auf
+// und verteilt sie an Kontakte und eigene Geräte. Jedes Gerät hält eigene
+// 1:1-Sessions: Nachrichten an einen Kontakt gehen als Kopie an alle seine
+// Geräte, gesendete Nachrichten zusätzlich als ContentSync an die eigenen.
+//
+// Verknüpfen: das neue Gerät erzeugt einen Link-Code (auch als QR-Payload),
+// das Primärgerät liest ihn ein, baut eine Session zum neuen Gerät auf und
+// schickt ihm Liste und Kontakte. Wer eine neue Liste empfängt, startet
+// die Handshakes zu neuen Geräten; das neue Gerät selbst wartet, so
+// kreuzen sich nie zwei Handshakes.
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	devicesFile      = "devices.bin"
+	linkCodePrefix   = "zero-link:"
+	linkSecretLen    = 16
+	maxDevices       = 8
+	maxDeviceNameLen = 64
+)
+
+var (
+	ErrNotPrimary    = errors.New("only the primary device can manage devices")
+	ErrAlreadyLinked = errors.New("device is already linked")
+	ErrNotLinking    = errors.New("device is not waiting to be linked")
+	ErrBadLinkCode   = errors.New("malformed link code")
+	ErrBadDeviceList = errors.New("invalid device list")
+)
+
+// Device ist ein weiteres Gerät eines Kontos. Das Bundle geht an mehrere
+// Empfänger und enthält deshalb keinen One-Time-Pre-Key.
+type Device struct {
+	IDPub  []byte    `json:"id_pub"`
+	Name   string    `json:"name"`
+	Bundle Bundle    `json:"bundle"`
+	Addr   string    `json:"addr,omitempty"` // Transport-Adresse, leer = unbekannt
+	Linked time.Time `json:"linked,omitzero"`
+}
+
+func (d *Device) validate() error {
+	if len(d.IDPub) != 32 || !bytes.Equal(d.Bundle.IdentityPub, d.IDPub) ||
+		d.Bundle.OneTimePreKey != nil || len(d.Name) > maxDeviceNameLen {
+		return fmt.Errorf("%w: device %q", ErrBadDeviceList, d.Name)
+	}
+	return nil
+}
+
+// DeviceList ist die vom Primärgerät signierte Liste seiner weiteren
+// Geräte. Jede Änderung erhöht Version; ältere Listen werden ignoriert.
+type DeviceList struct {
+	Account    []byte   `json:"account"` // Identity-Key des Primärgeräts
+	Version    uint32   `json:"version"`
+	Devices    []Device `json:"devices"`
+	SigningPub []byte   `json:"signing_pub"` // Ed25519 des Primärgeräts
+	Sig        []byte   `json:"sig,omitempty"`
+}
+
+func (l *DeviceList) signed() []byte {
+	c := *l
+	c.Sig = nil
+	raw, _ := json.Marshal(c)
+	return append([]byte("zero-devices\x00"), raw...)
+}
+
+func (l *DeviceList) sign(priv ed25519.PrivateKey) {
+	l.SigningPub = priv.Public().(ed25519.PublicKey)
+	l.Sig = ed25519.Sign(priv, l.signed())
+}
+
+func (l *DeviceList) verify() error {
+	if len(l.Account) != 32 || len(l.SigningPub) != ed25519.PublicKeySize ||
+		len(l.Devices) > maxDevices || !ed25519.Verify(l.SigningPub, l.signed(), l.Sig) {
+		return ErrBadDeviceList
+	}
+	for i, d := range l.Devices {
+		if err := d.validate(); err != nil {
+			return err
+		}
+		if bytes.Equal(d.IDPub, l.Account) || l.index(d.IDPub) != i {
+			return fmt.Errorf("%w: duplicate device", ErrBadDeviceList)
+		}
+	}
+	return nil
+}
+
+func (l *DeviceList) index(id []byte) int {
+	return slices.IndexFunc(l.Devices, func(d Device) bool { return bytes.Equal(d.IDPub, id) })
+}
+
+// has sagt, ob id zum Konto gehört (Primärgerät eingeschlossen).
+func (l *DeviceList) has(id []byte) bool {
+	return bytes.Equal(id, l.Account) || l.index(id) >= 0
+}
+
+// ids liefert alle Geräte des Kontos, das Primärgerät zuerst.
+func (l *DeviceList) ids() [][]byte {
+	out := [][]byte{l.Account}
+	for _, d := range l.Devices {
+		out = append(out, d.IDPub)
+	}
+	return out
+}
+
+func (l *DeviceList) clone() *DeviceList {
+	c := *l
+	c.Devices = slices.Clone(l.Devices)
+	return &c
+}
+
+// ─────────────────────────── Eigenes Konto ───────────────────────────
+
+// deviceState ist die Sicht dieses Geräts auf das eigene Konto.
+type deviceState struct {
+	Account []byte      `json:"account,omitempty"` // Primärgerät; leer = wir selbst
+	List    *DeviceList `json:"list,omitempty"`
+	Link    []byte      `json:"link,omitempty"` // Secret des offenen Link-Codes
+}
+
+func (st *deviceState) account(self []byte) []byte {
+	if st.Account != nil {
+		return st.Account
+	}
+	return self
+}
+
+// own sagt, ob id eines unserer Geräte ist.
+func (st *deviceState) own(id []byte) bool {
+	return st.List != nil && st.List.has(id)
+}
+
+// others liefert die eigenen Geräte außer diesem.
+func (st *deviceState) others(self []byte) [][]byte {
+	if st.List == nil {
+		return nil
+	}
+	return slices.DeleteFunc(st.List.ids(), func(id []byte) bool { return bytes.Equal(id, self) })
+}
+
+func (s *Store) LoadDeviceState() (*deviceState, error) {
+	path := filepath.Join(s.basePath, devicesFile)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &deviceState{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	plain, err := s.unwrap(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	var st deviceState
+	if err := json.Unmarshal(plain, &st); err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (s *Store) SaveDeviceState(st *deviceState) error {
+	raw, _ := json.Marshal(st)
+	path := filepath.Join(s.basePath, devicesFile)
+	buf, err := s.wrap(path, raw)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf)
+}
+
+// ─────────────────────────── Kontakte ────────────────────────────────
+
+// ownerOf liefert das Konto, zu dem ein weiteres Gerät eines Kontakts
+// gehört, oder nil.
+func (s *Store) ownerOf(id []byte) []byte {
+	list, _ := s.ListContacts()
+	for _, c := range list {
+		if slices.ContainsFunc(c.Devices, func(d Device) bool { return bytes.Equal(d.IDPub, id) }) {
+			return c.IDPub
+		}
+	}
+	return nil
+}
+
+// applyDeviceList übernimmt die Geräteliste eines Kontakts. Die erste
+// Liste muss vom Primärgerät selbst kommen und legt den Signaturschlüssel
+// fest; spätere dürfen auch bekannte weitere Geräte weiterreichen.
+// Veraltete Listen werden ignoriert (false).
+func (s *Store) applyDeviceList(l *DeviceList, from []byte) (bool, error) {
+	c, err := s.LoadContact(l.Account)
+	if err != nil {
+		return false, err
+	}
+	known := bytes.Equal(from, c.IDPub) ||
+		slices.ContainsFunc(c.Devices, func(d Device) bool { return bytes.Equal(d.IDPub, from) })
+	switch {
+	case !known, c.DeviceKey == nil && !bytes.Equal(from, c.IDPub):
+		return false, fmt.Errorf("%w: not sent by the account", ErrBadDeviceList)
+	case c.DeviceKey != nil && !bytes.Equal(c.DeviceKey, l.SigningPub):
+		return false, fmt.Errorf("%w: signing key changed", ErrBadDeviceList)
+	case l.Version <= c.DeviceVersion:
+		return false, nil
+	}
+	c.Devices, c.DeviceVersion, c.DeviceKey = l.Devices, l.Version, l.SigningPub
+	return true, s.SaveContact(c)
+}
+
+// ─────────────────────────── Link-Code ───────────────────────────────
+
+// linkRequest steckt im Link-Code des neuen Geräts. Secret beweist dem
+// neuen Gerät, dass das Primärgerät den Code gesehen hat.
+type linkRequest struct {
+	Device Device `json:"device"`
+	Secret []byte `json:"secret"`
+}
+
+func (r *linkRequest) encode() string {
+	raw, _ := json.Marshal(r)
+	return linkCodePrefix + base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeLinkCode(code string) (*linkRequest, error) {
+	rest, ok := strings.CutPrefix(strings.TrimSpace(code), linkCodePrefix)
+	if !ok {
+		return nil, ErrBadLinkCode
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(rest)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadLinkCode, err)
+	}
+	var r linkRequest
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadLinkCode, err)
+	}
+	if len(r.Secret) != linkSecretLen {
+		return nil, ErrBadLinkCode
+	}
+	if err := r.Device.validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadLinkCode, err)
+	}
+	return &r, nil
+}
+
+// linkBody schickt das Primärgerät dem neuen Gerät über die frische Session.
+type linkBody struct {
+	Secret   []byte     `json:"secret"`
+	List     DeviceList `json:"list"`
+	Contacts []*Contact `json:"contacts"`
+}
+
+// syncBody ist die Kopie einer gesendeten Nachricht für eigene Geräte.
+type syncBody struct {
+	To    []byte `json:"to"`    // Konto des Kontakts
+	Plain []byte `json:"plain"` // Envelope, wie er an den Kontakt ging
+}
+
+// ─────────────────────────── Session ─────────────────────────────────
+
+// account ist das Konto des Gegenübers: bei weiteren Geräten eines
+// Kontakts dessen Primärgerät, sonst das Gegenüber selbst.
+func (s *Session) account() []byte {
+	if s.Owner != nil {
+		if o := s.Owner(s.remoteID); o != nil {
+			return o
+		}
+	}
+	return s.remoteID
+}
+
+// SendDevices schickt die eigene Geräteliste; erscheint nicht im Verlauf.
+func (s *Session) SendDevices(l *DeviceList) error {
+	env, err := newEnvelope(ContentDevices, l)
+	if err != nil {
+		return err
+	}
+	return s.send(env)
+}
+
+// sendLink geht am Ausgang vorbei: verknüpft wird nur, solange das neue
+// Gerät erreichbar ist, und eine Ablehnung muss sofort ankommen.
+func (s *Session) sendLink(b *linkBody) error {
+	env, err := newEnvelope(ContentLink, b)
+	if err != nil {
+		return err
+	}
+	msg, err := s.seal(env, false)
+	if err != nil {
+		return err
+	}
+	return s.transport.SendCipher(s.remoteID, msg)
+}
+
+func (s *Session) sendSync(to []byte, sent *Envelope) error {
+	env, err := newEnvelope(ContentSync, syncBody{To: to, Plain: sent.encode()})
+	if err != nil {
+		return err
+	}
+	return s.send(env)
+}
+
+func (s *Session) receiveDevices(env *Envelope) error {
+	var l DeviceList
+	if err := env.decodeBody(&l); err != nil {
+		return err
+	}
+	if err := l.verify(); err != nil {
+		return err
+	}
+	st, err := s.store.LoadDeviceState()
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	if st.Account != nil && bytes.Equal(l.Account, st.Account) {
+		// eigene Liste: nur vom Primärgerät, mit dem bekannten Schlüssel
+		switch {
+		case !bytes.Equal(s.remoteID, st.Account), !bytes.Equal(l.SigningPub, st.List.SigningPub):
+			return fmt.Errorf("%w: not sent by the primary device", ErrBadDeviceList)
+		case l.Version > st.List.Version:
+			st.List, changed = &l, true
+			if !l.has(s.localPeer.IdentityPublicKey()) {
+				// entfernt: dieses Gerät steht wieder für sich
+				st = &deviceState{}
+			}
+			err = s.store.SaveDeviceState(st)
+		}
+	} else {
+		if !bytes.Equal(l.Account, s.account()) {
+			return fmt.Errorf("%w: foreign account", ErrBadDeviceList)
+		}
+		changed, err = s.store.applyDeviceList(&l, s.remoteID)
+	}
+	if err != nil {
+		return err
+	}
+	if changed && s.OnDevices != nil {
+		s.OnDevices(l.Account)
+	}
+	return nil
+}
+
+func (s *Session) receiveLink(env *Envelope) error {
+	var b linkBody
+	if err := env.decodeBody(&b); err != nil {
+		return err
+	}
+	if err := b.List.verify(); err != nil {
+		return err
+	}
+	st, err := s.store.LoadDeviceState()
+	if err != nil {
+		return err
+	}
+	if st.Link == nil || !hmac.Equal(b.Secret, st.Link) {
+		return ErrNotLinking
+	}
+	self := s.localPeer.IdentityPublicKey()
+	if !bytes.Equal(s.remoteID, b.List.Account) || b.List.index(self) < 0 {
+		return fmt.Errorf("%w: link from foreign account", ErrBadDeviceList)
+	}
+
+	for _, c := range b.Contacts {
+		if len(c.IDPub) != 32 || b.List.has(c.IDPub) {
+			continue
+		}
+		c.ID = ""
+		if err := s.store.SaveContact(c); err != nil {
+			return err
+		}
+	}
+	st.Account, st.List, st.Link = b.List.Account, &b.List, nil
+	if err := s.store.SaveDeviceState(st); err != nil {
+		return err
+	}
+	if s.OnLinked != nil {
+		s.OnLinked(st.Account)
+	}
+	return nil
+}
+
+// receiveSync übernimmt eine Nachricht, die ein eigenes Gerät gesendet
+// hat, als ausgehend in den Verlauf des Kontakts; Timer-Änderungen
+// gelten direkt für den Kontakt.
+func (s *Session) receiveSync(env *Envelope) error {
+	var b syncBody
+	if err := env.decodeBody(&b); err != nil {
+		return err
+	}
+	st, err := s.store.LoadDeviceState()
+	if err != nil {
+		return err
+	}
+	if !st.own(s.remoteID) {
+		return fmt.Errorf("%w: sync from foreign device", ErrBadDeviceList)
+	}
+	sent, err := decodeEnvelope(b.Plain)
+	if err != nil {
+		return err
+	}
+	if sent.ID == "" || !sent.synced() {
+		return fmt.Errorf("%w: %s in sync", ErrBadEnvelope, sent.Type)
+	}
+	if _, err := s.store.LoadContact(b.To); err != nil {
+		return err
+	}
+	switch {
+	case sent.Type == ContentTimer:
+		err = s.receiveTimer(b.To, sent)
+	case sent.changes():
+		err = s.receiveChange(b.To, true, sent)
+	default:
+		err = s.store.AppendMessage(b.To, CipherMessage{}, true, sent.ID, b.Plain)
+	}
+	if err != nil {
+		return err
+	}
+	if s.OnUpdate != nil {
+		s.OnUpdate(b.To)
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package chat
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Geräte", func() {
+	type node struct {
+		m  *Manager
+		tp *TorTransport
+	}
+	var (
+		network            *LoopbackNetwork
+		alice, bob, laptop *node
+		aID, bID, laptopID string
+	)
+
+	newNode := func(name string) *node {
+		tp := NewTorTransport(network)
+		Expect(tp.Start(context.Background())).To(Succeed())
+		DeferCleanup(tp.Close)
+		m, err := NewManagerWithTransport(GinkgoT().TempDir(), name, tp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Initialise()).To(Succeed())
+		return &node{m, tp}
+	}
+
+	texts := func(n *node, idB64 string) (in, out []string) {
+		msgs, err := n.m.Messages(idB64, 0)
+		Expect(err).NotTo(HaveOccurred())
+		for _, pm := range msgs {
+			if pm.Out {
+				out = append(out, pm.Text)
+			} else {
+				in = append(in, pm.Text)
+			}
+		}
+		return in, out
+	}
+
+	BeforeEach(func() {
+		network = NewLoopbackNetwork()
+		alice, bob, laptop = newNode("Alice"), newNode("Bob"), newNode("Bob")
+		aID, bID, laptopID = b64(alice.m.self()), b64(bob.m.self()), b64(laptop.m.self())
+
+		// Alice kennt Bobs Primärgerät, Bob lernt Alice über den Init; ihre
+		// Adresse kennt er vorab, aus einem Init lernt er keine Route
+		alice.tp.AddPeer(bob.m.self(), bob.tp.Address())
+		bob.tp.AddPeer(alice.m.self(), alice.tp.Address())
+		s := alice.m.newSession()
+		Expect(s.StartHandshake(bob.m.localPeer.Bundle())).To(Succeed())
+		alice.m.sessions[bID] = s
+		Expect(alice.m.store.AddContactIfMissing("Bob", bob.m.self())).To(Succeed())
+
+		code, err := laptop.m.LinkCode("Laptop")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bob.m.LinkDevice(code)).To(Succeed())
+	})
+
+	It("verknüpft ein Gerät und kündigt es den Kontakten an", func() {
+		devs, err := laptop.m.Devices()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(devs).To(HaveLen(2))
+		Expect(devs[0].ID).To(Equal(bID))
+		Expect(devs[1]).To(HaveField("Name", "Laptop"))
+		Expect(devs[1].Current).To(BeTrue())
+
+		contacts, _ := laptop.m.Contacts()
+		Expect(contacts).To(ConsistOf(HaveField("ID", aID)))
+		c, _ := alice.m.contactFor(bID)
+		Expect(c.Devices).To(ConsistOf(HaveField("IDPub", laptop.m.self())))
+
+		// beide Geräte zeigen dieselbe Sicherheitsnummer für Alice
+		fb, _ := bob.m.Fingerprint(aID)
+		fl, _ := laptop.m.Fingerprint(aID)
+		Expect(fl.SafetyNumber).To(Equal(fb.SafetyNumber))
+	})
+
+	It("stellt an alle Geräte zu und spiegelt gesendete Nachrichten", func() {
+		Expect(alice.m.Send(bID, "hallo")).To(Succeed())
+		Expect(laptop.m.Send(aID, "vom Laptop")).To(Succeed())
+		Expect(bob.m.Send(aID, "vom Desktop")).To(Succeed())
+
+		in, out := texts(alice, bID)
+		Expect(in).To(Equal([]string{"vom Laptop", "vom Desktop"}))
+		Expect(out).To(Equal([]string{"hallo"}))
+		for _, n := range []*node{bob, laptop} {
+			in, out := texts(n, aID)
+			Expect(in).To(Equal([]string{"hallo"}))
+			Expect(out).To(Equal([]string{"vom Laptop", "vom Desktop"}))
+		}
+
+		// das zweite Gerät ist kein eigener Kontakt
+		contacts, _ := alice.m.Contacts()
+		Expect(contacts).To(HaveLen(1))
+		msgs, _ := alice.m.Messages(bID, 0)
+		Expect(msgs[0].Status).To(Equal(StatusDelivered))
+	})
+
+	It("entfernt Geräte wieder", func() {
+		Expect(bob.m.UnlinkDevice(laptopID)).To(Succeed())
+
+		devs, _ := laptop.m.Devices()
+		Expect(devs).To(ConsistOf(HaveField("ID", laptopID)))
+		c, _ := alice.m.contactFor(bID)
+		Expect(c.Devices).To(BeEmpty())
+
+		Expect(alice.m.Send(bID, "nur Desktop")).To(Succeed())
+		in, _ := texts(laptop, aID)
+		Expect(in).To(BeEmpty())
+	})
+
+	It("lehnt fremde Codes, Listen und Verknüpfungen ab", func() {
+		Expect(laptop.m.LinkDevice("zero-link:xyz")).To(MatchError(ErrBadLinkCode))
+		_, err := laptop.m.LinkCode("")
+		Expect(err).To(MatchError(ErrAlreadyLinked))
+
+		// Code mit falschem Secret: das neue Gerät verweigert die Verknüpfung
+		tablet := newNode("Bob")
+		code, _ := tablet.m.LinkCode("Tablet")
+		req, err := decodeLinkCode(code)
+		Expect(err).NotTo(HaveOccurred())
+		req.Secret[0] ^= 1
+		Expect(bob.m.LinkDevice(req.encode())).To(MatchError(ErrRejected))
+		devs, _ := tablet.m.Devices()
+		Expect(devs).To(HaveLen(1))
+		devs, _ = bob.m.Devices()
+		Expect(devs).To(HaveLen(2))
+		Expect(laptop.m.LinkDevice(code)).To(MatchError(ErrNotPrimary))
+
+		// Liste für Bobs Konto, aber mit fremdem Schlüssel signiert
+		st, _ := bob.m.store.LoadDeviceState()
+		forged := st.List.clone()
+		forged.Version++
+		forged.sign(tablet.m.localPeer.signingPrivKey)
+		Expect(forged.verify()).To(Succeed())
+		_, err = alice.m.store.applyDeviceList(forged, bob.m.self())
+		Expect(err).To(MatchError(ErrBadDeviceList))
+
+		forged.Devices = nil
+		Expect(forged.verify()).To(MatchError(ErrBadDeviceList))
+	})
+})
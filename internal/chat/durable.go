@@ -0,0 +1,252 @@
+package chat
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Absturzsicherheit auf der Platte:
+//
+//   - Zustandsdateien (Sessions, Kontakte, Identität …) werden nie an Ort
+//     und Stelle überschrieben, sondern per temp + fsync + rename ersetzt.
+//     Nach einem Absturz liegt entweder die alte oder die neue Fassung da.
+//   - Log-Frames tragen eine CRC-32C. Ein beim Absturz abgerissenes Ende
+//     wird vor dem nächsten Anhängen abgeschnitten, ein kaputter Frame
+//     mitten im Log übersprungen, statt alles dahinter zu verlieren.
+//   - Wann Logs gefsynct werden, regelt SyncPolicy.
+
+// SyncPolicy legt fest, wann angehängte Log-Einträge auf die Platte
+// gezwungen werden. Zustandsdateien werden immer gefsynct.
+type SyncPolicy string
+
+const (
+	SyncAlways SyncPolicy = "always" // nach jedem Eintrag
+	SyncBatch  SyncPolicy = "batch"  // gesammelt bei SyncLogs (Worker, Sperren)
+	SyncNone   SyncPolicy = "none"   // dem Betriebssystem überlassen
+)
+
+func (p SyncPolicy) validate() error {
+	switch p {
+	case SyncAlways, SyncBatch, SyncNone:
+		return nil
+	}
+	return fmt.Errorf("unknown sync policy %q", p)
+}
+
+// SetSyncPolicy stellt ein, wann Logs gefsynct werden.
+func (s *Store) SetSyncPolicy(p SyncPolicy) error {
+	if err := p.validate(); err != nil {
+		return err
+	}
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.logSync = p
+	log.Printf("[Store] log sync policy: %s", p)
+	return nil
+}
+
+// SyncLogs fsynct alle Logs, die seit dem letzten Aufruf ungesynct
+// angehängt wurden (SyncBatch).
+func (s *Store) SyncLogs() error {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	var first error
+	for file := range s.unsynced {
+		f, err := os.OpenFile(file, os.O_WRONLY, 0)
+		if err == nil {
+			err = f.Sync()
+			f.Close()
+		}
+		if err != nil && !os.IsNotExist(err) && first == nil {
+			first = err
+		}
+	}
+	clear(s.unsynced)
+	return first
+}
+
+// crashWrite simuliert in Tests einen Absturz mitten in writeFileAtomic:
+// die temporäre Datei bleibt halb geschrieben liegen.
+var crashWrite func(path string) bool
+
+// writeFileAtomic ersetzt path ganz oder gar nicht.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if crashWrite != nil && crashWrite(path) {
+		f.Write(data[:len(data)/2])
+		f.Close()
+		return fmt.Errorf("simulated crash writing %s", filepath.Base(path))
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// writeFileSync schreibt path direkt und fsynct; für Dateien, die erst
+// ein späteres rename gültig macht (Rekey-Staging).
+func writeFileSync(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir macht ein rename dauerhaft. Nicht jedes System kann
+// Verzeichnisse fsyncen, Fehler werden deshalb ignoriert.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Log-Frame: u32 (Länge | frameChecked) ‖ u32 CRC-32C(Blob) ‖ Blob.
+// Frames ohne das Bit stammen aus der Zeit vor den Prüfsummen:
+// u32 Länge ‖ Blob.
+const frameChecked = 1 << 31
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func lengthPrefixed(blob []byte) []byte {
+	frame := make([]byte, 8+len(blob))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(blob))|frameChecked)
+	binary.BigEndian.PutUint32(frame[4:8], crc32.Checksum(blob, castagnoli))
+	copy(frame[8:], blob)
+	return frame
+}
+
+// frameBlob liefert den verschlüsselten Inhalt eines Frames.
+func frameBlob(frame []byte) []byte {
+	if binary.BigEndian.Uint32(frame[:4])&frameChecked != 0 {
+		return frame[8:]
+	}
+	return frame[4:]
+}
+
+// checkedFrame prüft, ob bei data ein Frame mit Prüfsumme beginnt, und
+// liefert seine Länge (0 = nein).
+func checkedFrame(data []byte) int {
+	if len(data) < 8 {
+		return 0
+	}
+	h := binary.BigEndian.Uint32(data[:4])
+	n := int(h &^ frameChecked)
+	if h&frameChecked == 0 || len(data) < 8+n {
+		return 0
+	}
+	if crc32.Checksum(data[8:8+n], castagnoli) != binary.BigEndian.Uint32(data[4:8]) {
+		return 0
+	}
+	return 8 + n
+}
+
+// splitFrames zerlegt ein Log in seine Frames; Beschädigtes fällt weg.
+func splitFrames(data []byte) [][]byte {
+	frames, _ := scanFrames(data)
+	return frames
+}
+
+// scanFrames zerlegt ein Log und liefert dazu, bis wohin es heil ist.
+// Hinter einem kaputten Frame wird der nächste gültige gesucht; findet
+// sich keiner, ist das der abgerissene Rest eines Absturzes.
+func scanFrames(data []byte) (frames [][]byte, good int) {
+	off := 0
+	for off+4 <= len(data) {
+		if n := checkedFrame(data[off:]); n > 0 {
+			frames = append(frames, data[off:off+n])
+			off += n
+			good = off
+			continue
+		}
+		h := binary.BigEndian.Uint32(data[off:])
+		if n := int(h); h&frameChecked == 0 && off+4+n <= len(data) {
+			frames = append(frames, data[off:off+4+n]) // Alt-Frame
+			off += 4 + n
+			good = off
+			continue
+		}
+
+		// kaputt oder abgerissen: nächsten gültigen Frame suchen
+		next := off + 1
+		for next+8 <= len(data) && checkedFrame(data[next:]) == 0 {
+			next++
+		}
+		if next+8 > len(data) {
+			log.Printf("  torn log tail at %d (%d bytes)", good, len(data)-good)
+			break
+		}
+		log.Printf("  skipping %d corrupt bytes at %d", next-off, off)
+		off = next
+	}
+	return frames, good
+}
+
+// repairTail schneidet ein abgerissenes Log-Ende ab, damit neue Einträge
+// nicht hinter Müll landen. Einmal pro Log und Prozess; logMu muss
+// gehalten werden.
+func (s *Store) repairTail(file string) error {
+	if s.repaired[file] {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if _, good := scanFrames(data); good < len(data) {
+		log.Printf("[Store] !! repairing %s: dropping %d torn bytes", filepath.Base(file), len(data)-good)
+		f, err := os.OpenFile(file, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(int64(good))
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if s.repaired == nil {
+		s.repaired = map[string]bool{}
+	}
+	s.repaired[file] = true
+	return nil
+}
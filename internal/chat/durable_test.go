@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Absturzsicherheit", func() {
+	var (
+		tmp  string
+		st   *Store
+		peer []byte
+		file string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "durable_*")
+		Expect(err).NotTo(HaveOccurred())
+		st, err = NewStore(tmp)
+		Expect(err).NotTo(HaveOccurred())
+		peer = []byte("bob-identity-key-000000000000000")
+		file = filepath.Join(tmp, msgDir, b64Name(peer)+".log")
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	appendText := func(s *Store, texts ...string) {
+		for _, t := range texts {
+			Expect(s.AppendMessage(peer, CipherMessage{}, true, t, []byte(t))).To(Succeed())
+		}
+	}
+	texts := func(s *Store) []string {
+		recs, err := s.LoadMessages(peer, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		var out []string
+		for _, r := range recs {
+			out = append(out, r.Plain)
+		}
+		return out
+	}
+
+	It("schneidet ein abgerissenes Log-Ende ab und hängt dahinter weiter an", func() {
+		appendText(st, "m1", "m2", "m3")
+		info, _ := os.Stat(file)
+		Expect(os.Truncate(file, info.Size()-5)).To(Succeed()) // Absturz mitten in m3
+
+		st2, err := NewStore(tmp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(texts(st2)).To(Equal([]string{"m1", "m2"}))
+		appendText(st2, "m4")
+		Expect(texts(st2)).To(Equal([]string{"m1", "m2", "m4"}))
+
+		data, _ := os.ReadFile(file)
+		_, good := scanFrames(data)
+		Expect(good).To(Equal(len(data)))
+	})
+
+	It("überspringt einen kaputten Frame mitten im Log", func() {
+		appendText(st, "m1", "m2", "m3")
+		data, _ := os.ReadFile(file)
+		frames := splitFrames(data)
+		Expect(frames).To(HaveLen(3))
+		data[len(frames[0])+20] ^= 0xff
+		Expect(os.WriteFile(file, data, 0o600)).To(Succeed())
+
+		Expect(texts(st)).To(Equal([]string{"m1", "m3"}))
+		appendText(st, "m4")
+		Expect(texts(st)).To(Equal([]string{"m1", "m3", "m4"}))
+	})
+
+	It("liest Frames ohne Prüfsumme weiter", func() {
+		appendText(st, "m1")
+		data, _ := os.ReadFile(file)
+		blob := frameBlob(data)
+		old := make([]byte, 4+len(blob))
+		binary.BigEndian.PutUint32(old, uint32(len(blob)))
+		copy(old[4:], blob)
+		Expect(os.WriteFile(file, old, 0o600)).To(Succeed())
+
+		st2, err := NewStore(tmp)
+		Expect(err).NotTo(HaveOccurred())
+		appendText(st2, "m2")
+		Expect(texts(st2)).To(Equal([]string{"m1", "m2"}))
+	})
+
+	It("behält beim Absturz während des Schreibens den alten Zustand", func() {
+		Expect(st.AddContactIfMissing("Bob", peer)).To(Succeed())
+		c, err := st.LoadContact(peer)
+		Expect(err).NotTo(HaveOccurred())
+
+		crashWrite = func(path string) bool { return filepath.Dir(path) == filepath.Join(tmp, contactsDir) }
+		DeferCleanup(func() { crashWrite = nil })
+		c.Name = "Robert"
+		Expect(st.SaveContact(c)).To(HaveOccurred())
+		crashWrite = nil
+
+		st2, err := NewStore(tmp)
+		Expect(err).NotTo(HaveOccurred())
+		got, err := st2.LoadContact(peer)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Name).To(Equal("Bob"))
+		list, err := st2.ListContacts()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(list).To(HaveLen(1)) // der halbe Temp-Rest zählt nicht
+
+		Expect(st2.SaveContact(c)).To(Succeed())
+		got, _ = st2.LoadContact(peer)
+		Expect(got.Name).To(Equal("Robert"))
+	})
+
+	It("fsynct bei SyncBatch erst mit SyncLogs", func() {
+		Expect(st.SetSyncPolicy("sometimes")).To(HaveOccurred())
+		Expect(st.SetSyncPolicy(SyncBatch)).To(Succeed())
+		appendText(st, "m1")
+		Expect(st.unsynced).To(HaveKey(file))
+		Expect(st.SyncLogs()).To(Succeed())
+		Expect(st.unsynced).To(BeEmpty())
+
+		Expect(st.SetSyncPolicy(SyncNone)).To(Succeed())
+		appendText(st, "m2")
+		Expect(st.unsynced).To(BeEmpty())
+		Expect(texts(st)).To(Equal([]string{"m1", "m2"}))
+	})
+})
@@ -0,0 +1,374 @@
+package chat
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Bearbeiten und Löschen für alle: Steuernachrichten, die per
+// Envelope.ID auf eine frühere Nachricht desselben Absenders verweisen.
+//
+// Das Log bleibt append-only: eine Änderung ist ein eigener Eintrag mit
+// Change = edit|delete und Refs = [ID]. loadLog hängt die Änderungen an
+// die Nachricht, der letzte Edit gilt, ein Delete ist endgültig.
+// compactLog entfernt danach Klartext und Edits gelöschter Nachrichten;
+// stehen bleiben der Eintrag selbst (ohne Inhalt) als Grabstein und der
+// Delete-Eintrag als Markierung.
+const (
+	ChangeEdit     = "edit"
+	ChangeDelete   = "delete"
+	ChangeReaction = "reaction" // siehe reaction.go
+)
+
+var (
+	ErrNoMessage   = errors.New("message not found")
+	ErrNotEditable = errors.New("message cannot be changed")
+)
+
+type editBody struct {
+	Ref  string `json:"ref"`
+	Text string `json:"text"`
+}
+
+type deleteBody struct {
+	Ref string `json:"ref"`
+}
+
+// MessageEdit ist eine frühere Fassung einer bearbeiteten Nachricht.
+type MessageEdit struct {
+	Text string    `json:"text"`
+	At   time.Time `json:"at"`
+}
+
+// SendEdit ersetzt den Text einer eigenen Textnachricht bei allen Geräten.
+func (s *Session) SendEdit(ref, text string) error {
+	log.Printf("[Session:%s] SendEdit ref=%s → %s", s.Name, ref, b64(s.remoteID)[:8])
+	env, err := newEnvelope(ContentEdit, editBody{Ref: ref, Text: text})
+	if err != nil {
+		return err
+	}
+	return s.sendChange(env)
+}
+
+// SendDelete zieht eine eigene Nachricht bei allen Geräten zurück.
+func (s *Session) SendDelete(ref string) error {
+	log.Printf("[Session:%s] SendDelete ref=%s → %s", s.Name, ref, b64(s.remoteID)[:8])
+	env, err := newEnvelope(ContentDelete, deleteBody{Ref: ref})
+	if err != nil {
+		return err
+	}
+	return s.sendChange(env)
+}
+
+// sendChange wendet die Änderung lokal an und verschickt sie dann; liegt
+// sie nur im Ausgang, gilt sie hier trotzdem schon.
+func (s *Session) sendChange(env *Envelope) error {
+	if err := s.store.applyChange(s.account(), true, env); err != nil {
+		return err
+	}
+	return s.send(env)
+}
+
+// receiveChange übernimmt eine Änderung des Kontakts (out = false) oder
+// eines eigenen Geräts per Sync (out = true). Ist die Nachricht noch
+// unterwegs (etwa aus dem Ausgang, während die Änderung direkt ankam),
+// wird die Änderung vorgemerkt statt abgelehnt.
+func (s *Session) receiveChange(account []byte, out bool, env *Envelope) error {
+	err := s.store.applyChange(account, out, env)
+	if !errors.Is(err, ErrNoMessage) {
+		return err
+	}
+	ref, _, _ := parseChange(env)
+	if _, ferr := s.store.findMessage(account, ref, func(*CipherMessageWithMeta) bool { return true }); ferr == nil {
+		return err // gibt es, nur nicht in dieser Richtung
+	}
+	return s.store.keepOrphan(account, ref, out, env)
+}
+
+// parseChange liefert Ziel und Art einer Änderung.
+func parseChange(env *Envelope) (ref, kind string, err error) {
+	switch env.Type {
+	case ContentEdit:
+		var b editBody
+		if err := env.decodeBody(&b); err != nil {
+			return "", "", err
+		}
+		if b.Text == "" {
+			return "", "", fmt.Errorf("%w: empty edit", ErrBadEnvelope)
+		}
+		ref, kind = b.Ref, ChangeEdit
+	case ContentDelete:
+		var b deleteBody
+		if err := env.decodeBody(&b); err != nil {
+			return "", "", err
+		}
+		ref, kind = b.Ref, ChangeDelete
+	case ContentReaction:
+		var b reactionBody
+		if err := env.decodeBody(&b); err != nil {
+			return "", "", err
+		}
+		if err := b.validate(); err != nil {
+			return "", "", err
+		}
+		ref, kind = b.Ref, ChangeReaction
+	default:
+		return "", "", fmt.Errorf("%w: %s is no change", ErrBadEnvelope, env.Type)
+	}
+	if ref == "" || env.ID == "" {
+		return "", "", fmt.Errorf("%w: change without reference", ErrBadEnvelope)
+	}
+	return ref, kind, nil
+}
+
+// applyChange prüft die Änderung gegen das Log und hängt sie an. Nur
+// Nachrichten derselben Richtung lassen sich ändern, bearbeiten nur Text;
+// reagieren kann jede Seite auf jede Nachricht.
+func (s *Store) applyChange(id []byte, out bool, env *Envelope) error {
+	ref, kind, err := parseChange(env)
+	if err != nil {
+		return err
+	}
+
+	orig, err := s.findMessage(id, ref, func(r *CipherMessageWithMeta) bool {
+		return kind == ChangeReaction || r.Out == out
+	})
+	if err != nil {
+		return err
+	}
+	pm, err := plainMessage(s, *orig)
+	if err != nil {
+		return err
+	}
+	if pm.Deleted || (kind == ChangeEdit && pm.Type != ContentText) {
+		return fmt.Errorf("%w: %s", ErrNotEditable, ref)
+	}
+
+	log.Printf("[Store] %s id=%s ref=%s out=%v", kind, b64Name(id)[:8], ref, out)
+	if err := s.appendRecord(id, CipherMessageWithMeta{
+		TS:     time.Now().UTC(),
+		Out:    out,
+		MsgID:  env.ID,
+		Plain:  string(env.encode()),
+		Change: kind,
+		Refs:   []string{ref},
+	}); err != nil {
+		return err
+	}
+	if kind == ChangeDelete {
+		// Klartext sofort von der Platte, nicht erst beim nächsten Sweep
+		_, _, err = s.compactLog(filepath.Join(s.basePath, msgDir, b64Name(id)+".log"), time.Now())
+	}
+	return err
+}
+
+// findMessage sucht eine Nachricht samt ihren Änderungen im Log.
+func (s *Store) findMessage(id []byte, ref string, match func(*CipherMessageWithMeta) bool) (*CipherMessageWithMeta, error) {
+	msgs, err := s.LoadMessages(id, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		if msgs[i].msgID() == ref && match(&msgs[i]) {
+			return &msgs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoMessage, ref)
+}
+
+// Vorgemerkte Änderungen (msgs/<id>.orphans): Edit, Delete oder Reaktion,
+// deren Nachricht noch nicht im Log steht. Sie warten nach Ziel-ID und
+// werden angewendet, sobald AppendMessage die Nachricht einträgt. Sie
+// tragen Klartext und verfallen deshalb wie Nachrichten: mit dem Timer,
+// spätestens nach orphanMaxAge (siehe ExpireMessages).
+const (
+	orphanExt    = ".orphans"
+	maxOrphans   = 256            // je Kontakt; darüber fallen die ältesten weg
+	orphanMaxAge = 24 * time.Hour // so lange behält auch der Absender Gesendetes (outboxKeepSent)
+)
+
+type orphanChange struct {
+	Ref string    `json:"ref"`
+	Out bool      `json:"out"`
+	Env []byte    `json:"env"` // kodierter Envelope der Änderung
+	TS  time.Time `json:"ts"`
+	TTL uint32    `json:"ttl,omitempty"` // Timer aus Umschlag oder Kontakt, 0 = aus
+}
+
+// expiry ist der Zeitpunkt, zu dem die Änderung verfällt.
+func (o *orphanChange) expiry() time.Time {
+	end := o.TS.Add(orphanMaxAge)
+	if ttl := o.TS.Add(time.Duration(o.TTL) * time.Second); o.TTL > 0 && ttl.Before(end) {
+		end = ttl
+	}
+	return end
+}
+
+func (s *Store) orphansPath(id []byte) string {
+	return filepath.Join(s.basePath, msgDir, b64Name(id)+orphanExt)
+}
+
+func (s *Store) loadOrphans(id []byte) ([]orphanChange, error) {
+	raw, err := os.ReadFile(s.orphansPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	plain, err := s.unwrap(s.orphansPath(id), raw)
+	if err != nil {
+		return nil, err
+	}
+	var list []orphanChange
+	if err := json.Unmarshal(plain, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (s *Store) saveOrphans(id []byte, list []orphanChange) error {
+	if len(list) == 0 {
+		err := os.Remove(s.orphansPath(id))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(s.basePath, msgDir), 0o700); err != nil {
+		return err
+	}
+	raw, _ := json.Marshal(list)
+	buf, err := s.wrap(s.orphansPath(id), raw)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.orphansPath(id), buf)
+}
+
+// keepOrphan merkt eine Änderung vor, deren Nachricht ref noch fehlt.
+// Änderungen reisen ohne Timer; dann gilt der des Kontakts, den auch die
+// Nachricht mitbringen wird.
+func (s *Store) keepOrphan(id []byte, ref string, out bool, env *Envelope) error {
+	log.Printf("[Store] orphan %s id=%s ref=%s out=%v", env.Type, b64Name(id)[:8], ref, out)
+	ttl := env.TTL
+	if c, err := s.LoadContact(id); err == nil && ttl == 0 {
+		ttl = c.ExpireTimer
+	}
+	s.orphanMu.Lock()
+	defer s.orphanMu.Unlock()
+	list, err := s.loadOrphans(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	list = slices.DeleteFunc(list, func(o orphanChange) bool { return !o.expiry().After(now) })
+	list = append(list, orphanChange{Ref: ref, Out: out, Env: env.encode(), TS: now, TTL: ttl})
+	if len(list) > maxOrphans {
+		list = list[len(list)-maxOrphans:]
+	}
+	return s.saveOrphans(id, list)
+}
+
+// adoptOrphans wendet die vorgemerkten Änderungen an msgID an, in der
+// Reihenfolge ihres Eintreffens.
+func (s *Store) adoptOrphans(id []byte, msgID string) {
+	s.orphanMu.Lock()
+	list, err := s.loadOrphans(id)
+	var mine []orphanChange
+	if err == nil {
+		n, now := len(list), time.Now()
+		list = slices.DeleteFunc(list, func(o orphanChange) bool {
+			if o.Ref != msgID {
+				return false
+			}
+			// schon verfallen: der Worker war nur noch nicht da
+			if o.expiry().After(now) {
+				mine = append(mine, o)
+			}
+			return true
+		})
+		if len(list) != n {
+			err = s.saveOrphans(id, list)
+		}
+	}
+	s.orphanMu.Unlock()
+	if err != nil {
+		log.Printf("[Store] !! orphans %s: %v", b64Name(id)[:8], err)
+		return
+	}
+
+	for _, o := range mine {
+		env, err := decodeEnvelope(o.Env)
+		if err == nil {
+			err = s.applyChange(id, o.Out, env)
+		}
+		if err != nil {
+			log.Printf("[Store] !! orphan for %s: %v", msgID, err)
+		}
+	}
+}
+
+// expireOrphans verwirft verfallene Änderungen zu id und liefert den
+// nächsten Verfallszeitpunkt.
+func (s *Store) expireOrphans(id []byte, now time.Time) (next time.Time, err error) {
+	s.orphanMu.Lock()
+	defer s.orphanMu.Unlock()
+	list, err := s.loadOrphans(id)
+	if err != nil {
+		return time.Time{}, err
+	}
+	n := len(list)
+	list = slices.DeleteFunc(list, func(o orphanChange) bool { return !o.expiry().After(now) })
+	for _, o := range list {
+		if end := o.expiry(); next.IsZero() || end.Before(next) {
+			next = end
+		}
+	}
+	if len(list) != n {
+		log.Printf("[Store] expire orphans id=%s n=%d", b64Name(id)[:8], n-len(list))
+		err = s.saveOrphans(id, list)
+	}
+	return next, err
+}
+
+// applyChanges setzt Text, Verlauf, Reaktionen und Markierungen aus den
+// Änderungen eines Log-Eintrags.
+func (pm *PlainMessage) applyChanges(changes []CipherMessageWithMeta) {
+	var reactions reactionSet
+	for _, c := range changes {
+		if pm.Deleted {
+			break
+		}
+		env, err := decodeEnvelope([]byte(c.Plain))
+		if err != nil {
+			continue
+		}
+		switch c.Change {
+		case ChangeReaction:
+			var b reactionBody
+			if env.decodeBody(&b) == nil {
+				reactions.set(c.Out, b)
+			}
+		case ChangeDelete:
+			pm.Deleted, pm.Text, pm.History, pm.Attachment = true, "", nil, nil
+			pm.Quote, reactions = nil, reactionSet{}
+		case ChangeEdit:
+			var b editBody
+			if pm.Type != ContentText || env.decodeBody(&b) != nil {
+				continue
+			}
+			at := cmp.Or(pm.EditedAt, pm.At)
+			pm.History = append(pm.History, MessageEdit{Text: pm.Text, At: at})
+			pm.Text, pm.Edited, pm.EditedAt = b.Text, true, c.TS
+		}
+	}
+	pm.Reactions = reactions.aggregate()
+}
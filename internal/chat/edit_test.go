@@ -0,0 +1,186 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Bearbeiten und Löschen", func() {
+	var (
+		tmp     string
+		mgr     *Manager
+		bobID   string
+		bobSess *Session
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "edit_*")
+		Expect(err).NotTo(HaveOccurred())
+		mgr, err = NewManager(tmp, "Alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mgr.Initialise()).To(Succeed())
+
+		list, _ := mgr.Contacts()
+		bobID = list[0].ID
+		dt := mgr.transport.(*DummyTransport)
+		for _, s := range dt.peers {
+			if b64(s.LocalPeer().IdentityPublicKey()) == bobID {
+				bobSess = s
+			}
+		}
+		Expect(bobSess).NotTo(BeNil())
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	last := func() PlainMessage {
+		msgs, err := mgr.Messages(bobID, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).NotTo(BeEmpty())
+		return msgs[len(msgs)-1]
+	}
+	bobLast := func() PlainMessage {
+		msgs, err := bobSess.LoadPlainMessages(bobSess.RemoteID(), time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).NotTo(BeEmpty())
+		return msgs[len(msgs)-1]
+	}
+
+	It("zeigt auf beiden Seiten die letzte Fassung samt Verlauf", func() {
+		Expect(mgr.Send(bobID, "Hallo Wlet")).To(Succeed())
+		id := last().ID
+		Expect(mgr.EditMessage(bobID, id, "Hallo Welt")).To(Succeed())
+		Expect(mgr.EditMessage(bobID, id, "Hallo Welt!")).To(Succeed())
+
+		for _, pm := range []PlainMessage{last(), bobLast()} {
+			Expect(pm.ID).To(Equal(id))
+			Expect(pm.Text).To(Equal("Hallo Welt!"))
+			Expect(pm.Edited).To(BeTrue())
+			Expect(pm.History).To(HaveLen(2))
+			Expect(pm.History[0].Text).To(Equal("Hallo Wlet"))
+			Expect(pm.History[1].Text).To(Equal("Hallo Welt"))
+		}
+		// Edits sind keine eigenen Nachrichten und bleiben zugestellt
+		msgs, _ := mgr.Messages(bobID, 0)
+		Expect(msgs).To(HaveLen(1))
+		Expect(msgs[0].Status).To(Equal(StatusDelivered))
+	})
+
+	It("löscht für alle und entfernt den Klartext aus dem Log", func() {
+		Expect(mgr.Send(bobID, "geheim")).To(Succeed())
+		id := last().ID
+		Expect(mgr.EditMessage(bobID, id, "noch geheimer")).To(Succeed())
+		Expect(mgr.DeleteMessage(bobID, id)).To(Succeed())
+
+		for _, pm := range []PlainMessage{last(), bobLast()} {
+			Expect(pm.ID).To(Equal(id))
+			Expect(pm.Deleted).To(BeTrue())
+			Expect(pm.Text).To(BeEmpty())
+			Expect(pm.History).To(BeEmpty())
+		}
+		for _, st := range []*Store{mgr.store, bobSess.store} {
+			for _, name := range []string{b64Name(bobSess.LocalPeer().IdentityPublicKey()), b64Name(bobSess.RemoteID())} {
+				path := filepath.Join(st.basePath, msgDir, name+".log")
+				data, err := os.ReadFile(path)
+				if os.IsNotExist(err) {
+					continue
+				}
+				Expect(err).NotTo(HaveOccurred())
+				for _, frame := range splitFrames(data) {
+					rec, err := st.record(path, frame)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(strings.Contains(rec.Plain, "geheim")).To(BeFalse())
+				}
+			}
+		}
+
+		Expect(mgr.EditMessage(bobID, id, "zurück")).To(MatchError(ErrNotEditable))
+		Expect(mgr.DeleteMessage(bobID, id)).To(MatchError(ErrNotEditable))
+	})
+
+	It("merkt Änderungen vor, die vor ihrer Nachricht ankommen", func() {
+		// Alice vom Transport nehmen: Bobs Nachrichten landen in seinem Ausgang
+		dt := mgr.transport.(*DummyTransport)
+		dt.mu.Lock()
+		delete(dt.peers, string(mgr.self()))
+		dt.mu.Unlock()
+		aliceID := bobSess.RemoteID()
+
+		Expect(bobSess.Send([]byte("Hallo Alcie"))).To(MatchError(ErrQueued))
+		id := bobLast().ID
+		Expect(bobSess.SendEdit(id, "Hallo Alice")).To(MatchError(ErrQueued))
+		Expect(bobSess.Send([]byte("weg damit"))).To(MatchError(ErrQueued))
+		gone := bobLast().ID
+		Expect(bobSess.SendDelete(gone)).To(MatchError(ErrQueued))
+
+		// Edit und Delete überholen ihre Nachrichten
+		queued, err := bobSess.store.LoadOutbox(aliceID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(queued).To(HaveLen(4))
+		sess, ok := mgr.session(bobID)
+		Expect(ok).To(BeTrue())
+		for _, i := range []int{1, 3, 0, 2} {
+			Expect(sess.Receive(queued[i].Msg)).To(Succeed())
+			if i == 3 {
+				Expect(mgr.store.orphansPath(sess.RemoteID())).To(BeAnExistingFile())
+			}
+		}
+
+		msgs, err := mgr.Messages(bobID, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).To(HaveLen(2))
+		Expect(msgs[0].ID).To(Equal(id))
+		Expect(msgs[0].Text).To(Equal("Hallo Alice"))
+		Expect(msgs[0].Edited).To(BeTrue())
+		Expect(msgs[1].ID).To(Equal(gone))
+		Expect(msgs[1].Deleted).To(BeTrue())
+		Expect(mgr.store.orphansPath(sess.RemoteID())).NotTo(BeAnExistingFile())
+	})
+
+	It("lässt vorgemerkte Änderungen verfallen", func() {
+		id := bobSess.LocalPeer().IdentityPublicKey()
+		keep := func(ref string, ttl uint32) {
+			env, err := newEnvelope(ContentEdit, editBody{Ref: ref, Text: "geheim"})
+			Expect(err).NotTo(HaveOccurred())
+			env.TTL = ttl
+			Expect(mgr.store.keepOrphan(id, ref, false, env)).To(Succeed())
+		}
+		keep("mit-timer", 60)
+		keep("ohne-timer", 0)
+
+		// der Timer greift zuerst, ohne Timer hält die Änderung orphanMaxAge
+		_, next, err := mgr.store.ExpireMessages(time.Now().Add(2 * time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(next).To(BeTemporally("~", time.Now().Add(orphanMaxAge), time.Minute))
+		list, err := mgr.store.loadOrphans(id)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(list).To(ConsistOf(HaveField("Ref", "ohne-timer")))
+
+		_, _, err = mgr.store.ExpireMessages(time.Now().Add(orphanMaxAge + time.Minute))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mgr.store.orphansPath(id)).NotTo(BeAnExistingFile())
+	})
+
+	It("ändert nur eigene Nachrichten", func() {
+		Expect(mgr.Send(bobID, "von Alice")).To(Succeed())
+		own := last().ID
+		Expect(bobSess.Send([]byte("von Bob"))).To(Succeed())
+		theirs := last().ID
+
+		Expect(mgr.EditMessage(bobID, theirs, "x")).To(MatchError(ErrNoMessage))
+		Expect(mgr.DeleteMessage(bobID, "gibt-es-nicht")).To(MatchError(ErrNoMessage))
+
+		// Bob versucht, Alices Nachricht zu ändern
+		env, _ := newEnvelope(ContentEdit, editBody{Ref: own, Text: "gefälscht"})
+		err := mgr.store.applyChange(bobSess.LocalPeer().IdentityPublicKey(), false, env)
+		Expect(err).To(MatchError(ErrNoMessage))
+		msgs, _ := mgr.Messages(bobID, 0)
+		Expect(msgs[0].Text).To(Equal("von Alice"))
+		Expect(msgs[0].Edited).To(BeFalse())
+	})
+})
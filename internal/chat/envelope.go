@@ -0,0 +1,138 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Innerer Umschlag im Ratchet-Klartext:
+//
+//	0x00 ‖ Version (1 Byte) ‖ JSON {type, id, sent, body}
+//
+// Alte Clients schicken rohes UTF-8; das beginnt nie mit einem NUL-Byte
+// und wird beim Lesen als Textnachricht ohne ID behandelt.
+const (
+	envelopeMagic   byte = 0x00
+	envelopeVersion byte = 1
+)
+
+// Inhaltstypen. Unbekannte Typen (neuere Clients) erscheinen im Verlauf
+// als Platzhalter statt verworfen zu werden.
+const (
+	ContentText       = "text"
+	ContentReceipt    = "receipt"
+	ContentAttachment = "attachment"
+	ContentGroup      = "group"   // Mitgliederliste und Sender-Key, nur über 1:1-Sessions
+	ContentDevices    = "devices" // signierte Geräteliste eines Kontos
+	ContentLink       = "link"    // Primärgerät → neues Gerät: Liste und Kontakte
+	ContentSync       = "sync"    // Kopie einer gesendeten Nachricht an eigene Geräte
+	ContentTimer      = "timer"   // Timer für verschwindende Nachrichten ändern
+	ContentEdit       = "edit"    // neuer Text für eine eigene Nachricht
+	ContentDelete     = "delete"  // eigene Nachricht für alle löschen
+	ContentReaction   = "reaction"
+)
+
+var ErrBadEnvelope = errors.New("malformed message envelope")
+
+// Envelope ist eine Nachricht, wie sie der Absender verschickt hat.
+type Envelope struct {
+	Type string          `json:"type"`
+	ID   string          `json:"id"`   // UUID, stabil über Quittungen, Edits usw.
+	Sent time.Time       `json:"sent"` // Uhr des Absenders
+	Body json.RawMessage `json:"body,omitempty"`
+	TTL  uint32          `json:"ttl,omitempty"` // Sekunden bis zum Löschen, 0 = bleibt
+
+	version byte // 0 = Alt-Nachricht ohne Umschlag
+}
+
+type textBody struct {
+	Text  string     `json:"text"`
+	Quote *quoteBody `json:"quote,omitempty"` // Antwort auf eine frühere Nachricht
+}
+
+func newEnvelope(typ string, body any) (*Envelope, error) {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		Type:    typ,
+		ID:      uuid.NewString(),
+		Sent:    time.Now().UTC(),
+		Body:    raw,
+		version: envelopeVersion,
+	}, nil
+}
+
+func (e *Envelope) encode() []byte {
+	raw, _ := json.Marshal(e)
+	return append([]byte{envelopeMagic, envelopeVersion}, raw...)
+}
+
+// decodeEnvelope liest einen Ratchet-Klartext. Eine höhere Version als
+// envelopeVersion wird nicht interpretiert, sondern als unbekannter Typ
+// durchgereicht.
+func decodeEnvelope(plain []byte) (*Envelope, error) {
+	if len(plain) == 0 || plain[0] != envelopeMagic {
+		body, _ := json.Marshal(textBody{Text: string(plain)})
+		return &Envelope{Type: ContentText, Body: body}, nil
+	}
+	if len(plain) < 2 {
+		return nil, ErrBadEnvelope
+	}
+	e := &Envelope{version: plain[1]}
+	if err := json.Unmarshal(plain[2:], e); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadEnvelope, err)
+	}
+	if e.version > envelopeVersion {
+		e.Type = fmt.Sprintf("v%d:%s", e.version, e.Type)
+	}
+	if e.Type == "" {
+		return nil, ErrBadEnvelope
+	}
+	return e, nil
+}
+
+// decodeBody entpackt den Body in den zum Typ passenden Go-Typ.
+func (e *Envelope) decodeBody(v any) error {
+	d := json.NewDecoder(bytes.NewReader(e.Body))
+	if err := d.Decode(v); err != nil {
+		return fmt.Errorf("%w: %s body: %v", ErrBadEnvelope, e.Type, err)
+	}
+	return nil
+}
+
+// logged sagt, ob der Typ im Verlauf erscheint. Steuernachrichten wie
+// Quittungen, Gruppen-Updates und Gerätelisten tun das nicht; unbekannte
+// Typen schon (als Platzhalter).
+func (e *Envelope) logged() bool {
+	switch e.Type {
+	case ContentReceipt, ContentGroup, ContentDevices, ContentLink, ContentSync, ContentTimer,
+		ContentEdit, ContentDelete, ContentReaction:
+		return false
+	}
+	return true
+}
+
+// synced sagt, ob eigene Geräte eine Kopie bekommen: alles aus dem
+// Verlauf, Timer-Änderungen sowie Edits und Löschungen.
+func (e *Envelope) synced() bool {
+	return e.logged() || e.Type == ContentTimer || e.changes()
+}
+
+// changes sagt, ob der Umschlag sich auf eine frühere Nachricht bezieht
+// und mit ihr geladen wird, statt eine eigene Blase zu bekommen.
+func (e *Envelope) changes() bool {
+	return e.Type == ContentEdit || e.Type == ContentDelete || e.Type == ContentReaction
+}
+
+// allDevices sagt, ob jedes Gerät des Kontakts eine Kopie bekommt.
+// Gruppen gelten pro Gerät, die Chunks eines Anhangs gehen nur an eines.
+func (e *Envelope) allDevices() bool {
+	return e.Type != ContentGroup && e.Type != ContentAttachment
+}
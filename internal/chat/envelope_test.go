@@ -0,0 +1,122 @@
+package chat
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Nachrichten-Umschlag", func() {
+
+	It("überträgt Typ, ID und Absender-Zeit", func() {
+		env, err := newEnvelope(ContentText, textBody{Text: "hallo"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(uuid.Validate(env.ID)).To(Succeed())
+
+		got, err := decodeEnvelope(env.encode())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Type).To(Equal(ContentText))
+		Expect(got.ID).To(Equal(env.ID))
+		Expect(got.Sent).To(BeTemporally("==", env.Sent))
+
+		var body textBody
+		Expect(got.decodeBody(&body)).To(Succeed())
+		Expect(body.Text).To(Equal("hallo"))
+	})
+
+	It("liest rohen Text alter Clients als Textnachricht ohne ID", func() {
+		got, err := decodeEnvelope([]byte("von früher"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Type).To(Equal(ContentText))
+		Expect(got.ID).To(BeEmpty())
+	})
+
+	It("reicht neuere Umschlag-Versionen als unbekannten Typ durch", func() {
+		got, err := decodeEnvelope([]byte("\x00\x09{\"type\":\"text\",\"id\":\"x\"}"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Type).To(Equal("v9:text"))
+
+		_, err = decodeEnvelope([]byte("\x00\x01{kaputt"))
+		Expect(err).To(MatchError(ErrBadEnvelope))
+		_, err = decodeEnvelope([]byte{envelopeMagic})
+		Expect(err).To(MatchError(ErrBadEnvelope))
+	})
+})
+
+var _ = Describe("Session.Receive nach Inhaltstyp", func() {
+	var (
+		aSess, bSess *Session
+		aliceID      []byte
+		bobID        []byte
+	)
+
+	BeforeEach(func() {
+		aStore, _ := NewStore(GinkgoT().TempDir())
+		bStore, _ := NewStore(GinkgoT().TempDir())
+		tp := NewDummyTransport()
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		aSess = NewSessionFromPeer(alice, tp, aStore)
+		bSess = NewSessionFromPeer(bob, tp, bStore)
+		Expect(aSess.StartHandshake(bob.Bundle())).To(Succeed())
+		aliceID, bobID = alice.IdentityPublicKey(), bob.IdentityPublicKey()
+	})
+
+	// rohen Klartext an Bob schicken, vorbei an Session.Send
+	sendRaw := func(plain []byte) error {
+		h, n, ct, err := aSess.localPeer.Encrypt(bobID, plain)
+		Expect(err).NotTo(HaveOccurred())
+		return bSess.Receive(CipherMessage{
+			Version: aSess.localPeer.state(bobID).protocol(),
+			Header:  h, Nonce: n, Cipher: ct,
+		})
+	}
+
+	It("liefert Textnachrichten mit derselben ID auf beiden Seiten", func() {
+		Expect(aSess.Send([]byte("Hallo Bob"))).To(Succeed())
+
+		sent, _ := aSess.LoadPlainMessages(bobID, time.Time{})
+		got, _ := bSess.LoadPlainMessages(aliceID, time.Time{})
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Type).To(Equal(ContentText))
+		Expect(got[0].Text).To(Equal("Hallo Bob"))
+		Expect(got[0].ID).To(Equal(sent[0].ID))
+		Expect(got[0].Sent).NotTo(BeZero())
+	})
+
+	It("zeigt unbekannte Typen als Platzhalter", func() {
+		env, _ := newEnvelope("sticker", map[string]string{"pack": "katzen"})
+		Expect(aSess.send(env)).To(Succeed())
+
+		got, _ := bSess.LoadPlainMessages(aliceID, time.Time{})
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Type).To(Equal("sticker"))
+		Expect(got[0].Unsupported).To(BeTrue())
+		Expect(got[0].Text).To(Equal(UnsupportedText))
+
+		// Zustellung wird trotzdem quittiert
+		sent, _ := aSess.LoadPlainMessages(bobID, time.Time{})
+		Expect(sent[0].Status).To(Equal(StatusDelivered))
+	})
+
+	It("nimmt Klartext alter Clients an", func() {
+		Expect(sendRaw([]byte("ohne Umschlag"))).To(Succeed())
+		got, _ := bSess.LoadPlainMessages(aliceID, time.Time{})
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Text).To(Equal("ohne Umschlag"))
+		Expect(got[0].ID).NotTo(BeEmpty())
+	})
+
+	It("meldet kaputte Umschläge, ohne sie zu speichern", func() {
+		var reported error
+		bSess.OnError = func(_ []byte, err error) { reported = err }
+
+		Expect(sendRaw([]byte("\x00\x01nicht json"))).To(MatchError(ErrBadEnvelope))
+		Expect(reported).To(MatchError(ErrBadEnvelope))
+		Expect(bSess.LoadPlainMessages(aliceID, time.Time{})).To(BeEmpty())
+
+		Expect(aSess.Send([]byte("danach geht's weiter"))).To(Succeed())
+		Expect(bSess.LoadPlainMessages(aliceID, time.Time{})).To(HaveLen(1))
+	})
+})
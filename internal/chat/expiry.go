@@ -0,0 +1,310 @@
+package chat
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Verschwindende Nachrichten: jede Nachricht trägt die Lebensdauer aus
+// dem Timer des Kontakts im Umschlag (Envelope.TTL). Beide Seiten
+// berechnen daraus beim Speichern den Ablaufzeitpunkt, der Sweeper im
+// Hintergrund schreibt die Logs ohne abgelaufene Einträge neu.
+const maxExpireTimer = 4 * 7 * 24 * 60 * 60 // vier Wochen
+
+var ErrBadTimer = errors.New("invalid disappearing message timer")
+
+type timerBody struct {
+	TTL uint32 `json:"ttl"` // Sekunden, 0 = aus
+}
+
+func validTimer(ttl uint32) error {
+	if ttl > maxExpireTimer {
+		return fmt.Errorf("%w: %ds exceeds %ds", ErrBadTimer, ttl, maxExpireTimer)
+	}
+	return nil
+}
+
+// SendTimer stellt den Timer für diesen Kontakt um und teilt ihn allen
+// Geräten beider Seiten mit. Er gilt nur für neue Nachrichten.
+func (s *Session) SendTimer(ttl uint32) error {
+	log.Printf("[Session:%s] SendTimer %ds → %s", s.Name, ttl, b64(s.remoteID)[:8])
+	if err := validTimer(ttl); err != nil {
+		return err
+	}
+	c, err := s.store.LoadContact(s.account())
+	if err != nil {
+		return err
+	}
+	c.ExpireTimer = ttl
+	if err := s.store.SaveContact(c); err != nil {
+		return err
+	}
+	env, err := newEnvelope(ContentTimer, timerBody{TTL: ttl})
+	if err != nil {
+		return err
+	}
+	return s.send(env)
+}
+
+// receiveTimer übernimmt einen Timer für account, vom Kontakt selbst
+// oder per Sync von einem eigenen Gerät.
+func (s *Session) receiveTimer(account []byte, env *Envelope) error {
+	var b timerBody
+	if err := env.decodeBody(&b); err != nil {
+		return err
+	}
+	if err := validTimer(b.TTL); err != nil {
+		return err
+	}
+	c, err := s.store.LoadContact(account)
+	if err != nil {
+		return err
+	}
+	if c.ExpireTimer == b.TTL {
+		return nil
+	}
+	c.ExpireTimer = b.TTL
+	return s.store.SaveContact(c)
+}
+
+// expiryOf liefert den Ablaufzeitpunkt einer bei ts gespeicherten
+// Nachricht. Die Lebensdauer steht in der Nachricht selbst, damit alle
+// Seiten denselben Timer anwenden.
+func expiryOf(ts time.Time, plain []byte) time.Time {
+	if env, err := decodeEnvelope(plain); err == nil && env.TTL > 0 {
+		return ts.Add(time.Duration(env.TTL) * time.Second)
+	}
+	return time.Time{}
+}
+
+// ExpireMessages entfernt abgelaufene Nachrichten samt ihren Anhängen
+// aus allen 1:1-Logs und räumt dabei gelöschte Nachrichten und verfallene
+// vorgemerkte Änderungen mit auf. Es
+// liefert die Kontakte mit abgelaufenen Nachrichten und den nächsten
+// Ablaufzeitpunkt (leer, wenn nichts mehr abläuft).
+func (s *Store) ExpireMessages(now time.Time) (expired [][]byte, next time.Time, err error) {
+	dir := filepath.Join(s.basePath, msgDir)
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	for _, e := range entries {
+		// vorgemerkte Änderungen tragen ebenfalls Klartext
+		if name, ok := strings.CutSuffix(e.Name(), orphanExt); ok && !e.IsDir() {
+			id, derr := base64.RawURLEncoding.DecodeString(name)
+			if derr != nil {
+				continue
+			}
+			due, oerr := s.expireOrphans(id, now)
+			if oerr != nil {
+				log.Printf("[Store] !! expire orphans %s: %v", name[:min(8, len(name))], oerr)
+				err = errors.Join(err, oerr)
+			}
+			if !due.IsZero() && (next.IsZero() || due.Before(next)) {
+				next = due
+			}
+			continue
+		}
+		name, ok := strings.CutSuffix(e.Name(), ".log")
+		if !ok || e.IsDir() {
+			continue
+		}
+		id, derr := base64.RawURLEncoding.DecodeString(name)
+		if derr != nil {
+			continue
+		}
+		removed, due, lerr := s.compactLog(filepath.Join(dir, e.Name()), now)
+		if lerr != nil {
+			log.Printf("[Store] !! expire %s: %v", name[:min(8, len(name))], lerr)
+			err = errors.Join(err, lerr)
+			continue
+		}
+		if removed {
+			expired = append(expired, id)
+		}
+		if !due.IsZero() && (next.IsZero() || due.Before(next)) {
+			next = due
+		}
+	}
+	return expired, next, err
+}
+
+// ExpireGroupMessages tut dasselbe für die Logs aller Gruppen und liefert
+// die Gruppen mit abgelaufenen Nachrichten.
+func (s *Store) ExpireGroupMessages(now time.Time) (expired []string, next time.Time, err error) {
+	entries, err := os.ReadDir(filepath.Join(s.basePath, groupsDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, time.Time{}, nil
+	}
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		path := filepath.Join(s.basePath, groupsDir, e.Name(), groupLogFile)
+		if _, serr := os.Stat(path); serr != nil {
+			continue // noch keine Nachrichten
+		}
+		removed, due, lerr := s.compactLog(path, now)
+		if lerr != nil {
+			log.Printf("[Store] !! expire group %s: %v", e.Name(), lerr)
+			err = errors.Join(err, lerr)
+			continue
+		}
+		if removed {
+			expired = append(expired, e.Name())
+		}
+		if !due.IsZero() && (next.IsZero() || due.Before(next)) {
+			next = due
+		}
+	}
+	return expired, next, err
+}
+
+// compactLog schreibt ein Log ohne abgelaufene Einträge neu (temp +
+// rename) und leert dabei für alle gelöschte Nachrichten bis auf den
+// Grabstein. Überholte oder zurückgenommene Reaktionen fallen weg,
+// Status-Einträge verlieren die Verweise auf entfernte Nachrichten;
+// unlesbare Frames bleiben unverändert stehen.
+func (s *Store) compactLog(path string, now time.Time) (removed bool, next time.Time, err error) {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	type key struct {
+		out bool
+		ref string
+	}
+	frames := splitFrames(data)
+	recs := make([]*CipherMessageWithMeta, len(frames))
+	gone := map[string]bool{}
+	deleted := map[string]bool{}
+	reaction := map[key]int{} // letzte Reaktion je Seite und Nachricht
+	for i, frame := range frames {
+		rec, err := s.record(path, frame)
+		if err != nil {
+			continue
+		}
+		recs[i] = &rec
+		switch {
+		case len(rec.Refs) != 1:
+		case rec.Change == ChangeDelete:
+			deleted[rec.Refs[0]] = true
+		case rec.Change == ChangeReaction:
+			reaction[key{rec.Out, rec.Refs[0]}] = i
+		}
+		if !rec.expired(now) {
+			if !rec.Expiry.IsZero() && (next.IsZero() || rec.Expiry.Before(next)) {
+				next = rec.Expiry
+			}
+			continue
+		}
+		gone[rec.msgID()] = true
+	}
+
+	// Edits und Reaktionen gelöschter Nachrichten, überholte Reaktionen
+	obsolete := func(i int, rec *CipherMessageWithMeta) bool {
+		ref := rec.Refs[0]
+		switch rec.Change {
+		case ChangeEdit:
+			return deleted[ref]
+		case ChangeReaction:
+			return deleted[ref] || reaction[key{rec.Out, ref}] != i || removal(rec)
+		}
+		return false
+	}
+
+	var out []byte
+	var blobs []string
+	dirty := len(gone) > 0
+	for i, frame := range frames {
+		rec := recs[i]
+		switch {
+		case rec == nil:
+		case rec.Change != "" && len(rec.Refs) == 1 && obsolete(i, rec):
+			dirty = true
+			continue
+		case len(rec.Refs) > 0:
+			refs := slices.DeleteFunc(slices.Clone(rec.Refs), func(r string) bool { return gone[r] })
+			if len(refs) == 0 {
+				continue
+			}
+			if len(refs) < len(rec.Refs) {
+				rec.Refs = refs
+				if frame, err = s.frame(path, *rec); err != nil {
+					return false, time.Time{}, err
+				}
+			}
+		case gone[rec.msgID()], deleted[rec.msgID()]:
+			blobs = append(blobs, attachmentBlob(rec)...)
+			if gone[rec.msgID()] {
+				continue
+			}
+			if rec.Plain == "" && rec.Cipher == nil {
+				break // schon ein Grabstein
+			}
+			dirty = true
+			rec.MsgID = rec.msgID()
+			rec.Plain, rec.CipherMessage = "", CipherMessage{}
+			if frame, err = s.frame(path, *rec); err != nil {
+				return false, time.Time{}, err
+			}
+		}
+		out = append(out, frame...)
+	}
+	if !dirty {
+		return false, next, nil
+	}
+
+	if err := writeFileAtomic(path, out); err != nil {
+		return false, time.Time{}, err
+	}
+	s.dropIndex(path)
+	log.Printf("[Store] compacted %s: %d expired", filepath.Base(path), len(gone))
+
+	for _, blob := range blobs {
+		if err := s.DeleteAttachment(blob); err != nil {
+			log.Printf("[Store] !! delete attachment %s: %v", blob, err)
+		}
+	}
+	return len(gone) > 0, next, nil
+}
+
+// removal sagt, ob ein Reaktions-Eintrag die Reaktion zurücknimmt.
+func removal(rec *CipherMessageWithMeta) bool {
+	env, err := decodeEnvelope([]byte(rec.Plain))
+	if err != nil {
+		return false
+	}
+	var b reactionBody
+	return env.decodeBody(&b) == nil && b.Remove
+}
+
+// attachmentBlob liefert den Anhang eines Log-Eintrags, falls er einen hat.
+func attachmentBlob(rec *CipherMessageWithMeta) []string {
+	env, err := decodeEnvelope([]byte(rec.Plain))
+	if err != nil || env.Type != ContentAttachment {
+		return nil
+	}
+	var body attachmentBody
+	if env.decodeBody(&body) != nil || body.Blob == "" {
+		return nil
+	}
+	return []string{body.Blob}
+}
@@ -0,0 +1,139 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Verschwindende Nachrichten", func() {
+	var (
+		tmp     string
+		mgr     *Manager
+		bobID   string
+		bobSess *Session
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "expiry_*")
+		Expect(err).NotTo(HaveOccurred())
+		mgr, err = NewManager(tmp, "Alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mgr.Initialise()).To(Succeed())
+
+		list, _ := mgr.Contacts()
+		bobID = list[0].ID
+		dt := mgr.transport.(*DummyTransport)
+		for _, s := range dt.peers {
+			if b64(s.LocalPeer().IdentityPublicKey()) == bobID {
+				bobSess = s
+			}
+		}
+		Expect(bobSess).NotTo(BeNil())
+		// der Demo-Bob kennt Alice sonst nur über die Session
+		Expect(bobSess.store.AddContactIfMissing("Alice", bobSess.RemoteID())).To(Succeed())
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	frames := func(st *Store, id []byte) int {
+		data, err := os.ReadFile(filepath.Join(st.basePath, msgDir, b64Name(id)+".log"))
+		if os.IsNotExist(err) {
+			return 0
+		}
+		Expect(err).NotTo(HaveOccurred())
+		return len(splitFrames(data))
+	}
+
+	It("einigt beide Seiten auf denselben Timer", func() {
+		Expect(mgr.SetExpireTimer(bobID, 60)).To(Succeed())
+		c, _ := mgr.contactFor(bobID)
+		Expect(c.ExpireTimer).To(Equal(uint32(60)))
+		alice, err := bobSess.store.LoadContact(bobSess.RemoteID())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(alice.ExpireTimer).To(Equal(uint32(60)))
+
+		// der Timer selbst erscheint nicht im Verlauf
+		msgs, _ := mgr.Messages(bobID, 0)
+		Expect(msgs).To(BeEmpty())
+
+		Expect(mgr.Send(bobID, "gleich weg")).To(Succeed())
+		msgs, _ = mgr.Messages(bobID, 0)
+		Expect(msgs).To(HaveLen(1))
+		Expect(msgs[0].Expires).To(BeTemporally("~", time.Now().Add(time.Minute), 5*time.Second))
+		theirs, _ := bobSess.LoadPlainMessages(bobSess.RemoteID(), time.Time{})
+		Expect(theirs).To(HaveLen(1))
+		Expect(theirs[0].Expires).To(BeTemporally("~", msgs[0].Expires, 5*time.Second))
+
+		Expect(mgr.SetExpireTimer(bobID, maxExpireTimer+1)).To(MatchError(ErrBadTimer))
+		Expect(mgr.SetExpireTimer(bobID, 0)).To(Succeed())
+		alice, _ = bobSess.store.LoadContact(bobSess.RemoteID())
+		Expect(alice.ExpireTimer).To(BeZero())
+	})
+
+	It("löscht abgelaufene Einträge aus dem Log", func() {
+		Expect(mgr.Send(bobID, "bleibt")).To(Succeed())
+		Expect(mgr.SetExpireTimer(bobID, 30)).To(Succeed())
+		Expect(mgr.Send(bobID, "weg")).To(Succeed())
+		id := mgr.sessions[bobID].RemoteID()
+		// zwei Nachrichten und zwei Zustellquittungen
+		Expect(frames(mgr.store, id)).To(Equal(4))
+
+		expired, next, err := mgr.store.ExpireMessages(time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expired).To(BeEmpty())
+		Expect(next).To(BeTemporally("~", time.Now().Add(30*time.Second), 5*time.Second))
+
+		later := time.Now().Add(time.Minute)
+		expired, next, err = mgr.store.ExpireMessages(later)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expired).To(Equal([][]byte{id}))
+		Expect(next.IsZero()).To(BeTrue())
+		Expect(frames(mgr.store, id)).To(Equal(2))
+
+		msgs, _ := mgr.Messages(bobID, 0)
+		Expect(msgs).To(HaveLen(1))
+		Expect(msgs[0].Text).To(Equal("bleibt"))
+		Expect(msgs[0].Status).To(Equal(StatusDelivered))
+
+		_, _, err = bobSess.store.ExpireMessages(later)
+		Expect(err).NotTo(HaveOccurred())
+		theirs, _ := bobSess.LoadPlainMessages(bobSess.RemoteID(), time.Time{})
+		Expect(theirs).To(ConsistOf(HaveField("Text", "bleibt")))
+	})
+
+	It("räumt auch die Logs der Gruppen auf", func() {
+		g, err := mgr.CreateGroup("Team", []string{bobID})
+		Expect(err).NotTo(HaveOccurred())
+		var changed []string
+		mgr.SetGroupHandler(func(id string) { changed = append(changed, id) })
+
+		// die Lebensdauer kommt mit der Nachricht des Absenders
+		add := func(text string, ttl uint32) {
+			env, err := newEnvelope(ContentText, textBody{Text: text})
+			Expect(err).NotTo(HaveOccurred())
+			env.TTL = ttl
+			Expect(mgr.store.AppendGroupMessage(g.ID, bobSess.LocalPeer().IdentityPublicKey(), env.ID, env.encode())).To(Succeed())
+		}
+		add("bleibt", 0)
+		add("weg", 30)
+
+		expired, next, err := mgr.store.ExpireGroupMessages(time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(expired).To(BeEmpty())
+		Expect(next).To(BeTemporally("~", time.Now().Add(30*time.Second), 5*time.Second))
+
+		later := time.Now().Add(time.Minute)
+		Expect(mgr.work(later).IsZero()).To(BeTrue())
+		Expect(changed).To(Equal([]string{g.ID}))
+		data, err := os.ReadFile(filepath.Join(tmp, groupsDir, g.ID, groupLogFile))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(splitFrames(data)).To(HaveLen(1))
+		msgs, err := mgr.GroupMessages(g.ID, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).To(ConsistOf(HaveField("Text", "bleibt")))
+	})
+})
@@ -0,0 +1,108 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	fingerprintVersion    = 0
+	fingerprintIterations = 5200
+)
+
+var ErrFingerprintMismatch = errors.New("safety number does not match")
+
+// Emoji-Alphabet für die Kurzdarstellung (64 Zeichen = 6 Bit pro Emoji).
+var fingerprintEmoji = []string{
+	"🐶", "🐱", "🐭", "🐹", "🐰", "🦊", "🐻", "🐼",
+	"🐨", "🐯", "🦁", "🐮", "🐷", "🐸", "🐵", "🐔",
+	"🐧", "🐦", "🦆", "🦉", "🐺", "🐴", "🦄", "🐝",
+	"🐛", "🦋", "🐌", "🐞", "🐢", "🐍", "🐙", "🦀",
+	"🐬", "🐳", "🦈", "🐊", "🦒", "🦘", "🐘", "🦔",
+	"🌵", "🌲", "🍀", "🍁", "🍄", "🌻", "🌙", "⭐",
+	"🔥", "🌈", "☂️", "❄️", "🍎", "🍋", "🍉", "🍇",
+	"🍓", "🥕", "🌽", "🥨", "🧀", "🍪", "🎈", "🔑",
+}
+
+// Fingerprint ist die vergleichbare Darstellung beider Identity-Keys.
+// Beide Seiten sehen dieselbe Sicherheitsnummer und dieselben Emoji.
+type Fingerprint struct {
+	SafetyNumber string   `json:"safety_number"` // 12 Blöcke à 5 Ziffern
+	Emoji        []string `json:"emoji"`
+	QRPayload    string   `json:"qr_payload"` // Base64: Version ‖ FP(lokal) ‖ FP(remote)
+	Verified     bool     `json:"verified"`
+}
+
+// identityFingerprint hasht den Identity-Key iteriert (wie Signal), damit
+// gezielte Kollisionen teuer werden.
+func identityFingerprint(ik []byte) []byte {
+	h := sha512.Sum512(slices.Concat([]byte{0, fingerprintVersion}, ik, ik))
+	for range fingerprintIterations - 1 {
+		h = sha512.Sum512(slices.Concat(h[:], ik))
+	}
+	return h[:32]
+}
+
+// 30 Ziffern pro Identität: 6 × 5 Byte, jeweils mod 100000
+func fingerprintDigits(fp []byte) string {
+	var sb strings.Builder
+	for i := 0; i < 30; i += 5 {
+		var buf [8]byte
+		copy(buf[3:], fp[i:i+5])
+		fmt.Fprintf(&sb, "%05d", binary.BigEndian.Uint64(buf[:])%100000)
+	}
+	return sb.String()
+}
+
+func NewFingerprint(localIK, remoteIK []byte) *Fingerprint {
+	local, remote := identityFingerprint(localIK), identityFingerprint(remoteIK)
+
+	// Sortierung macht die Darstellung unabhängig von der Blickrichtung
+	a, b := fingerprintDigits(local), fingerprintDigits(remote)
+	if a > b {
+		a, b = b, a
+	}
+	digits := a + b
+	blocks := make([]string, 0, len(digits)/5)
+	for i := 0; i < len(digits); i += 5 {
+		blocks = append(blocks, digits[i:i+5])
+	}
+
+	lo, hi := local, remote
+	if bytes.Compare(lo, hi) > 0 {
+		lo, hi = hi, lo
+	}
+	sum := sha256.Sum256(slices.Concat(lo, hi))
+	emoji := make([]string, 8)
+	for i := range emoji {
+		emoji[i] = fingerprintEmoji[int(sum[i])%len(fingerprintEmoji)]
+	}
+
+	payload := slices.Concat([]byte{fingerprintVersion}, local, remote)
+	return &Fingerprint{
+		SafetyNumber: strings.Join(blocks, " "),
+		Emoji:        emoji,
+		QRPayload:    base64.StdEncoding.EncodeToString(payload),
+	}
+}
+
+// MatchQR prüft den gescannten QR-Payload des Gegenübers. Dessen „lokal“
+// ist unser „remote“ und umgekehrt.
+func MatchQR(localIK, remoteIK []byte, scanned string) error {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(scanned))
+	if err != nil || len(raw) != 1+64 || raw[0] != fingerprintVersion {
+		return fmt.Errorf("invalid QR payload")
+	}
+	if !bytes.Equal(raw[1:33], identityFingerprint(remoteIK)) ||
+		!bytes.Equal(raw[33:], identityFingerprint(localIK)) {
+		return ErrFingerprintMismatch
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package chat
+
+import (
+	"os"
+	"regexp"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sicherheitsnummern", func() {
+	alice, bob, eve := NewPeer("Alice"), NewPeer("Bob"), NewPeer("Eve")
+
+	It("ist für beide Seiten identisch", func() {
+		fa := NewFingerprint(alice.IdentityPublicKey(), bob.IdentityPublicKey())
+		fb := NewFingerprint(bob.IdentityPublicKey(), alice.IdentityPublicKey())
+
+		Expect(fa.SafetyNumber).To(MatchRegexp(`^(\d{5} ){11}\d{5}$`))
+		Expect(fa.SafetyNumber).To(Equal(fb.SafetyNumber))
+		Expect(fa.Emoji).To(HaveLen(8))
+		Expect(fa.Emoji).To(Equal(fb.Emoji))
+		Expect(fa.QRPayload).NotTo(Equal(fb.QRPayload))
+	})
+
+	It("ändert sich mit dem Identity-Key", func() {
+		fa := NewFingerprint(alice.IdentityPublicKey(), bob.IdentityPublicKey())
+		fe := NewFingerprint(alice.IdentityPublicKey(), eve.IdentityPublicKey())
+		Expect(fe.SafetyNumber).NotTo(Equal(fa.SafetyNumber))
+	})
+
+	It("akzeptiert nur den QR-Code des echten Gegenübers", func() {
+		fromBob := NewFingerprint(bob.IdentityPublicKey(), alice.IdentityPublicKey()).QRPayload
+		fromEve := NewFingerprint(eve.IdentityPublicKey(), alice.IdentityPublicKey()).QRPayload
+		own := NewFingerprint(alice.IdentityPublicKey(), bob.IdentityPublicKey()).QRPayload
+
+		Expect(MatchQR(alice.IdentityPublicKey(), bob.IdentityPublicKey(), fromBob)).To(Succeed())
+		Expect(MatchQR(alice.IdentityPublicKey(), bob.IdentityPublicKey(), fromEve)).To(MatchError(ErrFingerprintMismatch))
+		Expect(MatchQR(alice.IdentityPublicKey(), bob.IdentityPublicKey(), own)).To(MatchError(ErrFingerprintMismatch))
+		Expect(MatchQR(alice.IdentityPublicKey(), bob.IdentityPublicKey(), "kaputt")).NotTo(Succeed())
+	})
+})
+
+var _ = Describe("Manager-Verifikation", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "verify_*")
+		Expect(err).NotTo(HaveOccurred())
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	It("speichert den Verified-Status im Kontakt", func() {
+		mgr, err := NewManager(tmp, "Alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mgr.Initialise()).To(Succeed())
+
+		list, _ := mgr.Contacts()
+		bobID := list[0].ID
+		Expect(list[0].Verified).To(BeFalse())
+
+		fp, err := mgr.Fingerprint(bobID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(regexp.MustCompile(`\d`).FindAllString(fp.SafetyNumber, -1)).To(HaveLen(60))
+
+		// Bob zeigt seinen QR-Code, Alice scannt ihn
+		bobFP := NewFingerprint(list[0].IDPub, mgr.localPeer.IdentityPublicKey())
+		Expect(mgr.VerifyQR(bobID, bobFP.QRPayload)).To(Succeed())
+
+		// Neustart → Flag bleibt erhalten
+		mgr2, _ := NewManager(tmp, "Alice")
+		Expect(mgr2.Initialise()).To(Succeed())
+		list, _ = mgr2.Contacts()
+		Expect(list[0].Verified).To(BeTrue())
+		Expect(list[0].VerifiedAt.IsZero()).To(BeFalse())
+
+		Expect(mgr2.SetVerified(bobID, false)).To(Succeed())
+		fp, _ = mgr2.Fingerprint(bobID)
+		Expect(fp.Verified).To(BeFalse())
+	})
+})
@@ -0,0 +1,537 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Gruppen bauen auf den 1:1-Sessions auf (Sender-Keys wie bei Signal).
+// Jedes Mitglied hat pro Gruppe eine eigene symmetrische Chain und einen
+// Ed25519-Schlüssel und verteilt beides samt Mitgliederliste als
+// ContentGroup-Nachricht über seine paarweisen Sessions. Eine
+// Gruppennachricht wird einmal verschlüsselt und per FrameGroup an alle
+// Mitglieder verteilt.
+//
+//	Message-Key = chainStep(kdfV2, CK_n)
+//	AD          = Gruppen-ID ‖ Absender-IK ‖ u32 Epoche ‖ u32 n
+//	Cipher      = AES-256-GCM(Message-Key, Umschlag, AD)
+//	Signatur    = Ed25519(AD ‖ Cipher)
+//
+// Die Signatur verhindert, dass ein Mitglied, das die Chain eines anderen
+// kennt, in dessen Namen schreibt. Mitglieder brauchen untereinander
+// 1:1-Sessions; fehlt eine, bekommt das Gegenüber den Sender-Key nicht.
+//
+// Ändert sich die Mitgliederliste (hinzufügen, entfernen, austreten),
+// bekommt jedes verbleibende Mitglied einen neuen Sender-Key (neue
+// Epoche), der nur an die aktuelle Liste geht. Wer die Änderung auslöst,
+// rotiert sofort; wer sie empfängt, vor der nächsten eigenen Nachricht –
+// im Empfangspfad zu senden, würde über Tor in gegenseitig blockierte
+// Zustellungen laufen.
+const (
+	groupsDir        = "groups"
+	groupFile        = "group.bin"
+	groupLogFile     = "msgs.log"
+	maxGroupMembers  = 64
+	maxGroupNameLen  = 64
+	keepSenderEpochs = 2 // alte Epoche für Nachrichten, die noch unterwegs sind
+)
+
+var (
+	ErrNoGroup          = errors.New("group not found")
+	ErrNotMember        = errors.New("not a group member")
+	ErrNoSenderKey      = errors.New("no sender key for group member")
+	ErrBadGroupUpdate   = errors.New("malformed group update")
+	ErrNoGroupTransport = errors.New("transport cannot carry group messages")
+)
+
+// GroupMessage ist eine mit dem Sender-Key verschlüsselte Nachricht auf
+// der Leitung; jedes Mitglied bekommt dieselben Bytes.
+type GroupMessage struct {
+	Group  string `json:"group"`
+	Sender []byte `json:"sender"` // Identity-Key des Absenders
+	Epoch  uint32 `json:"epoch"`
+	N      uint32 `json:"n"`
+	Cipher []byte `json:"ct"`
+	Sig    []byte `json:"sig"`
+}
+
+// groupSender sind Transports, die Gruppennachrichten übertragen können.
+type groupSender interface {
+	SendGroup(toID []byte, m GroupMessage) error
+}
+
+func (m *GroupMessage) ad() []byte {
+	ad := append([]byte(m.Group), m.Sender...)
+	ad = binary.BigEndian.AppendUint32(ad, m.Epoch)
+	return binary.BigEndian.AppendUint32(ad, m.N)
+}
+
+// senderKey ist die Chain eines Mitglieds; SignPriv gibt es nur bei der
+// eigenen.
+type senderKey struct {
+	Epoch    uint32            `json:"epoch"`
+	Chain    []byte            `json:"chain"` // Chain-Key für Nachricht N
+	N        uint32            `json:"n"`
+	SignPub  []byte            `json:"sign_pub"`
+	SignPriv []byte            `json:"sign_priv,omitempty"` // Ed25519-Seed
+	Skipped  map[uint32][]byte `json:"skipped,omitempty"`   // n → Message-Key verspäteter Nachrichten
+}
+
+func newSenderKey(epoch uint32) (*senderKey, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	k := &senderKey{Epoch: epoch, Chain: make([]byte, 32), SignPub: pub, SignPriv: priv.Seed()}
+	if _, err := rand.Read(k.Chain); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// public ist die Kopie, die an andere Mitglieder geht.
+func (k *senderKey) public() *senderKey {
+	return &senderKey{Epoch: k.Epoch, Chain: k.Chain, N: k.N, SignPub: k.SignPub}
+}
+
+func (k *senderKey) valid() bool {
+	return len(k.Chain) == 32 && len(k.SignPub) == ed25519.PublicKeySize
+}
+
+// seal verschlüsselt und signiert die nächste Nachricht der eigenen Chain.
+func (k *senderKey) seal(group string, sender, plaintext []byte) (*GroupMessage, error) {
+	ck, mk, err := chainStep(kdfV2, k.Chain)
+	if err != nil {
+		return nil, err
+	}
+	m := &GroupMessage{Group: group, Sender: sender, Epoch: k.Epoch, N: k.N}
+	ad := m.ad()
+	if _, m.Cipher, err = sealMessage(kdfV2, suiteAES256GCM, mk, plaintext, ad); err != nil {
+		return nil, err
+	}
+	m.Sig = ed25519.Sign(ed25519.NewKeyFromSeed(k.SignPriv), slices.Concat(ad, m.Cipher))
+	k.Chain, k.N = ck, k.N+1
+	return m, nil
+}
+
+// open prüft Signatur und entschlüsselt. Die Chain läuft nur bei Erfolg
+// weiter; übersprungene Schlüssel bleiben für verspätete Nachrichten.
+func (k *senderKey) open(m *GroupMessage) ([]byte, error) {
+	ad := m.ad()
+	if !ed25519.Verify(k.SignPub, slices.Concat(ad, m.Cipher), m.Sig) {
+		return nil, ErrAuthFailed
+	}
+
+	next := &senderKey{Chain: k.Chain, N: k.N, Skipped: map[uint32][]byte{}}
+	var mk []byte
+	switch {
+	case m.N < k.N:
+		if mk = k.Skipped[m.N]; mk == nil {
+			return nil, ErrAuthFailed // schon gelesen
+		}
+	case m.N-k.N > maxSkip:
+		return nil, ErrTooManySkipped
+	default:
+		for next.N <= m.N {
+			ck, key, err := chainStep(kdfV2, next.Chain)
+			if err != nil {
+				return nil, err
+			}
+			if next.N < m.N {
+				next.Skipped[next.N] = key
+			}
+			next.Chain, next.N, mk = ck, next.N+1, key
+		}
+	}
+
+	plain, err := openMessage(kdfV2, suiteAES256GCM, mk, nil, m.Cipher, ad)
+	if err != nil {
+		return nil, err
+	}
+	if m.N < k.N {
+		delete(k.Skipped, m.N)
+		return plain, nil
+	}
+	if k.Skipped == nil {
+		k.Skipped = map[uint32][]byte{}
+	}
+	for n, key := range next.Skipped {
+		k.Skipped[n] = key
+	}
+	// älteste Schlüssel zuerst verwerfen
+	for len(k.Skipped) > maxSkippedKeys {
+		delete(k.Skipped, slices.Min(slices.Collect(maps.Keys(k.Skipped))))
+	}
+	k.Chain, k.N = next.Chain, next.N
+	return plain, nil
+}
+
+// groupUpdate ist der Body einer ContentGroup-Nachricht: Name,
+// vollständige Mitgliederliste (inklusive Absender) und dessen aktueller
+// Sender-Key. Beim Austritt fehlen Absender und Key.
+type groupUpdate struct {
+	Group   string     `json:"group"`
+	Name    string     `json:"name"`
+	Members [][]byte   `json:"members"`
+	Key     *senderKey `json:"key,omitempty"`
+}
+
+func (u *groupUpdate) validate() error {
+	if uuid.Validate(u.Group) != nil || len(u.Name) > maxGroupNameLen || len(u.Members) > maxGroupMembers {
+		return ErrBadGroupUpdate
+	}
+	for _, id := range u.Members {
+		if len(id) != keyLen {
+			return ErrBadGroupUpdate
+		}
+	}
+	if u.Key != nil && !u.Key.valid() {
+		return ErrBadGroupUpdate
+	}
+	return nil
+}
+
+// Group ist der lokale Zustand einer Gruppe (group.bin).
+type Group struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Members [][]byte  `json:"members"` // inklusive uns selbst, solange wir dabei sind
+	Created time.Time `json:"created"`
+	Left    bool      `json:"left,omitempty"` // ausgetreten oder entfernt
+
+	Own    *senderKey              `json:"own,omitempty"`
+	Rotate bool                    `json:"rotate,omitempty"` // Liste geändert, Own vor dem nächsten Senden erneuern
+	Keys   map[string][]*senderKey `json:"keys,omitempty"`   // b64(Mitglied) → Epochen, neueste zuerst
+}
+
+// GroupInfo ist die Sicht der UI auf eine Gruppe.
+type GroupInfo struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Members []string `json:"members"` // b64(IK), ohne uns selbst
+	Left    bool     `json:"left"`
+}
+
+func (g *Group) info(self []byte) *GroupInfo {
+	gi := &GroupInfo{ID: g.ID, Name: g.Name, Members: []string{}, Left: g.Left}
+	for _, id := range g.others(self) {
+		gi.Members = append(gi.Members, b64(id))
+	}
+	return gi
+}
+
+func (g *Group) isMember(id []byte) bool {
+	return slices.ContainsFunc(g.Members, func(m []byte) bool { return bytes.Equal(m, id) })
+}
+
+// others sind alle Mitglieder außer uns – die Empfänger beim Senden.
+func (g *Group) others(self []byte) [][]byte {
+	var out [][]byte
+	for _, id := range g.Members {
+		if !bytes.Equal(id, self) {
+			out = append(out, id)
+		}
+	}
+	return out
+}
+
+// setKey merkt sich einen verteilten Sender-Key; eine bekannte Epoche
+// (erneut verschickt) ändert nichts.
+func (g *Group) setKey(member []byte, k *senderKey) {
+	if g.Keys == nil {
+		g.Keys = map[string][]*senderKey{}
+	}
+	list := g.Keys[b64(member)]
+	if slices.ContainsFunc(list, func(old *senderKey) bool { return old.Epoch == k.Epoch }) {
+		return
+	}
+	k.SignPriv, k.Skipped = nil, nil
+	list = append([]*senderKey{k}, list...)
+	g.Keys[b64(member)] = list[:min(len(list), keepSenderEpochs)]
+}
+
+func (g *Group) key(member []byte, epoch uint32) *senderKey {
+	for _, k := range g.Keys[b64(member)] {
+		if k.Epoch == epoch {
+			return k
+		}
+	}
+	return nil
+}
+
+func sameMembers(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, id := range a {
+		if !slices.ContainsFunc(b, func(x []byte) bool { return bytes.Equal(x, id) }) {
+			return false
+		}
+	}
+	return true
+}
+
+// ───────────────────────── Store ─────────────────────────────────
+
+// groupDir prüft die Gruppen-ID, bevor sie zum Pfad wird – sie kommt
+// vom Gegenüber.
+func (s *Store) groupDir(id string) (string, error) {
+	if uuid.Validate(id) != nil {
+		return "", ErrNoGroup
+	}
+	return filepath.Join(s.basePath, groupsDir, id), nil
+}
+
+// lockGroup serialisiert Laden, Ändern und Sichern von group.bin: UI
+// (Senden, Mitglieder) und Transport (Updates, Nachrichten) schalten
+// dieselbe Chain weiter. Ohne Sperre könnte ein veralteter Own.N
+// gesichert und ein Nachrichtenschlüssel zweimal benutzt werden.
+// Zurück kommt das Unlock.
+func (s *Store) lockGroup(id string) func() {
+	s.groupMu.Lock()
+	if s.groupLocks == nil {
+		s.groupLocks = map[string]*sync.Mutex{}
+	}
+	l, ok := s.groupLocks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		s.groupLocks[id] = l
+	}
+	s.groupMu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (s *Store) SaveGroup(g *Group) error {
+	dir, err := s.groupDir(g.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	raw, _ := json.Marshal(g)
+	path := filepath.Join(dir, groupFile)
+	buf, err := s.wrap(path, raw)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf)
+}
+
+func (s *Store) LoadGroup(id string) (*Group, error) {
+	dir, err := s.groupDir(id)
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, groupFile)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNoGroup
+	} else if err != nil {
+		return nil, err
+	}
+	plain, err := s.unwrap(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	var g Group
+	if err := json.Unmarshal(plain, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func (s *Store) ListGroups() ([]*Group, error) {
+	ents, err := os.ReadDir(filepath.Join(s.basePath, groupsDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var list []*Group
+	for _, e := range ents {
+		g, err := s.LoadGroup(e.Name())
+		if errors.Is(err, ErrNoGroup) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		list = append(list, g)
+	}
+	return list, nil
+}
+
+// AppendGroupMessage schreibt eine Gruppennachricht ins Log der Gruppe;
+// from ist bei eigenen Nachrichten leer.
+func (s *Store) AppendGroupMessage(groupID string, from []byte, msgID string, plain []byte) error {
+	dir, err := s.groupDir(groupID)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	return s.appendLog(filepath.Join(dir, groupLogFile), CipherMessageWithMeta{
+		TS:     now,
+		Out:    from == nil,
+		From:   from,
+		MsgID:  msgID,
+		Plain:  string(plain),
+		Expiry: expiryOf(now, plain),
+	})
+}
+
+func (s *Store) LoadGroupMessages(groupID string, since time.Time) ([]CipherMessageWithMeta, error) {
+	dir, err := s.groupDir(groupID)
+	if err != nil {
+		return nil, err
+	}
+	return s.loadLog(filepath.Join(dir, groupLogFile), since)
+}
+
+// applyGroupUpdate übernimmt Name, Mitgliederliste und Sender-Key, die
+// from über die 1:1-Session geschickt hat. Unbekannte Gruppen gelten als
+// Einladung, wenn wir und der Absender auf der Liste stehen; bekannte
+// darf nur ein Mitglied ändern.
+func (s *Store) applyGroupUpdate(self, from []byte, u *groupUpdate) (*Group, error) {
+	if err := u.validate(); err != nil {
+		return nil, err
+	}
+	defer s.lockGroup(u.Group)()
+	g, err := s.LoadGroup(u.Group)
+	switch {
+	case errors.Is(err, ErrNoGroup):
+		g = &Group{ID: u.Group, Members: u.Members, Created: time.Now().UTC()}
+		if !g.isMember(self) || !g.isMember(from) {
+			return nil, ErrNotMember
+		}
+	case err != nil:
+		return nil, err
+	case !g.isMember(from):
+		return nil, ErrNotMember
+	}
+
+	changed := !sameMembers(g.Members, u.Members)
+	g.Name, g.Members = u.Name, u.Members
+	if !g.isMember(self) {
+		log.Printf("[Store] removed from group %s", g.ID)
+		g.Left, g.Own, g.Rotate, g.Keys = true, nil, false, nil
+		return g, s.SaveGroup(g)
+	}
+	g.Left = false
+	if changed && g.Own != nil {
+		g.Rotate = true
+	}
+	for member := range g.Keys {
+		if !slices.ContainsFunc(g.Members, func(id []byte) bool { return b64(id) == member }) {
+			delete(g.Keys, member)
+		}
+	}
+	if u.Key != nil && g.isMember(from) {
+		g.setKey(from, u.Key)
+	}
+	return g, s.SaveGroup(g)
+}
+
+// openGroupMessage entschlüsselt eine Gruppennachricht und sichert die
+// weitergelaufene Chain des Absenders.
+func (s *Store) openGroupMessage(self []byte, m *GroupMessage) ([]byte, error) {
+	defer s.lockGroup(m.Group)()
+	g, err := s.LoadGroup(m.Group)
+	if err != nil {
+		return nil, err
+	}
+	if g.Left || !g.isMember(m.Sender) || bytes.Equal(m.Sender, self) {
+		return nil, ErrNotMember
+	}
+	k := g.key(m.Sender, m.Epoch)
+	if k == nil {
+		return nil, fmt.Errorf("%w (epoch %d)", ErrNoSenderKey, m.Epoch)
+	}
+	plain, err := k.open(m)
+	if err != nil {
+		return nil, err
+	}
+	return plain, s.SaveGroup(g)
+}
+
+// ───────────────────────── Session ───────────────────────────────
+
+// SendGroupUpdate schickt Mitgliederliste und Sender-Key über diese
+// 1:1-Session; die Nachricht erscheint nicht im Verlauf.
+func (s *Session) SendGroupUpdate(u *groupUpdate) error {
+	log.Printf("[Session:%s] SendGroupUpdate %s n=%d key=%v → %s",
+		s.Name, u.Group, len(u.Members), u.Key != nil, b64(s.remoteID)[:8])
+	env, err := newEnvelope(ContentGroup, u)
+	if err != nil {
+		return err
+	}
+	return s.send(env)
+}
+
+func (s *Session) receiveGroupUpdate(env *Envelope) error {
+	var u groupUpdate
+	if err := env.decodeBody(&u); err != nil {
+		return err
+	}
+	g, err := s.store.applyGroupUpdate(s.localPeer.IdentityPublicKey(), s.remoteID, &u)
+	if err != nil {
+		return err
+	}
+	if s.OnGroup != nil {
+		s.OnGroup(g.ID)
+	}
+	return nil
+}
+
+// ReceiveGroup entschlüsselt eine Gruppennachricht mit dem Sender-Key des
+// Absenders. Der Ratchet der 1:1-Session bleibt dabei unberührt.
+func (s *Session) ReceiveGroup(m GroupMessage) error {
+	if s.locked() {
+		return ErrLocked
+	}
+	log.Printf("[Session:%s] RecvGroup %s from=%s epoch=%d n=%d", s.Name, m.Group, b64(m.Sender)[:8], m.Epoch, m.N)
+	plain, err := s.store.openGroupMessage(s.localPeer.IdentityPublicKey(), &m)
+	if err == nil {
+		var env *Envelope
+		if env, err = decodeEnvelope(plain); err == nil {
+			switch env.Type {
+			case ContentText:
+				err = env.decodeBody(&textBody{})
+			case ContentReceipt, ContentGroup, ContentAttachment,
+				ContentDevices, ContentLink, ContentSync, ContentTimer,
+				ContentEdit, ContentDelete, ContentReaction:
+				// Steuernachrichten und Anhänge laufen nur über 1:1-Sessions
+				err = fmt.Errorf("%w: %s in group", ErrBadEnvelope, env.Type)
+			}
+		}
+		if err == nil {
+			err = s.store.AppendGroupMessage(m.Group, m.Sender, env.ID, plain)
+		}
+	}
+	if err != nil {
+		log.Println("  group-error:", err)
+		if s.OnError != nil {
+			s.OnError(m.Sender, err)
+		}
+		return err
+	}
+	if s.OnGroup != nil {
+		s.OnGroup(m.Group)
+	}
+	return nil
+}
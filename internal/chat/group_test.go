@@ -0,0 +1,197 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Gruppen", func() {
+	type node struct {
+		m  *Manager
+		tp *TorTransport
+	}
+	var (
+		network       *LoopbackNetwork
+		alice, bob    *node
+		carol         *node
+		groupID       string
+		aID, bID, cID string
+	)
+
+	newNode := func(name string) *node {
+		tp := NewTorTransport(network)
+		Expect(tp.Start(context.Background())).To(Succeed())
+		DeferCleanup(tp.Close)
+		m, err := NewManagerWithTransport(GinkgoT().TempDir(), name, tp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(m.Initialise()).To(Succeed())
+		return &node{m, tp}
+	}
+
+	// connect baut die 1:1-Session a → b auf; b lernt a über den Init.
+	connect := func(a, b *node) {
+		a.tp.AddPeer(b.m.self(), b.tp.Address())
+		s := a.m.newSession()
+		Expect(s.StartHandshake(b.m.localPeer.Bundle())).To(Succeed())
+		a.m.sessions[b64(b.m.self())] = s
+		Expect(a.m.store.AddContactIfMissing(b.m.localPeer.Name, b.m.self())).To(Succeed())
+	}
+
+	texts := func(n *node) []string {
+		msgs, err := n.m.GroupMessages(groupID, 0)
+		Expect(err).NotTo(HaveOccurred())
+		var out []string
+		for _, pm := range msgs {
+			out = append(out, pm.Text)
+		}
+		return out
+	}
+
+	BeforeEach(func() {
+		network = NewLoopbackNetwork()
+		alice, bob, carol = newNode("Alice"), newNode("Bob"), newNode("Carol")
+		connect(alice, bob)
+		connect(alice, carol)
+		connect(bob, carol)
+		aID, bID, cID = b64(alice.m.self()), b64(bob.m.self()), b64(carol.m.self())
+
+		g, err := alice.m.CreateGroup("Team", []string{bID, cID})
+		Expect(err).NotTo(HaveOccurred())
+		groupID = g.ID
+	})
+
+	It("verteilt Mitgliederliste und Nachrichten an alle", func() {
+		groups, err := bob.m.Groups()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(groups).To(HaveLen(1))
+		Expect(groups[0].Name).To(Equal("Team"))
+		Expect(groups[0].Members).To(ConsistOf(aID, cID))
+
+		Expect(alice.m.SendGroup(groupID, "hallo")).To(Succeed())
+		Expect(bob.m.SendGroup(groupID, "hallo zurück")).To(Succeed())
+
+		msgs, _ := carol.m.GroupMessages(groupID, 0)
+		Expect(msgs).To(HaveLen(2))
+		Expect(msgs[0].From).To(Equal(aID))
+		Expect(msgs[1].From).To(Equal(bID))
+		Expect(texts(alice)).To(Equal([]string{"hallo", "hallo zurück"}))
+
+		// Gruppen-Updates tauchen im 1:1-Verlauf nicht auf
+		one, _ := bob.m.Messages(aID, 0)
+		Expect(one).To(BeEmpty())
+	})
+
+	It("rotiert Sender-Keys, wenn jemand entfernt wird", func() {
+		Expect(bob.m.SendGroup(groupID, "vorher")).To(Succeed())
+		Expect(alice.m.RemoveGroupMember(groupID, cID)).To(Succeed())
+
+		cg, _ := carol.m.store.LoadGroup(groupID)
+		Expect(cg.Left).To(BeTrue())
+		Expect(cg.Keys).To(BeEmpty())
+		Expect(carol.m.SendGroup(groupID, "x")).To(MatchError(ErrNotMember))
+
+		// Bob rotiert vor seiner nächsten Nachricht, Carol bekommt nichts mehr
+		bg, _ := bob.m.store.LoadGroup(groupID)
+		Expect(bg.Rotate).To(BeTrue())
+		Expect(bob.m.SendGroup(groupID, "nachher")).To(Succeed())
+		bg, _ = bob.m.store.LoadGroup(groupID)
+		Expect(bg.Own.Epoch).To(Equal(uint32(1)))
+
+		Expect(texts(alice)).To(Equal([]string{"vorher", "nachher"}))
+		Expect(texts(carol)).To(Equal([]string{"vorher"}))
+
+		// mit dem neuen Key gesiegelte Nachrichten kann Carol nicht öffnen
+		ag, _ := alice.m.store.LoadGroup(groupID)
+		gm, err := ag.Own.seal(groupID, alice.m.self(), []byte("geheim"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = carol.m.store.openGroupMessage(carol.m.self(), gm)
+		Expect(err).To(MatchError(ErrNotMember))
+	})
+
+	It("nimmt neue Mitglieder auf und lässt Mitglieder austreten", func() {
+		Expect(alice.m.RemoveGroupMember(groupID, cID)).To(Succeed())
+		Expect(alice.m.AddGroupMember(groupID, cID)).To(Succeed())
+		Expect(alice.m.AddGroupMember(groupID, cID)).To(MatchError(ContainSubstring("already")))
+
+		Expect(bob.m.SendGroup(groupID, "willkommen zurück")).To(Succeed())
+		Expect(texts(carol)).To(Equal([]string{"willkommen zurück"}))
+
+		Expect(bob.m.LeaveGroup(groupID)).To(Succeed())
+		groups, _ := alice.m.Groups()
+		Expect(groups[0].Members).To(ConsistOf(cID))
+		Expect(alice.m.SendGroup(groupID, "ohne Bob")).To(Succeed())
+		Expect(texts(carol)).To(ContainElement("ohne Bob"))
+		Expect(texts(bob)).NotTo(ContainElement("ohne Bob"))
+	})
+
+	It("schaltet die eigene Chain auch bei gleichzeitigem Senden nie doppelt", func() {
+		const n = 8
+		done := make(chan error, n)
+		for i := range n {
+			go func() { done <- alice.m.SendGroup(groupID, fmt.Sprint("nachricht ", i)) }()
+		}
+		for range n {
+			Expect(<-done).To(Succeed())
+		}
+
+		ag, _ := alice.m.store.LoadGroup(groupID)
+		Expect(ag.Own.N).To(Equal(uint32(n)))
+		Expect(texts(bob)).To(HaveLen(n))
+		Expect(texts(carol)).To(HaveLen(n))
+	})
+
+	It("lehnt Updates von Nicht-Mitgliedern und gefälschte Absender ab", func() {
+		Expect(bob.m.RemoveGroupMember(groupID, cID)).To(Succeed())
+		Expect(carol.m.LeaveGroup(groupID)).To(MatchError(ErrNotMember))
+
+		u := &groupUpdate{Group: groupID, Name: "Übernahme", Members: [][]byte{bob.m.self(), carol.m.self()}}
+		_, err := alice.m.store.applyGroupUpdate(alice.m.self(), carol.m.self(), u)
+		Expect(err).To(MatchError(ErrNotMember))
+
+		// Bob kennt Alices Chain, aber nicht ihren Signaturschlüssel
+		bg, _ := bob.m.store.LoadGroup(groupID)
+		forged := *bg.key(alice.m.self(), 0)
+		forged.SignPriv = bg.Own.SignPriv
+		gm, _ := forged.seal(groupID, alice.m.self(), []byte("gefälscht"))
+		_, err = bob.m.store.openGroupMessage(bob.m.self(), gm)
+		Expect(err).To(MatchError(ErrAuthFailed))
+	})
+})
+
+var _ = Describe("Sender-Key", func() {
+	It("entschlüsselt verspätete Nachrichten genau einmal", func() {
+		own, err := newSenderKey(0)
+		Expect(err).NotTo(HaveOccurred())
+		peer := own.public()
+		sender := make([]byte, 32)
+
+		var msgs []*GroupMessage
+		for _, text := range []string{"eins", "zwei", "drei"} {
+			m, err := own.seal("g", sender, []byte(text))
+			Expect(err).NotTo(HaveOccurred())
+			msgs = append(msgs, m)
+		}
+
+		Expect(peer.open(msgs[2])).To(Equal([]byte("drei")))
+		Expect(peer.Skipped).To(HaveLen(2))
+		Expect(peer.open(msgs[0])).To(Equal([]byte("eins")))
+		_, err = peer.open(msgs[0])
+		Expect(err).To(MatchError(ErrAuthFailed))
+
+		// manipulierte Nachricht ändert den Zustand nicht
+		bad := *msgs[1]
+		bad.Cipher = append([]byte{bad.Cipher[0] ^ 1}, bad.Cipher[1:]...)
+		_, err = peer.open(&bad)
+		Expect(err).To(MatchError(ErrAuthFailed))
+		Expect(peer.open(msgs[1])).To(Equal([]byte("zwei")))
+		Expect(peer.Skipped).To(BeEmpty())
+
+		own.N += maxSkip + 1
+		far, _ := own.seal("g", sender, []byte("zu weit"))
+		_, err = peer.open(far)
+		Expect(err).To(MatchError(ErrTooManySkipped))
+	})
+})
@@ -0,0 +1,96 @@
+package chat
+
+import (
+	"cmp"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Länge des Klartext-Headers: DH-Public-Key (32) + PN (4) + N (4)
+const headerLen = 32 + 4 + 4
+
+// ratchetHeader ist der Double-Ratchet-Header jeder CipherMessage. Auf dem
+// Draht steht er nur verschlüsselt (siehe encryptHeader).
+//
+//	DH – aktueller Ratchet-Public-Key des Senders
+//	PN – Anzahl Nachrichten in der vorherigen Send-Chain
+//	N  – Nachrichtennummer in der aktuellen Send-Chain
+type ratchetHeader struct {
+	DH []byte
+	PN uint32
+	N  uint32
+}
+
+func (h ratchetHeader) encode() []byte {
+	buf := make([]byte, headerLen)
+	copy(buf, h.DH)
+	binary.BigEndian.PutUint32(buf[32:], h.PN)
+	binary.BigEndian.PutUint32(buf[36:], h.N)
+	return buf
+}
+
+func decodeHeader(b []byte) (ratchetHeader, error) {
+	if len(b) != headerLen {
+		return ratchetHeader{}, errors.New("invalid header length")
+	}
+	return ratchetHeader{
+		DH: append([]byte(nil), b[:32]...),
+		PN: binary.BigEndian.Uint32(b[32:]),
+		N:  binary.BigEndian.Uint32(b[36:]),
+	}, nil
+}
+
+// encryptHeader verschlüsselt den Header mit dem aktuellen Header-Key.
+// Ergebnis: Nonce ‖ AEAD(hk, Header, ad)
+func encryptHeader(suite byte, hk []byte, h ratchetHeader, ad []byte) ([]byte, error) {
+	nonce, ct, err := encryptAEAD(suite, hk, h.encode(), ad)
+	if err != nil {
+		return nil, err
+	}
+	return append(nonce, ct...), nil
+}
+
+func decryptHeader(suite byte, hk, enc, ad []byte) (ratchetHeader, error) {
+	if len(hk) == 0 || len(enc) < 12 {
+		return ratchetHeader{}, errors.New("cannot decrypt header")
+	}
+	plain, err := decryptAEAD(suite, hk, enc[:12], enc[12:], ad)
+	if err != nil {
+		return ratchetHeader{}, err
+	}
+	return decodeHeader(plain)
+}
+
+// sharedHeaderKeys leitet aus dem X3DH-Secret die beiden initialen
+// Header-Keys ab: HKa (Initiator → Responder) und NHKb (erste Chain des
+// Responders).
+func sharedHeaderKeys(sk []byte) (hka, nhkb []byte, err error) {
+	out, err := hkdf.Key(sha256.New, sk, nil, "zero shared header keys", 64)
+	if err != nil {
+		return nil, nil, err
+	}
+	return out[:32], out[32:], nil
+}
+
+// migrateHeaderKeys rüstet eine Session aus persistState v1 mit Header-Keys
+// nach. Beide Seiten leiten sie aus dem gemeinsamen Root-Key und den
+// aktuellen Ratchet-Public-Keys ab: hk(X) schützt Nachrichten unter X,
+// nhk(X) die Chain, die auf X folgt. Voraussetzung ist, dass beide Seiten
+// beim Upgrade denselben Root-Key hatten.
+func (st *sessionState) migrateHeaderKeys() error {
+	if st.dhSendPrivKey == nil || st.dhRecvPubKey == nil {
+		return ErrNoSession
+	}
+	var err error
+	derive := func(label string, pub []byte) []byte {
+		k, e := hkdf.Key(sha256.New, st.rootKey, pub, label, 32)
+		err = cmp.Or(err, e)
+		return k
+	}
+	own, remote := st.dhSendPrivKey.PublicKey().Bytes(), st.dhRecvPubKey.Bytes()
+	st.hks, st.nhks = derive("zero migrate hk", own), derive("zero migrate nhk", own)
+	st.hkr, st.nhkr = derive("zero migrate hk", remote), derive("zero migrate nhk", remote)
+	return err
+}
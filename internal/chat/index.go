@@ -0,0 +1,357 @@
+package chat
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Verlaufs-Index: Zu jedem Log gehört ein verschlüsselter Index
+// (msgs/<id>.idx, groups/<gid>/msgs.idx), der für jeden Eintrag Offset,
+// Länge und Zeit festhält, bei Nachrichten dazu ihre laufende Nummer,
+// bei Quittungen und Änderungen die betroffenen Nachrichten. Eine Seite
+// des Verlaufs liest damit nur ihre eigenen Frames statt des ganzen Logs.
+//
+// Der Index ist selbst ein Log aus Frames und wird beim Anhängen
+// mitgeschrieben, aber nie gefsynct: er lässt sich jederzeit aus dem Log
+// wiederherstellen. Hinkt er hinterher (Absturz zwischen Log und Index),
+// wird der Rest nachgetragen; passt er nicht mehr zum Log (umgeschrieben,
+// abgeschnitten, unlesbar), wird er neu aufgebaut.
+
+// PageDirection gibt an, in welche Richtung LoadMessagesPage blättert.
+type PageDirection string
+
+const (
+	PageOlder PageDirection = "older" // vor dem Cursor, Cursor 0 = neueste Nachrichten
+	PageNewer PageDirection = "newer" // nach dem Cursor, Cursor 0 = älteste Nachrichten
+)
+
+const defaultPageSize = 50
+
+func (d PageDirection) validate() error {
+	switch d {
+	case PageOlder, PageNewer:
+		return nil
+	}
+	return fmt.Errorf("unknown page direction %q", d)
+}
+
+// RecordPage ist eine Seite des Verlaufs, zeitlich sortiert.
+type RecordPage struct {
+	Records []CipherMessageWithMeta
+	First   uint64 // Seq der ältesten Nachricht der Seite, Cursor für PageOlder
+	Last    uint64 // Seq der neuesten, Cursor für PageNewer
+	More    bool   // in Blätterrichtung gibt es weitere Nachrichten
+}
+
+type indexEntry struct {
+	Seq  uint64   `json:"s,omitempty"` // nur Nachrichten
+	Off  int64    `json:"o"`
+	Len  int      `json:"l"`
+	TS   int64    `json:"t"`
+	Exp  int64    `json:"x,omitempty"`
+	MID  string   `json:"m,omitempty"`
+	Refs []string `json:"r,omitempty"` // Quittung oder Änderung
+}
+
+type logIndex struct {
+	end  int64  // bis hier ist das Log erfasst
+	seq  uint64 // zuletzt vergebene Nummer
+	msgs []indexEntry
+	refs map[string][]indexEntry // Quittungen und Änderungen je Nachricht
+}
+
+func (ix *logIndex) add(e indexEntry) {
+	if len(e.Refs) > 0 {
+		for _, ref := range e.Refs {
+			ix.refs[ref] = append(ix.refs[ref], e)
+		}
+	} else {
+		ix.msgs = append(ix.msgs, e)
+		ix.seq = e.Seq
+	}
+	ix.end = e.Off + int64(e.Len)
+}
+
+// entry beschreibt rec an off. Einträge ohne (passende) Nummer bekommen
+// die nächste; das betrifft nur Alt-Einträge beim Aufbau.
+func (ix *logIndex) entry(rec *CipherMessageWithMeta, off int64, n int) indexEntry {
+	e := indexEntry{Off: off, Len: n, TS: rec.TS.UnixNano()}
+	if len(rec.Refs) > 0 {
+		e.Refs = rec.Refs
+		return e
+	}
+	e.Seq = max(rec.Seq, ix.seq+1)
+	e.MID = rec.msgID()
+	if !rec.Expiry.IsZero() {
+		e.Exp = rec.Expiry.UnixNano()
+	}
+	return e
+}
+
+func indexPath(file string) string {
+	return strings.TrimSuffix(file, ".log") + ".idx"
+}
+
+// logIndex liefert den Index von file, auf dem Stand des Logs. logMu muss
+// gehalten werden.
+func (s *Store) logIndex(file string) (*logIndex, error) {
+	if s.Locked() {
+		return nil, ErrLocked // sonst sähe der Index unlesbar aus
+	}
+	var size int64
+	info, err := os.Stat(file)
+	if err == nil {
+		size = info.Size()
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	ix := s.indexes[file]
+	if ix == nil || ix.end > size {
+		if ix, err = s.readIndex(file, size); err != nil {
+			return nil, err
+		}
+		if s.indexes == nil {
+			s.indexes = map[string]*logIndex{}
+		}
+		s.indexes[file] = ix
+	}
+	if ix.end < size {
+		if err := s.catchUp(file, ix); err != nil {
+			delete(s.indexes, file)
+			return nil, err
+		}
+	}
+	return ix, nil
+}
+
+// readIndex lädt den Index von der Platte. Ist er unbrauchbar, wird er
+// verworfen und der Aufrufer baut ihn aus dem Log neu auf.
+func (s *Store) readIndex(file string, size int64) (*logIndex, error) {
+	path := indexPath(file)
+	fresh := func(why string) (*logIndex, error) {
+		log.Printf("[Store] rebuilding index %s: %s", filepath.Base(path), why)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return &logIndex{refs: map[string][]indexEntry{}}, nil
+	}
+
+	if err := s.repairTail(path); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &logIndex{refs: map[string][]indexEntry{}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	ix := &logIndex{refs: map[string][]indexEntry{}}
+	for _, frame := range splitFrames(data) {
+		plain, err := s.unwrap(path, frameBlob(frame))
+		if err != nil {
+			return fresh("unreadable")
+		}
+		var e indexEntry
+		if err := json.Unmarshal(plain, &e); err != nil {
+			return fresh("bad entry")
+		}
+		if e.Off < ix.end || (e.Seq != 0 && e.Seq <= ix.seq) {
+			return fresh("out of order")
+		}
+		ix.add(e)
+	}
+	if ix.end > size {
+		return fresh("log is shorter")
+	}
+	return ix, nil
+}
+
+// catchUp trägt die Log-Einträge hinter ix.end nach.
+func (s *Store) catchUp(file string, ix *logIndex) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	start := ix.end
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	frames, good := scanFrames(data)
+	var added []indexEntry
+	for _, frame := range frames {
+		rec, err := s.record(file, frame)
+		if err != nil {
+			continue
+		}
+		off := start + int64(cap(data)-cap(frame)) // frame ist ein Teil von data
+		e := ix.entry(&rec, off, len(frame))
+		ix.add(e)
+		added = append(added, e)
+	}
+	ix.end = start + int64(good)
+	log.Printf("[Store] indexed %d entries of %s", len(added), filepath.Base(file))
+	return s.appendIndex(file, added...)
+}
+
+// indexRecord hält einen gerade angehängten Eintrag im Index fest.
+func (s *Store) indexRecord(file string, ix *logIndex, rec *CipherMessageWithMeta, off int64, n int) {
+	e := ix.entry(rec, off, n)
+	ix.add(e)
+	if err := s.appendIndex(file, e); err != nil {
+		log.Printf("[Store] !! index %s: %v", filepath.Base(file), err)
+		s.dropIndex(file)
+	}
+}
+
+func (s *Store) appendIndex(file string, entries ...indexEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	path := indexPath(file)
+	var out []byte
+	for _, e := range entries {
+		raw, _ := json.Marshal(e)
+		blob, err := s.wrap(path, raw)
+		if err != nil {
+			return err
+		}
+		out = append(out, lengthPrefixed(blob)...)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(out)
+	return err
+}
+
+// dropIndex verwirft den Index eines umgeschriebenen Logs; er wird beim
+// nächsten Zugriff neu aufgebaut. logMu muss gehalten werden.
+func (s *Store) dropIndex(file string) {
+	delete(s.indexes, file)
+	if err := os.Remove(indexPath(file)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Printf("[Store] !! drop index %s: %v", filepath.Base(file), err)
+	}
+}
+
+// LoadMessagesPage liefert bis zu limit Nachrichten mit id vor bzw. nach
+// cursor, samt Quittungen und Änderungen. Gelesen werden nur die Frames
+// der Seite.
+func (s *Store) LoadMessagesPage(id []byte, cursor uint64, limit int, dir PageDirection) (*RecordPage, error) {
+	log.Printf("[Store] LoadMessagesPage id=%s cursor=%d limit=%d dir=%s", b64Name(id)[:8], cursor, limit, dir)
+	return s.loadPage(filepath.Join(s.basePath, msgDir, b64Name(id)+".log"), cursor, limit, dir)
+}
+
+func (s *Store) loadPage(path string, cursor uint64, limit int, dir PageDirection) (*RecordPage, error) {
+	if err := dir.validate(); err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if s.Locked() {
+		return nil, ErrLocked
+	}
+
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	ix, err := s.logIndex(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// abgelaufene Nachrichten hat der Sweeper nur noch nicht gelöscht
+	now := time.Now().UnixNano()
+	live := func(e indexEntry) bool { return e.Exp == 0 || now < e.Exp }
+	page := &RecordPage{}
+	var picked []indexEntry
+	if dir == PageOlder {
+		i := len(ix.msgs)
+		if cursor > 0 {
+			i = sort.Search(len(ix.msgs), func(i int) bool { return ix.msgs[i].Seq >= cursor })
+		}
+		for i--; i >= 0; i-- {
+			if !live(ix.msgs[i]) {
+				continue
+			}
+			if len(picked) == limit {
+				page.More = true
+				break
+			}
+			picked = append(picked, ix.msgs[i])
+		}
+		slices.Reverse(picked)
+	} else {
+		i := sort.Search(len(ix.msgs), func(i int) bool { return ix.msgs[i].Seq > cursor })
+		for ; i < len(ix.msgs); i++ {
+			if !live(ix.msgs[i]) {
+				continue
+			}
+			if len(picked) == limit {
+				page.More = true
+				break
+			}
+			picked = append(picked, ix.msgs[i])
+		}
+	}
+	if len(picked) == 0 {
+		return page, nil
+	}
+	page.First, page.Last = picked[0].Seq, picked[len(picked)-1].Seq
+
+	// Quittungen und Änderungen der Seite, jeder Eintrag einmal
+	var sides []indexEntry
+	seen := map[int64]bool{}
+	for _, m := range picked {
+		for _, e := range ix.refs[m.MID] {
+			if !seen[e.Off] {
+				seen[e.Off] = true
+				sides = append(sides, e)
+			}
+		}
+	}
+	slices.SortFunc(sides, func(a, b indexEntry) int { return cmp.Compare(a.Off, b.Off) })
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	read := func(entries []indexEntry) []CipherMessageWithMeta {
+		var out []CipherMessageWithMeta
+		for _, e := range entries {
+			frame := make([]byte, e.Len)
+			if _, err := f.ReadAt(frame, e.Off); err != nil {
+				log.Printf("  read-error at %d: %v", e.Off, err)
+				continue
+			}
+			if rec, err := s.record(path, frame); err == nil {
+				out = append(out, rec)
+			}
+		}
+		return out
+	}
+	page.Records = read(picked)
+	attachSide(page.Records, read(sides))
+	log.Printf("  returning %d of %d messages", len(page.Records), len(ix.msgs))
+	return page, nil
+}
@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Verlaufs-Index", func() {
+	var (
+		tmp  string
+		st   *Store
+		peer []byte
+		file string
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "index_*")
+		Expect(err).NotTo(HaveOccurred())
+		st, err = NewStore(tmp)
+		Expect(err).NotTo(HaveOccurred())
+		peer = []byte("bob-identity-key-000000000000000")
+		file = filepath.Join(tmp, msgDir, b64Name(peer)+".log")
+		for i := 1; i <= 7; i++ {
+			t := fmt.Sprintf("m%d", i)
+			Expect(st.AppendMessage(peer, CipherMessage{}, i%2 == 0, t, []byte(t))).To(Succeed())
+		}
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	page := func(s *Store, cursor uint64, limit int, dir PageDirection) ([]string, *RecordPage) {
+		p, err := s.LoadMessagesPage(peer, cursor, limit, dir)
+		Expect(err).NotTo(HaveOccurred())
+		var out []string
+		for _, r := range p.Records {
+			out = append(out, r.Plain)
+		}
+		return out, p
+	}
+
+	It("blättert vom Ende zurück und vom Anfang vor", func() {
+		got, p := page(st, 0, 3, PageOlder)
+		Expect(got).To(Equal([]string{"m5", "m6", "m7"}))
+		Expect(p.More).To(BeTrue())
+		got, p = page(st, p.First, 3, PageOlder)
+		Expect(got).To(Equal([]string{"m2", "m3", "m4"}))
+		got, p = page(st, p.First, 3, PageOlder)
+		Expect(got).To(Equal([]string{"m1"}))
+		Expect(p.More).To(BeFalse())
+
+		got, p = page(st, 0, 4, PageNewer)
+		Expect(got).To(Equal([]string{"m1", "m2", "m3", "m4"}))
+		got, p = page(st, p.Last, 4, PageNewer)
+		Expect(got).To(Equal([]string{"m5", "m6", "m7"}))
+		Expect(p.More).To(BeFalse())
+
+		_, err := st.LoadMessagesPage(peer, 0, 3, "sideways")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("liest nur die Frames der Seite samt ihrer Quittungen", func() {
+		Expect(st.SetMessageStatus(peer, true, "read", "m6")).To(Succeed())
+		Expect(st.appendRecord(peer, CipherMessageWithMeta{
+			TS: time.Now().UTC(), Out: true, Change: ChangeEdit, Refs: []string{"m6"},
+		})).To(Succeed())
+		page(st, 0, 1, PageOlder) // Index aufbauen
+
+		// ein kaputter früher Frame stört die letzte Seite nicht
+		data, _ := os.ReadFile(file)
+		data[20] ^= 0xff
+		Expect(os.WriteFile(file, data, 0o600)).To(Succeed())
+
+		_, p := page(st, 0, 2, PageOlder)
+		Expect(p.Records).To(HaveLen(2))
+		m6 := p.Records[0]
+		Expect(m6.Plain).To(Equal("m6"))
+		Expect(m6.Status).To(Equal("read"))
+		Expect(m6.changes).To(HaveLen(1))
+	})
+
+	It("baut einen fehlenden oder veralteten Index aus dem Log auf", func() {
+		idx := indexPath(file)
+		Expect(idx).To(BeAnExistingFile())
+		Expect(os.Remove(idx)).To(Succeed())
+
+		st2, err := NewStore(tmp)
+		Expect(err).NotTo(HaveOccurred())
+		got, p := page(st2, 0, 2, PageOlder)
+		Expect(got).To(Equal([]string{"m6", "m7"}))
+		Expect(p.Last).To(Equal(uint64(7)))
+
+		// der Index hinkt hinterher: nur der Rest wird nachgetragen
+		st3, err := NewStore(tmp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st2.AppendMessage(peer, CipherMessage{}, true, "m8", []byte("m8"))).To(Succeed())
+		idxData, _ := os.ReadFile(idx)
+		frames := splitFrames(idxData)
+		Expect(os.WriteFile(idx, idxData[:len(idxData)-len(frames[len(frames)-1])], 0o600)).To(Succeed())
+		got, p = page(st3, 0, 2, PageOlder)
+		Expect(got).To(Equal([]string{"m7", "m8"}))
+		Expect(p.Last).To(Equal(uint64(8)))
+
+		// umgeschrieben (Rekey) passt der alte Index nicht mehr
+		Expect(st3.Rekey("", KDFParams{}, nil)).To(Succeed())
+		Expect(idx).NotTo(BeAnExistingFile())
+		got, _ = page(st3, 7, 5, PageOlder)
+		Expect(got).To(Equal([]string{"m2", "m3", "m4", "m5", "m6"}))
+	})
+
+	It("lässt abgelaufene Nachrichten aus", func() {
+		env, err := newEnvelope(ContentText, textBody{Text: "weg"})
+		Expect(err).NotTo(HaveOccurred())
+		env.TTL = 1
+		Expect(st.AppendMessage(peer, CipherMessage{}, true, env.ID, env.encode())).To(Succeed())
+		got, _ := page(st, 0, 2, PageOlder)
+		Expect(got).To(HaveLen(2))
+		Expect(got[1]).NotTo(Equal("m7"))
+
+		Eventually(func() []string {
+			got, _ := page(st, 0, 2, PageOlder)
+			return got
+		}, "3s", "100ms").Should(Equal([]string{"m6", "m7"}))
+	})
+})
@@ -0,0 +1,140 @@
+package chat
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"slices"
+)
+
+// KDF-Versionen der Ratchet. Die Version wird pro Session gespeichert:
+// Sessions aus der Zeit vor v2 rechnen unverändert weiter, jeder neue
+// Handshake startet mit v2.
+//
+//	v1 – HKDF ohne Salt und Info, Nachrichtenschlüssel = nächster Chain-Key,
+//	     zufällige Nonce, AD = Header
+//	v2 – Root-KDF mit Salt = Root-Key, getrennte Info-Labels für Root-,
+//	     Chain- und Message-Keys, Message-Key = AES-Key ‖ IV,
+//	     AD = IK_Initiator ‖ IK_Responder ‖ Header
+const (
+	kdfV1 byte = 1
+	kdfV2 byte = 2
+)
+
+const (
+	infoRoot    = "zero ratchet root v2"
+	infoChain   = "zero ratchet chain v2"
+	infoMessage = "zero ratchet message v2"
+)
+
+const (
+	msgKeyLen = 32
+	msgIVLen  = 12
+)
+
+// kdfRoot liefert neuen Root-Key, Chain-Key und den nächsten Header-Key
+// (Header-Encryption-Variante des Double Ratchet).
+func kdfRoot(v byte, rootKey, dhSecret []byte) (newRootKey, chainKey, nextHeaderKey []byte, err error) {
+	if v != kdfV2 {
+		return kdfRootV1(rootKey, dhSecret)
+	}
+	out, err := hkdf.Key(sha256.New, dhSecret, rootKey, infoRoot, 96)
+	if err != nil {
+		return
+	}
+	return out[:32], out[32:64], out[64:], nil
+}
+
+func kdfRootV1(rootKey, dhSecret []byte) (newRootKey, chainKey, nextHeaderKey []byte, err error) {
+	if newRootKey, err = hkdf32(slices.Concat(rootKey, dhSecret)); err != nil {
+		return
+	}
+	if chainKey, err = hkdf32(slices.Concat(dhSecret, newRootKey)); err != nil {
+		return
+	}
+	nextHeaderKey, err = hkdf.Key(sha256.New, chainKey, newRootKey, "zero next header key", 32)
+	return
+}
+
+// chainStep leitet aus dem Chain-Key den nächsten Chain-Key und den
+// Nachrichtenschlüssel ab.
+func chainStep(v byte, ck []byte) (nextCK, mk []byte, err error) {
+	if v != kdfV2 {
+		if nextCK, err = hkdf32(ck); err != nil {
+			return
+		}
+		return nextCK, nextCK, nil
+	}
+	if nextCK, err = hkdf.Key(sha256.New, ck, nil, infoChain, 32); err != nil {
+		return
+	}
+	mk, err = hkdf.Key(sha256.New, ck, nil, infoMessage, msgKeyLen+msgIVLen)
+	return
+}
+
+// sealMessage verschlüsselt mit einem Nachrichtenschlüssel und der
+// ausgehandelten AEAD-Suite. Bei v2 ist die Nonce Teil des
+// Schlüsselmaterials und wird nicht übertragen.
+func sealMessage(v, suite byte, mk, plaintext, aad []byte) (nonce, ciphertext []byte, err error) {
+	if v != kdfV2 {
+		return encryptAEAD(suite, mk, plaintext, aad)
+	}
+	aead, err := newAEAD(suite, mk[:msgKeyLen])
+	if err != nil {
+		return
+	}
+	return nil, aead.Seal(nil, mk[msgKeyLen:], plaintext, aad), nil
+}
+
+func openMessage(v, suite byte, mk, nonce, ct, aad []byte) ([]byte, error) {
+	var (
+		plaintext []byte
+		err       error
+	)
+	if v != kdfV2 {
+		plaintext, err = decryptAEAD(suite, mk, nonce, ct, aad)
+	} else if aead, aerr := newAEAD(suite, mk[:msgKeyLen]); aerr != nil {
+		err = aerr
+	} else {
+		plaintext, err = aead.Open(nil, mk[msgKeyLen:], ct, aad)
+	}
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// messageAD bindet bei v2 beide Identitäten an jede Nachricht.
+func (st *sessionState) messageAD(header []byte) []byte {
+	if st.kdf != kdfV2 {
+		return header
+	}
+	return slices.Concat(st.ad, header)
+}
+
+// headerAD ist die Associated Data der Header-Verschlüsselung.
+func (st *sessionState) headerAD() []byte {
+	if st.kdf != kdfV2 {
+		return nil
+	}
+	return st.ad
+}
+
+// nextMessageKey schaltet eine Chain weiter und liefert den Nachrichtenschlüssel.
+func (st *sessionState) nextMessageKey(r *SymmRatchet) ([]byte, error) {
+	ck, mk, err := chainStep(st.kdf, r.state)
+	if err != nil {
+		return nil, err
+	}
+	r.state = ck
+	return mk, nil
+}
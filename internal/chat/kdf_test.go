@@ -0,0 +1,96 @@
+package chat
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Ratchet-KDF v2", func() {
+
+	It("separates chain and message keys and derives the IV", func() {
+		ck := rand32()
+		next, mk, err := chainStep(kdfV2, ck)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mk).To(HaveLen(msgKeyLen + msgIVLen))
+		Expect(mk[:msgKeyLen]).NotTo(Equal(next))
+
+		// v1: Nachrichtenschlüssel ist der nächste Chain-Key
+		next1, mk1, _ := chainStep(kdfV1, ck)
+		Expect(mk1).To(Equal(next1))
+	})
+
+	It("does not alias the caller's root key", func() {
+		backing := make([]byte, 32, 64)
+		copy(backing, rand32())
+		spare := backing[:64]
+		before := append([]byte(nil), spare[32:]...)
+
+		_, _, _, err := kdfRoot(kdfV1, backing, rand32())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(spare[32:]).To(Equal(before))
+	})
+
+	It("binds both identity keys into the associated data", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		handshake(alice, bob)
+
+		aliceID, bobID := alice.IdentityPublicKey(), bob.IdentityPublicKey()
+		aSt, bSt := alice.state(bobID), bob.state(aliceID)
+		Expect(aSt.kdf).To(Equal(kdfV2))
+		Expect(aSt.ad).To(Equal(append(append([]byte(nil), aliceID...), bobID...)))
+		Expect(bSt.ad).To(Equal(aSt.ad))
+
+		h, n, ct, err := alice.Encrypt(bobID, []byte("gebunden"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(n).To(BeEmpty()) // IV steckt im Schlüsselmaterial
+
+		// gleiche Schlüssel, aber andere Identitäten → Authentisierung scheitert
+		saved := bSt.ad
+		bSt.ad = append(append([]byte(nil), bobID...), aliceID...)
+		_, err = bob.Decrypt(aliceID, h, n, ct)
+		Expect(err).To(MatchError(ErrBadHeader))
+		bSt.ad = saved
+
+		plain, err := bob.Decrypt(aliceID, h, n, ct)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(plain)).To(Equal("gebunden"))
+	})
+
+	It("keeps legacy v1 sessions working", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		handshake(alice, bob)
+		aliceID, bobID := alice.IdentityPublicKey(), bob.IdentityPublicKey()
+
+		// beide Seiten auf die Alt-KDF zurückstellen (wie nach LoadSession v1/v2)
+		for _, st := range []*sessionState{alice.state(bobID), bob.state(aliceID)} {
+			st.kdf, st.ad = kdfV1, nil
+		}
+
+		send := func(src, dst *Peer, msg string) {
+			h, n, ct, err := src.Encrypt(dst.IdentityPublicKey(), []byte(msg))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(n).NotTo(BeEmpty()) // v1: zufällige Nonce
+			plain, err := dst.Decrypt(src.IdentityPublicKey(), h, n, ct)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(plain)).To(Equal(msg))
+		}
+		send(alice, bob, "alt 1")
+		send(bob, alice, "alt 2")
+		send(alice, bob, "alt 3")
+	})
+
+	It("accepts inits without a KDF version as v1 and rejects unknown ones", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+
+		initMsg, err := alice.InitiateSession(bob.Bundle())
+		Expect(err).NotTo(HaveOccurred())
+
+		bad := initMsg
+		bad.KDF = 9
+		Expect(bob.AcceptSession(bad)).To(MatchError(ErrBadInit))
+
+		initMsg.KDF = 0
+		Expect(bob.AcceptSession(initMsg)).To(Succeed())
+		Expect(bob.state(alice.IdentityPublicKey()).kdf).To(Equal(kdfV1))
+	})
+})
@@ -0,0 +1,121 @@
+package chat
+
+import (
+	"crypto/ecdh"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Identity-Key-Wechsel (TOFU)", func() {
+	var (
+		tmp string
+		mgr *Manager
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "keychange_*")
+		Expect(err).NotTo(HaveOccurred())
+		mgr, err = NewManager(tmp, "Alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mgr.Initialise()).To(Succeed())
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	// Bob meldet sich nach einer Neuinstallation mit frischem Identity-Key
+	reinstalledBob := func() *Session {
+		seed := sha256.Sum256([]byte("reinstalled bob"))
+		priv, _ := ecdh.X25519().NewPrivateKey(seed[:])
+		st, err := NewStore(filepath.Join(tmp, "bob-new"))
+		Expect(err).NotTo(HaveOccurred())
+		bob := NewSessionFromPeer(NewPeerWithIdentity("Bob", priv), mgr.transport, st)
+		Expect(bob.StartHandshake(mgr.localPeer.Bundle())).To(Succeed())
+		return bob
+	}
+
+	It("merkt sich unbekannte Absender beim ersten Kontakt", func() {
+		st, _ := NewStore(filepath.Join(tmp, "carol"))
+		carol := NewSessionFromPeer(NewPeer("Carol"), mgr.transport, st)
+		Expect(carol.StartHandshake(mgr.localPeer.Bundle())).To(Succeed())
+
+		c, err := mgr.store.LoadContact(carol.LocalPeer().IdentityPublicKey())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.Name).To(Equal("Carol"))
+		Expect(c.KeyChanged).To(BeFalse())
+	})
+
+	It("merkt einen neuen Key nur vor und zieht erst nach Bestätigung um", func() {
+		list, _ := mgr.Contacts()
+		oldID := list[0].ID
+		Expect(mgr.SetVerified(oldID, true)).To(Succeed())
+		Expect(mgr.Send(oldID, "vorher")).To(Succeed())
+
+		var changed string
+		mgr.SetKeyChangeHandler(func(id string) { changed = id })
+
+		bob := reinstalledBob()
+		newID := b64(bob.LocalPeer().IdentityPublicKey())
+		Expect(changed).To(Equal(oldID))
+
+		// der Name im Init ist nicht authentisiert: nichts wird angefasst
+		list, _ = mgr.Contacts()
+		Expect(list).To(HaveLen(1))
+		c := list[0]
+		Expect(c.ID).To(Equal(oldID))
+		Expect(c.KeyChanged).To(BeTrue())
+		Expect(b64(c.PendingKey)).To(Equal(newID))
+		Expect(c.Verified).To(BeTrue())
+		Expect(c.KeyHistory).To(BeEmpty())
+		Expect(filepath.Join(tmp, keysDir, oldID+".key")).To(BeAnExistingFile())
+		Expect(mgr.store.LoadSession(c.IDPub)).NotTo(BeNil())
+
+		// die Verifikation des alten Keys nimmt den neuen nicht an
+		Expect(mgr.SetVerified(oldID, true)).To(Succeed())
+		Expect(mgr.Send(oldID, "hallo?")).To(MatchError(ErrSafetyNumberChanged))
+
+		id, err := mgr.AcknowledgeKeyChange(oldID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(id).To(Equal(newID))
+
+		list, _ = mgr.Contacts()
+		Expect(list).To(HaveLen(1))
+		c = list[0]
+		Expect(c.ID).To(Equal(newID))
+		Expect(c.KeyChanged).To(BeFalse())
+		Expect(c.PendingKey).To(BeNil())
+		Expect(c.Verified).To(BeFalse())
+		Expect(c.KeyHistory).To(HaveLen(1))
+		Expect(b64(c.KeyHistory[0].IDPub)).To(Equal(oldID))
+		Expect(c.KeyHistory[0].Verified).To(BeTrue())
+		Expect(filepath.Join(tmp, keysDir, oldID+".key")).NotTo(BeAnExistingFile())
+
+		// Verlauf bleibt erhalten
+		msgs, err := mgr.Messages(newID, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).To(HaveLen(1))
+		Expect(mgr.Send(newID, "hallo!")).To(Succeed())
+	})
+
+	It("behält beim Ablehnen den alten Key", func() {
+		list, _ := mgr.Contacts()
+		oldID := list[0].ID
+		bob := reinstalledBob()
+		newID := b64(bob.LocalPeer().IdentityPublicKey())
+
+		Expect(mgr.Send(oldID, "x")).To(MatchError(ErrSafetyNumberChanged))
+		Expect(mgr.RejectKeyChange(oldID)).To(Succeed())
+		Expect(mgr.RejectKeyChange(oldID)).To(HaveOccurred())
+
+		c, err := mgr.contactFor(oldID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(c.KeyChanged).To(BeFalse())
+		Expect(c.PendingKey).To(BeNil())
+		Expect(mgr.sessions).NotTo(HaveKey(newID))
+		Expect(filepath.Join(tmp, sessionsDir, newID)).NotTo(BeAnExistingFile())
+		Expect(filepath.Join(tmp, sessionsDir, oldID)).To(BeADirectory())
+	})
+})
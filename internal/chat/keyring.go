@@ -0,0 +1,227 @@
+package chat
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Passphrase-Schutz: der Master-Key liegt dann nicht mehr im Klartext in
+// master.key, sondern mit AES-GCM verpackt in master.hdr. Der Schlüssel
+// dafür kommt per Argon2id aus der Passphrase; Parameter und Salt stehen
+// im Header und sind als Associated Data an den verpackten Key gebunden.
+//
+// Ein geschützter Store startet gesperrt (masterKey = nil) und lässt
+// bis Unlock nur Zugriffe zu, die ohne Schlüssel auskommen.
+const (
+	keyHeaderFile    = "master.hdr"
+	keyHeaderVersion = 1
+	kdfArgon2id      = "argon2id"
+)
+
+var (
+	ErrLocked          = errors.New("store is locked")
+	ErrWrongPassphrase = errors.New("wrong passphrase")
+	ErrNotProtected    = errors.New("store has no passphrase")
+	ErrBadKDFParams    = errors.New("invalid key derivation parameters")
+)
+
+// KDFParams sind die Argon2id-Parameter, mit denen die Passphrase
+// gestreckt wird.
+type KDFParams struct {
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"` // KiB
+	Threads uint8  `json:"threads"`
+}
+
+// Voreinstellung nach RFC 9106 (zweite Empfehlung); Tests setzen sie herab.
+var defaultKDFParams = KDFParams{Time: 3, Memory: 64 * 1024, Threads: 4}
+
+func (p KDFParams) validate() error {
+	switch {
+	case p.Time < 1, p.Threads < 1:
+		return fmt.Errorf("%w: time and threads must be positive", ErrBadKDFParams)
+	case p.Memory < 8*uint32(p.Threads):
+		return fmt.Errorf("%w: memory below 8 KiB per thread", ErrBadKDFParams)
+	case p.Memory > 4*1024*1024:
+		return fmt.Errorf("%w: memory above 4 GiB", ErrBadKDFParams)
+	}
+	return nil
+}
+
+func (p KDFParams) derive(pass string, salt []byte) []byte {
+	return argon2.IDKey([]byte(pass), salt, p.Time, p.Memory, p.Threads, 32)
+}
+
+type keyHeader struct {
+	Version int       `json:"v"`
+	KDF     string    `json:"kdf"`
+	Params  KDFParams `json:"params"`
+	Salt    []byte    `json:"salt"`
+	Nonce   []byte    `json:"nonce,omitempty"`
+	Key     []byte    `json:"key,omitempty"` // verpackter Master-Key
+}
+
+// ad ist der Header ohne Nonce und Key: wer Parameter oder Salt ändert,
+// bricht die Authentifizierung.
+func (h keyHeader) ad() []byte {
+	h.Nonce, h.Key = nil, nil
+	b, _ := json.Marshal(h)
+	return b
+}
+
+func (h keyHeader) aead(pass string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(h.Params.derive(pass, h.Salt))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Protected sagt, ob der Master-Key mit einer Passphrase geschützt ist.
+func (s *Store) Protected() bool {
+	_, err := os.Stat(filepath.Join(s.basePath, keyHeaderFile))
+	return err == nil
+}
+
+// Locked sagt, ob der Master-Key gerade nicht im Speicher ist.
+func (s *Store) Locked() bool {
+	s.keyMu.RLock()
+	defer s.keyMu.RUnlock()
+	return s.masterKey == nil
+}
+
+// SetPassphrase schützt den Master-Key mit pass oder ersetzt eine
+// bestehende Passphrase. Der Store muss dafür entsperrt sein; danach
+// liegt kein Klartext-Key mehr auf der Platte.
+func (s *Store) SetPassphrase(pass string, params KDFParams) error {
+	if pass == "" {
+		return fmt.Errorf("%w: empty passphrase", ErrWrongPassphrase)
+	}
+	if err := params.validate(); err != nil {
+		return err
+	}
+	s.keyMu.RLock()
+	defer s.keyMu.RUnlock()
+	if s.masterKey == nil {
+		return ErrLocked
+	}
+	raw, err := sealKeyHeader(s.masterKey, pass, params)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(filepath.Join(s.basePath, keyHeaderFile), raw); err != nil {
+		return err
+	}
+	// erst wenn der Header steht, verschwindet der Klartext-Key
+	if err := os.Remove(filepath.Join(s.basePath, masterKeyFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	log.Printf("[Store] passphrase set (argon2id t=%d m=%dKiB p=%d)", params.Time, params.Memory, params.Threads)
+	return nil
+}
+
+// sealKeyHeader verpackt key unter pass und liefert den Header.
+func sealKeyHeader(key []byte, pass string, params KDFParams) ([]byte, error) {
+	h := keyHeader{Version: keyHeaderVersion, KDF: kdfArgon2id, Params: params, Salt: make([]byte, 16)}
+	if _, err := rand.Read(h.Salt); err != nil {
+		return nil, err
+	}
+	gcm, err := h.aead(pass)
+	if err != nil {
+		return nil, err
+	}
+	h.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(h.Nonce); err != nil {
+		return nil, err
+	}
+	h.Key = gcm.Seal(nil, h.Nonce, key, h.ad())
+	return json.Marshal(h)
+}
+
+// openKeyHeader entpackt den Master-Key aus master.hdr.
+func (s *Store) openKeyHeader(pass string) ([]byte, error) {
+	raw, err := os.ReadFile(filepath.Join(s.basePath, keyHeaderFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotProtected
+	} else if err != nil {
+		return nil, err
+	}
+	var h keyHeader
+	if err := json.Unmarshal(raw, &h); err != nil {
+		return nil, fmt.Errorf("key header: %w", err)
+	}
+	if h.Version != keyHeaderVersion || h.KDF != kdfArgon2id {
+		return nil, fmt.Errorf("key header: unsupported %s v%d", h.KDF, h.Version)
+	}
+	if err := h.Params.validate(); err != nil {
+		return nil, err
+	}
+	gcm, err := h.aead(pass)
+	if err != nil {
+		return nil, err
+	}
+	if len(h.Nonce) != gcm.NonceSize() {
+		return nil, ErrWrongPassphrase
+	}
+	key, err := gcm.Open(nil, h.Nonce, h.Key, h.ad())
+	if err != nil || len(key) != 32 {
+		return nil, ErrWrongPassphrase
+	}
+	return key, nil
+}
+
+// CheckPassphrase prüft pass gegen master.hdr, ohne etwas zu ändern.
+func (s *Store) CheckPassphrase(pass string) error {
+	key, err := s.openKeyHeader(pass)
+	clear(key)
+	return err
+}
+
+// Unlock entpackt den Master-Key mit pass.
+func (s *Store) Unlock(pass string) error {
+	key, err := s.openKeyHeader(pass)
+	if err != nil {
+		return err
+	}
+
+	s.keyMu.Lock()
+	s.masterKey = key
+	s.keyMu.Unlock()
+	log.Printf("[Store] unlocked")
+	if s.legacy {
+		return s.migrate()
+	}
+	return nil
+}
+
+// Lock überschreibt den Master-Key im Speicher. Ohne Passphrase ließe
+// er sich nicht zurückholen, deshalb nur bei geschütztem Store.
+func (s *Store) Lock() error {
+	if !s.Protected() {
+		return ErrNotProtected
+	}
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	clear(s.masterKey)
+	s.masterKey = nil
+	s.forgetSubkeys()
+	log.Printf("[Store] locked")
+	return nil
+}
+
+// locked: Sessions eines gesperrten Stores nehmen nichts an und
+// verschicken nichts, ihr Ratchet-State ist nicht im Speicher.
+func (s *Session) locked() bool {
+	return s.store != nil && s.store.Locked()
+}
@@ -0,0 +1,178 @@
+package chat
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// billige Parameter, damit die Tests nicht an Argon2id hängen
+var testKDFParams = KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+var _ = Describe("Passphrase", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "keyring_*")
+		Expect(err).NotTo(HaveOccurred())
+		old := defaultKDFParams
+		defaultKDFParams = testKDFParams
+		DeferCleanup(func() { defaultKDFParams = old })
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	Describe("Store", func() {
+		It("verpackt den Master-Key und startet danach gesperrt", func() {
+			st, err := NewStore(tmp)
+			Expect(err).NotTo(HaveOccurred())
+			ik, err := st.EnsureIdentity()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(st.Lock()).To(MatchError(ErrNotProtected))
+
+			Expect(st.SetPassphrase("", testKDFParams)).To(HaveOccurred())
+			Expect(st.SetPassphrase("pw", KDFParams{})).To(MatchError(ErrBadKDFParams))
+			Expect(st.SetPassphrase("korrekt pferd", testKDFParams)).To(Succeed())
+			Expect(filepath.Join(tmp, masterKeyFile)).NotTo(BeAnExistingFile())
+			Expect(st.Protected()).To(BeTrue())
+			Expect(st.Locked()).To(BeFalse())
+
+			st2, err := NewStore(tmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(st2.Locked()).To(BeTrue())
+			_, err = st2.EnsureIdentity()
+			Expect(err).To(MatchError(ErrLocked))
+			Expect(filepath.Join(tmp, identityFile)).To(BeAnExistingFile())
+
+			Expect(st2.Unlock("falsches pferd")).To(MatchError(ErrWrongPassphrase))
+			Expect(st2.Unlock("korrekt pferd")).To(Succeed())
+			ik2, err := st2.EnsureIdentity()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ik2.Bytes()).To(Equal(ik.Bytes()))
+
+			Expect(st2.Lock()).To(Succeed())
+			Expect(st2.Locked()).To(BeTrue())
+			Expect(st2.SetPassphrase("neu", testKDFParams)).To(MatchError(ErrLocked))
+		})
+
+		It("lehnt manipulierte Parameter ab", func() {
+			st, err := NewStore(tmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(st.SetPassphrase("pw", testKDFParams)).To(Succeed())
+
+			path := filepath.Join(tmp, keyHeaderFile)
+			raw, err := os.ReadFile(path)
+			Expect(err).NotTo(HaveOccurred())
+			var h keyHeader
+			Expect(json.Unmarshal(raw, &h)).To(Succeed())
+			h.Params.Time++
+			raw, _ = json.Marshal(h)
+			Expect(os.WriteFile(path, raw, 0o600)).To(Succeed())
+
+			st2, err := NewStore(tmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(st2.Unlock("pw")).To(MatchError(ErrWrongPassphrase))
+			Expect(st2.Locked()).To(BeTrue())
+		})
+	})
+
+	Describe("Manager", func() {
+		var (
+			mgr     *Manager
+			bobID   string
+			bobSess *Session
+			locks   atomic.Int32 // der Idle-Timer sperrt aus eigener Goroutine
+		)
+
+		BeforeEach(func() {
+			var err error
+			mgr, err = NewManager(tmp, "Alice")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mgr.Initialise()).To(Succeed())
+			locks.Store(0)
+			mgr.SetLockHandler(func() { locks.Add(1) })
+
+			list, _ := mgr.Contacts()
+			bobID = list[0].ID
+			dt := mgr.transport.(*DummyTransport)
+			for _, s := range dt.peers {
+				if b64(s.LocalPeer().IdentityPublicKey()) == bobID {
+					bobSess = s
+				}
+			}
+			Expect(bobSess).NotTo(BeNil())
+			Expect(mgr.Lock()).To(MatchError(ErrNotProtected))
+			Expect(mgr.SetPassphrase("geheim")).To(Succeed())
+		})
+		AfterEach(func() { mgr.setIdle(0) })
+
+		It("vergisst beim Sperren alle Schlüssel und lädt sie beim Entsperren", func() {
+			Expect(mgr.Send(bobID, "vorher")).To(Succeed())
+			self := mgr.self()
+
+			Expect(mgr.Lock()).To(Succeed())
+			Expect(mgr.Locked()).To(BeTrue())
+			Expect(locks.Load()).To(Equal(int32(1)))
+			Expect(mgr.localPeer.IdentityPublicKey()).To(BeNil())
+			Expect(mgr.localPeer.sess).To(BeEmpty())
+			Expect(mgr.store.MasterKey()).To(BeNil())
+
+			Expect(mgr.Send(bobID, "gesperrt")).To(MatchError(ErrLocked))
+			_, err := mgr.Messages(bobID, 0)
+			Expect(err).To(MatchError(ErrLocked))
+			sess, _ := mgr.session(bobID)
+			Expect(sess.Receive(CipherMessage{})).To(MatchError(ErrLocked))
+
+			Expect(mgr.Unlock("falsch")).To(MatchError(ErrWrongPassphrase))
+			Expect(mgr.Locked()).To(BeTrue())
+			Expect(mgr.Unlock("geheim")).To(Succeed())
+			Expect(mgr.self()).To(Equal(self))
+
+			// die Sessions laufen dort weiter, wo sie beim Sperren standen
+			Expect(mgr.Send(bobID, "nachher")).To(Succeed())
+			Expect(bobSess.Send([]byte("zurück"))).To(Succeed())
+			msgs, err := mgr.Messages(bobID, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msgs).To(HaveLen(3))
+			Expect(msgs[0].Text).To(Equal("vorher"))
+			Expect(msgs[1].Text).To(Equal("nachher"))
+			Expect(msgs[1].Status).To(Equal(StatusDelivered))
+			Expect(msgs[2].Text).To(Equal("zurück"))
+		})
+
+		It("übersteht ein verspätetes Sichern nach dem Sperren", func() {
+			Expect(mgr.Send(bobID, "vorher")).To(Succeed())
+			sess, _ := mgr.session(bobID)
+			Expect(mgr.Lock()).To(Succeed())
+
+			Expect(sess.persist).NotTo(Panic())
+			Expect(mgr.localPeer.sess).To(BeEmpty())
+
+			// auch ohne State bei offenem Store legt persist nichts an
+			Expect(mgr.Unlock("geheim")).To(Succeed())
+			mgr.localPeer.dropState(sess.RemoteID())
+			Expect(sess.persist).NotTo(Panic())
+			Expect(mgr.localPeer.sess).NotTo(HaveKey(keyOf(sess.RemoteID())))
+			st, err := mgr.store.LoadSession(sess.RemoteID())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(st.dhSendPrivKey).NotTo(BeNil())
+		})
+
+		It("sperrt sich nach Leerlauf selbst", func() {
+			mgr.setIdle(50 * time.Millisecond)
+			Eventually(locks.Load).Should(Equal(int32(1)))
+			Expect(mgr.Locked()).To(BeTrue())
+
+			Expect(mgr.Unlock("geheim")).To(Succeed())
+			Expect(mgr.SetAutoLock(0)).To(Succeed())
+			Consistently(mgr.Locked, 200*time.Millisecond).Should(BeFalse())
+			st, _ := mgr.Settings()
+			Expect(st.AutoLockMinutes).To(BeZero())
+		})
+	})
+})
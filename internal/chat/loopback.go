@@ -0,0 +1,89 @@
+package chat
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// LoopbackNetwork ersetzt Tor im Speicher: Listen vergibt Adressen
+// „loop-N“, Dial verbindet per net.Pipe. Damit läuft der komplette
+// TorTransport-Pfad ohne Netzwerk.
+type LoopbackNetwork struct {
+	mu        sync.Mutex
+	next      int
+	listeners map[string]*loopListener
+}
+
+func NewLoopbackNetwork() *LoopbackNetwork {
+	return &LoopbackNetwork{listeners: map[string]*loopListener{}}
+}
+
+func (n *LoopbackNetwork) Listen(context.Context) (net.Listener, string, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.next++
+	addr := fmt.Sprintf("loop-%d", n.next)
+	l := &loopListener{
+		net:   n,
+		addr:  loopAddr(addr),
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, addr, nil
+}
+
+func (n *LoopbackNetwork) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	n.mu.Lock()
+	l := n.listeners[addr]
+	n.mu.Unlock()
+	if l == nil {
+		return nil, fmt.Errorf("loopback: no listener at %s", addr)
+	}
+
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type loopListener struct {
+	net   *LoopbackNetwork
+	addr  loopAddr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (l *loopListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *loopListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.net.mu.Lock()
+		delete(l.net.listeners, string(l.addr))
+		l.net.mu.Unlock()
+	})
+	return nil
+}
+
+func (l *loopListener) Addr() net.Addr { return l.addr }
+
+type loopAddr string
+
+func (a loopAddr) Network() string { return "loopback" }
+func (a loopAddr) String() string  { return string(a) }
@@ -1,43 +1,119 @@
 package chat
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"crypto/ecdh"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
+	"path/filepath"
+	"slices"
+	"sync"
 	"time"
+
+	"github.com/google/uuid"
 )
 
+// ErrSafetyNumberChanged blockiert das Senden an einen Kontakt, dessen
+// Identity-Key sich geändert hat, bis der Nutzer das bestätigt.
+var ErrSafetyNumberChanged = errors.New("safety number changed, acknowledge before sending")
+
 // Manager kapselt alles, was nicht GUI-spezifisch ist.
 type Manager struct {
 	store      *Store
-	transport  *DummyTransport
+	transport  Transport
 
 	localPeer  *Peer                 // Alice
 	sessions   map[string]*Session   // key = b64(remote IK)
+	sessMu     sync.Mutex            // sessions: Empfang und UI greifen gleichzeitig zu
+
+	onError     func(idB64 string, err error) // Empfangsfehler → UI
+	onKeyChange func(idB64 string)            // Sicherheitsnummer geändert → UI
+	onOutbox    func(idB64 string)            // Ausgang hat sich geändert → UI
+	onHistory   func(idB64 string)            // neue Nachricht/Quittung → UI
+	onGroup     func(groupID string)          // Gruppennachricht/Mitglieder geändert → UI
+	onDevices   func()                        // eigene oder fremde Geräteliste geändert → UI
+	onLock      func()                        // gesperrt (von Hand oder nach Leerlauf) → UI
+	onRekey     func(done, total int)         // Fortschritt beim Umschlüsseln → UI
+
+	outboxWake chan struct{} // weckt den Ausgangs-Worker vorzeitig
+
+	lockMu  sync.RWMutex // Sperren vs. Worker und Senden
+	remotes [][]byte     // Sessions beim Sperren, Unlock lädt sie neu
+
+	idleMu    sync.Mutex
+	idle      *time.Timer   // Auto-Lock, nil = aus
+	idleAfter time.Duration // 0 = kein Auto-Lock
 }
 
 // ───────────────────────── Construction ──────────────────────────
 
 func NewManager(storePath, peerName string) (*Manager, error) {
+	return NewManagerWithTransport(storePath, peerName, NewDummyTransport())
+}
+
+// NewManagerWithTransport erlaubt einen echten Transport (z. B. Tor).
+// Transports mit SetAcceptor bekommen für Inits unbekannter Absender
+// eine frische Session des Managers.
+func NewManagerWithTransport(storePath, peerName string, t Transport) (*Manager, error) {
 	st, err := NewStore(storePath)
 	if err != nil {
 		return nil, err
 	}
 
-	ik, _ := st.EnsureIdentity()
 	m := &Manager{
 		store:     st,
-		transport: NewDummyTransport(),
-		localPeer: NewPeerWithIdentity(peerName, ik),
-		sessions:  map[string]*Session{},
+		transport:  t,
+		localPeer:  newPeer(peerName),
+		sessions:   map[string]*Session{},
+		outboxWake: make(chan struct{}, 1),
+	}
+	// gesperrter Store: Schlüssel erst mit Unlock, Initialise danach; bis
+	// dahin nimmt der Transport nichts an und Absender behalten ihren Ausgang
+	if st.Locked() {
+		m.pause(true)
+	} else if err := m.open(); err != nil {
+		return nil, err
+	}
+	if a, ok := t.(interface{ SetAcceptor(func([]byte) *Session) }); ok {
+		a.SetAcceptor(func([]byte) *Session { return m.newSession() })
+	}
+	if r, ok := t.(reachability); ok {
+		r.OnReachable(m.markReachable)
 	}
 	return m, nil
 }
 
+// open lädt Identität und Pre-Keys in den lokalen Peer und wendet die
+// Sync-Einstellung an.
+func (m *Manager) open() error {
+	ik, err := m.store.EnsureIdentity()
+	if err != nil {
+		return err
+	}
+	m.localPeer.setIdentity(ik)
+	if ks, err := m.store.LoadPreKeys(); err == nil {
+		m.localPeer.preKeys = ks
+	} else if err != ErrNoPreKeys {
+		return err
+	}
+	st, err := m.store.LoadSettings()
+	if err != nil {
+		return err
+	}
+	return m.store.SetSyncPolicy(st.LogSync)
+}
+
 // Public bootstrap for App.startup()
 func (m *Manager) Initialise() error {
+	if err := m.refreshPreKeys(); err != nil {
+		return err
+	}
 	if err := m.restoreAllContacts(); err != nil {
 		return err
 	}
@@ -46,6 +122,14 @@ func (m *Manager) Initialise() error {
 
 // ───────────────────────── Persistence ───────────────────────────
 
+// Signed-Pre-Key rotieren, OPK-Pool auffüllen und verschlüsselt ablegen.
+func (m *Manager) refreshPreKeys() error {
+	if err := m.localPeer.RefreshPreKeys(); err != nil {
+		return err
+	}
+	return m.store.SavePreKeys(m.localPeer.preKeys)
+}
+
 func (m *Manager) restoreAllContacts() error {
     contacts, err := m.store.ListContacts()
     if err != nil {
@@ -54,32 +138,47 @@ func (m *Manager) restoreAllContacts() error {
 
     for _, c := range contacts {
         st, err := m.store.LoadSession(c.IDPub)
-        if err != nil {
+        if errors.Is(err, ErrNoSession) {
             continue // noch kein state.bin
+        } else if err != nil {
+            log.Printf("[Manager] !! session for %s: %v", b64(c.IDPub), err)
+            continue
         }
 
-        s := NewSessionFromPeer(m.localPeer, m.transport, m.store)
+        s := m.newSession()
         s.Restore(c.IDPub, st)
-        m.sessions[b64(c.IDPub)] = s
+        m.setSession(b64(c.IDPub), s)
     }
     return nil
 }
 
 // ───────────────────────── Demo-Kontakt Bob ──────────────────────
 
+const demoBobDir = "demo-bob"
+
 func (m *Manager) addDemoBob() error {
+	// Bob lebt nur im Prozess – über echte Transports gibt es ihn nicht
+	if _, ok := m.transport.(*DummyTransport); !ok {
+		return nil
+	}
 	seed := sha256.Sum256([]byte("fixedSeedForDemo"))
 	bobPriv, _ := ecdh.X25519().NewPrivateKey(seed[:])
 	bobPeer    := NewPeerWithIdentity("Bob", bobPriv)
 	key        := b64(bobPeer.IdentityPublicKey())
 
-	if _, ok := m.sessions[key]; ok {
+	if _, ok := m.session(key); ok {
     return nil
 	}
 	// einmaliger Demo-Handshake:
 	//   1) Alice → Bob
-	aliceSess := NewSessionFromPeer(m.localPeer, m.transport, m.store)
-	bobSess   := NewSessionFromPeer(bobPeer,   m.transport, m.store)
+	aliceSess := m.newSession()
+	// Bob bekommt einen eigenen Store, damit sein Pre-Key-Material
+	// nicht über Alices prekeys.bin schreibt.
+	bobStore, err := NewStore(filepath.Join(m.store.basePath, demoBobDir))
+	if err != nil {
+		return err
+	}
+	bobSess   := NewSessionFromPeer(bobPeer,   m.transport, bobStore)
 
 	if err := aliceSess.StartHandshake(bobSess.LocalBundle()); err != nil {
 		return err
@@ -90,12 +189,29 @@ func (m *Manager) addDemoBob() error {
 		return err
 	}
 
-	m.sessions[key] = aliceSess
+	m.setSession(key, aliceSess)
 	return m.store.AddContactIfMissing("Bob", bobPeer.IdentityPublicKey())
 }
 
 // ───────────────────────── External API ──────────────────────────
 
+// SetErrorHandler registriert einen Callback für Fehler beim Empfang
+// (manipulierte oder nicht entschlüsselbare Nachrichten).
+func (m *Manager) SetErrorHandler(fn func(idB64 string, err error)) {
+	m.onError = fn
+}
+
+// SetKeyChangeHandler registriert einen Callback für geänderte Identity-Keys.
+func (m *Manager) SetKeyChangeHandler(fn func(idB64 string)) {
+	m.onKeyChange = fn
+}
+
+// SetHistoryHandler registriert einen Callback für neue Nachrichten und
+// Quittungen.
+func (m *Manager) SetHistoryHandler(fn func(idB64 string)) {
+	m.onHistory = fn
+}
+
 func (m *Manager) Contacts() ([]*Contact, error) {
 	list, err := m.store.ListContacts()
 	if err != nil { return nil, err }
@@ -106,14 +222,223 @@ func (m *Manager) Contacts() ([]*Contact, error) {
 	return list, nil
 }
 
+// ───────────────────────── Verifikation ──────────────────────────
+
+// Fingerprint liefert Sicherheitsnummer, Emoji und QR-Payload für einen Kontakt.
+func (m *Manager) Fingerprint(idB64 string) (*Fingerprint, error) {
+	c, err := m.contactFor(idB64)
+	if err != nil {
+		return nil, err
+	}
+	fp := NewFingerprint(m.account(), c.IDPub)
+	fp.Verified = c.Verified
+	return fp, nil
+}
+
+// VerifyQR vergleicht den gescannten QR-Code des Gegenübers und markiert
+// den Kontakt bei Übereinstimmung als verifiziert.
+func (m *Manager) VerifyQR(idB64, payload string) error {
+	c, err := m.contactFor(idB64)
+	if err != nil {
+		return err
+	}
+	if err := MatchQR(m.account(), c.IDPub, payload); err != nil {
+		return err
+	}
+	return m.setVerified(c, true)
+}
+
+// SetVerified markiert einen Kontakt manuell als (un)verifiziert,
+// z. B. nach Vorlesen der Sicherheitsnummer.
+func (m *Manager) SetVerified(idB64 string, verified bool) error {
+	c, err := m.contactFor(idB64)
+	if err != nil {
+		return err
+	}
+	return m.setVerified(c, verified)
+}
+
+func (m *Manager) setVerified(c *Contact, verified bool) error {
+	log.Printf("[Manager] SetVerified(id=%s) = %v", b64(c.IDPub), verified)
+	c.Verified = verified
+	c.VerifiedAt = time.Time{}
+	if verified {
+		c.VerifiedAt = time.Now()
+		// bestätigt den aktuellen Key; ein vorgemerkter muss eigens
+		// angenommen werden
+		if c.PendingKey == nil {
+			c.KeyChanged = false
+		}
+	}
+	return m.store.SaveContact(c)
+}
+
+// AcknowledgeKeyChange nimmt einen vorgemerkten Key-Wechsel an: Verlauf
+// und Kontakt ziehen zum neuen Key um, Session und Ausgang des alten
+// werden vernichtet. Liefert die neue ID des Kontakts.
+func (m *Manager) AcknowledgeKeyChange(idB64 string) (string, error) {
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	c, err := m.contactFor(idB64)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("[Manager] AcknowledgeKeyChange(id=%s)", idB64)
+	if c.PendingKey == nil {
+		c.KeyChanged = false // Wechsel aus älteren Versionen, schon umgezogen
+		return idB64, m.store.SaveContact(c)
+	}
+
+	newID := b64(c.PendingKey)
+	if _, err := m.store.ReplaceContactKey(c.IDPub, c.PendingKey); err != nil {
+		return "", err
+	}
+	m.dropSession(c.IDPub)
+	m.historyChanged(c.PendingKey)
+	return newID, nil
+}
+
+// RejectKeyChange verwirft einen vorgemerkten Key-Wechsel. Der alte Key
+// bleibt gültig, was unter dem neuen angekommen ist, wird vernichtet.
+func (m *Manager) RejectKeyChange(idB64 string) error {
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	c, err := m.contactFor(idB64)
+	if err != nil {
+		return err
+	}
+	if c.PendingKey == nil {
+		return fmt.Errorf("no pending key change for %s", c.Name)
+	}
+	log.Printf("[Manager] RejectKeyChange(id=%s) pending=%s", idB64, b64(c.PendingKey))
+	pending := c.PendingKey
+	c.PendingKey, c.KeyChanged = nil, false
+	if err := m.store.SaveContact(c); err != nil {
+		return err
+	}
+	m.dropSession(pending)
+	return m.store.ShredContact(pending)
+}
+
+// DeleteContact löscht einen Kontakt samt Verlauf, Sessions und Ausgang,
+// auch zu seinen weiteren Geräten. Der Kontakt-Key wird vernichtet, der
+// Verlauf ist damit auch aus Sicherungen nicht mehr lesbar.
+func (m *Manager) DeleteContact(idB64 string) error {
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	c, err := m.contactFor(idB64)
+	if err != nil {
+		return err
+	}
+	log.Printf("[Manager] DeleteContact(id=%s)", idB64)
+
+	ids := [][]byte{c.IDPub}
+	for _, d := range c.Devices {
+		ids = append(ids, d.IDPub)
+	}
+	if c.PendingKey != nil {
+		ids = append(ids, c.PendingKey)
+	}
+	for _, id := range ids {
+		m.dropSession(id)
+		if err := m.store.ShredContact(id); err != nil {
+			return err
+		}
+	}
+	m.historyChanged(c.IDPub)
+	return nil
+}
+
+func (m *Manager) contactFor(idB64 string) (*Contact, error) {
+	id, err := base64.RawURLEncoding.DecodeString(idB64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid contact ID: %w", err)
+	}
+	return m.store.LoadContact(id)
+}
+
 func (m *Manager) Send(idB64, text string) error {
 	log.Printf("[Manager] Send(id=%s) text=%q", idB64, text)
+	return m.sendWith(idB64, func(sess *Session) error {
+		return sess.Send([]byte(text))
+	})
+}
+
+// EditMessage ersetzt den Text einer eigenen Nachricht, auch beim Kontakt.
+func (m *Manager) EditMessage(idB64, msgID, text string) error {
+	log.Printf("[Manager] EditMessage(id=%s) ref=%s text=%q", idB64, msgID, text)
+	return m.sendWith(idB64, func(sess *Session) error {
+		return sess.SendEdit(msgID, text)
+	})
+}
+
+// DeleteMessage löscht eine eigene Nachricht für alle; lokal bleibt nur
+// ein Grabstein im Verlauf.
+func (m *Manager) DeleteMessage(idB64, msgID string) error {
+	log.Printf("[Manager] DeleteMessage(id=%s) ref=%s", idB64, msgID)
+	return m.sendWith(idB64, func(sess *Session) error {
+		return sess.SendDelete(msgID)
+	})
+}
+
+// Reply antwortet auf eine Nachricht und zitiert sie.
+func (m *Manager) Reply(idB64, msgID, text string) error {
+	log.Printf("[Manager] Reply(id=%s) ref=%s text=%q", idB64, msgID, text)
+	return m.sendWith(idB64, func(sess *Session) error {
+		return sess.SendReply(msgID, text)
+	})
+}
+
+// React setzt oder ersetzt die eigene Reaktion auf eine Nachricht.
+func (m *Manager) React(idB64, msgID, emoji string) error {
+	log.Printf("[Manager] React(id=%s) ref=%s %q", idB64, msgID, emoji)
+	return m.sendWith(idB64, func(sess *Session) error {
+		return sess.SendReaction(msgID, emoji)
+	})
+}
+
+// RemoveReaction nimmt die eigene Reaktion zurück.
+func (m *Manager) RemoveReaction(idB64, msgID string) error {
+	log.Printf("[Manager] RemoveReaction(id=%s) ref=%s", idB64, msgID)
+	return m.sendWith(idB64, func(sess *Session) error {
+		return sess.RemoveReaction(msgID)
+	})
+}
+
+// sendWith prüft die Sendesperre nach einem Key-Wechsel und meldet
+// eingereihte Nachrichten als Erfolg.
+func (m *Manager) sendWith(idB64 string, send func(*Session) error) error {
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	if m.store.Locked() {
+		return ErrLocked
+	}
+	return m.sendWithLocked(idB64, send)
+}
+
+// sendWithLocked ist sendWith für Aufrufer, die lockMu schon halten.
+func (m *Manager) sendWithLocked(idB64 string, send func(*Session) error) error {
+	if c, err := m.contactFor(idB64); err == nil && c.KeyChanged {
+		log.Printf("[Manager] !! Send blocked: safety number of %s changed", idB64)
+		return ErrSafetyNumberChanged
+	}
     sess, err := m.sessionFor(idB64)
     if err != nil {
 			log.Printf("[Manager] !! Send aborted: %v", err)
         return err
     }
-    return sess.Send([]byte(text))
+	err = send(sess)
+	m.wakeOutbox() // Ablaufzeit neuer Nachrichten einplanen
+	if errors.Is(err, ErrQueued) {
+		// kein Fehler für die UI: die Nachricht steht als „queued“ im Verlauf
+		log.Printf("[Manager] %v", err)
+		m.outboxChanged(idB64)
+		return nil
+	}
+	if err != nil {
+		m.outboxChanged(idB64) // abgelehnt: steht als fehlgeschlagen im Ausgang
+	}
+	return err
 }
 func (m *Manager) Messages(idB64 string, since int64) ([]PlainMessage, error) {
 	log.Printf("[Manager] Messages(id=%s since=%d)", idB64, since)
@@ -126,9 +451,36 @@ func (m *Manager) Messages(idB64 string, since int64) ([]PlainMessage, error) {
     return sess.LoadPlainMessages(id, time.Unix(0, since))
 }
 
+// MessagesPage liefert eine Seite des Verlaufs mit idB64, ohne das ganze
+// Log zu lesen. Cursor 0 mit PageOlder sind die neuesten limit Nachrichten.
+func (m *Manager) MessagesPage(idB64 string, cursor uint64, limit int, dir string) (*MessagePage, error) {
+	log.Printf("[Manager] MessagesPage(id=%s cursor=%d limit=%d dir=%s)", idB64, cursor, limit, dir)
+	sess, err := m.sessionFor(idB64)
+	if err != nil {
+		log.Printf("[Manager] !! MessagesPage aborted: %v", err)
+		return nil, err
+	}
+	id, _ := base64.RawURLEncoding.DecodeString(idB64)
+	return sess.LoadPlainPage(id, cursor, limit, PageDirection(dir))
+}
+
 // ----------------------------------------------------------------
 
+// sessionFor liefert die Session zu einem Kontakt, samt Kopien an seine
+// weiteren Geräte und unsere eigenen.
 func (m *Manager) sessionFor(idB64 string) (*Session, error) {
+	s, err := m.deviceSession(idB64)
+	if err != nil {
+		return nil, err
+	}
+	m.attachDevices(s)
+	return s, nil
+}
+
+func (m *Manager) deviceSession(idB64 string) (*Session, error) {
+    // gesperrt bis zum Eintragen, sonst laden zwei Aufrufer dieselbe Session
+    m.sessMu.Lock()
+    defer m.sessMu.Unlock()
     log.Printf("[Manager] sessionFor(id=%s) – sessions keys: %v", idB64, keys(m.sessions))
     if s, ok := m.sessions[idB64]; ok {
         log.Printf("[Manager]  → found in-memory session for %s", idB64)
@@ -144,7 +496,7 @@ func (m *Manager) sessionFor(idB64 string) (*Session, error) {
     }
     if st, err := m.store.LoadSession(id); err == nil {
         log.Printf("[Manager]  → restored session from disk for %s", idB64)
-        s := NewSessionFromPeer(m.localPeer, m.transport, m.store)
+        s := m.newSession()
         s.Restore(id, st)
         m.sessions[idB64] = s
         return s, nil
@@ -154,6 +506,90 @@ func (m *Manager) sessionFor(idB64 string) (*Session, error) {
     return nil, fmt.Errorf("no session for peer %s", idB64)
 }
 
+func (m *Manager) newSession() *Session {
+	s := NewSessionFromPeer(m.localPeer, m.transport, m.store)
+	s.OnError = m.reportError
+	s.OnInit = m.handleInit
+	s.OnUpdate = m.historyChanged
+	s.OnGroup = m.groupChanged
+	s.Owner = m.store.ownerOf
+	s.OnDevices = m.connectDevices
+	s.OnLinked = func([]byte) { m.devicesChanged() }
+	return s
+}
+
+// handleInit setzt Trust-on-first-use um: ein unbekannter Key wird als
+// neuer Kontakt gemerkt. Meldet sich jemand unter dem Namen eines
+// bekannten Kontakts mit anderem Key, wird der Key nur vorgemerkt und der
+// Kontakt gesperrt; der Name ist nicht authentisiert, deshalb bleiben
+// alter Key, Session und Verlauf unangetastet, bis der Nutzer entscheidet.
+func (m *Manager) handleInit(remoteID []byte, claimedName string) error {
+	if _, err := m.store.LoadContact(remoteID); err == nil {
+		return nil
+	} else if err != ErrNoContact {
+		return err
+	}
+	// eigene Geräte und weitere Geräte bekannter Kontakte sind keine neuen
+	// Kontakte; ein Gerät mit offenem Link-Code wartet auf sein Primärgerät
+	st, err := m.store.LoadDeviceState()
+	if err != nil {
+		return err
+	}
+	if st.Link != nil || st.own(remoteID) || m.store.ownerOf(remoteID) != nil {
+		return nil
+	}
+
+	old, err := m.store.FindContactByName(claimedName)
+	if claimedName == "" || err == ErrNoContact {
+		log.Printf("[Manager] new contact %q (%s), trusting first key", claimedName, b64(remoteID))
+		return m.store.AddContactIfMissing(cmp.Or(claimedName, "Unknown"), remoteID)
+	} else if err != nil {
+		return err
+	}
+
+	log.Printf("[Manager] !! %q claims a new identity key: %s → %s, waiting for the user",
+		claimedName, b64(old.IDPub), b64(remoteID))
+	old.PendingKey = remoteID
+	old.KeyChanged = true
+	if err := m.store.SaveContact(old); err != nil {
+		return err
+	}
+
+	if m.onKeyChange != nil {
+		m.onKeyChange(b64(old.IDPub))
+	}
+	return nil
+}
+
+// session liefert die Session zu idB64, sofern sie im Speicher ist.
+func (m *Manager) session(idB64 string) (*Session, bool) {
+	m.sessMu.Lock()
+	defer m.sessMu.Unlock()
+	s, ok := m.sessions[idB64]
+	return s, ok
+}
+
+func (m *Manager) setSession(idB64 string, s *Session) {
+	m.sessMu.Lock()
+	m.sessions[idB64] = s
+	m.sessMu.Unlock()
+}
+
+// dropSession vergisst die Session zu id im Speicher.
+func (m *Manager) dropSession(id []byte) {
+	m.sessMu.Lock()
+	delete(m.sessions, b64(id))
+	m.sessMu.Unlock()
+	m.localPeer.dropState(id)
+}
+
+func (m *Manager) reportError(remoteID []byte, err error) {
+	log.Printf("[Manager] !! receive from %s failed: %v", b64(remoteID), err)
+	if m.onError != nil {
+		m.onError(b64(remoteID), err)
+	}
+}
+
 func keys(m map[string]*Session) []string {
     out := make([]string, 0, len(m))
     for k := range m {
@@ -162,3 +598,1229 @@ func keys(m map[string]*Session) []string {
     return out
 }
 
+
+// ───────────────────────── Ausgang ───────────────────────────────
+
+// PendingMessage ist die UI-Sicht auf einen Ausgangs-Eintrag.
+type PendingMessage struct {
+	ID       string    `json:"id"`
+	State    string    `json:"state"`
+	Attempts int       `json:"attempts"`
+	NextTry  time.Time `json:"next_try"`
+	LastErr  string    `json:"last_err,omitempty"`
+}
+
+// SetOutboxHandler registriert einen Callback für Änderungen im Ausgang.
+func (m *Manager) SetOutboxHandler(fn func(idB64 string)) {
+	m.onOutbox = fn
+}
+
+// Pending liefert die noch nicht zugestellten Nachrichten eines Kontakts.
+func (m *Manager) Pending(idB64 string) ([]PendingMessage, error) {
+	id, err := base64.RawURLEncoding.DecodeString(idB64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid contact ID: %w", err)
+	}
+	list, err := m.store.LoadOutbox(id)
+	if err != nil {
+		return nil, err
+	}
+	var out []PendingMessage
+	for _, e := range list {
+		if e.pending() && e.Group == nil {
+			out = append(out, PendingMessage{e.ID, e.State, e.Attempts, e.NextTry, e.LastErr})
+		}
+	}
+	return out, nil
+}
+
+// CancelMessage verwirft eine wartende Nachricht.
+func (m *Manager) CancelMessage(idB64, msgID string) error {
+	return m.updateEntry(idB64, msgID, func(e *OutboxEntry) {
+		e.State = OutboxCancelled
+	})
+}
+
+// RetryMessage stellt eine (fehlgeschlagene) Nachricht sofort wieder an.
+func (m *Manager) RetryMessage(idB64, msgID string) error {
+	err := m.updateEntry(idB64, msgID, func(e *OutboxEntry) {
+		e.State, e.Attempts, e.NextTry = OutboxQueued, 0, time.Now()
+	})
+	if err == nil {
+		m.wakeOutbox()
+	}
+	return err
+}
+
+func (m *Manager) updateEntry(idB64, msgID string, fn func(e *OutboxEntry)) error {
+	id, err := base64.RawURLEncoding.DecodeString(idB64)
+	if err != nil {
+		return fmt.Errorf("invalid contact ID: %w", err)
+	}
+	err = m.store.UpdateOutbox(id, func(list []*OutboxEntry) ([]*OutboxEntry, error) {
+		for _, e := range list {
+			if e.ID == msgID && e.pending() {
+				fn(e)
+				e.Updated = time.Now().UTC()
+				return list, nil
+			}
+		}
+		return nil, fmt.Errorf("no pending message %s", msgID)
+	})
+	if err == nil {
+		m.outboxChanged(idB64)
+	}
+	return err
+}
+
+// StartOutbox startet den Hintergrund-Worker, der wartende Nachrichten
+// mit exponentiellem Backoff erneut zustellt.
+func (m *Manager) StartOutbox(ctx context.Context) {
+	go func() {
+		for {
+			next := m.work(time.Now())
+			wait := outboxMaxDelay
+			if !next.IsZero() {
+				wait = max(time.Until(next), 0)
+			}
+			t := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				t.Stop()
+				if err := m.store.SyncLogs(); err != nil {
+					log.Printf("[Manager] !! sync logs: %v", err)
+				}
+				return
+			case <-m.outboxWake:
+				t.Stop()
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// work ist ein Durchgang des Workers. Gesperrt ruht er, Unlock weckt ihn.
+func (m *Manager) work(now time.Time) (next time.Time) {
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	if m.store.Locked() {
+		return time.Time{}
+	}
+	next = m.flushOutbox(now)
+	m.resumeUploads()
+	if err := m.store.PruneAttachments(now); err != nil {
+		log.Printf("[Manager] !! prune attachments: %v", err)
+	}
+	expired, due, err := m.store.ExpireMessages(now)
+	if err != nil {
+		log.Printf("[Manager] !! expire messages: %v", err)
+	}
+	for _, id := range expired {
+		m.historyChanged(id)
+	}
+	if !due.IsZero() && (next.IsZero() || due.Before(next)) {
+		next = due
+	}
+	groups, due, err := m.store.ExpireGroupMessages(now)
+	if err != nil {
+		log.Printf("[Manager] !! expire group messages: %v", err)
+	}
+	for _, g := range groups {
+		m.groupChanged(g)
+	}
+	if !due.IsZero() && (next.IsZero() || due.Before(next)) {
+		next = due
+	}
+	if err := m.store.SyncLogs(); err != nil {
+		log.Printf("[Manager] !! sync logs: %v", err)
+	}
+	return next
+}
+
+func (m *Manager) wakeOutbox() {
+	select {
+	case m.outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// markReachable zieht die nächsten Versuche für einen Peer vor, sobald der
+// Transport ihn wieder erreicht.
+func (m *Manager) markReachable(id []byte) {
+	changed := false
+	_ = m.store.UpdateOutbox(id, func(list []*OutboxEntry) ([]*OutboxEntry, error) {
+		now := time.Now()
+		for _, e := range list {
+			if e.State == OutboxQueued && e.NextTry.After(now) {
+				e.NextTry, changed = now, true
+			}
+		}
+		return list, nil
+	})
+	if changed || m.uploading(id) {
+		log.Printf("[Manager] %s reachable again → retrying outbox", b64(id))
+		m.wakeOutbox()
+	}
+}
+
+// flushOutbox versucht alle fälligen Nachrichten (pro Kontakt in
+// Reihenfolge, beim ersten Fehler ist für den Kontakt Schluss) und liefert
+// den nächsten fälligen Zeitpunkt.
+func (m *Manager) flushOutbox(now time.Time) (next time.Time) {
+	ids, err := m.store.OutboxContacts()
+	if err != nil {
+		log.Printf("[Manager] !! outbox: %v", err)
+		return
+	}
+	for _, id := range ids {
+		list, err := m.store.LoadOutbox(id)
+		if err != nil {
+			log.Printf("[Manager] !! outbox %s: %v", b64(id), err)
+			continue
+		}
+
+		// Senden ohne Lock: der Empfang auf der Gegenseite darf selbst senden
+		results := map[string]error{}
+		for _, e := range list {
+			if e.State != OutboxQueued {
+				continue
+			}
+			if e.NextTry.After(now) {
+				break
+			}
+			err := m.sendEntry(id, e)
+			results[e.ID] = err
+			if err != nil {
+				break
+			}
+		}
+		if len(results) > 0 {
+			_ = m.store.UpdateOutbox(id, func(list []*OutboxEntry) ([]*OutboxEntry, error) {
+				for _, e := range list {
+					err, tried := results[e.ID]
+					if !tried || e.State != OutboxQueued {
+						continue
+					}
+					e.Attempts++
+					e.Updated = now.UTC()
+					switch {
+					case err == nil:
+						e.State, e.LastErr = OutboxSent, ""
+					case !retryable(err) || e.Attempts >= outboxMaxAttempts:
+						e.State, e.LastErr = OutboxFailed, err.Error()
+					default:
+						e.NextTry, e.LastErr = now.Add(backoff(e.Attempts)), err.Error()
+					}
+					log.Printf("[Manager] outbox %s msg=%.8s attempt=%d state=%s", b64(id), e.ID, e.Attempts, e.State)
+				}
+				return list, nil
+			})
+			m.outboxChanged(b64(id))
+		}
+
+		list, _ = m.store.LoadOutbox(id)
+		for _, e := range list {
+			if e.State == OutboxQueued && (next.IsZero() || e.NextTry.Before(next)) {
+				next = e.NextTry
+			}
+		}
+	}
+	return next
+}
+
+func (m *Manager) sendEntry(id []byte, e *OutboxEntry) error {
+	if e.Group == nil {
+		return m.transport.SendCipher(id, e.Msg)
+	}
+	gs, ok := m.transport.(groupSender)
+	if !ok {
+		return ErrNoGroupTransport
+	}
+	return gs.SendGroup(id, *e.Group)
+}
+
+func (m *Manager) outboxChanged(idB64 string) {
+	if m.onOutbox != nil {
+		m.onOutbox(idB64)
+	}
+}
+
+// ───────────────────────── Quittungen ────────────────────────────
+
+// MarkRead markiert alle eingehenden Nachrichten eines Kontakts als
+// gelesen und schickt eine Lesebestätigung, sofern weder global noch
+// für den Kontakt abgeschaltet.
+func (m *Manager) MarkRead(idB64 string) error {
+	c, err := m.contactFor(idB64)
+	if err != nil {
+		return err
+	}
+	msgs, err := m.store.LoadMessages(c.IDPub, time.Time{})
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, mm := range msgs {
+		if !mm.Out && mm.Status != StatusRead {
+			ids = append(ids, mm.msgID())
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	log.Printf("[Manager] MarkRead(id=%s) n=%d", idB64, len(ids))
+	if err := m.store.SetMessageStatus(c.IDPub, false, StatusRead, ids...); err != nil {
+		return err
+	}
+
+	settings, err := m.store.LoadSettings()
+	if err != nil {
+		return err
+	}
+	if !settings.ReadReceipts || c.NoReadReceipts {
+		return nil
+	}
+	sess, err := m.sessionFor(idB64)
+	if err != nil {
+		return err
+	}
+	if err := sess.SendReceipt(StatusRead, ids...); errors.Is(err, ErrQueued) {
+		m.outboxChanged(idB64)
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (m *Manager) Settings() (*Settings, error) {
+	return m.store.LoadSettings()
+}
+
+// SetReadReceipts schaltet Lesebestätigungen global an oder ab.
+func (m *Manager) SetReadReceipts(enabled bool) error {
+	st, err := m.store.LoadSettings()
+	if err != nil {
+		return err
+	}
+	st.ReadReceipts = enabled
+	return m.store.SaveSettings(st)
+}
+
+// SetLogSync stellt ein, wann der Verlauf auf die Platte gezwungen wird
+// (always, batch oder none). Zustandsdateien betrifft das nicht.
+func (m *Manager) SetLogSync(policy string) error {
+	p := SyncPolicy(policy)
+	if err := m.store.SetSyncPolicy(p); err != nil {
+		return err
+	}
+	st, err := m.store.LoadSettings()
+	if err != nil {
+		return err
+	}
+	st.LogSync = p
+	return m.store.SaveSettings(st)
+}
+
+// SetContactReadReceipts schaltet Lesebestätigungen für einen Kontakt
+// an oder ab; die globale Einstellung hat Vorrang.
+func (m *Manager) SetContactReadReceipts(idB64 string, enabled bool) error {
+	c, err := m.contactFor(idB64)
+	if err != nil {
+		return err
+	}
+	c.NoReadReceipts = !enabled
+	return m.store.SaveContact(c)
+}
+
+// SetExpireTimer stellt verschwindende Nachrichten für einen Kontakt ein
+// (Sekunden, 0 = aus); der Kontakt übernimmt denselben Timer.
+func (m *Manager) SetExpireTimer(idB64 string, seconds uint32) error {
+	log.Printf("[Manager] SetExpireTimer(id=%s) %ds", idB64, seconds)
+	return m.sendWith(idB64, func(sess *Session) error {
+		return sess.SendTimer(seconds)
+	})
+}
+
+func (m *Manager) historyChanged(remoteID []byte) {
+	if m.onHistory != nil {
+		m.onHistory(b64(remoteID))
+	}
+	// eine neue Nachricht kann früher ablaufen, als der Worker schläft
+	m.wakeOutbox()
+}
+
+// ───────────────────────── Anhänge ───────────────────────────────
+
+// SendAttachment verschickt eine Datei; Bild-Metadaten werden vorher
+// entfernt, die Größe ist durch Settings.MaxAttachmentSize begrenzt.
+func (m *Manager) SendAttachment(idB64, name, mime string, data []byte) error {
+	log.Printf("[Manager] SendAttachment(id=%s) %q %dB", idB64, name, len(data))
+	return m.sendWith(idB64, func(sess *Session) error {
+		return sess.SendAttachment(name, mime, data)
+	})
+}
+
+// Attachment liefert den entschlüsselten Inhalt eines Anhangs.
+func (m *Manager) Attachment(blob string) (*AttachmentInfo, []byte, error) {
+	a, data, err := m.store.OpenAttachment(blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	return a.info(), data, nil
+}
+
+// DeleteAttachment löscht die lokale Kopie; die Nachricht bleibt im
+// Verlauf stehen.
+func (m *Manager) DeleteAttachment(blob string) error {
+	log.Printf("[Manager] DeleteAttachment(%s)", blob)
+	return m.store.DeleteAttachment(blob)
+}
+
+// SetMaxAttachmentSize setzt die Obergrenze für ein- und ausgehende Anhänge.
+func (m *Manager) SetMaxAttachmentSize(n int64) error {
+	if n <= 0 {
+		return fmt.Errorf("invalid attachment size limit %d", n)
+	}
+	st, err := m.store.LoadSettings()
+	if err != nil {
+		return err
+	}
+	st.MaxAttachmentSize = n
+	return m.store.SaveSettings(st)
+}
+
+// resumeUploads setzt abgebrochene Uploads fort, sobald der Ausgang des
+// Kontakts leer ist – der Zeiger muss vor den Chunks ankommen.
+func (m *Manager) resumeUploads() {
+	list, err := m.store.ListAttachments()
+	if err != nil {
+		log.Printf("[Manager] !! attachments: %v", err)
+		return
+	}
+	failed := map[string]bool{}
+	for _, a := range list {
+		id := b64(a.Contact)
+		if !a.Out || a.State != AttachmentUploading || failed[id] || m.store.HasPending(a.Contact) {
+			continue
+		}
+		if err := m.store.upload(m.transport, a); err != nil {
+			log.Printf("[Manager] upload %s to %s: %v", a.Blob, id, err)
+			failed[id] = true
+		}
+		m.historyChanged(a.Contact)
+	}
+}
+
+func (m *Manager) uploading(id []byte) bool {
+	list, _ := m.store.ListAttachments()
+	for _, a := range list {
+		if a.Out && a.State == AttachmentUploading && bytes.Equal(a.Contact, id) {
+			return true
+		}
+	}
+	return false
+}
+
+// ───────────────────────── Gruppen ───────────────────────────────
+
+// SetGroupHandler registriert einen Callback für neue Gruppennachrichten
+// und geänderte Gruppen.
+func (m *Manager) SetGroupHandler(fn func(groupID string)) {
+	m.onGroup = fn
+}
+
+func (m *Manager) Groups() ([]*GroupInfo, error) {
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	if m.store.Locked() {
+		return nil, ErrLocked
+	}
+	list, err := m.store.ListGroups()
+	if err != nil {
+		return nil, err
+	}
+	out := []*GroupInfo{}
+	for _, g := range list {
+		out = append(out, g.info(m.self()))
+	}
+	return out, nil
+}
+
+// CreateGroup legt eine Gruppe mit den angegebenen Kontakten an und
+// verteilt den ersten eigenen Sender-Key.
+func (m *Manager) CreateGroup(name string, memberIDs []string) (*GroupInfo, error) {
+	log.Printf("[Manager] CreateGroup(%q) n=%d", name, len(memberIDs))
+	if name == "" || len(name) > maxGroupNameLen {
+		return nil, fmt.Errorf("invalid group name %q", name)
+	}
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	if m.store.Locked() {
+		return nil, ErrLocked
+	}
+	g := &Group{
+		ID:      uuid.NewString(),
+		Name:    name,
+		Members: [][]byte{m.self()},
+		Created: time.Now().UTC(),
+	}
+	for _, idB64 := range memberIDs {
+		id, err := m.groupMember(g, idB64)
+		if err != nil {
+			return nil, err
+		}
+		g.Members = append(g.Members, id)
+	}
+	defer m.store.lockGroup(g.ID)()
+	if err := m.rotateSenderKey(g); err != nil {
+		return nil, err
+	}
+	m.groupChanged(g.ID)
+	return g.info(m.self()), nil
+}
+
+// AddGroupMember nimmt einen Kontakt auf; alle Mitglieder rotieren ihren
+// Sender-Key, der neue bekommt nur die neuen.
+func (m *Manager) AddGroupMember(groupID, idB64 string) error {
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	if m.store.Locked() {
+		return ErrLocked
+	}
+	defer m.store.lockGroup(groupID)()
+	g, err := m.activeGroup(groupID)
+	if err != nil {
+		return err
+	}
+	id, err := m.groupMember(g, idB64)
+	if err != nil {
+		return err
+	}
+	log.Printf("[Manager] AddGroupMember(%s) %s", groupID, idB64)
+	g.Members = append(g.Members, id)
+	if err := m.rotateSenderKey(g); err != nil {
+		return err
+	}
+	m.groupChanged(g.ID)
+	return nil
+}
+
+// RemoveGroupMember entfernt ein Mitglied. Es erfährt davon, bekommt aber
+// keinen der neuen Sender-Keys.
+func (m *Manager) RemoveGroupMember(groupID, idB64 string) error {
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	if m.store.Locked() {
+		return ErrLocked
+	}
+	defer m.store.lockGroup(groupID)()
+	g, err := m.activeGroup(groupID)
+	if err != nil {
+		return err
+	}
+	id, err := base64.RawURLEncoding.DecodeString(idB64)
+	if err != nil {
+		return fmt.Errorf("invalid contact ID: %w", err)
+	}
+	if !g.isMember(id) || bytes.Equal(id, m.self()) {
+		return ErrNotMember
+	}
+	log.Printf("[Manager] RemoveGroupMember(%s) %s", groupID, idB64)
+	g.Members = slices.DeleteFunc(g.Members, func(x []byte) bool { return bytes.Equal(x, id) })
+	if err := m.rotateSenderKey(g); err != nil {
+		return err
+	}
+	m.distribute(g, [][]byte{id}, nil)
+	m.groupChanged(g.ID)
+	return nil
+}
+
+// LeaveGroup meldet uns bei allen Mitgliedern ab; der Verlauf bleibt.
+func (m *Manager) LeaveGroup(groupID string) error {
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	if m.store.Locked() {
+		return ErrLocked
+	}
+	defer m.store.lockGroup(groupID)()
+	g, err := m.activeGroup(groupID)
+	if err != nil {
+		return err
+	}
+	log.Printf("[Manager] LeaveGroup(%s)", groupID)
+	others := g.others(m.self())
+	g.Members = others
+	g.Left, g.Own, g.Rotate, g.Keys = true, nil, false, nil
+	if err := m.store.SaveGroup(g); err != nil {
+		return err
+	}
+	m.distribute(g, others, nil)
+	m.groupChanged(g.ID)
+	return nil
+}
+
+// SendGroup verschlüsselt eine Textnachricht einmal mit dem eigenen
+// Sender-Key und verteilt sie an alle Mitglieder.
+func (m *Manager) SendGroup(groupID, text string) error {
+	log.Printf("[Manager] SendGroup(%s) text=%q", groupID, text)
+	gs, ok := m.transport.(groupSender)
+	if !ok {
+		return ErrNoGroupTransport
+	}
+	env, err := newEnvelope(ContentText, textBody{Text: text})
+	if err != nil {
+		return err
+	}
+	plain := env.encode()
+
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	if m.store.Locked() {
+		return ErrLocked
+	}
+	g, gm, err := m.sealGroup(groupID, plain)
+	if err != nil {
+		return err
+	}
+	if err := m.store.AppendGroupMessage(g.ID, nil, env.ID, plain); err != nil {
+		return err
+	}
+
+	for _, id := range g.others(m.self()) {
+		// hinter wartenden 1:1-Nachrichten (evtl. dem Sender-Key) anstellen
+		err := ErrPeerUnreachable
+		if !m.store.HasPending(id) {
+			err = gs.SendGroup(id, *gm)
+		}
+		if err == nil {
+			continue
+		}
+		log.Printf("[Manager] group message to %s: %v", b64(id), err)
+		if !retryable(err) {
+			continue
+		}
+		if _, err := m.store.EnqueueGroup(id, env.ID, *gm); err != nil {
+			return err
+		}
+		m.wakeOutbox()
+	}
+	m.groupChanged(g.ID)
+	return nil
+}
+
+// sealGroup verschlüsselt plain mit dem eigenen Sender-Key und sichert
+// die weitergelaufene Chain, bevor irgendetwas rausgeht. Ein nötiger
+// neuer Sender-Key ist danach verteilt.
+func (m *Manager) sealGroup(groupID string, plain []byte) (*Group, *GroupMessage, error) {
+	defer m.store.lockGroup(groupID)()
+	g, err := m.activeGroup(groupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if g.Own == nil || g.Rotate {
+		if err := m.rotateSenderKey(g); err != nil {
+			return nil, nil, err
+		}
+	}
+	gm, err := g.Own.seal(g.ID, m.self(), plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	return g, gm, m.store.SaveGroup(g)
+}
+
+func (m *Manager) GroupMessages(groupID string, since int64) ([]PlainMessage, error) {
+	m.lockMu.RLock()
+	defer m.lockMu.RUnlock()
+	if m.store.Locked() {
+		return nil, ErrLocked
+	}
+	g, err := m.store.LoadGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := m.store.LoadGroupMessages(g.ID, time.Unix(0, since))
+	if err != nil {
+		return nil, err
+	}
+
+	// wartet eine Nachricht noch bei einem Mitglied, gilt sie als wartend
+	status := map[string]string{}
+	for _, id := range g.Members {
+		list, _ := m.store.LoadOutbox(id)
+		for _, e := range list {
+			if e.Group != nil && e.Group.Group == g.ID && e.pending() {
+				status[e.ID] = cmp.Or(status[e.ID], e.State)
+			}
+		}
+	}
+
+	var out []PlainMessage
+	for _, mm := range raw {
+		pm, err := plainMessage(m.store, mm)
+		if err != nil {
+			log.Println("  envelope-error:", err)
+			continue
+		}
+		pm.Status = status[pm.ID]
+		if mm.From != nil {
+			pm.From = b64(mm.From)
+		}
+		out = append(out, pm)
+	}
+	return out, nil
+}
+
+func (m *Manager) self() []byte {
+	return m.localPeer.IdentityPublicKey()
+}
+
+func (m *Manager) activeGroup(groupID string) (*Group, error) {
+	g, err := m.store.LoadGroup(groupID)
+	if err != nil {
+		return nil, err
+	}
+	if g.Left {
+		return nil, ErrNotMember
+	}
+	return g, nil
+}
+
+// groupMember prüft einen neuen Teilnehmer: bekannter Kontakt mit
+// Session und ohne ungeprüften Key-Wechsel.
+func (m *Manager) groupMember(g *Group, idB64 string) ([]byte, error) {
+	c, err := m.contactFor(idB64)
+	if err != nil {
+		return nil, err
+	}
+	if c.KeyChanged {
+		return nil, ErrSafetyNumberChanged
+	}
+	if g.isMember(c.IDPub) {
+		return nil, fmt.Errorf("%s is already a member", c.Name)
+	}
+	if len(g.Members) >= maxGroupMembers {
+		return nil, fmt.Errorf("group is limited to %d members", maxGroupMembers)
+	}
+	if _, err := m.sessionFor(idB64); err != nil {
+		return nil, err
+	}
+	return c.IDPub, nil
+}
+
+// rotateSenderKey erzeugt den nächsten eigenen Sender-Key und verteilt ihn
+// mit der aktuellen Mitgliederliste. Der Aufrufer hält lockGroup.
+func (m *Manager) rotateSenderKey(g *Group) error {
+	var epoch uint32
+	if g.Own != nil {
+		epoch = g.Own.Epoch + 1
+	}
+	k, err := newSenderKey(epoch)
+	if err != nil {
+		return err
+	}
+	log.Printf("[Manager] group %s: sender key epoch %d", g.ID, epoch)
+	g.Own, g.Rotate = k, false
+	if err := m.store.SaveGroup(g); err != nil {
+		return err
+	}
+	m.distribute(g, g.others(m.self()), k)
+	return nil
+}
+
+// distribute schickt Mitgliederliste und (optional) Sender-Key über die
+// 1:1-Sessions. Nicht erreichbare Mitglieder bekommen das Update aus dem
+// Ausgang; andere Fehler werden nur protokolliert. Der Aufrufer hält
+// lockMu.
+func (m *Manager) distribute(g *Group, to [][]byte, k *senderKey) {
+	u := &groupUpdate{Group: g.ID, Name: g.Name, Members: g.Members}
+	if k != nil {
+		u.Key = k.public()
+	}
+	for _, id := range to {
+		err := m.sendWithLocked(b64(id), func(sess *Session) error {
+			return sess.SendGroupUpdate(u)
+		})
+		if err != nil {
+			log.Printf("[Manager] !! group update to %s: %v", b64(id), err)
+		}
+	}
+}
+
+func (m *Manager) groupChanged(groupID string) {
+	if m.onGroup != nil {
+		m.onGroup(groupID)
+	}
+}
+
+// ───────────────────────── Geräte ────────────────────────────────
+
+// DeviceInfo ist die UI-Sicht auf ein Gerät des eigenen Kontos.
+type DeviceInfo struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Primary bool      `json:"primary"`
+	Current bool      `json:"current"` // dieses Gerät
+	Linked  time.Time `json:"linked,omitzero"`
+}
+
+// SetDeviceHandler registriert einen Callback für geänderte Gerätelisten
+// und die Verknüpfung dieses Geräts.
+func (m *Manager) SetDeviceHandler(fn func()) {
+	m.onDevices = fn
+}
+
+// Devices liefert die Geräte des eigenen Kontos, das Primärgerät zuerst.
+func (m *Manager) Devices() ([]*DeviceInfo, error) {
+	st, err := m.store.LoadDeviceState()
+	if err != nil {
+		return nil, err
+	}
+	self := m.self()
+	out := []*DeviceInfo{{
+		ID:      b64(st.account(self)),
+		Primary: true,
+		Current: st.Account == nil,
+	}}
+	if st.Account == nil {
+		out[0].Name = m.localPeer.Name
+	}
+	if st.List != nil {
+		for _, d := range st.List.Devices {
+			out = append(out, &DeviceInfo{
+				ID:      b64(d.IDPub),
+				Name:    d.Name,
+				Current: bytes.Equal(d.IDPub, self),
+				Linked:  d.Linked,
+			})
+		}
+	}
+	return out, nil
+}
+
+// LinkCode bereitet dieses (neue) Gerät auf die Verknüpfung vor und
+// liefert den Code, den das Primärgerät mit LinkDevice einliest – als
+// Text oder QR-Payload.
+func (m *Manager) LinkCode(deviceName string) (string, error) {
+	st, err := m.store.LoadDeviceState()
+	if err != nil {
+		return "", err
+	}
+	if st.Account != nil || (st.List != nil && len(st.List.Devices) > 0) {
+		return "", ErrAlreadyLinked
+	}
+	name := cmp.Or(deviceName, m.localPeer.Name)
+	if len(name) > maxDeviceNameLen {
+		return "", fmt.Errorf("invalid device name %q", name)
+	}
+
+	st.Link = make([]byte, linkSecretLen)
+	if _, err := rand.Read(st.Link); err != nil {
+		return "", err
+	}
+	if err := m.store.SaveDeviceState(st); err != nil {
+		return "", err
+	}
+	b := m.localPeer.Bundle()
+	b.OneTimePreKeyID, b.OneTimePreKey = 0, nil
+	req := &linkRequest{
+		Device: Device{IDPub: m.self(), Name: name, Bundle: b},
+		Secret: st.Link,
+	}
+	if a, ok := m.transport.(interface{ Address() string }); ok {
+		req.Device.Addr = a.Address()
+	}
+	log.Printf("[Manager] LinkCode(%q)", name)
+	return req.encode(), nil
+}
+
+// LinkDevice nimmt das Gerät hinter einem Link-Code in die Geräteliste
+// auf, schickt ihm Liste und Kontakte und kündigt es allen Kontakten an.
+func (m *Manager) LinkDevice(code string) error {
+	req, err := decodeLinkCode(code)
+	if err != nil {
+		return err
+	}
+	st, err := m.store.LoadDeviceState()
+	if err != nil {
+		return err
+	}
+	if st.Account != nil {
+		return ErrNotPrimary
+	}
+	self := m.self()
+	l := &DeviceList{Account: self}
+	if st.List != nil {
+		l = st.List.clone()
+	}
+	d := req.Device
+	if l.has(d.IDPub) {
+		return fmt.Errorf("%w: device is already linked", ErrBadLinkCode)
+	}
+	if _, err := m.store.LoadContact(d.IDPub); err == nil {
+		return fmt.Errorf("%w: key belongs to a contact", ErrBadLinkCode)
+	}
+	if len(l.Devices) >= maxDevices {
+		return fmt.Errorf("an account is limited to %d linked devices", maxDevices)
+	}
+	log.Printf("[Manager] LinkDevice(%s) %q", b64(d.IDPub), d.Name)
+
+	if err := m.connectDevice(d); err != nil {
+		return err
+	}
+	d.Linked = time.Now().UTC()
+	l.Devices = append(l.Devices, d)
+	l.Version++
+	l.sign(m.localPeer.signingPrivKey)
+
+	contacts, err := m.store.ListContacts()
+	if err != nil {
+		return err
+	}
+	// lehnt das Gerät ab (falsches Secret), bleibt die Liste unverändert
+	s, _ := m.session(b64(d.IDPub))
+	err = s.sendLink(&linkBody{Secret: req.Secret, List: *l, Contacts: contacts})
+	if err != nil {
+		m.sessMu.Lock()
+		delete(m.sessions, b64(d.IDPub))
+		m.sessMu.Unlock()
+		return err
+	}
+	st.List = l
+	if err := m.store.SaveDeviceState(st); err != nil {
+		return err
+	}
+	// erst jetzt kennt das neue Gerät die Kontakte, die sich gleich melden
+	m.announceDevices(l, d.IDPub)
+	m.devicesChanged()
+	return nil
+}
+
+// UnlinkDevice entfernt ein weiteres Gerät aus der Geräteliste. Es erfährt
+// davon und steht danach wieder für sich.
+func (m *Manager) UnlinkDevice(idB64 string) error {
+	id, err := base64.RawURLEncoding.DecodeString(idB64)
+	if err != nil {
+		return fmt.Errorf("invalid device ID: %w", err)
+	}
+	st, err := m.store.LoadDeviceState()
+	if err != nil {
+		return err
+	}
+	if st.Account != nil {
+		return ErrNotPrimary
+	}
+	if st.List == nil || st.List.index(id) < 0 {
+		return fmt.Errorf("unknown device %s", idB64)
+	}
+	log.Printf("[Manager] UnlinkDevice(%s)", idB64)
+	l := st.List.clone()
+	l.Devices = slices.Delete(l.Devices, l.index(id), l.index(id)+1)
+	l.Version++
+	l.sign(m.localPeer.signingPrivKey)
+	st.List = l
+	if err := m.store.SaveDeviceState(st); err != nil {
+		return err
+	}
+	if s, err := m.deviceSession(idB64); err == nil {
+		if err := s.SendDevices(l); err != nil {
+			log.Printf("[Manager] !! device list to %s: %v", idB64, err)
+		}
+	}
+	m.announceDevices(l, nil)
+	m.devicesChanged()
+	return nil
+}
+
+// account ist der Identity-Key, unter dem uns Kontakte kennen.
+func (m *Manager) account() []byte {
+	st, err := m.store.LoadDeviceState()
+	if err != nil {
+		return m.self()
+	}
+	return st.account(m.self())
+}
+
+// announceDevices schickt die Geräteliste an alle Kontakte (und deren
+// Geräte) sowie an die eigenen Geräte außer skip.
+func (m *Manager) announceDevices(l *DeviceList, skip []byte) {
+	contacts, _ := m.store.ListContacts()
+	for _, c := range contacts {
+		err := m.sendWith(b64(c.IDPub), func(sess *Session) error {
+			return sess.SendDevices(l)
+		})
+		if err != nil {
+			log.Printf("[Manager] !! device list to %s: %v", b64(c.IDPub), err)
+		}
+	}
+	for _, d := range l.Devices {
+		if bytes.Equal(d.IDPub, skip) {
+			continue
+		}
+		s, err := m.deviceSession(b64(d.IDPub))
+		if err == nil {
+			err = s.SendDevices(l)
+		}
+		if err != nil && !errors.Is(err, ErrQueued) {
+			log.Printf("[Manager] !! device list to %s: %v", b64(d.IDPub), err)
+		}
+	}
+}
+
+// attachDevices hängt die Sessions zu weiteren Geräten des Kontakts und
+// zu unseren eigenen Geräten an. Geräte ohne Session fehlen, bis eine
+// Geräteliste sie verbindet.
+func (m *Manager) attachDevices(s *Session) {
+	s.Devices, s.Mirrors = nil, nil
+	c, err := m.store.LoadContact(s.remoteID)
+	if err != nil {
+		return
+	}
+	for _, d := range c.Devices {
+		if ds, err := m.deviceSession(b64(d.IDPub)); err == nil {
+			s.Devices = append(s.Devices, ds)
+		}
+	}
+	st, err := m.store.LoadDeviceState()
+	if err != nil {
+		return
+	}
+	for _, id := range st.others(m.self()) {
+		if ds, err := m.deviceSession(b64(id)); err == nil {
+			s.Mirrors = append(s.Mirrors, ds)
+		}
+	}
+}
+
+// connectDevices baut nach einer neuen Geräteliste Sessions zu Geräten
+// auf, mit denen wir noch keine haben.
+func (m *Manager) connectDevices(account []byte) {
+	var devs []Device
+	if st, err := m.store.LoadDeviceState(); err == nil && bytes.Equal(account, st.Account) {
+		devs = st.List.Devices
+	} else if c, err := m.store.LoadContact(account); err == nil {
+		devs = c.Devices
+	}
+	for _, d := range devs {
+		if bytes.Equal(d.IDPub, m.self()) {
+			continue
+		}
+		if _, err := m.deviceSession(b64(d.IDPub)); err == nil {
+			continue
+		}
+		if err := m.connectDevice(d); err != nil {
+			log.Printf("[Manager] !! connect device %s: %v", b64(d.IDPub), err)
+		}
+	}
+	m.devicesChanged()
+}
+
+func (m *Manager) connectDevice(d Device) error {
+	if r, ok := m.transport.(interface{ AddPeer([]byte, string) }); ok && d.Addr != "" {
+		r.AddPeer(d.IDPub, d.Addr)
+	}
+	s := m.newSession()
+	if err := s.StartHandshake(d.Bundle); err != nil {
+		return err
+	}
+	m.setSession(b64(d.IDPub), s)
+	return nil
+}
+
+func (m *Manager) devicesChanged() {
+	if m.onDevices != nil {
+		m.onDevices()
+	}
+}
+
+// ───────────────────────── Sperre ────────────────────────────────
+
+// pauser sind Transports, die eingehende Nachrichten zurückhalten können,
+// solange der Manager gesperrt ist (TorTransport).
+type pauser interface {
+	SetPaused(paused bool)
+}
+
+func (m *Manager) pause(paused bool) {
+	if p, ok := m.transport.(pauser); ok {
+		p.SetPaused(paused)
+	}
+}
+
+// SetLockHandler registriert einen Callback für das Sperren.
+func (m *Manager) SetLockHandler(fn func()) {
+	m.onLock = fn
+}
+
+// Protected sagt, ob der Store mit einer Passphrase geschützt ist.
+func (m *Manager) Protected() bool { return m.store.Protected() }
+
+// Locked sagt, ob die Schlüssel gerade nicht im Speicher sind.
+func (m *Manager) Locked() bool { return m.store.Locked() }
+
+// SetPassphrase schützt den Store mit einer Passphrase oder ändert sie;
+// ab dann gilt das Auto-Lock aus den Einstellungen.
+func (m *Manager) SetPassphrase(pass string) error {
+	if err := m.store.SetPassphrase(pass, defaultKDFParams); err != nil {
+		return err
+	}
+	return m.loadAutoLock()
+}
+
+// Unlock entsperrt den Store und lädt Identität, Pre-Keys und die beim
+// Sperren offenen Sessions neu. Danach läuft der Ausgang wieder an.
+func (m *Manager) Unlock(pass string) error {
+	m.lockMu.Lock()
+	defer m.lockMu.Unlock()
+	if !m.store.Locked() {
+		return nil
+	}
+	if err := m.store.Unlock(pass); err != nil {
+		log.Printf("[Manager] !! unlock: %v", err)
+		return err
+	}
+	if err := m.open(); err != nil {
+		_ = m.store.Lock()
+		return err
+	}
+	for _, id := range m.remotes {
+		if st, err := m.store.LoadSession(id); err == nil {
+			m.localPeer.setState(id, st)
+			if pst, err := m.store.LoadPendingSession(id); err == nil {
+				m.localPeer.setPending(id, pst)
+			}
+		}
+	}
+	m.remotes = nil
+	m.pause(false)
+	log.Printf("[Manager] unlocked")
+
+	m.wakeOutbox()
+	return m.loadAutoLock()
+}
+
+// Lock entfernt Master-Key, Identität und Ratchet-States aus dem
+// Speicher. Eingehende Nachrichten bleiben bis Unlock beim Absender.
+func (m *Manager) Lock() error {
+	m.lockMu.Lock()
+	if m.store.Locked() {
+		m.lockMu.Unlock()
+		return nil
+	}
+	if !m.store.Protected() {
+		m.lockMu.Unlock()
+		return ErrNotProtected
+	}
+	m.pause(true)
+	m.remotes = m.localPeer.wipe()
+	if err := m.store.SyncLogs(); err != nil {
+		log.Printf("[Manager] !! sync logs: %v", err)
+	}
+	err := m.store.Lock()
+	m.lockMu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("[Manager] locked")
+
+	m.armIdle()
+	if m.onLock != nil {
+		m.onLock()
+	}
+	return nil
+}
+
+// SetRekeyHandler registriert einen Callback für den Fortschritt von Rekey.
+func (m *Manager) SetRekeyHandler(fn func(done, total int)) {
+	m.onRekey = fn
+}
+
+// Rekey tauscht den Master-Key aus und verschlüsselt den Store damit neu.
+// Bei geschütztem Store muss current die Passphrase sein; next ersetzt
+// sie (leer = bleibt) bzw. schützt einen bisher ungeschützten Store.
+// Worker, Senden und Empfang ruhen so lange.
+func (m *Manager) Rekey(current, next string) error {
+	m.lockMu.Lock()
+	defer m.lockMu.Unlock()
+	if m.store.Locked() {
+		return ErrLocked
+	}
+	if m.store.Protected() {
+		if err := m.store.CheckPassphrase(current); err != nil {
+			return err
+		}
+		next = cmp.Or(next, current)
+	}
+
+	log.Printf("[Manager] rekey (protected=%v)", next != "")
+	m.pause(true)
+	err := m.store.Rekey(next, defaultKDFParams, m.onRekey)
+	m.pause(false)
+	if err != nil {
+		log.Printf("[Manager] !! rekey: %v", err)
+		return err
+	}
+	return m.loadAutoLock()
+}
+
+// SetAutoLock stellt ein, nach wie vielen Minuten ohne Aktivität der
+// Manager sich sperrt (0 = nie).
+func (m *Manager) SetAutoLock(minutes int) error {
+	if minutes < 0 {
+		return fmt.Errorf("invalid auto-lock delay %d", minutes)
+	}
+	st, err := m.store.LoadSettings()
+	if err != nil {
+		return err
+	}
+	st.AutoLockMinutes = minutes
+	if err := m.store.SaveSettings(st); err != nil {
+		return err
+	}
+	m.setIdle(time.Duration(minutes) * time.Minute)
+	return nil
+}
+
+// Touch meldet Aktivität des Nutzers und schiebt das Auto-Lock auf.
+func (m *Manager) Touch() {
+	m.idleMu.Lock()
+	defer m.idleMu.Unlock()
+	if m.idle != nil {
+		m.idle.Reset(m.idleAfter)
+	}
+}
+
+func (m *Manager) loadAutoLock() error {
+	st, err := m.store.LoadSettings()
+	if err != nil {
+		return err
+	}
+	m.setIdle(time.Duration(st.AutoLockMinutes) * time.Minute)
+	return nil
+}
+
+func (m *Manager) setIdle(d time.Duration) {
+	m.idleMu.Lock()
+	m.idleAfter = d
+	m.idleMu.Unlock()
+	m.armIdle()
+}
+
+// armIdle startet das Auto-Lock neu; es läuft nur bei geschütztem,
+// entsperrtem Store.
+func (m *Manager) armIdle() {
+	m.idleMu.Lock()
+	defer m.idleMu.Unlock()
+	if m.idle != nil {
+		m.idle.Stop()
+		m.idle = nil
+	}
+	if m.idleAfter > 0 && m.store.Protected() && !m.store.Locked() {
+		m.idle = time.AfterFunc(m.idleAfter, func() {
+			log.Printf("[Manager] idle → auto-lock")
+			if err := m.Lock(); err != nil {
+				log.Printf("[Manager] !! auto-lock: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// stripMetadata entfernt EXIF (inkl. GPS), XMP, IPTC und Kommentare aus
+// JPEG- und PNG-Bildern, ohne die Bilddaten neu zu kodieren. Andere Typen
+// bleiben unverändert.
+func stripMetadata(mime string, data []byte) ([]byte, error) {
+	switch mime {
+	case "image/jpeg":
+		return stripJPEG(data)
+	case "image/png":
+		return stripPNG(data)
+	}
+	return data, nil
+}
+
+var ErrBadImage = errors.New("malformed image")
+
+// JPEG-Marker, deren Segment Metadaten trägt.
+var jpegDrop = map[byte]bool{
+	0xE1: true, // APP1: EXIF, XMP
+	0xED: true, // APP13: IPTC/Photoshop
+	0xFE: true, // COM
+}
+
+func stripJPEG(b []byte) ([]byte, error) {
+	if len(b) < 4 || b[0] != 0xFF || b[1] != 0xD8 {
+		return nil, ErrBadImage
+	}
+	out := append(make([]byte, 0, len(b)), b[:2]...)
+	b = b[2:]
+	for {
+		if len(b) < 2 || b[0] != 0xFF {
+			return nil, ErrBadImage
+		}
+		marker := b[1]
+		switch {
+		case marker == 0xFF: // Füllbyte
+			b = b[1:]
+			continue
+		case marker == 0xD9, marker == 0xDA:
+			// EOI oder Start of Scan: ab hier nur noch Bilddaten
+			return append(out, b...), nil
+		case marker == 0x01, marker >= 0xD0 && marker <= 0xD7:
+			out = append(out, b[:2]...)
+			b = b[2:]
+			continue
+		}
+		if len(b) < 4 {
+			return nil, ErrBadImage
+		}
+		n := int(binary.BigEndian.Uint16(b[2:4])) + 2
+		if n < 4 || n > len(b) {
+			return nil, ErrBadImage
+		}
+		if !jpegDrop[marker] {
+			out = append(out, b[:n]...)
+		}
+		b = b[n:]
+	}
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// PNG-Chunks mit Metadaten; alle anderen werden übernommen.
+var pngDrop = map[string]bool{
+	"tEXt": true, "zTXt": true, "iTXt": true, "eXIf": true, "tIME": true,
+}
+
+func stripPNG(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, pngSignature) {
+		return nil, ErrBadImage
+	}
+	out := append(make([]byte, 0, len(b)), pngSignature...)
+	b = b[len(pngSignature):]
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, ErrBadImage
+		}
+		n := int(binary.BigEndian.Uint32(b[:4]))
+		if n > len(b)-12 {
+			return nil, ErrBadImage
+		}
+		typ := string(b[4:8])
+		if !pngDrop[typ] {
+			out = append(out, b[:12+n]...)
+		}
+		b = b[12+n:]
+		if typ == "IEND" {
+			break
+		}
+	}
+	return out, nil
+}
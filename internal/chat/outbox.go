@@ -0,0 +1,201 @@
+package chat
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const outboxDir = "outbox"
+
+// Zustände einer Nachricht im Ausgang.
+const (
+	OutboxQueued    = "queued"    // wartet auf (erneuten) Versand
+	OutboxSent      = "sent"      // vom Transport angenommen
+	OutboxFailed    = "failed"    // abgelehnt oder Versuche aufgebraucht, wartet auf den Nutzer
+	OutboxCancelled = "cancelled" // vom Nutzer verworfen
+)
+
+const (
+	outboxBaseDelay   = 2 * time.Second
+	outboxMaxDelay    = 10 * time.Minute
+	outboxMaxAttempts = 12
+	outboxKeepSent    = 24 * time.Hour // danach fliegen gesendete Einträge raus
+)
+
+// ErrQueued meldet, dass eine Nachricht nicht sofort zugestellt werden
+// konnte und im Ausgang auf den nächsten Versuch wartet.
+var ErrQueued = errors.New("message queued for later delivery")
+
+// OutboxEntry ist ein bereits verschlüsselter Frame, der noch nicht beim
+// Transport angekommen ist. Der Ratchet ist schon weitergelaufen, die
+// Nachricht darf also nicht neu verschlüsselt, nur erneut gesendet werden.
+// Gruppennachrichten stehen im Ausgang jedes Mitglieds, damit sie nicht
+// vor dem Sender-Key (1:1-Nachricht) ankommen.
+type OutboxEntry struct {
+	ID       string        `json:"id"` // wie PlainMessage.ID
+	Msg      CipherMessage `json:"msg"`
+	Group    *GroupMessage `json:"group,omitempty"` // statt Msg: Gruppennachricht
+	State    string        `json:"state"`
+	Attempts int           `json:"attempts"`
+	NextTry  time.Time     `json:"next_try"`
+	LastErr  string        `json:"last_err,omitempty"`
+	Created  time.Time     `json:"created"`
+	Updated  time.Time     `json:"updated"`
+}
+
+func messageID(m CipherMessage) string {
+	return base64.RawURLEncoding.EncodeToString(m.Header) +
+		base64.RawURLEncoding.EncodeToString(m.Nonce)
+}
+
+// backoff liefert die Wartezeit nach n Fehlversuchen: 2s, 4s, 8s … ≤ 10 min
+func backoff(n int) time.Duration {
+	d := outboxBaseDelay
+	for range n - 1 {
+		if d *= 2; d >= outboxMaxDelay {
+			return outboxMaxDelay
+		}
+	}
+	return d
+}
+
+// pending: Einträge, die noch versendet werden sollen oder Aufmerksamkeit brauchen
+func (e *OutboxEntry) pending() bool {
+	return e.State == OutboxQueued || e.State == OutboxFailed
+}
+
+// ───────────────────────── Store ─────────────────────────────────
+
+func (s *Store) outboxPath(id []byte) string {
+	return filepath.Join(s.basePath, outboxDir, b64Name(id)+".bin")
+}
+
+// LoadOutbox liefert alle Ausgangs-Einträge eines Kontakts (älteste zuerst).
+func (s *Store) LoadOutbox(id []byte) ([]*OutboxEntry, error) {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	return s.loadOutbox(id)
+}
+
+func (s *Store) loadOutbox(id []byte) ([]*OutboxEntry, error) {
+	raw, err := os.ReadFile(s.outboxPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	plain, err := s.unwrap(s.outboxPath(id), raw)
+	if err != nil {
+		return nil, err
+	}
+	var list []*OutboxEntry
+	if err := json.Unmarshal(plain, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (s *Store) saveOutbox(id []byte, list []*OutboxEntry) error {
+	cutoff := time.Now().Add(-outboxKeepSent)
+	list = slices.DeleteFunc(list, func(e *OutboxEntry) bool {
+		return e.State == OutboxSent && e.Updated.Before(cutoff)
+	})
+	if len(list) == 0 {
+		err := os.Remove(s.outboxPath(id))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.basePath, outboxDir), 0o700); err != nil {
+		return err
+	}
+	raw, _ := json.Marshal(list)
+	buf, err := s.wrap(s.outboxPath(id), raw)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.outboxPath(id), buf)
+}
+
+// Enqueue legt eine verschlüsselte Nachricht in den Ausgang; der erste
+// Versuch ist sofort fällig.
+func (s *Store) Enqueue(id []byte, msgID string, m CipherMessage) (*OutboxEntry, error) {
+	return s.enqueue(id, &OutboxEntry{ID: msgID, Msg: m})
+}
+
+// EnqueueGroup reiht eine Gruppennachricht für ein Mitglied ein.
+func (s *Store) EnqueueGroup(id []byte, msgID string, m GroupMessage) (*OutboxEntry, error) {
+	return s.enqueue(id, &OutboxEntry{ID: msgID, Group: &m})
+}
+
+// EnqueueFailed hält eine vom Peer abgelehnte Nachricht fest; sie wird
+// nicht automatisch wiederholt, nur auf Wunsch des Nutzers.
+func (s *Store) EnqueueFailed(id []byte, msgID string, m CipherMessage, cause error) (*OutboxEntry, error) {
+	return s.enqueue(id, &OutboxEntry{ID: msgID, Msg: m, State: OutboxFailed, Attempts: 1, LastErr: cause.Error()})
+}
+
+func (s *Store) enqueue(id []byte, e *OutboxEntry) (*OutboxEntry, error) {
+	now := time.Now().UTC()
+	e.State = cmp.Or(e.State, OutboxQueued)
+	e.NextTry, e.Created, e.Updated = now, now, now
+	return e, s.UpdateOutbox(id, func(list []*OutboxEntry) ([]*OutboxEntry, error) {
+		return append(list, e), nil
+	})
+}
+
+// UpdateOutbox ändert den Ausgang eines Kontakts atomar (Lesen, Ändern,
+// Schreiben unter einem Lock).
+func (s *Store) UpdateOutbox(id []byte, fn func([]*OutboxEntry) ([]*OutboxEntry, error)) error {
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+
+	list, err := s.loadOutbox(id)
+	if err != nil {
+		return err
+	}
+	if list, err = fn(list); err != nil {
+		return err
+	}
+	return s.saveOutbox(id, list)
+}
+
+// HasPending meldet, ob für den Kontakt noch Nachrichten auf den Versand
+// warten. Neue Nachrichten reihen sich dann hinten an, statt zu überholen.
+// Fehlgeschlagene zählen nicht: sie halten den Verlauf nicht auf, bis der
+// Nutzer sie wiederholt oder verwirft, und kommen dann eben später an
+// (der Ratchet verkraftet die Lücke).
+func (s *Store) HasPending(id []byte) bool {
+	list, _ := s.LoadOutbox(id)
+	return slices.ContainsFunc(list, func(e *OutboxEntry) bool { return e.State == OutboxQueued })
+}
+
+// OutboxContacts liefert alle Kontakte mit Ausgangs-Datei.
+func (s *Store) OutboxContacts() ([][]byte, error) {
+	ents, err := os.ReadDir(filepath.Join(s.basePath, outboxDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ids [][]byte
+	for _, e := range ents {
+		name, ok := strings.CutSuffix(e.Name(), ".bin")
+		if !ok {
+			continue
+		}
+		if id, err := base64.RawURLEncoding.DecodeString(name); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
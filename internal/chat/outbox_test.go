@@ -0,0 +1,163 @@
+package chat
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Ausgang (Outbox)", func() {
+	var (
+		tmp     string
+		mgr     *Manager
+		dt      *DummyTransport
+		bobID   string
+		bobSess *Session
+	)
+
+	// Bob vom Transport nehmen bzw. wieder anmelden
+	offline := func() {
+		dt.mu.Lock()
+		defer dt.mu.Unlock()
+		for k, s := range dt.peers {
+			if b64(s.LocalPeer().IdentityPublicKey()) == bobID {
+				bobSess = s
+				delete(dt.peers, k)
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "outbox_*")
+		Expect(err).NotTo(HaveOccurred())
+		mgr, err = NewManager(tmp, "Alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mgr.Initialise()).To(Succeed())
+		dt = mgr.transport.(*DummyTransport)
+
+		list, _ := mgr.Contacts()
+		bobID = list[0].ID
+		offline()
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	It("reiht Nachrichten an Offline-Peers ein und stellt sie später zu", func() {
+		Expect(mgr.Send(bobID, "eins")).To(Succeed())
+		Expect(mgr.Send(bobID, "zwei")).To(Succeed())
+
+		msgs, _ := mgr.Messages(bobID, 0)
+		Expect(msgs).To(HaveLen(2))
+		Expect(msgs[0].Status).To(Equal(OutboxQueued))
+
+		// erster Versuch scheitert → Backoff
+		now := time.Now()
+		mgr.flushOutbox(now)
+		pending, _ := mgr.Pending(bobID)
+		Expect(pending).To(HaveLen(2))
+		Expect(pending[0].Attempts).To(Equal(1))
+		Expect(pending[0].NextTry).To(BeTemporally("~", now.Add(outboxBaseDelay), time.Millisecond))
+		Expect(pending[1].Attempts).To(BeZero()) // Reihenfolge bleibt
+
+		// Bob meldet sich zurück → sofort erneut versuchen
+		var received []string
+		bobSess.OnError = func(_ []byte, err error) { Fail(err.Error()) }
+		dt.Register(bobSess)
+		Expect(mgr.outboxWake).To(Receive())
+		mgr.flushOutbox(time.Now())
+
+		pending, _ = mgr.Pending(bobID)
+		Expect(pending).To(BeEmpty())
+		msgs, _ = mgr.Messages(bobID, 0)
+		for _, m := range msgs {
+			Expect(m.Status).To(Equal(StatusDelivered)) // Bob hat quittiert
+			received = append(received, m.Text)
+		}
+		Expect(received).To(Equal([]string{"eins", "zwei"}))
+
+		got, _ := bobSess.LoadPlainMessages(bobSess.RemoteID(), time.Time{})
+		Expect(got).To(HaveLen(2))
+		Expect(got[1].Text).To(Equal("zwei"))
+	})
+
+	It("gibt nach zu vielen Versuchen auf, bis der Nutzer es erneut versucht", func() {
+		Expect(mgr.Send(bobID, "hartnäckig")).To(Succeed())
+
+		now := time.Now()
+		for range outboxMaxAttempts {
+			mgr.flushOutbox(now)
+			now = now.Add(outboxMaxDelay)
+		}
+		pending, _ := mgr.Pending(bobID)
+		Expect(pending).To(HaveLen(1))
+		Expect(pending[0].State).To(Equal(OutboxFailed))
+		Expect(pending[0].LastErr).To(ContainSubstring("unreachable"))
+
+		dt.Register(bobSess)
+		Expect(mgr.RetryMessage(bobID, pending[0].ID)).To(Succeed())
+		mgr.flushOutbox(time.Now())
+		Expect(mgr.Pending(bobID)).To(BeEmpty())
+	})
+
+	It("kann wartende Nachrichten verwerfen", func() {
+		Expect(mgr.Send(bobID, "doch nicht")).To(Succeed())
+		pending, _ := mgr.Pending(bobID)
+		Expect(mgr.CancelMessage(bobID, pending[0].ID)).To(Succeed())
+
+		dt.Register(bobSess)
+		mgr.flushOutbox(time.Now())
+		Expect(mgr.Pending(bobID)).To(BeEmpty())
+		msgs, _ := mgr.Messages(bobID, 0)
+		Expect(msgs[0].Status).To(Equal(OutboxCancelled))
+		Expect(mgr.CancelMessage(bobID, pending[0].ID)).NotTo(Succeed())
+	})
+
+	It("reiht abgelehnte Nachrichten nicht ein und lässt neue vorbei", func() {
+		dt.Register(bobSess)
+		aliceID := mgr.self()
+		st := bobSess.localPeer.state(aliceID)
+		bobSess.localPeer.dropState(aliceID) // Bob kann nichts entschlüsseln
+
+		Expect(mgr.Send(bobID, "abgelehnt")).To(MatchError(ErrRejected))
+		pending, _ := mgr.Pending(bobID)
+		Expect(pending).To(HaveLen(1))
+		Expect(pending[0].State).To(Equal(OutboxFailed))
+		Expect(pending[0].LastErr).To(ContainSubstring(ErrNoSession.Error()))
+
+		// kein automatischer Versuch mehr
+		mgr.flushOutbox(time.Now().Add(outboxMaxDelay))
+		pending, _ = mgr.Pending(bobID)
+		Expect(pending[0].Attempts).To(Equal(1))
+
+		// eine fehlgeschlagene Nachricht hält neue nicht auf …
+		bobSess.Restore(aliceID, st)
+		Expect(mgr.Send(bobID, "danach")).To(Succeed())
+		Expect(mgr.store.HasPending(bobSess.localPeer.IdentityPublicKey())).To(BeFalse())
+		got, _ := bobSess.LoadPlainMessages(aliceID, time.Time{})
+		Expect(got).To(HaveLen(1))
+
+		// … und kommt beim Wiederholen eben später an
+		Expect(mgr.RetryMessage(bobID, pending[0].ID)).To(Succeed())
+		mgr.flushOutbox(time.Now())
+		Expect(mgr.Pending(bobID)).To(BeEmpty())
+		got, _ = bobSess.LoadPlainMessages(aliceID, time.Time{})
+		Expect(got).To(HaveLen(2))
+		Expect(got[1].Text).To(Equal("abgelehnt"))
+	})
+
+	It("hält neue Nachrichten hinter wartenden zurück", func() {
+		Expect(mgr.Send(bobID, "eins")).To(Succeed())
+		dt.Register(bobSess)
+		Expect(mgr.Send(bobID, "zwei")).To(Succeed())
+		pending, _ := mgr.Pending(bobID)
+		Expect(pending).To(HaveLen(2))
+	})
+
+	It("verdoppelt die Wartezeit bis zur Obergrenze", func() {
+		Expect(backoff(1)).To(Equal(2 * time.Second))
+		Expect(backoff(3)).To(Equal(8 * time.Second))
+		Expect(backoff(30)).To(Equal(outboxMaxDelay))
+	})
+})
@@ -1,217 +1,747 @@
 package chat
 
 import (
-    "bytes"
-    "crypto/aes"
-    "crypto/cipher"
-    "crypto/ecdh"
-    "crypto/hkdf"
-    "crypto/rand"
-    "crypto/sha256"
-    "encoding/base64"
-    "fmt"
-    "log"
+	"bytes"
+	"cmp"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrBadHeader      = errors.New("ratchet header invalid")
+	ErrAuthFailed     = errors.New("message authentication failed")
+	ErrBadInit        = errors.New("init message invalid")
+	ErrTooManySkipped = errors.New("too many skipped messages")
 )
 
-func check(err error) { if err != nil { log.Fatal(err) } }
 func b64(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
 
-func hkdf32(in []byte) []byte {
-    out, err := hkdf.Key(sha256.New, in, nil, "", 32)
-    check(err)
-    return out
+func hkdf32(in []byte) ([]byte, error) {
+	return hkdf.Key(sha256.New, in, nil, "", 32)
 }
 
-func kdfRoot(rootKey, dhSecret []byte) (newRootKey, chainKey []byte) {
-    temp := append(rootKey, dhSecret...)
-    newRootKey = hkdf32(temp)
-    chainKey   = hkdf32(append(dhSecret, newRootKey...))
-    return
+// X3DH:  SK = HKDF(F ‖ DH1 ‖ DH2 ‖ DH3 [‖ DH4]), F = 32 × 0xFF
+// PQXDH: dasselbe, zusätzlich ‖ SS (ML-KEM) und eigenes Info-Label
+//
+// Ab Protokoll v2 hängt das Verhandlungs-Transcript am Info-Label.
+func x3dhKDF(hs byte, transcript []byte, dhs ...[]byte) ([]byte, error) {
+	info := "zero X3DH"
+	if hs == handshakePQXDH {
+		info = "zero PQXDH"
+	}
+	info += string(transcript)
+	ikm := bytes.Repeat([]byte{0xff}, 32)
+	for _, dh := range dhs {
+		ikm = append(ikm, dh...)
+	}
+	return hkdf.Key(sha256.New, ikm, make([]byte, 32), info, 32)
 }
 
-func encryptAEAD(key, plaintext, aad []byte) (nonce, ciphertext []byte, err error) {
-    block, err := aes.NewCipher(key); if err != nil { return }
-    gcm, err := cipher.NewGCM(block); if err != nil { return }
-    nonce = make([]byte, gcm.NonceSize()); _, err = rand.Read(nonce); if err != nil { return }
-    ciphertext = gcm.Seal(nil, nonce, plaintext, aad)
-    return
+func encryptAEAD(suite byte, key, plaintext, aad []byte) (nonce, ciphertext []byte, err error) {
+	aead, err := newAEAD(suite, key)
+	if err != nil {
+		return
+	}
+	nonce = make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	ciphertext = aead.Seal(nil, nonce, plaintext, aad)
+	return
 }
-func decryptAEAD(key, nonce, ciphertext, aad []byte) ([]byte, error) {
-    block, err := aes.NewCipher(key); if err != nil { return nil, err }
-    gcm, err := cipher.NewGCM(block); if err != nil { return nil, err }
-    return gcm.Open(nil, nonce, ciphertext, aad)
+func decryptAEAD(suite byte, key, nonce, ciphertext, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(suite, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("invalid nonce length")
+	}
+	return aead.Open(nil, nonce, ciphertext, aad)
 }
 
 func keyOf(pub []byte) string { return base64.StdEncoding.EncodeToString(pub) }
 
-func (p *Peer) IdentityPublicKey() []byte { return p.identityPrivKey.PublicKey().Bytes() }
+func (p *Peer) IdentityPublicKey() []byte {
+	if p.identityPrivKey == nil {
+		return nil // gesperrt
+	}
+	return p.identityPrivKey.PublicKey().Bytes()
+}
 
+// state liefert den State zu remoteID und legt ihn bei Bedarf an. Der
+// Aufrufer hält lockRemote(remoteID), solange er ihn liest.
 func (p *Peer) state(remoteID []byte) *sessionState {
-    k := keyOf(remoteID)
-    st, ok := p.sess[k]
-    if !ok {
-        st = &sessionState{}
-        p.sess[k] = st
-    }
-    return st
+	k := keyOf(remoteID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st, ok := p.sess[k]
+	if !ok {
+		st = &sessionState{}
+		p.sess[k] = st
+	}
+	return st
 }
 
-type SymmRatchet struct{ state []byte }
-func NewSymmRatchet(k []byte) *SymmRatchet { c := make([]byte,len(k)); copy(c,k); return &SymmRatchet{state:c} }
-func (r *SymmRatchet) Next() []byte { r.state = hkdf32(r.state); return r.state }
+// lookup liefert nur bereits etablierte Sessions (legt nichts an). Der
+// Aufrufer hält lockRemote(remoteID).
+func (p *Peer) lookup(remoteID []byte) (*sessionState, bool) {
+	p.mu.Lock()
+	st, ok := p.sess[keyOf(remoteID)]
+	p.mu.Unlock()
+	if !ok || st.dhSendPrivKey == nil || st.dhRecvPubKey == nil {
+		return nil, false
+	}
+	return st, true
+}
 
-type Peer struct {
-    Name string
+// setState ersetzt den State zu remoteID, etwa nach einem Handshake oder
+// beim Laden von der Platte.
+func (p *Peer) setState(remoteID []byte, st *sessionState) {
+	p.mu.Lock()
+	p.sess[keyOf(remoteID)] = st
+	p.mu.Unlock()
+}
+
+func (p *Peer) dropState(remoteID []byte) {
+	p.mu.Lock()
+	delete(p.sess, keyOf(remoteID))
+	delete(p.pending, keyOf(remoteID))
+	p.mu.Unlock()
+}
+
+// acceptState übernimmt den State eines angenommenen Inits. Hat die
+// laufende Session schon Nachrichten der Gegenseite entschlüsselt, ist
+// sie bewiesen und der neue State wird nur vorgemerkt; sonst (keine oder
+// eine eigene, unbeantwortete Session) ersetzt er sie gleich.
+func (p *Peer) acceptState(remoteID []byte, st *sessionState) {
+	k := keyOf(remoteID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if cur, ok := p.sess[k]; ok && cur.dhSendPrivKey != nil && cur.dhRecvPubKey != nil && !cur.unconfirmed {
+		p.pending[k] = st
+		return
+	}
+	p.sess[k] = st
+	delete(p.pending, k)
+}
+
+// pendingState liefert den vorgemerkten State zu remoteID (oder nil). Der
+// Aufrufer hält lockRemote(remoteID).
+func (p *Peer) pendingState(remoteID []byte) *sessionState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pending[keyOf(remoteID)]
+}
 
-    // Längerfristige X3DH‑Schlüssel
-    identityPrivKey      *ecdh.PrivateKey              // IK  (priv)
+func (p *Peer) setPending(remoteID []byte, st *sessionState) {
+	p.mu.Lock()
+	p.pending[keyOf(remoteID)] = st
+	p.mu.Unlock()
+}
 
-    // ─── Alle aktiven Sitzungen ───────────────────────
-    //   Key: Remote-Identity-Public-Key (Base64 oder []byte-string)
-    sess map[string]*sessionState
+// lockRemote serialisiert den Zugriff auf den State einer Gegenstelle:
+// Senden (UI) und Empfangen (Transport) schalten denselben Ratchet weiter,
+// auch über mehrere Session-Objekte hinweg. Zurück kommt das Unlock.
+func (p *Peer) lockRemote(remoteID []byte) func() {
+	k := keyOf(remoteID)
+	p.mu.Lock()
+	l, ok := p.locks[k]
+	if !ok {
+		l = &sync.Mutex{}
+		p.locks[k] = l
+	}
+	p.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+// protocol liefert die Protokollversion der Session zu remoteID.
+func (p *Peer) protocol(remoteID []byte) byte {
+	defer p.lockRemote(remoteID)()
+	return p.state(remoteID).protocol()
+}
+
+type SymmRatchet struct{ state []byte }
+
+// SymmRatchet hält nur den Chain-Key; weitergeschaltet wird über
+// sessionState.nextMessageKey (abhängig von der KDF-Version).
+func NewSymmRatchet(k []byte) *SymmRatchet {
+	c := make([]byte, len(k))
+	copy(c, k)
+	return &SymmRatchet{state: c}
+}
+
+type Peer struct {
+	Name string
+
+	// Längerfristige X3DH‑Schlüssel
+	identityPrivKey *ecdh.PrivateKey   // IK  (priv)
+	signingPrivKey  ed25519.PrivateKey // aus IK abgeleitet, signiert Gerätelisten
+	preKeys         *preKeySet         // SPK + OPK-Pool (priv)
+
+	versions, suites []byte // angebotene Protokollversionen / AEAD-Suites
+
+	// ─── Alle aktiven Sitzungen ───────────────────────
+	//   Key: Remote-Identity-Public-Key (Base64 oder []byte-string)
+	//   mu schützt die Maps, locks[k] den State einer Sitzung während
+	//   eines Ratchet-Schritts (siehe lockRemote).
+	mu    sync.Mutex
+	sess  map[string]*sessionState
+	locks map[string]*sync.Mutex
+
+	// Ein Init beweist nicht, wer ihn geschickt hat. Steht schon eine
+	// Session, wartet der neue State hier, bis die erste Nachricht unter
+	// ihm entschlüsselt – erst dann ersetzt er die alte (siehe Decrypt).
+	pending map[string]*sessionState
 }
 
 func NewPeer(name string) *Peer {
-    curve := ecdh.X25519()
+	curve := ecdh.X25519()
 
-    idPriv, _  := curve.GenerateKey(rand.Reader)      // IK
+	idPriv, _ := curve.GenerateKey(rand.Reader) // IK
 
-    return &Peer{
-        Name:               name,
-        identityPrivKey:    idPriv,
-				sess:              make(map[string]*sessionState),
-    }
+	return NewPeerWithIdentity(name, idPriv)
 }
 
 func NewPeerWithIdentity(name string, idPriv *ecdh.PrivateKey) *Peer {
+	p := newPeer(name)
+	p.setIdentity(idPriv)
+	return p
+}
+
+// newPeer legt einen Peer ohne Schlüssel an, etwa für einen gesperrten
+// Store; setIdentity ergänzt sie nach dem Entsperren.
+func newPeer(name string) *Peer {
 	return &Peer{
-		Name:             name,
-		identityPrivKey:  idPriv,
-		sess:             make(map[string]*sessionState),
+		Name:     name,
+		versions: slices.Clone(supportedVersions),
+		suites:   slices.Clone(supportedSuites),
+		sess:     make(map[string]*sessionState),
+		locks:    make(map[string]*sync.Mutex),
+		pending:  make(map[string]*sessionState),
+	}
+}
+
+func (p *Peer) setIdentity(idPriv *ecdh.PrivateKey) {
+	sign, _ := deriveSigningKey(idPriv)
+	ks, _ := newPreKeySet(idPriv)
+	p.identityPrivKey, p.signingPrivKey, p.preKeys = idPriv, sign, ks
+}
+
+// wipe überschreibt Signaturschlüssel und Session-States und vergisst
+// alle Schlüssel. Es liefert die Gegenstellen der Sessions, damit sie
+// sich nach dem Entsperren wieder laden lassen. (Die X25519-Schlüssel
+// selbst lassen sich in Go nicht überschreiben, sie fallen dem GC zu.)
+func (p *Peer) wipe() (remotes [][]byte) {
+	p.mu.Lock()
+	sess, pending := p.sess, p.pending
+	p.sess, p.pending = make(map[string]*sessionState), make(map[string]*sessionState)
+	p.mu.Unlock()
+	for k, st := range sess {
+		id, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			continue
+		}
+		remotes = append(remotes, id)
+		unlock := p.lockRemote(id) // kein Ratchet-Schritt mehr mittendrin
+		st.wipe()
+		if pst := pending[k]; pst != nil {
+			pst.wipe()
+		}
+		unlock()
+	}
+	clear(p.signingPrivKey)
+	p.identityPrivKey, p.signingPrivKey, p.preKeys = nil, nil, nil
+	return remotes
+}
+
+func (st *sessionState) wipe() {
+	for _, b := range [][]byte{st.rootKey, st.hks, st.hkr, st.nhks, st.nhkr} {
+		clear(b)
+	}
+	for _, c := range []*SymmRatchet{st.sendChain, st.recvChain} {
+		if c != nil {
+			clear(c.state)
+		}
+	}
+	for _, k := range st.skipped {
+		clear(k.hk)
+		clear(k.mk)
+	}
+	*st = sessionState{}
+}
+
+// RefreshPreKeys rotiert einen zu alten Signed‑Pre‑Key und füllt den
+// One‑Time‑Pre‑Key‑Pool auf.
+func (p *Peer) RefreshPreKeys() error {
+	// SPKs ohne KEM-Schlüssel (vor PQXDH erzeugt) und solche, die noch der
+	// abgeleitete Ed25519-Schlüssel signiert hat, werden sofort ersetzt
+	spk := p.preKeys.signed[0]
+	legacy := spk.kem == nil ||
+		!xeddsaVerify(p.IdentityPublicKey(), spkSignedData(p.IdentityPublicKey(), spk.id, spk.priv.PublicKey().Bytes()), spk.sig)
+	if legacy || time.Since(spk.created) > signedPreKeyMaxAge {
+		if err := p.preKeys.rotateSigned(p.identityPrivKey); err != nil {
+			return err
+		}
+	}
+	if len(p.preKeys.oneTime) < oneTimePreKeyMin {
+		return p.preKeys.refill()
 	}
+	return nil
 }
 
 // Pre‑Key‑Bundle (wird veröffentlicht)
 func (p *Peer) Bundle() Bundle {
-    return Bundle{
-        IdentityPub:  p.identityPrivKey.PublicKey().Bytes(),
-    }
+	spk := p.preKeys.signed[0]
+	b := Bundle{
+		IdentityPub:     p.identityPrivKey.PublicKey().Bytes(),
+		SignedPreKeyID:  spk.id,
+		SignedPreKey:    spk.priv.PublicKey().Bytes(),
+		SignedPreKeySig: spk.sig,
+		Versions:        p.versions,
+		Suites:          p.suites,
+	}
+	if spk.kem != nil {
+		b.KEMPreKey = spk.kem.EncapsulationKey().Bytes()
+		b.KEMPreKeySig = spk.kemSig
+	}
+	if id, opk := p.preKeys.nextOneTime(); opk != nil {
+		b.OneTimePreKeyID = id
+		b.OneTimePreKey = opk.PublicKey().Bytes()
+	}
+	return b
 }
 
-// Initiator  – startet X3DH + erster Send‑Chain‑Key
-func (p *Peer) InitiateSession(remoteBundle Bundle) map[string][]byte {
-    curve := ecdh.X25519()
-    remoteIdPub, _  := curve.NewPublicKey(remoteBundle.IdentityPub)
+func badInit(err error) error { return fmt.Errorf("%w: %v", ErrBadInit, err) }
+
+// Initiator  – startet X3DH + erster Send‑Chain‑Key
+func (p *Peer) InitiateSession(remoteBundle Bundle) (InitMessage, error) {
+	// 1) Bundle prüfen, bevor irgendein State angefasst wird
+	if err := verifyBundle(remoteBundle); err != nil {
+		return InitMessage{}, err
+	}
+	// wer schon PQXDH angeboten hat, bekommt keinen reinen X3DH-Handshake:
+	// ein Bundle ohne KEM-Key ist dann eher gekürzt als alt
+	if cur, ok := p.lookup(remoteBundle.IdentityPub); ok &&
+		cur.handshake == handshakePQXDH && len(remoteBundle.KEMPreKey) == 0 {
+		return InitMessage{}, ErrDowngrade
+	}
+	curve := ecdh.X25519()
+	remoteIdPub, err := curve.NewPublicKey(remoteBundle.IdentityPub)
+	if err != nil {
+		return InitMessage{}, badInit(err)
+	}
+	remoteSpkPub, err := curve.NewPublicKey(remoteBundle.SignedPreKey)
+	if err != nil {
+		return InitMessage{}, badInit(err)
+	}
 
-		st := p.state(remoteIdPub.Bytes())
+	// 1b) Version und AEAD-Suite mit dem Angebot aus dem Bundle aushandeln
+	remoteVersions, remoteSuites := legacyOffer(remoteBundle.Versions, remoteBundle.Suites)
+	version, suite, err := negotiate(p.versions, p.suites, remoteVersions, remoteSuites)
+	if err != nil {
+		return InitMessage{}, err
+	}
 
-    // 2) Eigenes Ephemeral‑Key‑Pair
-    ephemeralPrivKey, _ := curve.GenerateKey(rand.Reader)
+	// 2) Eigenes Ephemeral‑Key‑Pair
+	ephemeralPrivKey, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return InitMessage{}, err
+	}
 
-    // 3) Drei X3DH‑Secrets
-    dh1, _ := p.identityPrivKey.ECDH(remoteIdPub)
-    dh2, _ := ephemeralPrivKey.ECDH(remoteIdPub)
+	// 3) X3DH‑Secrets (DH4 nur mit One‑Time‑Pre‑Key)
+	dh1, err := p.identityPrivKey.ECDH(remoteSpkPub)
+	if err != nil {
+		return InitMessage{}, badInit(err)
+	}
+	dh2, err := ephemeralPrivKey.ECDH(remoteIdPub)
+	if err != nil {
+		return InitMessage{}, badInit(err)
+	}
+	dh3, err := ephemeralPrivKey.ECDH(remoteSpkPub)
+	if err != nil {
+		return InitMessage{}, badInit(err)
+	}
+	dhs := [][]byte{dh1, dh2, dh3}
+
+	initMsg := InitMessage{
+		Version:        version,
+		Versions:       p.versions,
+		Suite:          suite,
+		Suites:         p.suites,
+		IdentityPub:    p.identityPrivKey.PublicKey().Bytes(),
+		EphemeralPub:   ephemeralPrivKey.PublicKey().Bytes(),
+		SignedPreKeyID: remoteBundle.SignedPreKeyID,
+		KDF:            kdfV2,
+	}
+	if len(remoteBundle.OneTimePreKey) > 0 {
+		remoteOpkPub, err := curve.NewPublicKey(remoteBundle.OneTimePreKey)
+		if err != nil {
+			return InitMessage{}, badInit(err)
+		}
+		dh4, err := ephemeralPrivKey.ECDH(remoteOpkPub)
+		if err != nil {
+			return InitMessage{}, badInit(err)
+		}
+		dhs = append(dhs, dh4)
+		initMsg.OneTimePreKeyID = remoteBundle.OneTimePreKeyID
+	}
 
-    st.rootKey = hkdf32(append(dh1, dh2...))
+	// 3b) Hybrid: ML-KEM-Secret mischen, falls das Bundle einen KEM-Key anbietet
+	hs := handshakeX3DH
+	if len(remoteBundle.KEMPreKey) > 0 {
+		ek, err := mlkem.NewEncapsulationKey768(remoteBundle.KEMPreKey)
+		if err != nil {
+			return InitMessage{}, badInit(err)
+		}
+		ss, kemCT := ek.Encapsulate()
+		dhs = append(dhs, ss)
+		initMsg.KEMCiphertext = kemCT
+		hs = handshakePQXDH
+	}
+	initMsg.Handshake = hs
 
-    // 4) Start Double‑Ratchet
-    st.dhSendPrivKey = ephemeralPrivKey
-    st.dhRecvPubKey  = remoteIdPub
+	sk, err := x3dhKDF(hs, initMsg.transcript(), dhs...)
+	if err != nil {
+		return InitMessage{}, err
+	}
+	hka, nhkb, err := sharedHeaderKeys(sk)
+	if err != nil {
+		return InitMessage{}, err
+	}
 
-    secret, _ := st.dhSendPrivKey.ECDH(st.dhRecvPubKey)
-		var chainKey []byte
-    st.rootKey, chainKey = kdfRoot(st.rootKey, secret)
-    st.sendChain = NewSymmRatchet(chainKey)   // send‑chain zuerst (Initiator)
+	// 4) Start Double‑Ratchet gegen den Signed‑Pre‑Key
+	st := &sessionState{
+		version:       version,
+		suite:         suite,
+		handshake:     hs,
+		unconfirmed:   true,
+		kdf:           kdfV2,
+		ad:            slices.Concat(p.IdentityPublicKey(), remoteIdPub.Bytes()),
+		dhSendPrivKey: ephemeralPrivKey,
+		dhRecvPubKey:  remoteSpkPub,
+		hks:           hka,
+		nhkr:          nhkb,
+	}
+	var chainKey []byte
+	if st.rootKey, chainKey, st.nhks, err = kdfRoot(st.kdf, sk, dh3); err != nil {
+		return InitMessage{}, err
+	}
+	st.sendChain = NewSymmRatchet(chainKey) // send‑chain zuerst (Initiator)
+	p.setState(remoteIdPub.Bytes(), st)
 
-    fmt.Printf("[%s] RootKey₀: %s\n", p.Name, b64(st.rootKey))
+	fmt.Printf("[%s] RootKey₀: %s\n", p.Name, b64(st.rootKey))
 
-    // 5) Rückgabe an Responder
-    return map[string][]byte{
-        "idPub": p.identityPrivKey.PublicKey().Bytes(),
-        "ekPub": ephemeralPrivKey.PublicKey().Bytes(),
-    }
+	// 5) Rückgabe an Responder
+	return initMsg, nil
 }
 
-// Responder  – schließt X3DH ab + erster Recv‑Chain‑Key
-func (p *Peer) AcceptSession(initMsg map[string][]byte) {
-    curve := ecdh.X25519()
-    remoteIdPub, _ := curve.NewPublicKey(initMsg["idPub"])
-    remoteEkPub, _ := curve.NewPublicKey(initMsg["ekPub"])
+// Responder  – schließt X3DH ab + erster Recv‑Chain‑Key.
+// Unbekannte Signed‑Pre‑Keys und bereits verbrauchte One‑Time‑Pre‑Keys
+// werden abgelehnt. Bei Fehlern bleibt eine bestehende Session unangetastet.
+func (p *Peer) AcceptSession(initMsg InitMessage) error {
+	// Gewählte Version muss bekannt sein und zum Angebot passen – sonst
+	// hat jemand unterwegs an der Verhandlung gedreht.
+	if !slices.Contains(p.versions, initMsg.Version) {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, initMsg.Version)
+	}
+	offerVersions, offerSuites := legacyOffer(initMsg.Versions, initMsg.Suites)
+	version, suite, err := negotiate(offerVersions, offerSuites, p.versions, p.suites)
+	if err != nil {
+		return err
+	}
+	if version != initMsg.Version || suite != initMsg.Suite {
+		return fmt.Errorf("%w: negotiated v%d/suite %d, init claims v%d/suite %d",
+			ErrBadInit, version, suite, initMsg.Version, initMsg.Suite)
+	}
 
-		st := p.state(remoteIdPub.Bytes())
+	curve := ecdh.X25519()
+	remoteIdPub, err := curve.NewPublicKey(initMsg.IdentityPub)
+	if err != nil {
+		return badInit(err)
+	}
+	remoteEkPub, err := curve.NewPublicKey(initMsg.EphemeralPub)
+	if err != nil {
+		return badInit(err)
+	}
 
-    // dieselben zwei DH‑Berechnungen, nur gespiegelt
-    dh1, _ := p.identityPrivKey.ECDH(remoteIdPub)
-    dh2, _ := p.identityPrivKey.ECDH(remoteEkPub)
+	spk := p.preKeys.signedByID(initMsg.SignedPreKeyID)
+	if spk == nil {
+		return ErrUnknownPreKey
+	}
 
-    st.rootKey = hkdf32(append(dh1, dh2...))
+	// dieselben DH‑Berechnungen, nur gespiegelt
+	dh1, err := spk.priv.ECDH(remoteIdPub)
+	if err != nil {
+		return badInit(err)
+	}
+	dh2, err := p.identityPrivKey.ECDH(remoteEkPub)
+	if err != nil {
+		return badInit(err)
+	}
+	dh3, err := spk.priv.ECDH(remoteEkPub)
+	if err != nil {
+		return badInit(err)
+	}
+	dhs := [][]byte{dh1, dh2, dh3}
+
+	opkID := initMsg.OneTimePreKeyID
+	if opkID != 0 {
+		opk := p.preKeys.oneTime[opkID]
+		if opk == nil {
+			return ErrPreKeyReused
+		}
+		dh4, err := opk.ECDH(remoteEkPub)
+		if err != nil {
+			return badInit(err)
+		}
+		dhs = append(dhs, dh4)
+	}
 
-    st.dhSendPrivKey = p.identityPrivKey
-    st.dhRecvPubKey  = remoteEkPub
+	// Init ohne Handshake-Variante stammt von einem Client vor PQXDH
+	hs := cmp.Or(initMsg.Handshake, handshakeX3DH)
+	switch hs {
+	case handshakeX3DH:
+		// das Bundle zu diesem SPK bot ML-KEM an; X3DH heißt, jemand hat
+		// den KEM-Key unterwegs entfernt
+		if spk.kem != nil {
+			return fmt.Errorf("%w: x3dh for a prekey with kem key", ErrDowngrade)
+		}
+	case handshakePQXDH:
+		if spk.kem == nil {
+			return ErrUnknownPreKey
+		}
+		ss, err := spk.kem.Decapsulate(initMsg.KEMCiphertext)
+		if err != nil {
+			return badInit(err)
+		}
+		dhs = append(dhs, ss)
+	default:
+		return fmt.Errorf("%w: unsupported handshake %d", ErrBadInit, hs)
+	}
 
-    secret, _ := st.dhSendPrivKey.ECDH(st.dhRecvPubKey)
-		var chainKey []byte
-    st.rootKey, chainKey = kdfRoot(st.rootKey, secret)
-    st.recvChain = NewSymmRatchet(chainKey)  // Recv‑Chain zuerst (Responder)
+	// Init ohne KDF-Version stammt von einem Client vor KDF v2
+	kdf := cmp.Or(initMsg.KDF, kdfV1)
+	if kdf != kdfV1 && kdf != kdfV2 {
+		return fmt.Errorf("%w: unsupported kdf %d", ErrBadInit, kdf)
+	}
 
-    fmt.Printf("[%s] RootKey₀: %s\n", p.Name, b64(st.rootKey))
+	sk, err := x3dhKDF(hs, initMsg.transcript(), dhs...)
+	if err != nil {
+		return err
+	}
+	hka, nhkb, err := sharedHeaderKeys(sk)
+	if err != nil {
+		return err
+	}
+
+	st := &sessionState{
+		version:       version,
+		suite:         suite,
+		handshake:     hs,
+		unconfirmed:   true,
+		kdf:           kdf,
+		ad:            slices.Concat(remoteIdPub.Bytes(), p.IdentityPublicKey()),
+		dhSendPrivKey: spk.priv,
+		dhRecvPubKey:  remoteEkPub,
+		hkr:           hka,
+		nhks:          nhkb,
+	}
+	var chainKey []byte
+	if st.rootKey, chainKey, st.nhkr, err = kdfRoot(st.kdf, sk, dh3); err != nil {
+		return err
+	}
+	st.recvChain = NewSymmRatchet(chainKey) // Recv‑Chain zuerst (Responder)
+	p.acceptState(remoteIdPub.Bytes(), st)
+
+	// One‑Time‑Pre‑Key ist verbraucht
+	delete(p.preKeys.oneTime, opkID)
+
+	fmt.Printf("[%s] RootKey₀: %s\n", p.Name, b64(st.rootKey))
+	return nil
 }
 
-// Verschlüsselt eine Nachricht (erzeugt bei Bedarf neue Send‑Chain)
+// Verschlüsselt eine Nachricht (erzeugt bei Bedarf neue Send‑Chain).
+// Liefert Header, Nonce und Ciphertext.
 func (p *Peer) Encrypt(remoteID []byte, plaintext []byte) ([]byte, []byte, []byte, error) {
-		st := p.state(remoteID)
+	defer p.lockRemote(remoteID)()
+	st, ok := p.lookup(remoteID)
+	if !ok {
+		return nil, nil, nil, ErrNoSession
+	}
+
+	work := st.clone()
+	header, nonce, ciphertext, err := work.encrypt(plaintext)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	*st = *work
 
-    // Falls noch keine Send‑Chain existiert (erster Send nach Richtungswechsel)
-    if st.sendChain == nil {
-        curve := ecdh.X25519()
-				var err error
-        st.dhSendPrivKey, err = curve.GenerateKey(rand.Reader) // neues DH‑Paar
-				if (err != nil) { return nil, nil, nil, err }
+	fmt.Printf("[%s] → %q\n", p.Name, plaintext)
+	return header, nonce, ciphertext, nil
+}
 
-        secret, err := st.dhSendPrivKey.ECDH(st.dhRecvPubKey)
-				if (err != nil) { return nil, nil, nil, err }
+// Entschlüsselt eine Nachricht. Schlägt irgendein Schritt fehl (Header,
+// Authentisierung, zu große Lücke), bleibt der Ratchet‑State unverändert –
+// eine gefälschte Nachricht kann die Session also nicht beschädigen.
+//
+// Passt die Nachricht nicht zur laufenden Session, aber zu einem
+// vorgemerkten Handshake, hat sich dieser als echt erwiesen und ersetzt
+// die Session.
+func (p *Peer) Decrypt(remoteID []byte, header []byte, nonce []byte, ct []byte) ([]byte, error) {
+	defer p.lockRemote(remoteID)()
+	err := ErrNoSession
+	if st, ok := p.lookup(remoteID); ok {
+		work := st.clone()
+		var plaintext []byte
+		if plaintext, err = work.decrypt(header, nonce, ct); err == nil {
+			work.unconfirmed = false
+			*st = *work
+			return plaintext, nil
+		}
+	}
+	pst := p.pendingState(remoteID)
+	if pst == nil {
+		return nil, err
+	}
+	work := pst.clone()
+	plaintext, perr := work.decrypt(header, nonce, ct)
+	if perr != nil {
+		return nil, err
+	}
+	log.Printf("[%s] pending handshake with %s confirmed", p.Name, b64(remoteID)[:8])
+	work.unconfirmed = false
+	p.mu.Lock()
+	p.sess[keyOf(remoteID)] = work
+	delete(p.pending, keyOf(remoteID))
+	p.mu.Unlock()
+	return plaintext, nil
+}
 
-				var chainKey []byte
-        st.rootKey, chainKey = kdfRoot(st.rootKey, secret)
-        st.sendChain = NewSymmRatchet(chainKey)
-    }
+func (st *sessionState) encrypt(plaintext []byte) (header, nonce, ciphertext []byte, err error) {
+	// Falls noch keine Send‑Chain existiert (erster Send nach Richtungswechsel)
+	if st.sendChain == nil {
+		curve := ecdh.X25519()
+		if st.dhSendPrivKey, err = curve.GenerateKey(rand.Reader); err != nil { // neues DH‑Paar
+			return
+		}
+		var secret, chainKey []byte
+		if secret, err = st.dhSendPrivKey.ECDH(st.dhRecvPubKey); err != nil {
+			return
+		}
+		st.hks = st.nhks
+		if st.rootKey, chainKey, st.nhks, err = kdfRoot(st.kdf, st.rootKey, secret); err != nil {
+			return
+		}
+		st.sendChain = NewSymmRatchet(chainKey)
+		st.pn, st.ns = st.ns, 0
+	}
 
-    msgKey := st.sendChain.Next()
-    header := st.dhSendPrivKey.PublicKey().Bytes()
+	msgKey, err := st.nextMessageKey(st.sendChain)
+	if err != nil {
+		return
+	}
+	header, err = encryptHeader(st.suite, st.hks, ratchetHeader{
+		DH: st.dhSendPrivKey.PublicKey().Bytes(),
+		PN: st.pn,
+		N:  st.ns,
+	}, st.headerAD())
+	if err != nil {
+		return
+	}
+	st.ns++
 
-    nonce, ciphertext, err := encryptAEAD(msgKey, plaintext, header)
-    fmt.Printf("[%s] → %q\n", p.Name, plaintext)
-		return header, nonce, ciphertext, err
+	nonce, ciphertext, err = sealMessage(st.kdf, st.suite, msgKey, plaintext, st.messageAD(header))
+	return
 }
 
-// Entschlüsselt eine Nachricht (dreht DH‑Ratchet, falls Header‑Key neu ist)
-func (p *Peer) Decrypt(remoteID []byte, header []byte, nonce []byte, ct []byte) (string, []byte) {
-		st := p.state(remoteID)
-    curve := ecdh.X25519()
-    peerPub, _ := curve.NewPublicKey(header)
+// Der Header lässt sich entweder mit dem aktuellen Header‑Key (gleiche
+// Chain) oder dem nächsten (→ DH‑Ratchet) öffnen. Verspätete oder
+// vertauschte Nachrichten werden über den Skipped‑Key‑Cache entschlüsselt.
+func (st *sessionState) decrypt(header, nonce, ct []byte) ([]byte, error) {
+	// 0) Nachricht aus einer bereits übersprungenen Lücke?
+	if mk := st.takeSkipped(header); mk != nil {
+		return openMessage(st.kdf, st.suite, mk, nonce, ct, st.messageAD(header))
+	}
 
-    // 1) Neuer Header‑Key → DH‑Ratchet zuerst
-    if st.dhRecvPubKey == nil || !bytes.Equal(peerPub.Bytes(), st.dhRecvPubKey.Bytes()) {
-        secret, _ := st.dhSendPrivKey.ECDH(peerPub)     // DH(DHs, DHr′)
-				var chainKey []byte
-        st.rootKey, chainKey = kdfRoot(st.rootKey, secret)
-        st.recvChain = NewSymmRatchet(chainKey)
-        st.dhRecvPubKey = peerPub
-        st.sendChain = nil                              // zwingt beim Gegen‑Senden neues DH
-    }
+	// 1) Nächster Header‑Key → Rest der alten Chain sichern, dann DH‑Ratchet
+	h, err := decryptHeader(st.suite, st.hkr, header, st.headerAD())
+	if err != nil {
+		if h, err = decryptHeader(st.suite, st.nhkr, header, st.headerAD()); err != nil {
+			return nil, ErrBadHeader
+		}
+
+		curve := ecdh.X25519()
+		peerPub, err := curve.NewPublicKey(h.DH)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadHeader, err)
+		}
+
+		if err := st.skipMessageKeys(h.PN); err != nil {
+			return nil, err
+		}
+		secret, err := st.dhSendPrivKey.ECDH(peerPub) // DH(DHs, DHr′)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadHeader, err)
+		}
+		var chainKey []byte
+		st.hkr = st.nhkr
+		if st.rootKey, chainKey, st.nhkr, err = kdfRoot(st.kdf, st.rootKey, secret); err != nil {
+			return nil, err
+		}
+		st.recvChain = NewSymmRatchet(chainKey)
+		st.dhRecvPubKey = peerPub
+		st.nr = 0
+		st.sendChain = nil // zwingt beim Gegen‑Senden neues DH
+	}
+
+	// 2) Lücke bis N überspringen, Nachrichtenschlüssel ziehen & entschlüsseln
+	if err := st.skipMessageKeys(h.N); err != nil {
+		return nil, err
+	}
+	if st.recvChain == nil {
+		return nil, ErrBadHeader
+	}
+	msgKey, err := st.nextMessageKey(st.recvChain)
+	if err != nil {
+		return nil, err
+	}
+	st.nr++
+	return openMessage(st.kdf, st.suite, msgKey, nonce, ct, st.messageAD(header))
+}
 
-    // 2) Nachrichtenschlüssel ziehen & entschlüsseln
-    msgKey := st.recvChain.Next()
-    plaintext, err := decryptAEAD(msgKey, nonce, ct, header); check(err)
-		return p.Name, plaintext
+// clone kopiert den State so tief, dass ein verworfener Versuch das
+// Original nicht verändert.
+func (st *sessionState) clone() *sessionState {
+	c := *st
+	c.sendChain = maybeRatchet(st.sendCK())
+	c.recvChain = maybeRatchet(st.recvCK())
+	c.skipped = slices.Clone(st.skipped)
+	return &c
 }
 
 func (st *sessionState) sendCK() []byte {
-	if st.sendChain == nil { return nil }
+	if st.sendChain == nil {
+		return nil
+	}
 	return append([]byte(nil), st.sendChain.state...)
 }
 func (st *sessionState) recvCK() []byte {
-	if st.recvChain == nil { return nil }
+	if st.recvChain == nil {
+		return nil
+	}
 	return append([]byte(nil), st.recvChain.state...)
 }
 
@@ -15,14 +15,16 @@ var _ = Describe("Double-Ratchet End-to-End (Encrypt/Decrypt API)", func() {
 		bobID   := bob.IdentityPublicKey()
 
 		/* ── Sitzung 1: Bob initiiert ─────────────────────────────── */
-		init1 := bob.InitiateSession(alice.Bundle())
-		alice.AcceptSession(init1)
+		init1, err := bob.InitiateSession(alice.Bundle())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(alice.AcceptSession(init1)).To(Succeed())
 
 		Expect(alice.state(bobID).rootKey).To(Equal(bob.state(aliceID).rootKey))
 
 		sendAndVerify := func(src, dst *Peer, msg string) {
 			header, nonce, ct, _ := src.Encrypt(dst.IdentityPublicKey(), []byte(msg))
-			_, plain := dst.Decrypt(src.IdentityPublicKey(), header, nonce, ct)
+			plain, err := dst.Decrypt(src.IdentityPublicKey(), header, nonce, ct)
+			Expect(err).NotTo(HaveOccurred())
 
 			Expect(plain).To(Equal([]byte(msg)))
 			Expect(src.state(dst.IdentityPublicKey()).rootKey).
@@ -35,10 +37,12 @@ var _ = Describe("Double-Ratchet End-to-End (Encrypt/Decrypt API)", func() {
 		sendAndVerify(alice, bob,   "Alles angekommen.")
 
 		/* ── Sitzung 2: Alice initiiert ───────────────────────────── */
-		init2 := alice.InitiateSession(bob.Bundle())
-		bob.AcceptSession(init2)
+		init2, err := alice.InitiateSession(bob.Bundle())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bob.AcceptSession(init2)).To(Succeed())
 
-		Expect(alice.state(bobID).rootKey).To(Equal(bob.state(aliceID).rootKey))
+		// Bobs Session steht, der neue Handshake wartet auf Alices erste Nachricht
+		Expect(alice.state(bobID).rootKey).To(Equal(bob.pendingState(aliceID).rootKey))
 
 		sendAndVerify(alice, bob, "Neue Session: Nachricht 1")
 		sendAndVerify(alice, bob, "Nachricht 2")
@@ -56,12 +60,10 @@ var _ = Describe("Double-Ratchet End-to-End (Encrypt/Decrypt API)", func() {
 		tomID   := tom.IdentityPublicKey()
 
 		/* ── Handshake mit Bob ─────────────────────────── */
-		initBob := alice.InitiateSession(bob.Bundle())
-		bob.AcceptSession(initBob)
+		handshake(alice, bob)
 
 		/* ── Handshake mit Tom ─────────────────────────── */
-		initTom := alice.InitiateSession(tom.Bundle())
-		tom.AcceptSession(initTom)
+		handshake(alice, tom)
 
 		/* ── RootKeys korrekt gespiegelt, aber unterschiedlich ───────── */
 		Expect(alice.state(bobID).rootKey).To(Equal(bob.state(aliceID).rootKey))
@@ -70,7 +72,7 @@ var _ = Describe("Double-Ratchet End-to-End (Encrypt/Decrypt API)", func() {
 
 		send := func(src, dst *Peer, dstID []byte, msg string) {
 			h, n, ct, _ := src.Encrypt(dstID, []byte(msg))
-			_, plain    := dst.Decrypt(src.IdentityPublicKey(), h, n, ct)
+			plain, _    := dst.Decrypt(src.IdentityPublicKey(), h, n, ct)
 			Expect(string(plain)).To(Equal(msg))
 		}
 
@@ -87,5 +89,174 @@ var _ = Describe("Double-Ratchet End-to-End (Encrypt/Decrypt API)", func() {
 		Expect(bob.state(aliceID).rootKey).NotTo(Equal(tom.state(aliceID).rootKey))
 	})
 
+	It("decrypts reordered and late messages via the skipped-key cache", func() {
+
+		alice := NewPeer("Alice")
+		bob   := NewPeer("Bob")
+
+		aliceID := alice.IdentityPublicKey()
+		bobID   := bob.IdentityPublicKey()
+
+		handshake(alice, bob)
+
+		type frame struct{ h, n, ct []byte }
+		enc := func(src *Peer, dstID []byte, msg string) frame {
+			h, n, ct, err := src.Encrypt(dstID, []byte(msg))
+			Expect(err).NotTo(HaveOccurred())
+			return frame{h, n, ct}
+		}
+		dec := func(dst *Peer, srcID []byte, f frame) string {
+			plain, err := dst.Decrypt(srcID, f.h, f.n, f.ct)
+			Expect(err).NotTo(HaveOccurred())
+			return string(plain)
+		}
+
+		a0 := enc(alice, bobID, "a0")
+		a1 := enc(alice, bobID, "a1")
+		a2 := enc(alice, bobID, "a2")
+
+		/* ── a2 kommt zuerst, a0/a1 landen im Cache ── */
+		Expect(dec(bob, aliceID, a2)).To(Equal("a2"))
+		Expect(bob.state(aliceID).skipped).To(HaveLen(2))
+
+		/* ── Richtungswechsel, danach trudelt a1 verspätet ein ── */
+		b0 := enc(bob, aliceID, "b0")
+		Expect(dec(alice, bobID, b0)).To(Equal("b0"))
+		a3 := enc(alice, bobID, "a3")
+
+		Expect(dec(bob, aliceID, a1)).To(Equal("a1"))
+		Expect(dec(bob, aliceID, a3)).To(Equal("a3"))
+		Expect(dec(bob, aliceID, a0)).To(Equal("a0"))
+		Expect(bob.state(aliceID).skipped).To(BeEmpty())
+	})
+
+	It("skips the rest of the previous chain when a new ratchet key arrives", func() {
+
+		alice := NewPeer("Alice")
+		bob   := NewPeer("Bob")
+
+		aliceID := alice.IdentityPublicKey()
+		bobID   := bob.IdentityPublicKey()
+
+		handshake(alice, bob)
+
+		h, n, ct, _ := alice.Encrypt(bobID, []byte("hello"))
+		bob.Decrypt(aliceID, h, n, ct)
+
+		// Bob sendet zwei Nachrichten, nur die zweite kommt an
+		lh, ln, lct, _ := bob.Encrypt(aliceID, []byte("lost"))
+		h, n, ct, _ = bob.Encrypt(aliceID, []byte("second"))
+		plain, _ := alice.Decrypt(bobID, h, n, ct)
+		Expect(string(plain)).To(Equal("second"))
+
+		// Alice antwortet → neuer Ratchet-Key mit PN = 0
+		h, n, ct, _ = alice.Encrypt(bobID, []byte("reply"))
+		plain, _ = bob.Decrypt(aliceID, h, n, ct)
+		Expect(string(plain)).To(Equal("reply"))
+
+		// die verlorene Nachricht wird später doch noch zugestellt
+		plain, _ = alice.Decrypt(bobID, lh, ln, lct)
+		Expect(string(plain)).To(Equal("lost"))
+	})
+
+
+	It("encrypts the ratchet header", func() {
+
+		alice := NewPeer("Alice")
+		bob   := NewPeer("Bob")
+		handshake(alice, bob)
+
+		bobID := bob.IdentityPublicKey()
+		h1, _, _, _ := alice.Encrypt(bobID, []byte("one"))
+		h2, _, _, _ := alice.Encrypt(bobID, []byte("two"))
+
+		dhPub := alice.state(bobID).dhSendPrivKey.PublicKey().Bytes()
+		Expect(h1).NotTo(ContainSubstring(string(dhPub)))
+		Expect(h1).NotTo(HaveLen(headerLen))
+		// gleiche Chain, trotzdem keine gemeinsamen Header-Bytes
+		Expect(h1[12:]).NotTo(Equal(h2[12:]))
+
+		hdr, err := decryptHeader(alice.state(bobID).suite, alice.state(bobID).hks, h2, alice.state(bobID).ad)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hdr.DH).To(Equal(dhPub))
+		Expect(hdr.N).To(Equal(uint32(1)))
+	})
+
+
+	It("returns typed errors and leaves the ratchet untouched on forged input", func() {
+
+		alice := NewPeer("Alice")
+		bob   := NewPeer("Bob")
+		handshake(alice, bob)
+
+		aliceID, bobID := alice.IdentityPublicKey(), bob.IdentityPublicKey()
+
+		_, _, _, err := alice.Encrypt(NewPeer("Mallory").IdentityPublicKey(), []byte("x"))
+		Expect(err).To(MatchError(ErrNoSession))
+		_, err = bob.Decrypt(NewPeer("Mallory").IdentityPublicKey(), nil, nil, nil)
+		Expect(err).To(MatchError(ErrNoSession))
+
+		h, n, ct, _ := alice.Encrypt(bobID, []byte("echt"))
+		before := bob.state(aliceID).clone()
+
+		// manipulierter Ciphertext
+		forged := append([]byte(nil), ct...)
+		forged[0] ^= 0x01
+		_, err = bob.Decrypt(aliceID, h, n, forged)
+		Expect(err).To(MatchError(ErrAuthFailed))
+
+		// Header-Müll
+		_, err = bob.Decrypt(aliceID, []byte("garbage"), n, ct)
+		Expect(err).To(MatchError(ErrBadHeader))
+		badHdr := append([]byte(nil), h...)
+		badHdr[len(badHdr)-1] ^= 0x01
+		_, err = bob.Decrypt(aliceID, badHdr, n, ct)
+		Expect(err).To(MatchError(ErrBadHeader))
+
+		after := bob.state(aliceID)
+		Expect(after.rootKey).To(Equal(before.rootKey))
+		Expect(after.recvCK()).To(Equal(before.recvCK()))
+		Expect(after.nr).To(Equal(before.nr))
+		Expect(after.skipped).To(BeEmpty())
+
+		// die echte Nachricht geht danach trotzdem durch
+		plain, err := bob.Decrypt(aliceID, h, n, ct)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(plain)).To(Equal("echt"))
+	})
+
+	It("rejects gaps larger than the skip limit", func() {
+
+		alice := NewPeer("Alice")
+		bob   := NewPeer("Bob")
+		handshake(alice, bob)
+
+		aliceID, bobID := alice.IdentityPublicKey(), bob.IdentityPublicKey()
+		alice.state(bobID).ns = maxSkip + 1
+
+		h, n, ct, _ := alice.Encrypt(bobID, []byte("zu weit"))
+		_, err := bob.Decrypt(aliceID, h, n, ct)
+		Expect(err).To(MatchError(ErrTooManySkipped))
+		Expect(bob.state(aliceID).skipped).To(BeEmpty())
+	})
+
+	It("rejects malformed init messages", func() {
+
+		alice := NewPeer("Alice")
+		bob   := NewPeer("Bob")
+
+		initMsg, _ := alice.InitiateSession(bob.Bundle())
+		initMsg.EphemeralPub = []byte("kurz")
+		Expect(bob.AcceptSession(initMsg)).To(MatchError(ErrBadInit))
+		Expect(bob.sess).To(BeEmpty())
+	})
+
 })
 
+// handshake führt X3DH zwischen initiator und responder durch.
+func handshake(initiator, responder *Peer) InitMessage {
+	initMsg, err := initiator.InitiateSession(responder.Bundle())
+	Expect(err).NotTo(HaveOccurred())
+	Expect(responder.AcceptSession(initMsg)).To(Succeed())
+	return initMsg
+}
@@ -1,7 +1,14 @@
 package chat
 
+import "time"
+
+// Version 2: Header-Encryption (Header-Keys + Skipped-Keys nach Header-Key).
+// Version 3: KDF-Version und Associated Data pro Session.
+// Ältere Versionen werden beim Laden migriert.
+const persistVersion = 3
+
 type persistState struct {
-	Version byte   `json:"v"`   // aktuell 1
+	Version byte   `json:"v"`   // aktuell persistVersion
 	RootKey []byte `json:"rk"`
 
 	DHSPriv []byte `json:"dhs"` // send-priv
@@ -9,4 +16,53 @@ type persistState struct {
 
 	SendCK []byte `json:"sc"`   // aktueller Send-Chain-Key (optional)
 	RecvCK []byte `json:"rc"`   // aktueller Recv-Chain-Key (optional)
+
+	Proto byte `json:"proto,omitempty"` // Protokollversion (fehlt → v1)
+	Suite byte `json:"suite,omitempty"` // AEAD-Suite (fehlt → AES-256-GCM)
+
+	HS  byte   `json:"hs,omitempty"`  // Handshake-Variante (0 = Alt-Session)
+	KDF byte   `json:"kdf,omitempty"` // KDF-Version (fehlt bis v2 → kdfV1)
+	AD  []byte `json:"ad,omitempty"`  // IK_Initiator ‖ IK_Responder
+
+	Ns uint32 `json:"ns,omitempty"` // Nachrichtenzähler Send-Chain
+	Nr uint32 `json:"nr,omitempty"` // Nachrichtenzähler Recv-Chain
+	PN uint32 `json:"pn,omitempty"` // Länge der vorherigen Send-Chain
+
+	HKs  []byte `json:"hks,omitempty"`  // Header-Key Send
+	HKr  []byte `json:"hkr,omitempty"`  // Header-Key Recv
+	NHKs []byte `json:"nhks,omitempty"` // nächster Header-Key Send
+	NHKr []byte `json:"nhkr,omitempty"` // nächster Header-Key Recv
+
+	Skipped []persistSkipped `json:"sk,omitempty"` // Cache für verspätete Nachrichten
+
+	Unconfirmed bool `json:"uc,omitempty"` // noch keine Nachricht der Gegenseite entschlüsselt
+}
+
+type persistSkipped struct {
+	HK []byte `json:"hk,omitempty"`
+	DH []byte `json:"dh,omitempty"` // nur Version 1
+	N  uint32 `json:"n"`
+	MK []byte `json:"mk"`
+}
+
+// persistPreKeys ist das (verschlüsselt gespeicherte) Pre-Key-Material.
+type persistPreKeys struct {
+	Version byte                   `json:"v"` // aktuell 1
+	Signed  []persistSignedPreKey  `json:"spk"`
+	OneTime []persistOneTimePreKey `json:"opk"`
+	NextID  uint32                 `json:"next"`
+}
+
+type persistSignedPreKey struct {
+	ID      uint32    `json:"id"`
+	Priv    []byte    `json:"priv"`
+	Sig     []byte    `json:"sig"`
+	KEMSeed []byte    `json:"kem,omitempty"` // ML-KEM-768-Seed (64 Byte)
+	KEMSig  []byte    `json:"ksig,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+type persistOneTimePreKey struct {
+	ID   uint32 `json:"id"`
+	Priv []byte `json:"priv"`
 }
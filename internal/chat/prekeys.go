@@ -0,0 +1,183 @@
+package chat
+
+import (
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hkdf"
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	oneTimePreKeyCount = 100                // Poolgröße nach dem Auffüllen
+	oneTimePreKeyMin   = 20                 // darunter wird nachgefüllt
+	signedPreKeyMaxAge = 7 * 24 * time.Hour // danach wird rotiert
+	signedPreKeyKeep   = 2                  // Vorgänger, die noch angenommen werden
+)
+
+var (
+	ErrBadSignature  = errors.New("bundle signature invalid")
+	ErrUnknownPreKey = errors.New("unknown signed prekey")
+	ErrPreKeyReused  = errors.New("one-time prekey unknown or already used")
+	ErrDowngrade     = errors.New("handshake downgraded from pqxdh")
+)
+
+// Handshake-Varianten; wird pro Session mitgespeichert, damit alte
+// X3DH-Sessions unverändert weiterlaufen, während neue hybrid sind.
+const (
+	handshakeX3DH  byte = 1 // nur X25519
+	handshakePQXDH byte = 2 // X25519 + ML-KEM-768
+)
+
+// signedPreKey bündelt den X25519-SPK mit dem gleichzeitig rotierten
+// ML-KEM-768-Pre-Key. kem ist nil bei Pre-Keys aus der Zeit vor PQXDH.
+type signedPreKey struct {
+	id      uint32
+	priv    *ecdh.PrivateKey
+	sig     []byte
+	kem     *mlkem.DecapsulationKey768
+	kemSig  []byte
+	created time.Time
+}
+
+// preKeySet hält das private Pre-Key-Material eines Peers.
+type preKeySet struct {
+	signed  []*signedPreKey // [0] = aktueller Signed-Pre-Key, danach Vorgänger
+	oneTime map[uint32]*ecdh.PrivateKey
+	nextID  uint32
+}
+
+// Der Signaturschlüssel für Gerätelisten wird deterministisch aus dem
+// Identity-Key abgeleitet, damit identity.id das einzige langlebige
+// Geheimnis bleibt. Pre-Keys signiert der Identity-Key selbst (XEdDSA).
+func deriveSigningKey(idPriv *ecdh.PrivateKey) (ed25519.PrivateKey, error) {
+	seed, err := hkdf.Key(sha256.New, idPriv.Bytes(), nil, "zero identity signing key", ed25519.SeedSize)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// Signiert wird IK ‖ SPK-ID ‖ SPK, damit ein Pre-Key nicht unter eine
+// fremde Identität geschoben werden kann.
+func spkSignedData(idPub []byte, id uint32, spk []byte) []byte {
+	buf := make([]byte, 0, 8+len(idPub)+4+len(spk))
+	buf = append(buf, "zero-spk"...)
+	buf = append(buf, idPub...)
+	buf = binary.BigEndian.AppendUint32(buf, id)
+	return append(buf, spk...)
+}
+
+func kemSignedData(idPub []byte, id uint32, ek []byte) []byte {
+	buf := make([]byte, 0, 8+len(idPub)+4+len(ek))
+	buf = append(buf, "zero-kem"...)
+	buf = append(buf, idPub...)
+	buf = binary.BigEndian.AppendUint32(buf, id)
+	return append(buf, ek...)
+}
+
+func newPreKeySet(idPriv *ecdh.PrivateKey) (*preKeySet, error) {
+	ks := &preKeySet{oneTime: map[uint32]*ecdh.PrivateKey{}, nextID: 1}
+	if err := ks.rotateSigned(idPriv); err != nil {
+		return nil, err
+	}
+	return ks, ks.refill()
+}
+
+func (ks *preKeySet) newID() uint32 {
+	id := ks.nextID
+	ks.nextID++
+	return id
+}
+
+// rotateSigned erzeugt einen neuen Signed-Pre-Key; die letzten Vorgänger
+// bleiben für noch unterwegs befindliche Init-Nachrichten gültig.
+func (ks *preKeySet) rotateSigned(idPriv *ecdh.PrivateKey) error {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	kem, err := mlkem.GenerateKey768()
+	if err != nil {
+		return err
+	}
+	idPub, id := idPriv.PublicKey().Bytes(), ks.newID()
+	sig, err := xeddsaSign(idPriv, spkSignedData(idPub, id, priv.PublicKey().Bytes()))
+	if err != nil {
+		return err
+	}
+	kemSig, err := xeddsaSign(idPriv, kemSignedData(idPub, id, kem.EncapsulationKey().Bytes()))
+	if err != nil {
+		return err
+	}
+	spk := &signedPreKey{
+		id:      id,
+		priv:    priv,
+		sig:     sig,
+		kem:     kem,
+		kemSig:  kemSig,
+		created: time.Now().UTC(),
+	}
+	ks.signed = append([]*signedPreKey{spk}, ks.signed...)
+	if len(ks.signed) > 1+signedPreKeyKeep {
+		ks.signed = ks.signed[:1+signedPreKeyKeep]
+	}
+	return nil
+}
+
+func (ks *preKeySet) refill() error {
+	for len(ks.oneTime) < oneTimePreKeyCount {
+		priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		ks.oneTime[ks.newID()] = priv
+	}
+	return nil
+}
+
+func (ks *preKeySet) signedByID(id uint32) *signedPreKey {
+	for _, spk := range ks.signed {
+		if spk.id == id {
+			return spk
+		}
+	}
+	return nil
+}
+
+// nextOneTime liefert den One-Time-Pre-Key mit der kleinsten ID (0 = keiner).
+func (ks *preKeySet) nextOneTime() (uint32, *ecdh.PrivateKey) {
+	var best uint32
+	for id := range ks.oneTime {
+		if best == 0 || id < best {
+			best = id
+		}
+	}
+	return best, ks.oneTime[best]
+}
+
+// verifyBundle prüft die Pre-Key-Signaturen gegen den Identity-Key des
+// Bundles – den Schlüssel, den die Sicherheitsnummer zeigt.
+func verifyBundle(b Bundle) error {
+	if !xeddsaVerify(b.IdentityPub, spkSignedData(b.IdentityPub, b.SignedPreKeyID, b.SignedPreKey), b.SignedPreKeySig) {
+		return ErrBadSignature
+	}
+	if len(b.KEMPreKey) > 0 &&
+		!xeddsaVerify(b.IdentityPub, kemSignedData(b.IdentityPub, b.SignedPreKeyID, b.KEMPreKey), b.KEMPreKeySig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func u32b(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+
+func bu32(b []byte) (uint32, bool) {
+	if len(b) != 4 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(b), true
+}
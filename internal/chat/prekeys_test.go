@@ -0,0 +1,205 @@
+package chat
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("X3DH Pre-Keys", func() {
+
+	It("rejects bundles with a bad signature", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+
+		b := bob.Bundle()
+		b.SignedPreKey = alice.Bundle().SignedPreKey // untergeschobener SPK
+
+		_, err := alice.InitiateSession(b)
+		Expect(err).To(MatchError(ErrBadSignature))
+		Expect(alice.sess).To(BeEmpty())
+	})
+
+	It("rejects bundles re-signed by anyone but the identity key", func() {
+		alice, bob, mallory := NewPeer("Alice"), NewPeer("Bob"), NewPeer("Mallory")
+
+		// Mallory schiebt ihren SPK unter Bobs Identität und signiert selbst
+		b := bob.Bundle()
+		b.SignedPreKeyID, b.SignedPreKey = 7, mallory.Bundle().SignedPreKey
+		signed := spkSignedData(b.IdentityPub, b.SignedPreKeyID, b.SignedPreKey)
+		var err error
+		b.SignedPreKeySig, err = xeddsaSign(mallory.identityPrivKey, signed)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = alice.InitiateSession(b)
+		Expect(err).To(MatchError(ErrBadSignature))
+
+		_, foreign, _ := ed25519.GenerateKey(nil)
+		b.SignedPreKeySig = ed25519.Sign(foreign, signed)
+		_, err = alice.InitiateSession(b)
+		Expect(err).To(MatchError(ErrBadSignature))
+
+		// echte Bundles gelten, gleich welches Vorzeichen der Edwards-Punkt hat
+		for range 16 {
+			Expect(verifyBundle(NewPeer("Carol").Bundle())).To(Succeed())
+		}
+	})
+
+	It("replaces a signed prekey from before XEdDSA", func() {
+		bob := NewPeer("Bob")
+		spk := bob.preKeys.signed[0]
+		spk.sig = ed25519.Sign(bob.signingPrivKey, spkSignedData(bob.IdentityPublicKey(), spk.id, spk.priv.PublicKey().Bytes()))
+		Expect(verifyBundle(bob.Bundle())).To(MatchError(ErrBadSignature))
+
+		Expect(bob.RefreshPreKeys()).To(Succeed())
+		Expect(bob.Bundle().SignedPreKeyID).NotTo(Equal(spk.id))
+		Expect(verifyBundle(bob.Bundle())).To(Succeed())
+	})
+
+	It("consumes a one-time prekey exactly once", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+
+		b := bob.Bundle()
+		Expect(b.OneTimePreKeyID).NotTo(BeZero())
+
+		initMsg, err := alice.InitiateSession(b)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bob.AcceptSession(initMsg)).To(Succeed())
+		Expect(bob.preKeys.oneTime).NotTo(HaveKey(b.OneTimePreKeyID))
+
+		// Replay derselben Init-Nachricht
+		Expect(bob.AcceptSession(initMsg)).To(MatchError(ErrPreKeyReused))
+		Expect(bob.Bundle().OneTimePreKeyID).NotTo(Equal(b.OneTimePreKeyID))
+	})
+
+	It("works without one-time prekeys once the pool is empty", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		clear(bob.preKeys.oneTime)
+
+		b := bob.Bundle()
+		Expect(b.OneTimePreKey).To(BeEmpty())
+		initMsg, err := alice.InitiateSession(b)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(initMsg.OneTimePreKeyID).To(BeZero())
+		Expect(bob.AcceptSession(initMsg)).To(Succeed())
+		Expect(alice.state(bob.IdentityPublicKey()).rootKey).
+			To(Equal(bob.state(alice.IdentityPublicKey()).rootKey))
+	})
+
+	It("keeps accepting the previous signed prekey after rotation", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+
+		old := bob.Bundle()
+		bob.preKeys.signed[0].created = time.Now().Add(-2 * signedPreKeyMaxAge)
+		Expect(bob.RefreshPreKeys()).To(Succeed())
+		Expect(bob.Bundle().SignedPreKeyID).NotTo(Equal(old.SignedPreKeyID))
+
+		initMsg, err := alice.InitiateSession(old)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bob.AcceptSession(initMsg)).To(Succeed())
+
+		// nach genügend Rotationen fliegt der alte SPK raus
+		for range signedPreKeyKeep {
+			Expect(bob.preKeys.rotateSigned(bob.identityPrivKey)).To(Succeed())
+		}
+		initMsg, _ = NewPeer("Carol").InitiateSession(old)
+		Expect(bob.AcceptSession(initMsg)).To(MatchError(ErrUnknownPreKey))
+	})
+
+	It("stores prekeys encrypted and restores them", func() {
+		tmp := GinkgoT().TempDir()
+		store, _ := NewStore(tmp)
+		bob := NewPeer("Bob")
+
+		Expect(store.SavePreKeys(bob.preKeys)).To(Succeed())
+
+		raw, err := os.ReadFile(filepath.Join(tmp, "prekeys.bin"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(raw).NotTo(ContainSubstring(string(bob.preKeys.signed[0].priv.Bytes())))
+
+		ks, err := store.LoadPreKeys()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ks.nextID).To(Equal(bob.preKeys.nextID))
+		Expect(ks.oneTime).To(HaveLen(len(bob.preKeys.oneTime)))
+		Expect(ks.signed[0].priv.Bytes()).To(Equal(bob.preKeys.signed[0].priv.Bytes()))
+		Expect(ks.signed[0].kem.Bytes()).To(Equal(bob.preKeys.signed[0].kem.Bytes()))
+	})
+})
+
+var _ = Describe("PQXDH (ML-KEM-768 hybrid)", func() {
+
+	It("establishes hybrid sessions when the bundle carries a KEM key", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+
+		initMsg, err := alice.InitiateSession(bob.Bundle())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(initMsg.KEMCiphertext).NotTo(BeEmpty())
+		Expect(bob.AcceptSession(initMsg)).To(Succeed())
+
+		aSt, bSt := alice.state(bob.IdentityPublicKey()), bob.state(alice.IdentityPublicKey())
+		Expect(aSt.handshake).To(Equal(handshakePQXDH))
+		Expect(bSt.handshake).To(Equal(handshakePQXDH))
+		Expect(aSt.rootKey).To(Equal(bSt.rootKey))
+	})
+
+	It("rejects a swapped KEM key", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+
+		b := bob.Bundle()
+		b.KEMPreKey = alice.Bundle().KEMPreKey
+
+		_, err := alice.InitiateSession(b)
+		Expect(err).To(MatchError(ErrBadSignature))
+	})
+
+	It("derives a different root key when the KEM ciphertext is tampered with", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+
+		initMsg, _ := alice.InitiateSession(bob.Bundle())
+		initMsg.KEMCiphertext[0] ^= 0xff
+		Expect(bob.AcceptSession(initMsg)).To(Succeed())
+
+		Expect(alice.state(bob.IdentityPublicKey()).rootKey).
+			NotTo(Equal(bob.state(alice.IdentityPublicKey()).rootKey))
+	})
+
+	It("refuses to downgrade to X3DH when the peer offered a KEM key", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+
+		// unterwegs gekürztes Bundle: Bob weiß, dass sein SPK hybrid ist
+		stripped := bob.Bundle()
+		stripped.KEMPreKey, stripped.KEMPreKeySig = nil, nil
+		initMsg, err := alice.InitiateSession(stripped)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(initMsg.Handshake).NotTo(Equal(handshakePQXDH))
+		Expect(bob.AcceptSession(initMsg)).To(MatchError(ErrDowngrade))
+
+		// nach einer hybriden Session nimmt Alice kein Bundle ohne KEM mehr an
+		initMsg, err = alice.InitiateSession(bob.Bundle())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bob.AcceptSession(initMsg)).To(Succeed())
+		stripped = bob.Bundle()
+		stripped.KEMPreKey, stripped.KEMPreKeySig = nil, nil
+		_, err = alice.InitiateSession(stripped)
+		Expect(err).To(MatchError(ErrDowngrade))
+		Expect(alice.state(bob.IdentityPublicKey()).handshake).To(Equal(handshakePQXDH))
+	})
+
+	It("falls back to classic X3DH for prekeys created before PQXDH", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		bob.preKeys.signed[0].kem = nil
+
+		b := bob.Bundle()
+		Expect(b.KEMPreKey).To(BeEmpty())
+		initMsg, err := alice.InitiateSession(b)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bob.AcceptSession(initMsg)).To(Succeed())
+		Expect(bob.state(alice.IdentityPublicKey()).handshake).To(Equal(handshakeX3DH))
+
+		// beim nächsten Refresh bekommt Bob einen hybriden SPK
+		Expect(bob.RefreshPreKeys()).To(Succeed())
+		Expect(bob.Bundle().KEMPreKey).NotTo(BeEmpty())
+	})
+})
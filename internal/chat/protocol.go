@@ -0,0 +1,126 @@
+package chat
+
+import (
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Protokollversionen. Der Initiator bietet im Handshake alle Versionen
+// und AEAD-Suites an, die er kennt; beide Seiten einigen sich auf die
+// höchste gemeinsame Version.
+//
+//	v1 – Alt-Protokoll: untypisierte Init-Map, fest AES-256-GCM
+//	v2 – versionierter Umschlag, AEAD-Suite verhandelt, Angebot und Wahl
+//	     fließen in die Schlüsselableitung ein (kein stiller Downgrade)
+const (
+	protocolV1 byte = 1
+	protocolV2 byte = 2
+)
+
+// AEAD-Suites für Nachrichten und Header.
+const (
+	suiteAES256GCM        byte = 1
+	suiteChaCha20Poly1305 byte = 2
+)
+
+var (
+	// eigene Fähigkeiten; Suites in Präferenzreihenfolge
+	supportedVersions = []byte{protocolV2, protocolV1}
+	supportedSuites   = []byte{suiteAES256GCM, suiteChaCha20Poly1305}
+)
+
+var (
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+	ErrUnsupportedSuite   = errors.New("unsupported cipher suite")
+)
+
+// legacyOffer ergänzt das Angebot eines Peers, der noch keine Versionen
+// ankündigt (Bundle oder Init von vor v2).
+func legacyOffer(versions, suites []byte) ([]byte, []byte) {
+	if len(versions) == 0 {
+		return []byte{protocolV1}, []byte{suiteAES256GCM}
+	}
+	return versions, suites
+}
+
+// negotiate wählt die höchste gemeinsame Version und die erste Suite aus
+// der Präferenzliste des Initiators, die auch der Responder kennt. Beide
+// Seiten rechnen dasselbe und kommen so zum selben Ergebnis.
+func negotiate(initVersions, initSuites, respVersions, respSuites []byte) (version, suite byte, err error) {
+	for _, v := range initVersions {
+		if v > version && slices.Contains(respVersions, v) {
+			version = v
+		}
+	}
+	switch version {
+	case 0:
+		return 0, 0, fmt.Errorf("%w: offered %v, supported %v", ErrUnsupportedVersion, initVersions, respVersions)
+	case protocolV1:
+		return protocolV1, suiteAES256GCM, nil
+	}
+	for _, s := range initSuites {
+		if slices.Contains(respSuites, s) {
+			return version, s, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("%w: offered %v, supported %v", ErrUnsupportedSuite, initSuites, respSuites)
+}
+
+// transcript ist das ausgehandelte Ergebnis samt Angebot des Initiators.
+// Ab v2 geht es in die X3DH-KDF ein: wer das Angebot unterwegs verändert,
+// erzeugt auf beiden Seiten verschiedene Schlüssel.
+func (m InitMessage) transcript() []byte {
+	if m.Version < protocolV2 {
+		return nil
+	}
+	t := []byte{m.Version, m.Suite, byte(len(m.Versions))}
+	t = append(t, m.Versions...)
+	t = append(t, byte(len(m.Suites)))
+	return append(t, m.Suites...)
+}
+
+func newAEAD(suite byte, key []byte) (cipher.AEAD, error) {
+	switch suite {
+	case suiteChaCha20Poly1305:
+		return chacha20poly1305.New(key)
+	case suiteAES256GCM, 0: // 0 = Alt-Session
+		return newGCM(key)
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnsupportedSuite, suite)
+}
+
+// checkVersion prüft die Protokollversion einer eingehenden CipherMessage
+// gegen die der Session oder eines vorgemerkten Handshakes (fehlende
+// Version = v1).
+func (p *Peer) checkVersion(remoteID []byte, v byte) error {
+	defer p.lockRemote(remoteID)()
+	st, ok := p.lookup(remoteID)
+	pst := p.pendingState(remoteID)
+	if !ok && pst == nil {
+		return ErrNoSession
+	}
+	if v == 0 {
+		v = protocolV1
+	}
+	if pst != nil && slices.Contains(p.versions, v) && v == pst.protocol() {
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("%w: message v%d, session v%d", ErrUnsupportedVersion, v, pst.protocol())
+	}
+	if !slices.Contains(p.versions, v) || v != st.protocol() {
+		return fmt.Errorf("%w: message v%d, session v%d", ErrUnsupportedVersion, v, st.protocol())
+	}
+	return nil
+}
+
+func (st *sessionState) protocol() byte {
+	if st.version == 0 {
+		return protocolV1
+	}
+	return st.version
+}
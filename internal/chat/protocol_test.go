@@ -0,0 +1,94 @@
+package chat
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Protokoll-Verhandlung", func() {
+
+	roundtrip := func(alice, bob *Peer) {
+		h, n, ct, err := alice.Encrypt(bob.IdentityPublicKey(), []byte("ping"))
+		Expect(err).NotTo(HaveOccurred())
+		plain, err := bob.Decrypt(alice.IdentityPublicKey(), h, n, ct)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(plain)).To(Equal("ping"))
+
+		h, n, ct, err = bob.Encrypt(alice.IdentityPublicKey(), []byte("pong"))
+		Expect(err).NotTo(HaveOccurred())
+		plain, err = alice.Decrypt(bob.IdentityPublicKey(), h, n, ct)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(plain)).To(Equal("pong"))
+	}
+
+	It("einigt sich auf die höchste gemeinsame Version", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		initMsg := handshake(alice, bob)
+
+		Expect(initMsg.Version).To(Equal(protocolV2))
+		Expect(initMsg.Suite).To(Equal(suiteAES256GCM))
+		Expect(bob.state(alice.IdentityPublicKey()).version).To(Equal(protocolV2))
+		roundtrip(alice, bob)
+	})
+
+	It("verwendet ChaCha20-Poly1305, wenn der Responder nur das kann", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		bob.suites = []byte{suiteChaCha20Poly1305}
+
+		initMsg := handshake(alice, bob)
+		Expect(initMsg.Suite).To(Equal(suiteChaCha20Poly1305))
+		Expect(alice.state(bob.IdentityPublicKey()).suite).To(Equal(suiteChaCha20Poly1305))
+		roundtrip(alice, bob)
+	})
+
+	It("fällt auf v1 mit AES-256-GCM zurück", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		bob.versions = []byte{protocolV1}
+		alice.suites = []byte{suiteChaCha20Poly1305, suiteAES256GCM}
+
+		initMsg := handshake(alice, bob)
+		Expect(initMsg.Version).To(Equal(protocolV1))
+		Expect(initMsg.Suite).To(Equal(suiteAES256GCM))
+		roundtrip(alice, bob)
+	})
+
+	It("lehnt unbekannte Versionen und fehlende Gemeinsamkeiten ab", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+
+		initMsg, err := alice.InitiateSession(bob.Bundle())
+		Expect(err).NotTo(HaveOccurred())
+		bad := initMsg
+		bad.Version = 7
+		Expect(bob.AcceptSession(bad)).To(MatchError(ErrUnsupportedVersion))
+
+		bob.versions = []byte{9}
+		_, err = alice.InitiateSession(bob.Bundle())
+		Expect(err).To(MatchError(ErrUnsupportedVersion))
+
+		bob.versions, bob.suites = []byte{protocolV2}, []byte{42}
+		_, err = alice.InitiateSession(bob.Bundle())
+		Expect(err).To(MatchError(ErrUnsupportedSuite))
+	})
+
+	It("erkennt einen manipulierten Downgrade", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+
+		// Angreifer kürzt Bobs Angebot im Bundle auf v1
+		b := bob.Bundle()
+		b.Versions = []byte{protocolV1}
+		initMsg, err := alice.InitiateSession(b)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bob.AcceptSession(initMsg)).To(MatchError(ErrBadInit))
+
+		// Angreifer ändert die Suite-Liste im Init → andere Schlüssel
+		initMsg, err = alice.InitiateSession(bob.Bundle())
+		Expect(err).NotTo(HaveOccurred())
+		initMsg.Suites = []byte{suiteAES256GCM}
+		Expect(bob.AcceptSession(initMsg)).To(Succeed())
+
+		h, n, ct, err := alice.Encrypt(bob.IdentityPublicKey(), []byte("x"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = bob.Decrypt(alice.IdentityPublicKey(), h, n, ct)
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,165 @@
+package chat
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"unicode/utf8"
+)
+
+// Antworten und Reaktionen. Eine Antwort ist eine normale Textnachricht
+// mit Zitat (ID und Ausschnitt des Originals); eine Reaktion ist ein
+// Log-Eintrag wie ein Edit (Change = reaction), den loadLog an die
+// Nachricht hängt. Pro Seite gilt die letzte Reaktion, Remove nimmt sie
+// zurück.
+const (
+	maxSnippetLen  = 120 // Zeichen im Zitat
+	maxReactionLen = 64  // Bytes, reicht für Emoji mit ZWJ und Hautfarbe
+)
+
+type quoteBody struct {
+	ID   string `json:"id"`
+	Text string `json:"text"` // Ausschnitt beim Absenden
+}
+
+type reactionBody struct {
+	Ref    string `json:"ref"`
+	Emoji  string `json:"emoji,omitempty"`
+	Remove bool   `json:"remove,omitempty"`
+}
+
+func (b *reactionBody) validate() error {
+	switch {
+	case b.Remove:
+		return nil
+	case b.Emoji == "", len(b.Emoji) > maxReactionLen, !utf8.ValidString(b.Emoji):
+		return fmt.Errorf("%w: invalid reaction", ErrBadEnvelope)
+	}
+	return nil
+}
+
+// Quote ist das Zitat einer Antwort, wie es die UI anzeigt.
+type Quote struct {
+	ID      string `json:"id"`
+	Text    string `json:"text"`
+	Out     bool   `json:"out"`               // zitierte Nachricht ist von uns
+	Deleted bool   `json:"deleted,omitempty"` // Original wurde für alle gelöscht
+}
+
+// Reaction fasst gleiche Reaktionen auf eine Nachricht zusammen.
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Mine  bool   `json:"mine"` // eine davon ist unsere
+}
+
+// SendReply antwortet auf eine Nachricht aus diesem Verlauf.
+func (s *Session) SendReply(ref, text string) error {
+	log.Printf("[Session:%s] SendReply ref=%s → %s", s.Name, ref, b64(s.remoteID)[:8])
+	orig, err := s.store.findMessage(s.account(), ref, func(*CipherMessageWithMeta) bool { return true })
+	if err != nil {
+		return err
+	}
+	pm, err := plainMessage(s.store, *orig)
+	if err != nil {
+		return err
+	}
+	if pm.Deleted {
+		return fmt.Errorf("%w: %s", ErrNotEditable, ref)
+	}
+	env, err := newEnvelope(ContentText, textBody{
+		Text:  text,
+		Quote: &quoteBody{ID: ref, Text: snippet(pm.Text)},
+	})
+	if err != nil {
+		return err
+	}
+	return s.send(env)
+}
+
+// SendReaction reagiert auf eine Nachricht; eine frühere eigene Reaktion
+// wird dabei ersetzt.
+func (s *Session) SendReaction(ref, emoji string) error {
+	log.Printf("[Session:%s] SendReaction ref=%s %q → %s", s.Name, ref, emoji, b64(s.remoteID)[:8])
+	env, err := newEnvelope(ContentReaction, reactionBody{Ref: ref, Emoji: emoji})
+	if err != nil {
+		return err
+	}
+	return s.sendChange(env)
+}
+
+// RemoveReaction nimmt die eigene Reaktion auf eine Nachricht zurück.
+func (s *Session) RemoveReaction(ref string) error {
+	log.Printf("[Session:%s] RemoveReaction ref=%s → %s", s.Name, ref, b64(s.remoteID)[:8])
+	env, err := newEnvelope(ContentReaction, reactionBody{Ref: ref, Remove: true})
+	if err != nil {
+		return err
+	}
+	return s.sendChange(env)
+}
+
+// snippet kürzt den zitierten Text auf maxSnippetLen Zeichen.
+func snippet(text string) string {
+	if utf8.RuneCountInString(text) <= maxSnippetLen {
+		return text
+	}
+	return string([]rune(text)[:maxSnippetLen-1]) + "…"
+}
+
+// resolveQuotes ergänzt Richtung und Löschstatus der zitierten
+// Nachrichten, soweit sie noch im Verlauf stehen.
+func resolveQuotes(msgs []PlainMessage) {
+	byID := make(map[string]*PlainMessage, len(msgs))
+	for i := range msgs {
+		byID[msgs[i].ID] = &msgs[i]
+	}
+	for i := range msgs {
+		q := msgs[i].Quote
+		if q == nil {
+			continue
+		}
+		if orig, ok := byID[q.ID]; ok {
+			q.Out = orig.Out
+			if orig.Deleted {
+				q.Text, q.Deleted = "", true
+			}
+		}
+	}
+}
+
+// reactionSet hält die letzte Reaktion jeder Seite in der Reihenfolge,
+// in der zuerst reagiert wurde.
+type reactionSet struct {
+	order []bool
+	emoji map[bool]string
+}
+
+func (rs *reactionSet) set(out bool, b reactionBody) {
+	if rs.emoji == nil {
+		rs.emoji = map[bool]string{}
+	}
+	if _, ok := rs.emoji[out]; !ok {
+		rs.order = append(rs.order, out)
+	}
+	rs.emoji[out] = b.Emoji
+	if b.Remove {
+		rs.emoji[out] = ""
+	}
+}
+
+func (rs *reactionSet) aggregate() []Reaction {
+	var out []Reaction
+	for _, who := range rs.order {
+		e := rs.emoji[who]
+		if e == "" {
+			continue
+		}
+		if i := slices.IndexFunc(out, func(r Reaction) bool { return r.Emoji == e }); i >= 0 {
+			out[i].Count++
+			out[i].Mine = out[i].Mine || who
+			continue
+		}
+		out = append(out, Reaction{Emoji: e, Count: 1, Mine: who})
+	}
+	return out
+}
@@ -0,0 +1,109 @@
+package chat
+
+import (
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Antworten und Reaktionen", func() {
+	var (
+		tmp     string
+		mgr     *Manager
+		bobID   string
+		bobSess *Session
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "reaction_*")
+		Expect(err).NotTo(HaveOccurred())
+		mgr, err = NewManager(tmp, "Alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mgr.Initialise()).To(Succeed())
+
+		list, _ := mgr.Contacts()
+		bobID = list[0].ID
+		dt := mgr.transport.(*DummyTransport)
+		for _, s := range dt.peers {
+			if b64(s.LocalPeer().IdentityPublicKey()) == bobID {
+				bobSess = s
+			}
+		}
+		Expect(bobSess).NotTo(BeNil())
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	messages := func() []PlainMessage {
+		msgs, err := mgr.Messages(bobID, 0)
+		Expect(err).NotTo(HaveOccurred())
+		return msgs
+	}
+	bobMessages := func() []PlainMessage {
+		msgs, err := bobSess.LoadPlainMessages(bobSess.RemoteID(), time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		return msgs
+	}
+
+	It("zitiert die beantwortete Nachricht", func() {
+		Expect(bobSess.Send([]byte("Kommst du morgen?"))).To(Succeed())
+		ref := messages()[0].ID
+		Expect(mgr.Reply(bobID, ref, "Ja!")).To(Succeed())
+
+		mine := messages()[1]
+		Expect(mine.Text).To(Equal("Ja!"))
+		Expect(mine.Quote).To(Equal(&Quote{ID: ref, Text: "Kommst du morgen?", Out: false}))
+		theirs := bobMessages()[1]
+		Expect(theirs.Quote).To(Equal(&Quote{ID: ref, Text: "Kommst du morgen?", Out: true}))
+
+		Expect(mgr.Reply(bobID, "gibt-es-nicht", "?")).To(MatchError(ErrNoMessage))
+	})
+
+	It("fasst Reaktionen pro Nachricht zusammen", func() {
+		Expect(bobSess.Send([]byte("Neuer Release ist raus"))).To(Succeed())
+		ref := messages()[0].ID
+
+		Expect(mgr.React(bobID, ref, "👍")).To(Succeed())
+		Expect(bobSess.SendReaction(ref, "👍")).To(Succeed())
+		msgs := messages()
+		Expect(msgs).To(HaveLen(1))
+		Expect(msgs[0].Reactions).To(Equal([]Reaction{{Emoji: "👍", Count: 2, Mine: true}}))
+
+		Expect(mgr.React(bobID, ref, "🎉")).To(Succeed())
+		Expect(messages()[0].Reactions).To(Equal([]Reaction{
+			{Emoji: "🎉", Count: 1, Mine: true},
+			{Emoji: "👍", Count: 1, Mine: false},
+		}))
+		Expect(bobMessages()[0].Reactions).To(Equal([]Reaction{
+			{Emoji: "🎉", Count: 1, Mine: false},
+			{Emoji: "👍", Count: 1, Mine: true},
+		}))
+
+		Expect(mgr.RemoveReaction(bobID, ref)).To(Succeed())
+		want := []Reaction{{Emoji: "👍", Count: 1, Mine: false}}
+		Expect(messages()[0].Reactions).To(Equal(want))
+
+		// überholte und zurückgenommene Reaktionen verschwinden beim Kompaktieren
+		id := bobSess.LocalPeer().IdentityPublicKey()
+		before, _ := mgr.store.LoadMessages(id, time.Time{})
+		_, _, err := mgr.store.ExpireMessages(time.Now())
+		Expect(err).NotTo(HaveOccurred())
+		after, _ := mgr.store.LoadMessages(id, time.Time{})
+		Expect(after[0].changes).To(HaveLen(1))
+		Expect(len(before[0].changes)).To(BeNumerically(">", 1))
+		Expect(messages()[0].Reactions).To(Equal(want))
+	})
+
+	It("lehnt ungültige Reaktionen ab", func() {
+		Expect(mgr.Send(bobID, "hallo")).To(Succeed())
+		ref := messages()[0].ID
+		Expect(mgr.React(bobID, "gibt-es-nicht", "👍")).To(MatchError(ErrNoMessage))
+		Expect(mgr.React(bobID, ref, "")).To(MatchError(ErrBadEnvelope))
+
+		Expect(mgr.DeleteMessage(bobID, ref)).To(Succeed())
+		Expect(bobSess.SendReaction(ref, "👍")).To(MatchError(ErrNotEditable))
+		Expect(mgr.React(bobID, ref, "👍")).To(MatchError(ErrNotEditable))
+	})
+})
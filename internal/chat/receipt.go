@@ -0,0 +1,40 @@
+package chat
+
+import (
+	"errors"
+)
+
+// Zustellstatus ausgehender Nachrichten laut Quittung des Gegenübers;
+// bei eingehenden Nachrichten markiert StatusRead das lokale Lesen.
+const (
+	StatusDelivered = "delivered"
+	StatusRead      = "read"
+)
+
+var ErrBadReceipt = errors.New("malformed receipt")
+
+// receipt ist der Body einer ContentReceipt-Nachricht und quittiert eine
+// oder mehrere Nachrichten (IDs wie PlainMessage.ID).
+type receipt struct {
+	Kind string   `json:"kind"` // StatusDelivered | StatusRead
+	IDs  []string `json:"ids"`
+}
+
+func (r receipt) validate() error {
+	if statusRank(r.Kind) == 0 || len(r.IDs) == 0 {
+		return ErrBadReceipt
+	}
+	return nil
+}
+
+// statusRank ordnet die Zustände, damit eine späte „delivered“-Quittung
+// ein „read“ nicht überschreibt.
+func statusRank(status string) int {
+	switch status {
+	case StatusDelivered:
+		return 1
+	case StatusRead:
+		return 2
+	}
+	return 0
+}
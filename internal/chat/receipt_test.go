@@ -0,0 +1,129 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Zustell- und Lesebestätigungen", func() {
+	var (
+		tmp     string
+		mgr     *Manager
+		bobID   string
+		bobSess *Session
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "receipt_*")
+		Expect(err).NotTo(HaveOccurred())
+		mgr, err = NewManager(tmp, "Alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mgr.Initialise()).To(Succeed())
+
+		list, _ := mgr.Contacts()
+		bobID = list[0].ID
+		dt := mgr.transport.(*DummyTransport)
+		for _, s := range dt.peers {
+			if b64(s.LocalPeer().IdentityPublicKey()) == bobID {
+				bobSess = s
+			}
+		}
+		Expect(bobSess).NotTo(BeNil())
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	// Status von Bobs Nachrichten aus Bobs Sicht
+	bobView := func() []string {
+		msgs, err := bobSess.LoadPlainMessages(bobSess.RemoteID(), time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		var out []string
+		for _, m := range msgs {
+			if m.Out {
+				out = append(out, m.Status)
+			}
+		}
+		return out
+	}
+
+	It("quittiert die Zustellung, ohne dass Quittungen im Verlauf auftauchen", func() {
+		var updates int
+		mgr.SetHistoryHandler(func(id string) {
+			Expect(id).To(Equal(bobID))
+			updates++
+		})
+
+		Expect(mgr.Send(bobID, "hallo")).To(Succeed())
+		msgs, _ := mgr.Messages(bobID, 0)
+		Expect(msgs).To(HaveLen(1))
+		Expect(msgs[0].Status).To(Equal(StatusDelivered))
+		Expect(updates).To(Equal(1))
+
+		got, _ := bobSess.LoadPlainMessages(bobSess.RemoteID(), time.Time{})
+		Expect(got).To(HaveLen(1))
+		Expect(got[0].Text).To(Equal("hallo"))
+		Expect(got[0].Status).To(BeEmpty())
+	})
+
+	It("schickt beim Lesen eine Lesebestätigung, aber nur einmal", func() {
+		Expect(bobSess.Send([]byte("gelesen?"))).To(Succeed())
+		Expect(bobView()).To(Equal([]string{StatusDelivered}))
+
+		Expect(mgr.MarkRead(bobID)).To(Succeed())
+		Expect(bobView()).To(Equal([]string{StatusRead}))
+		msgs, _ := mgr.Messages(bobID, 0)
+		Expect(msgs[0].Status).To(Equal(StatusRead))
+
+		logFile := filepath.Join(tmp, msgDir, bobID+".log")
+		before, _ := os.Stat(logFile)
+		Expect(mgr.MarkRead(bobID)).To(Succeed()) // nichts Neues
+		after, _ := os.Stat(logFile)
+		Expect(after.Size()).To(Equal(before.Size()))
+	})
+
+	It("respektiert den globalen und den Kontakt-Schalter", func() {
+		Expect(mgr.SetReadReceipts(false)).To(Succeed())
+		settings, _ := mgr.Settings()
+		Expect(settings.ReadReceipts).To(BeFalse())
+
+		Expect(bobSess.Send([]byte("eins"))).To(Succeed())
+		Expect(mgr.MarkRead(bobID)).To(Succeed())
+		Expect(bobView()).To(Equal([]string{StatusDelivered}))
+
+		Expect(mgr.SetReadReceipts(true)).To(Succeed())
+		Expect(mgr.SetContactReadReceipts(bobID, false)).To(Succeed())
+		Expect(bobSess.Send([]byte("zwei"))).To(Succeed())
+		Expect(mgr.MarkRead(bobID)).To(Succeed())
+		Expect(bobView()).To(Equal([]string{StatusDelivered, StatusDelivered}))
+
+		// lokal sind beide trotzdem gelesen
+		msgs, _ := mgr.Messages(bobID, 0)
+		Expect(msgs[0].Status).To(Equal(StatusRead))
+		Expect(msgs[1].Status).To(Equal(StatusRead))
+	})
+
+	It("stuft einen Status nie zurück", func() {
+		id := bobSess.LocalPeer().IdentityPublicKey()
+		Expect(mgr.Send(bobID, "x")).To(Succeed())
+		msgs, _ := mgr.Messages(bobID, 0)
+
+		Expect(mgr.store.SetMessageStatus(id, true, StatusRead, msgs[0].ID)).To(Succeed())
+		Expect(mgr.store.SetMessageStatus(id, true, StatusDelivered, msgs[0].ID)).To(Succeed())
+		msgs, _ = mgr.Messages(bobID, 0)
+		Expect(msgs[0].Status).To(Equal(StatusRead))
+
+		// Quittungen des Gegenübers betreffen nie eingehende Nachrichten
+		Expect(mgr.store.SetMessageStatus(id, true, StatusRead, "fremd")).To(Succeed())
+		Expect(mgr.Messages(bobID, 0)).To(HaveLen(1))
+	})
+
+	It("lehnt Quittungen ohne gültige Art oder IDs ab", func() {
+		Expect(receipt{Kind: "gelesen", IDs: []string{"x"}}.validate()).To(MatchError(ErrBadReceipt))
+		Expect(receipt{Kind: StatusRead}.validate()).To(MatchError(ErrBadReceipt))
+		Expect(receipt{Kind: StatusRead, IDs: []string{"x"}}.validate()).To(Succeed())
+	})
+})
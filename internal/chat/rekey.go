@@ -0,0 +1,337 @@
+package chat
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Rekey tauscht den Master-Key aus und verschlüsselt dabei alles neu,
+// was mit ihm verschlüsselt ist. Ablauf wie ein Journal:
+//
+//  1. alle Dateien neu verschlüsselt nach .rekey/ schreiben, samt neuem
+//     master.key bzw. master.hdr
+//  2. .rekey/commit anlegen (temp + rename) – ab hier gilt der neue Key
+//  3. die Dateien aus .rekey/ über die alten schieben, .rekey/ löschen
+//
+// Bricht der Vorgang ab, entscheidet NewStore beim nächsten Start: ohne
+// commit wird .rekey/ verworfen, mit commit wird Schritt 3 zu Ende
+// geführt. Ein halb umgeschlüsselter Store wird so nie geöffnet.
+//
+// Die Kontakt-Keys in keys/ werden dabei mit ausgetauscht. Anhang-Chunks
+// haben eigene Schlüssel (in meta.bin) und bleiben liegen.
+const (
+	rekeyDir        = ".rekey"
+	rekeyCommitFile = "commit"
+)
+
+// rekeyCommit steht in .rekey/commit: Dateien, die nach dem Umzug
+// wegfallen (der Klartext-Key, wenn eine Passphrase dazukommt, und
+// verwaiste Kontakt-Keys).
+type rekeyCommit struct {
+	Remove []string `json:"remove,omitempty"`
+}
+
+// storeFile ist eine mit dem Master-Key verschlüsselte Datei, relativ
+// zum Store. Logs bestehen aus einzeln verschlüsselten Frames.
+type storeFile struct {
+	rel string
+	log bool
+}
+
+// encryptedFiles listet alle Dateien, die am Master-Key hängen. Der
+// Demo-Bob hat einen eigenen Store und bleibt außen vor.
+func (s *Store) encryptedFiles() ([]storeFile, error) {
+	patterns := []struct {
+		glob string
+		log  bool
+	}{
+		{identityFile, false},
+		{preKeysFile, false},
+		{settingsFile, false},
+		{devicesFile, false},
+		{filepath.Join(contactsDir, "*.json"), false},
+		{filepath.Join(sessionsDir, "*", sessionFile), false},
+		{filepath.Join(sessionsDir, "*", pendingSessionFile), false},
+		{filepath.Join(outboxDir, "*.bin"), false},
+		{filepath.Join(msgDir, "*"+orphanExt), false},
+		{filepath.Join(attachmentsDir, "*", attachmentMetaFile), false},
+		{filepath.Join(groupsDir, "*", groupFile), false},
+		{filepath.Join(groupsDir, "*", groupLogFile), true},
+		{filepath.Join(msgDir, "*.log"), true},
+	}
+	var files []storeFile
+	for _, p := range patterns {
+		matches, err := filepath.Glob(filepath.Join(s.basePath, p.glob))
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			rel, err := filepath.Rel(s.basePath, m)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, storeFile{rel: rel, log: p.log})
+		}
+	}
+	return files, nil
+}
+
+// Rekey erzeugt einen neuen Master-Key und verschlüsselt den Store damit
+// neu. pass schützt den neuen Key; leer geht nur bei ungeschütztem Store.
+// progress (optional) meldet erledigte und gesamte Dateien.
+//
+// Der Aufrufer muss dafür sorgen, dass währenddessen niemand schreibt
+// (Manager.Rekey hält dafür Worker und Transport an).
+func (s *Store) Rekey(pass string, params KDFParams, progress func(done, total int)) error {
+	if pass == "" && s.Protected() {
+		return fmt.Errorf("%w: protected store needs a passphrase", ErrWrongPassphrase)
+	}
+	if pass != "" {
+		if err := params.validate(); err != nil {
+			return err
+		}
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	err := s.rewrite(key, func() (*rekeyCommit, error) {
+		return s.stageRekey(key, pass, params, progress)
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("[Store] rekeyed")
+	return nil
+}
+
+// migrate bringt einen Store im alten Format (ein Key für alles, keine
+// AD) auf Subkeys. Der Master-Key bleibt derselbe.
+func (s *Store) migrate() error {
+	log.Printf("[Store] migrating to store format %d", storeFormat)
+	return s.rewrite(nil, func() (*rekeyCommit, error) {
+		return s.stageFiles(s.masterKey, nil)
+	})
+}
+
+// rewrite sperrt den Store, lässt stage alles nach .rekey/ schreiben und
+// zieht es per Commit um. key ≠ nil ist der neue Master-Key.
+func (s *Store) rewrite(key []byte, stage func() (*rekeyCommit, error)) error {
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	s.outboxMu.Lock()
+	defer s.outboxMu.Unlock()
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	if s.masterKey == nil {
+		return ErrLocked
+	}
+
+	commit, err := stage()
+	if err != nil {
+		os.RemoveAll(filepath.Join(s.basePath, rekeyDir))
+		return err
+	}
+	if err := s.commitRekey(commit); err != nil {
+		os.RemoveAll(filepath.Join(s.basePath, rekeyDir))
+		return err
+	}
+
+	// ab dem Commit gelten die neuen Keys, auch wenn der Umzug scheitert –
+	// den holt dann der nächste Start nach
+	if key != nil {
+		clear(s.masterKey)
+		s.masterKey = key
+	}
+	s.legacy = false
+	s.forgetSubkeys()
+	s.indexes = nil // Offsets und Keys haben sich geändert
+	return finishRekey(s.basePath)
+}
+
+// stageRekey schreibt alle Dateien mit key verschlüsselt nach .rekey/,
+// dazu master.key bzw. master.hdr.
+func (s *Store) stageRekey(key []byte, pass string, params KDFParams, progress func(done, total int)) (*rekeyCommit, error) {
+	commit, err := s.stageFiles(key, progress)
+	if err != nil {
+		return nil, err
+	}
+	staging := filepath.Join(s.basePath, rekeyDir)
+	if pass == "" {
+		err = writeFileSync(filepath.Join(staging, masterKeyFile), key)
+	} else {
+		var hdr []byte
+		if hdr, err = sealKeyHeader(key, pass, params); err == nil {
+			err = writeFileSync(filepath.Join(staging, keyHeaderFile), hdr)
+		}
+		commit.Remove = append(commit.Remove, masterKeyFile)
+	}
+	return commit, err
+}
+
+// stageFiles verschlüsselt alle Dateien unter key neu nach .rekey/. Die
+// Kontakt-Keys entstehen dabei frisch in .rekey/keys/; Dateien, deren
+// Kontakt-Key schon gelöscht ist, fallen weg.
+func (s *Store) stageFiles(key []byte, progress func(done, total int)) (*rekeyCommit, error) {
+	staging := filepath.Join(s.basePath, rekeyDir)
+	if err := os.RemoveAll(staging); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(staging, 0o700); err != nil {
+		return nil, err
+	}
+	files, err := s.encryptedFiles()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("[Store] rekey: staging %d files", len(files))
+
+	next := &Store{basePath: staging, masterKey: key}
+	commit := &rekeyCommit{}
+	for i, f := range files {
+		rel := filepath.ToSlash(f.rel)
+		if s.shredded(rel) {
+			log.Printf("[Store] rekey: dropping %s (contact key deleted)", rel)
+			commit.Remove = append(commit.Remove, f.rel)
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(s.basePath, f.rel))
+		if err != nil {
+			return nil, err
+		}
+		var out []byte
+		if f.log {
+			out, err = s.rekeyLog(next, rel, raw)
+		} else {
+			out, err = s.rekeyBlob(next, rel, raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rekey %s: %w", f.rel, err)
+		}
+		dst := filepath.Join(staging, f.rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+			return nil, err
+		}
+		if err := writeFileSync(dst, out); err != nil {
+			return nil, err
+		}
+		if progress != nil {
+			progress(i+1, len(files))
+		}
+	}
+	if err := writeFileSync(filepath.Join(staging, storeFormatFile), formatBytes()); err != nil {
+		return nil, err
+	}
+
+	// Verlaufs-Indizes werden danach aus den neuen Logs aufgebaut
+	for _, glob := range []string{filepath.Join(msgDir, "*.idx"), filepath.Join(groupsDir, "*", "*.idx")} {
+		idx, err := filepath.Glob(filepath.Join(s.basePath, glob))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range idx {
+			rel, _ := filepath.Rel(s.basePath, p)
+			commit.Remove = append(commit.Remove, rel)
+		}
+	}
+
+	// alte Kontakt-Keys ohne Dateien verschwinden mit dem Commit
+	old, err := filepath.Glob(filepath.Join(s.basePath, keysDir, "*.key"))
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range old {
+		rel := filepath.Join(keysDir, filepath.Base(k))
+		if _, err := os.Stat(filepath.Join(staging, rel)); errors.Is(err, fs.ErrNotExist) {
+			commit.Remove = append(commit.Remove, rel)
+		}
+	}
+	return commit, nil
+}
+
+func (s *Store) rekeyBlob(next *Store, rel string, raw []byte) ([]byte, error) {
+	plain, err := s.open(rel, raw)
+	if err != nil {
+		return nil, err
+	}
+	return next.seal(rel, plain)
+}
+
+// rekeyLog verschlüsselt ein Log Frame für Frame neu. Unlesbare Frames
+// wären auch mit dem alten Key verloren und fallen weg.
+func (s *Store) rekeyLog(next *Store, rel string, data []byte) ([]byte, error) {
+	var out []byte
+	dropped := 0
+	for _, frame := range splitFrames(data) {
+		blob, err := s.rekeyBlob(next, rel, frameBlob(frame))
+		if err != nil {
+			dropped++
+			continue
+		}
+		out = append(out, lengthPrefixed(blob)...)
+	}
+	if dropped > 0 {
+		log.Printf("[Store] !! rekey %s: dropped %d unreadable frames", rel, dropped)
+	}
+	return out, nil
+}
+
+// commitRekey legt den Commit-Eintrag atomar an.
+func (s *Store) commitRekey(c *rekeyCommit) error {
+	raw, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.basePath, rekeyDir, rekeyCommitFile), raw)
+}
+
+// finishRekey bringt einen abgebrochenen Rekey zu Ende oder verwirft
+// ihn, je nachdem ob er schon committet war. Mehrfach aufrufbar.
+func finishRekey(base string) error {
+	staging := filepath.Join(base, rekeyDir)
+	commitPath := filepath.Join(staging, rekeyCommitFile)
+	raw, err := os.ReadFile(commitPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, serr := os.Stat(staging); serr == nil {
+			log.Printf("[Store] !! discarding unfinished rekey")
+		}
+		return os.RemoveAll(staging)
+	} else if err != nil {
+		return err
+	}
+	var c rekeyCommit
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return fmt.Errorf("rekey commit: %w", err)
+	}
+
+	err = filepath.WalkDir(staging, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || path == commitPath {
+			return err
+		}
+		rel, err := filepath.Rel(staging, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(base, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+			return err
+		}
+		return os.Rename(path, dst)
+	})
+	if err != nil {
+		return err
+	}
+	for _, rel := range c.Remove {
+		if err := os.Remove(filepath.Join(base, rel)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return os.RemoveAll(staging)
+}
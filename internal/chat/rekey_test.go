@@ -0,0 +1,143 @@
+package chat
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Rekey", func() {
+	var tmp string
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "rekey_*")
+		Expect(err).NotTo(HaveOccurred())
+		old := defaultKDFParams
+		defaultKDFParams = testKDFParams
+		DeferCleanup(func() { defaultKDFParams = old })
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	Describe("Manager", func() {
+		var (
+			mgr   *Manager
+			bobID string
+		)
+
+		BeforeEach(func() {
+			var err error
+			mgr, err = NewManager(tmp, "Alice")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(mgr.Initialise()).To(Succeed())
+			list, _ := mgr.Contacts()
+			bobID = list[0].ID
+			Expect(mgr.Send(bobID, "eins")).To(Succeed())
+			Expect(mgr.Send(bobID, "zwei")).To(Succeed())
+		})
+		AfterEach(func() { mgr.setIdle(0) })
+
+		It("verschlüsselt alles mit einem neuen Key", func() {
+			oldKey := append([]byte(nil), mgr.store.MasterKey()...)
+			identity, err := os.ReadFile(filepath.Join(tmp, identityFile))
+			Expect(err).NotTo(HaveOccurred())
+
+			var done, total int
+			mgr.SetRekeyHandler(func(d, t int) { done, total = d, t })
+			Expect(mgr.Rekey("", "")).To(Succeed())
+			Expect(total).To(BeNumerically(">", 3))
+			Expect(done).To(Equal(total))
+			Expect(mgr.store.MasterKey()).NotTo(Equal(oldKey))
+			Expect(filepath.Join(tmp, rekeyDir)).NotTo(BeAnExistingFile())
+
+			// alter Key passt auf nichts mehr
+			raw, _ := os.ReadFile(filepath.Join(tmp, identityFile))
+			Expect(raw).NotTo(Equal(identity))
+			old := &Store{basePath: tmp, masterKey: oldKey}
+			_, err = old.open(identityFile, raw)
+			Expect(err).To(HaveOccurred())
+
+			Expect(mgr.Send(bobID, "drei")).To(Succeed())
+			msgs, err := mgr.Messages(bobID, 0)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(msgs).To(HaveLen(3))
+			Expect(msgs[0].Status).To(Equal(StatusDelivered))
+
+			st, err := NewStore(tmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(st.MasterKey()).To(Equal(mgr.store.MasterKey()))
+			recs, err := st.LoadMessages(mgr.sessions[bobID].RemoteID(), time.Time{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recs).To(HaveLen(3))
+		})
+
+		It("wechselt dabei die Passphrase", func() {
+			Expect(mgr.SetPassphrase("alt")).To(Succeed())
+			Expect(mgr.Rekey("falsch", "neu")).To(MatchError(ErrWrongPassphrase))
+			Expect(mgr.Rekey("alt", "neu")).To(Succeed())
+
+			st, err := NewStore(tmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(st.Locked()).To(BeTrue())
+			Expect(st.Unlock("alt")).To(MatchError(ErrWrongPassphrase))
+			Expect(st.Unlock("neu")).To(Succeed())
+			Expect(st.MasterKey()).To(Equal(mgr.store.MasterKey()))
+			Expect(filepath.Join(tmp, masterKeyFile)).NotTo(BeAnExistingFile())
+		})
+	})
+
+	Describe("nach einem Abbruch", func() {
+		var (
+			st     *Store
+			oldKey []byte
+			newKey []byte
+			peer   []byte
+		)
+
+		BeforeEach(func() {
+			var err error
+			st, err = NewStore(tmp)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = st.EnsureIdentity()
+			Expect(err).NotTo(HaveOccurred())
+			peer = []byte("bob-identity-key-000000000000000")
+			Expect(st.AddContactIfMissing("Bob", peer)).To(Succeed())
+			Expect(st.AppendMessage(peer, CipherMessage{}, true, "m1", []byte("hallo"))).To(Succeed())
+
+			oldKey = append([]byte(nil), st.MasterKey()...)
+			newKey = make([]byte, 32)
+			newKey[0] = 1
+			_, err = st.stageRekey(newKey, "", KDFParams{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		readable := func(key []byte) {
+			st2, err := NewStore(tmp)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(st2.MasterKey()).To(Equal(key))
+			Expect(filepath.Join(tmp, rekeyDir)).NotTo(BeAnExistingFile())
+			_, err = st2.EnsureIdentity()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = st2.LoadContact(peer)
+			Expect(err).NotTo(HaveOccurred())
+			recs, err := st2.LoadMessages(peer, time.Time{})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recs).To(ConsistOf(HaveField("Plain", "hallo")))
+		}
+
+		It("verwirft einen Rekey ohne Commit", func() {
+			readable(oldKey)
+		})
+
+		It("führt einen committeten Rekey zu Ende", func() {
+			Expect(st.commitRekey(&rekeyCommit{})).To(Succeed())
+			// Umzug nach der ersten Datei unterbrochen
+			staged := filepath.Join(tmp, rekeyDir, identityFile)
+			Expect(os.Rename(staged, filepath.Join(tmp, identityFile))).To(Succeed())
+			readable(newKey)
+		})
+	})
+})
@@ -1,8 +1,9 @@
 package chat
 
 import (
+	"cmp"
 	"crypto/ecdh"
-	"encoding/base64"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -14,6 +15,35 @@ type Session struct {
 	remoteID  []byte
 	transport Transport
 	store     *Store
+
+	// OnError wird bei fehlgeschlagenem Empfang aufgerufen (optional).
+	OnError func(remoteID []byte, err error)
+
+	// OnInit wird nach einem angenommenen Handshake aufgerufen (optional);
+	// claimedName ist der Name, unter dem sich der Absender meldet.
+	OnInit func(remoteID []byte, claimedName string) error
+
+	// OnUpdate meldet einen geänderten Verlauf: neue Nachricht oder
+	// Quittung (optional).
+	OnUpdate func(remoteID []byte)
+
+	// OnGroup meldet eine geänderte Gruppe: neue Nachricht oder
+	// Mitgliederliste (optional).
+	OnGroup func(groupID string)
+
+	// Owner ordnet ein weiteres Gerät seinem Konto zu (optional);
+	// Verlauf und Quittungen laufen unter dem Konto.
+	Owner func(deviceID []byte) []byte
+
+	// Devices sind Sessions zu weiteren Geräten des Kontakts, sie bekommen
+	// jede Nachricht als Kopie. Mirrors sind unsere eigenen anderen
+	// Geräte, sie bekommen gesendete Nachrichten als ContentSync.
+	Devices, Mirrors []*Session
+
+	// OnDevices meldet eine neue Geräteliste eines Kontos, OnLinked die
+	// Verknüpfung dieses Geräts mit einem Primärgerät (beide optional).
+	OnDevices func(account []byte)
+	OnLinked  func(account []byte)
 }
 
 type sessionState struct {
@@ -22,6 +52,18 @@ type sessionState struct {
 	dhSendPrivKey        *ecdh.PrivateKey
 	dhRecvPubKey         *ecdh.PublicKey
 	sendChain, recvChain *SymmRatchet
+	version              byte   // Protokollversion, 0 = Alt-Session (v1)
+	suite                byte   // AEAD-Suite, 0 = Alt-Session (AES-256-GCM)
+	handshake            byte   // handshakeX3DH / handshakePQXDH, 0 = Alt-Session
+	kdf                  byte   // kdfV1 / kdfV2
+	ad                   []byte // IK_Initiator ‖ IK_Responder (nur kdfV2)
+
+	hks, hkr, nhks, nhkr []byte // (nächste) Header-Keys für Send/Recv
+
+	ns, nr, pn uint32      // Nachrichtenzähler (Send, Recv, vorherige Send-Chain)
+	skipped    []skippedKey // Schlüssel für verspätete Nachrichten
+
+	unconfirmed bool // frisch aus einem Handshake, siehe Peer.acceptState
 }
 
 func NewSession(name string, transport Transport) *Session {
@@ -31,8 +73,8 @@ func NewSession(name string, transport Transport) *Session {
 		transport: transport,
 	}
 
-	if dt, ok := transport.(*DummyTransport); ok {
-		dt.Register(s)
+	if r, ok := transport.(registrar); ok {
+		r.Register(s)
 	}
 
 	return s
@@ -40,81 +82,307 @@ func NewSession(name string, transport Transport) *Session {
 
 func NewSessionFromPeer(p *Peer, t Transport, st *Store) *Session {
 	s := &Session{Name: p.Name, localPeer: p, transport: t, store: st}
-	if dt, ok := t.(*DummyTransport); ok {
-		dt.Register(s)
+	if r, ok := t.(registrar); ok {
+		r.Register(s)
 	}
 	return s
 }
 
 func (s *Session) StartHandshake(remote Bundle) error {
+	initMsg, err := s.localPeer.InitiateSession(remote)
+	if err != nil {
+		return err
+	}
 	s.remoteID = remote.IdentityPub
+	initMsg.Name = s.Name
 
-	initMsg := s.localPeer.InitiateSession(remote)
     log.Printf("[Session:%s] StartHandshake → sending Init to %s", s.Name, b64(s.remoteID)[:8])
-    s.transport.SendInit(s.remoteID, initMsg)
+	if err := s.transport.SendInit(s.remoteID, initMsg); err != nil {
+		return err
+	}
 
 	s.persist()
 	return nil
 }
 
 func (s *Session) HandleInit(initMsg InitMessage) error {
-	s.remoteID = initMsg["idPub"]
-	s.localPeer.AcceptSession(initMsg)
+	if s.locked() {
+		return ErrLocked
+	}
+	if err := s.localPeer.AcceptSession(initMsg); err != nil {
+		return err
+	}
+	s.remoteID = initMsg.IdentityPub
 
 	s.persist()
 
+	// verbrauchter One-Time-Pre-Key darf nach Neustart nicht wieder auftauchen
+	if s.store != nil {
+		if err := s.store.SavePreKeys(s.localPeer.preKeys); err != nil {
+			return err
+		}
+	}
+	if s.OnInit != nil {
+		return s.OnInit(s.remoteID, initMsg.Name)
+	}
 	return nil
 }
 
 func (s *Session) Send(plaintext []byte) error {
 log.Printf("[Session:%s] Send called remote=%s plaintext=%q", s.Name, b64(s.remoteID)[:8], plaintext)
-	header, nonce, cyphertext, err := s.localPeer.Encrypt(s.remoteID, plaintext)
+	env, err := newEnvelope(ContentText, textBody{Text: string(plaintext)})
 	if err != nil {
-		log.Println("  Encrypt-error:", err)
 		return err
 	}
-	log.Printf("  hdr=%dB non=%dB ct=%dB", len(header), len(nonce), len(cyphertext))
-	msg := CipherMessage{Header: header, Nonce: nonce, Cipher: cyphertext}
-	err = s.transport.SendCipher(s.remoteID, msg)
-	if err == nil {
-		_ = s.store.AppendMessage(s.remoteID, msg, true, plaintext)
-		s.persist()
+	return s.send(env)
+}
+
+// SendReceipt quittiert Nachrichten des Gegenübers (kind = StatusDelivered
+// oder StatusRead). Die Quittung ist eine normale verschlüsselte Nachricht,
+// erscheint aber nicht im Verlauf.
+func (s *Session) SendReceipt(kind string, ids ...string) error {
+	log.Printf("[Session:%s] SendReceipt %s n=%d → %s", s.Name, kind, len(ids), b64(s.remoteID)[:8])
+	env, err := newEnvelope(ContentReceipt, receipt{Kind: kind, IDs: ids})
+	if err != nil {
+		return err
+	}
+	return s.send(env)
+}
+
+func (s *Session) send(env *Envelope) error {
+	if s.locked() {
+		return ErrLocked
+	}
+	if env.logged() && env.TTL == 0 {
+		// der Timer des Kontakts reist mit, der Empfänger übernimmt ihn
+		if c, err := s.store.LoadContact(s.account()); err == nil {
+			env.TTL = c.ExpireTimer
+		}
+	}
+	err := s.transmit(env, env.logged())
+	if env.allDevices() {
+		for _, d := range s.Devices {
+			if derr := d.transmit(env, false); derr != nil {
+				log.Printf("  device %s: %v", b64(d.remoteID)[:8], derr)
+			}
+		}
+	}
+	if env.synced() {
+		for _, o := range s.Mirrors {
+			if serr := o.sendSync(s.account(), env); serr != nil {
+				log.Printf("  sync to %s: %v", b64(o.remoteID)[:8], serr)
+			}
+		}
 	}
 	return err
 }
 
+// transmit verschlüsselt für genau dieses Gerät; mit logged landet die
+// Nachricht im Verlauf des Kontos.
+func (s *Session) transmit(env *Envelope, logged bool) error {
+	msg, err := s.seal(env, logged)
+	if err != nil {
+		return err
+	}
+	if s.store.HasPending(s.remoteID) {
+		// ältere Nachrichten warten noch → hinten anstellen statt überholen
+		err = ErrPeerUnreachable
+	} else {
+		err = s.transport.SendCipher(s.remoteID, msg)
+	}
+	if err == nil {
+		return nil
+	}
+	if !retryable(err) {
+		// abgelehnt: ein neuer Versuch ändert nichts, die Nachricht steht
+		// gleich als fehlgeschlagen im Ausgang
+		log.Printf("  SendCipher-error: %v → failed", err)
+		if logged {
+			if _, qerr := s.store.EnqueueFailed(s.remoteID, env.ID, msg, err); qerr != nil {
+				return qerr
+			}
+		}
+		return err
+	}
+	log.Printf("  SendCipher-error: %v → outbox", err)
+	if _, qerr := s.store.Enqueue(s.remoteID, env.ID, msg); qerr != nil {
+		return qerr
+	}
+	return fmt.Errorf("%w: %v", ErrQueued, err)
+}
+
+func (s *Session) seal(env *Envelope, logged bool) (CipherMessage, error) {
+	plaintext := env.encode()
+	header, nonce, cyphertext, err := s.localPeer.Encrypt(s.remoteID, plaintext)
+	if err != nil {
+		log.Println("  Encrypt-error:", err)
+		return CipherMessage{}, err
+	}
+	log.Printf("  %s id=%s hdr=%dB non=%dB ct=%dB", env.Type, env.ID, len(header), len(nonce), len(cyphertext))
+	msg := CipherMessage{
+		Version: s.localPeer.protocol(s.remoteID),
+		Header:  header,
+		Nonce:   nonce,
+		Cipher:  cyphertext,
+	}
+	// Der Ratchet ist weitergelaufen: State und Log sichern, egal ob die
+	// Zustellung klappt – neu verschlüsselt wird die Nachricht nie.
+	if logged {
+		_ = s.store.AppendMessage(s.account(), msg, true, env.ID, plaintext)
+	}
+	s.persist()
+	return msg, nil
+}
+
+// Receive entschlüsselt eine eingehende Nachricht und verteilt sie nach
+// Inhaltstyp. Fehler (ErrBadHeader, ErrAuthFailed, ErrNoSession,
+// ErrUnsupportedVersion, ErrBadEnvelope, …) gehen an den Aufrufer und an
+// OnError; bei Entschlüsselungsfehlern bleibt der Ratchet-State unverändert.
 func (s *Session) Receive(m CipherMessage) error {
+	if s.locked() {
+		return ErrLocked // kein OnError: der Absender versucht es später erneut
+	}
 	log.Printf("[Session:%s] Recv hdr=%dB non=%dB ct=%dB",
         s.Name, len(m.Header), len(m.Nonce), len(m.Cipher))
-	_, plain := s.localPeer.Decrypt(s.remoteID, m.Header, m.Nonce, m.Cipher)
-	fmt.Printf("[%s] ← %q\n", s.Name, plain)
-	_ = s.store.AppendMessage(s.remoteID, m, false, plain)
+	err := s.localPeer.checkVersion(s.remoteID, m.Version)
+	var plain []byte
+	if err == nil {
+		plain, err = s.localPeer.Decrypt(s.remoteID, m.Header, m.Nonce, m.Cipher)
+	}
+	if err != nil {
+		log.Println("  Decrypt-error:", err)
+		return s.fail(err)
+	}
 	s.persist()
+
+	env, err := decodeEnvelope(plain)
+	if err != nil {
+		return s.fail(err)
+	}
+	log.Printf("  %s id=%s", env.Type, env.ID)
+	switch env.Type {
+	case ContentReceipt:
+		var r receipt
+		if err = env.decodeBody(&r); err == nil {
+			err = r.validate()
+		}
+		if err == nil {
+			// Quittungen gelten nur für eigene (ausgehende) Nachrichten
+			_ = s.store.SetMessageStatus(s.account(), true, r.Kind, r.IDs...)
+		}
+	case ContentText:
+		var body textBody
+		if err = env.decodeBody(&body); err == nil {
+			fmt.Printf("[%s] ← %q\n", s.Name, body.Text)
+		}
+	case ContentAttachment:
+		err = s.expectAttachment(env)
+	case ContentGroup:
+		err = s.receiveGroupUpdate(env)
+	case ContentDevices:
+		err = s.receiveDevices(env)
+	case ContentLink:
+		err = s.receiveLink(env)
+	case ContentSync:
+		err = s.receiveSync(env)
+	case ContentTimer:
+		err = s.receiveTimer(s.account(), env)
+	case ContentEdit, ContentDelete, ContentReaction:
+		err = s.receiveChange(s.account(), false, env)
+	}
+	if err != nil {
+		return s.fail(err)
+	}
+
+	// unbekannte Typen bleiben im Verlauf und werden als Platzhalter
+	// angezeigt; ein Update macht sie später lesbar
+	if env.logged() {
+		_ = s.store.AppendMessage(s.account(), m, false, env.ID, plain)
+		// landet die Quittung im Ausgang, ist das kein Empfangsfehler
+		id := cmp.Or(env.ID, messageID(m))
+		receipt := func() {
+			if err := s.SendReceipt(StatusDelivered, id); err != nil && !errors.Is(err, ErrQueued) {
+				log.Println("  receipt-error:", err)
+			}
+		}
+		if d, ok := s.transport.(deferrer); ok {
+			d.later(receipt)
+		} else {
+			receipt()
+		}
+	}
+	if s.OnUpdate != nil {
+		s.OnUpdate(s.account())
+	}
 	return nil
 }
 
+func (s *Session) fail(err error) error {
+	if s.OnError != nil {
+		s.OnError(s.remoteID, err)
+	}
+	return err
+}
+
 func (s *Session) LocalBundle() Bundle {
 	return s.localPeer.Bundle()
 }
 
 func (s *Session) persist() {
-	if s.store == nil || s.remoteID == nil {
+	if s.store == nil || s.remoteID == nil || s.store.Locked() {
+		return
+	}
+	// jeweils der neueste State; Schreiben nacheinander, damit kein
+	// älterer Stand einen neueren überschreibt
+	defer s.localPeer.lockRemote(s.remoteID)()
+	// nach dem Sperren sind die States gelöscht: nichts anlegen, nichts
+	// Leeres über den gesicherten Stand schreiben
+	st, ok := s.localPeer.lookup(s.remoteID)
+	if !ok {
 		return
 	}
-	st := s.localPeer.state(s.remoteID)
 	_ = s.store.SaveSession(s.remoteID, st) // Fehler bei Demo ignorieren
+	_ = s.store.SavePendingSession(s.remoteID, s.localPeer.pendingState(s.remoteID))
 }
 
+// Restore setzt eine gespeicherte Session fort, samt eines noch
+// unbestätigten Handshakes.
 func (s *Session) Restore(remoteID []byte, st *sessionState) {
 	s.remoteID = remoteID
-	s.localPeer.sess[keyOf(remoteID)] = st
+	s.localPeer.setState(remoteID, st)
+	if s.store == nil {
+		return
+	}
+	if pst, err := s.store.LoadPendingSession(remoteID); err == nil {
+		s.localPeer.setPending(remoteID, pst)
+	}
 }
 
+// UnsupportedText ersetzt den Inhalt von Nachrichten, deren Typ dieser
+// Client nicht kennt.
+const UnsupportedText = "This message needs a newer version of zero."
+
 type PlainMessage struct {
-	ID   string    `json:"id"`
-	At   time.Time `json:"at"`
-	Out  bool      `json:"out"`
-	Text string    `json:"text"`
+	ID     string    `json:"id"`
+	Type   string    `json:"type"` // ContentText oder unbekannter Typ
+	At     time.Time `json:"at"`
+	Sent   time.Time `json:"sent,omitzero"` // Uhr des Absenders, leer bei Alt-Nachrichten
+	Out    bool      `json:"out"`
+	Text   string    `json:"text"`
+	Status string    `json:"status,omitempty"` // queued | failed | cancelled | delivered | read, leer = gesendet
+
+	From        string          `json:"from,omitempty"`        // b64(IK) des Absenders, nur eingehende Gruppennachrichten
+	Unsupported bool            `json:"unsupported,omitempty"` // Text ist UnsupportedText
+	Attachment  *AttachmentInfo `json:"attachment,omitempty"`  // nur ContentAttachment
+	Expires     time.Time       `json:"expires,omitzero"`      // verschwindende Nachricht
+
+	Edited   bool          `json:"edited,omitempty"`
+	EditedAt time.Time     `json:"edited_at,omitzero"`
+	History  []MessageEdit `json:"history,omitempty"` // frühere Fassungen, älteste zuerst
+	Deleted  bool          `json:"deleted,omitempty"` // für alle gelöscht, Text ist leer
+
+	Quote     *Quote     `json:"quote,omitempty"`     // Antwort auf diese Nachricht
+	Reactions []Reaction `json:"reactions,omitempty"` // zusammengefasst, ohne eigene Blasen
 }
 
 func (s *Session) LoadPlainMessages(remoteID []byte, since time.Time) ([]PlainMessage, error) {
@@ -125,20 +393,103 @@ func (s *Session) LoadPlainMessages(remoteID []byte, since time.Time) ([]PlainMe
 		return nil, err
 	}
 log.Printf("  got %d cipher frames", len(raw))
+	return s.plainMessages(remoteID, raw)
+}
+
+// MessagePage ist eine Seite des Verlaufs für die Oberfläche, siehe
+// Store.LoadMessagesPage.
+type MessagePage struct {
+	Messages []PlainMessage `json:"messages"`
+	First    uint64         `json:"first"` // Cursor für ältere Nachrichten
+	Last     uint64         `json:"last"`  // Cursor für neuere Nachrichten
+	More     bool           `json:"more"`  // in Blätterrichtung gibt es weitere
+}
+
+func (s *Session) LoadPlainPage(remoteID []byte, cursor uint64, limit int, dir PageDirection) (*MessagePage, error) {
+	log.Printf("[Session:%s] LoadPlainPage cursor=%d limit=%d dir=%s", s.Name, cursor, limit, dir)
+	raw, err := s.store.LoadMessagesPage(remoteID, cursor, limit, dir)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := s.plainMessages(remoteID, raw.Records)
+	if err != nil {
+		return nil, err
+	}
+	return &MessagePage{Messages: msgs, First: raw.First, Last: raw.Last, More: raw.More}, nil
+}
+
+// plainMessages entschlüsselt die Umschläge und ergänzt den Ausgangsstatus.
+func (s *Session) plainMessages(remoteID []byte, raw []CipherMessageWithMeta) ([]PlainMessage, error) {
+	outbox, err := s.store.LoadOutbox(remoteID)
+	if err != nil {
+		return nil, err
+	}
+	status := map[string]string{}
+	for _, e := range outbox {
+		if e.State != OutboxSent {
+			status[e.ID] = e.State
+		}
+	}
+
 	var out []PlainMessage
 	for _, mm := range raw {
-		txt := mm.Plain
-
-		out = append(out, PlainMessage{
-			ID: base64.RawURLEncoding.EncodeToString(mm.Header) +
-				base64.RawURLEncoding.EncodeToString(mm.Nonce),
-			At:   mm.TS,
-			Out:  mm.Out,
-			Text: txt,
-		})
+		pm, err := plainMessage(s.store, mm)
+		if err != nil {
+			log.Println("  envelope-error:", err)
+			continue
+		}
+		pm.Status = cmp.Or(status[pm.ID], pm.Status)
+		out = append(out, pm)
 	}
+	resolveQuotes(out)
 	return out, nil
 }
 
+// plainMessage macht aus einem Log-Eintrag eine typisierte Nachricht.
+func plainMessage(store *Store, mm CipherMessageWithMeta) (PlainMessage, error) {
+	env, err := decodeEnvelope([]byte(mm.Plain))
+	if err != nil {
+		return PlainMessage{}, err
+	}
+	pm := PlainMessage{
+		ID:      mm.msgID(),
+		Type:    env.Type,
+		At:      mm.TS,
+		Sent:    env.Sent,
+		Out:     mm.Out,
+		Status:  mm.Status,
+		Expires: mm.Expiry,
+	}
+	switch env.Type {
+	case ContentText:
+		var body textBody
+		if err := env.decodeBody(&body); err != nil {
+			return PlainMessage{}, err
+		}
+		pm.Text = body.Text
+		if q := body.Quote; q != nil {
+			pm.Quote = &Quote{ID: q.ID, Text: snippet(q.Text)}
+		}
+	case ContentAttachment:
+		var body attachmentBody
+		if err := env.decodeBody(&body); err != nil {
+			return PlainMessage{}, err
+		}
+		pm.Text = body.Name
+		pm.Attachment = &AttachmentInfo{
+			ID: body.Blob, Name: body.Name, Mime: body.Mime, Size: body.Size,
+			State: AttachmentFailed, Chunks: body.Chunks,
+		}
+		// lokaler Zustand; fehlt er, wurde der Anhang gelöscht
+		if a, err := store.LoadAttachment(body.Blob); err == nil {
+			pm.Attachment = a.info()
+		}
+	default:
+		pm.Text, pm.Unsupported = UnsupportedText, true
+	}
+	pm.applyChanges(mm.changes)
+	return pm, nil
+}
+
 func (s *Session) LocalPeer() *Peer { return s.localPeer }
 func (s *Session) RemoteID() []byte { return s.remoteID }
@@ -3,7 +3,9 @@ package chat
 import (
 	"crypto/ecdh"
 	"crypto/sha256"
+	"fmt"
 	"os"
+	"sync"
 	"time"
 
 	. "github.com/onsi/ginkgo/v2"
@@ -39,6 +41,32 @@ var _ = Describe("Session-Lifecycle über DummyTransport", func() {
 	})
 })
 
+var _ = Describe("Session.Receive mit kaputten Nachrichten", func() {
+
+	It("meldet den Fehler und lässt die Session weiterlaufen", func() {
+		store, _ := NewStore(GinkgoT().TempDir())
+		tp := NewDummyTransport()
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+
+		aSess := NewSessionFromPeer(alice, tp, store)
+		bSess := NewSessionFromPeer(bob, tp, store)
+		Expect(aSess.StartHandshake(bob.Bundle())).To(Succeed())
+
+		var reported error
+		bSess.OnError = func(_ []byte, err error) { reported = err }
+
+		Expect(bSess.Receive(CipherMessage{Version: protocolV2, Header: []byte("x"), Nonce: []byte("y"), Cipher: []byte("z")})).
+			To(MatchError(ErrBadHeader))
+		Expect(reported).To(MatchError(ErrBadHeader))
+
+		// unbekannte Protokollversion → klarer Fehler statt Absturz
+		Expect(bSess.Receive(CipherMessage{Version: 99, Header: []byte("x")})).
+			To(MatchError(ErrUnsupportedVersion))
+
+		Expect(aSess.Send([]byte("trotzdem angekommen"))).To(Succeed())
+	})
+})
+
 var _ = Describe("Session resume ohne neuen Handshake", func() {
 
 	It("Alice kann nach Neustart sofort wieder senden", func() {
@@ -125,3 +153,43 @@ var _ = Describe("LoadPlainMessages", func() {
 		Expect(msgs[0].At.Before(msgs[1].At)).To(BeTrue())
 	})
 })
+
+var _ = Describe("Session bei gleichzeitigem Senden und Empfangen", func() {
+
+	It("schaltet den Ratchet ohne verlorene Nachrichten weiter", func() {
+		aStore, _ := NewStore(GinkgoT().TempDir())
+		bStore, _ := NewStore(GinkgoT().TempDir())
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		dt := NewDummyTransport()
+
+		aSess := NewSessionFromPeer(alice, dt, aStore)
+		bSess := NewSessionFromPeer(bob, dt, bStore)
+		Expect(aSess.StartHandshake(bob.Bundle())).To(Succeed())
+		Expect(bSess.Send([]byte("los"))).To(Succeed())
+
+		// ein zweites Session-Objekt teilt sich Alices Ratchet (wie im Manager)
+		aSess2 := NewSessionFromPeer(alice, dt, aStore)
+		aSess2.Restore(bob.IdentityPublicKey(), alice.state(bob.IdentityPublicKey()))
+
+		const n = 20
+		var wg sync.WaitGroup
+		for _, s := range []*Session{aSess, aSess2, bSess} {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				for i := range n {
+					Expect(s.Send(fmt.Appendf(nil, "%s %d", s.Name, i))).To(Succeed())
+				}
+			}()
+		}
+		wg.Wait()
+
+		msgs, err := aSess.LoadPlainMessages(bob.IdentityPublicKey(), time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).To(HaveLen(3*n + 1))
+		msgs, err = bSess.LoadPlainMessages(alice.IdentityPublicKey(), time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).To(HaveLen(3*n + 1))
+	})
+})
@@ -0,0 +1,61 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const settingsFile = "settings.bin"
+
+// Settings sind globale Einstellungen des Nutzers.
+type Settings struct {
+	ReadReceipts      bool  `json:"read_receipts"`       // Lesebestätigungen senden
+	MaxAttachmentSize int64 `json:"max_attachment_size"` // Bytes, gilt für Senden und Empfangen
+	AutoLockMinutes   int   `json:"auto_lock_minutes"`   // sperrt nach so viel Leerlauf, 0 = nie
+
+	LogSync SyncPolicy `json:"log_sync,omitempty"` // wann der Verlauf gefsynct wird
+}
+
+const defaultAutoLockMinutes = 15
+
+func defaultSettings() *Settings {
+	return &Settings{
+		ReadReceipts:      true,
+		MaxAttachmentSize: defaultMaxAttachmentSize,
+		AutoLockMinutes:   defaultAutoLockMinutes,
+		LogSync:           SyncAlways,
+	}
+}
+
+func (s *Store) LoadSettings() (*Settings, error) {
+	path := filepath.Join(s.basePath, settingsFile)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return defaultSettings(), nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	plain, err := s.unwrap(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	st := defaultSettings()
+	if err := json.Unmarshal(plain, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (s *Store) SaveSettings(st *Settings) error {
+	raw, _ := json.Marshal(st)
+	path := filepath.Join(s.basePath, settingsFile)
+	buf, err := s.wrap(path, raw)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf)
+}
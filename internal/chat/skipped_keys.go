@@ -0,0 +1,69 @@
+package chat
+
+import (
+	"bytes"
+	"slices"
+)
+
+const (
+	// maximal übersprungene Nachrichten pro Chain-Schritt
+	maxSkip = 1000
+	// Obergrenze für den gesamten Cache; älteste Einträge fliegen zuerst raus
+	maxSkippedKeys = 2000
+)
+
+// skippedKey merkt sich den Nachrichtenschlüssel einer noch nicht
+// angekommenen Nachricht (identifiziert über Header-Key + Nummer).
+type skippedKey struct {
+	hk []byte
+	n  uint32
+	mk []byte
+}
+
+// takeSkipped probiert die Header-Keys aus dem Cache durch. Passt einer und
+// ist die Nachrichtennummer bekannt, wird der Schlüssel entfernt und geliefert.
+func (st *sessionState) takeSkipped(encHeader []byte) []byte {
+	var tried [][]byte
+	for _, sk := range st.skipped {
+		if slices.ContainsFunc(tried, func(hk []byte) bool { return bytes.Equal(hk, sk.hk) }) {
+			continue
+		}
+		tried = append(tried, sk.hk)
+
+		h, err := decryptHeader(st.suite, sk.hk, encHeader, st.headerAD())
+		if err != nil {
+			continue
+		}
+		for i, cand := range st.skipped {
+			if cand.n == h.N && bytes.Equal(cand.hk, sk.hk) {
+				st.skipped = append(st.skipped[:i:i], st.skipped[i+1:]...)
+				return cand.mk
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// skipMessageKeys zieht die Recv-Chain bis Nachricht `until` vor und legt die
+// dabei entstehenden Schlüssel im Cache ab.
+func (st *sessionState) skipMessageKeys(until uint32) error {
+	if st.recvChain == nil || until <= st.nr {
+		return nil
+	}
+	if until-st.nr > maxSkip {
+		return ErrTooManySkipped
+	}
+	for st.nr < until {
+		mk, err := st.nextMessageKey(st.recvChain)
+		if err != nil {
+			return err
+		}
+		st.skipped = append(st.skipped, skippedKey{hk: st.hkr, n: st.nr, mk: append([]byte(nil), mk...)})
+		st.nr++
+	}
+	if over := len(st.skipped) - maxSkippedKeys; over > 0 {
+		st.skipped = append([]skippedKey(nil), st.skipped[over:]...)
+	}
+	return nil
+}
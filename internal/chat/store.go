@@ -5,6 +5,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdh"
+	"crypto/mlkem"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/binary"
@@ -16,13 +17,16 @@ import (
 	"path/filepath"
 	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	masterKeyFile = "master.key"
 	identityFile  = "identity.id"
+	preKeysFile   = "prekeys.bin"
 	contactsDir   = "contacts"
+	sessionsDir   = "sessions"
 	msgDir        = "msgs"
 )
 
@@ -30,24 +34,71 @@ var (
 	ErrNoIdentity = errors.New("identity not found")
 	ErrNoContact  = errors.New("contact not found")
 	ErrNoSession  = errors.New("session not found")
+	ErrNoPreKeys  = errors.New("prekeys not found")
 )
 
 type Store struct {
 	basePath  string
-	masterKey []byte
+	masterKey []byte       // nil = gesperrt, siehe keyring.go
+	keyMu     sync.RWMutex // Sperren vs. laufende Ver-/Entschlüsselung
+	legacy    bool         // noch altes Blob-Format, siehe subkey.go
+
+	subMu   sync.Mutex
+	subKeys map[string][]byte // Kontakt-Keys aus keys/, nach Name
+
+	outboxMu sync.Mutex // Ausgang wird auch vom Hintergrund-Worker geschrieben
+	logMu    sync.Mutex // Verlauf: Anhängen vs. Umschreiben beim Ablauf
+	orphanMu sync.Mutex // vorgemerkte Änderungen, siehe edit.go
+
+	groupMu    sync.Mutex
+	groupLocks map[string]*sync.Mutex // je Gruppe: group.bin laden, ändern, sichern, siehe lockGroup
+
+	// unter logMu, siehe durable.go
+	logSync  SyncPolicy           // leer = SyncAlways
+	unsynced map[string]bool      // bei SyncBatch noch nicht gefsyncte Logs
+	repaired map[string]bool      // Logs, deren Ende schon geprüft ist
+	indexes  map[string]*logIndex // geladene Verlaufs-Indizes, nach Log
 }
 
 type CipherMessageWithMeta struct {
-	TS    time.Time `json:"ts"`
-	Out   bool      `json:"out"`
-	Plain string    `json:"plain,omitempty"`
+	TS     time.Time `json:"ts"`
+	Out    bool      `json:"out"`
+	Plain  string    `json:"plain,omitempty"`
+	Status string    `json:"status,omitempty"` // delivered | read
+	MsgID  string    `json:"mid,omitempty"`    // Envelope.ID, leer bei Alt-Einträgen
+	From   []byte    `json:"from,omitempty"`   // Absender, nur bei eingehenden Gruppennachrichten
+	Expiry time.Time `json:"exp,omitzero"`     // verschwindet danach, leer = nie
+	Change string    `json:"change,omitempty"` // edit | delete | reaction, mit Refs = [Nachricht]
+	Seq    uint64    `json:"seq,omitempty"`    // laufende Nummer im Log, 0 bei Alt-Einträgen, siehe index.go
 	CipherMessage
+
+	// Refs ≠ leer: Status-Eintrag für die genannten Nachrichten statt
+	// eigener Nachricht. Out gibt an, ob er ausgehende (Quittung vom
+	// Gegenüber) oder eingehende Nachrichten (lokal gelesen) betrifft.
+	Refs []string `json:"refs,omitempty"`
+
+	changes []CipherMessageWithMeta // Edits, Delete, Reaktionen aus dem Log, nur beim Laden
 }
 
 func NewStore(path string) (*Store, error) {
 	if err := os.MkdirAll(path, 0o700); err != nil {
 		return nil, err
 	}
+	// ein abgebrochener Rekey wird vor allem anderen abgeschlossen
+	if err := finishRekey(path); err != nil {
+		return nil, err
+	}
+
+	legacy, err := loadFormat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// mit Passphrase geschützt: gesperrt starten, Unlock liefert den Key
+	// (und migriert dann)
+	if _, err := os.Stat(filepath.Join(path, keyHeaderFile)); err == nil {
+		return &Store{basePath: path, legacy: legacy}, nil
+	}
 
 	keyPath := filepath.Join(path, masterKeyFile)
 	key, err := os.ReadFile(keyPath)
@@ -56,33 +107,41 @@ func NewStore(path string) (*Store, error) {
 		if _, err := rand.Read(key); err != nil {
 			return nil, err
 		}
-		if err := os.WriteFile(keyPath, key, 0o600); err != nil {
+		if err := writeFileAtomic(keyPath, key); err != nil {
 			return nil, err
 		}
 	} else if err != nil {
 		return nil, err
 	}
 
-	return &Store{basePath: path, masterKey: key}, nil
+	s := &Store{basePath: path, masterKey: key, legacy: legacy}
+	if legacy {
+		if err := s.migrate(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
 }
 
 func (s *Store) saveIdentity(pk *ecdh.PrivateKey) error {
-	buf, err := s.wrap(pk.Bytes())
+	path := filepath.Join(s.basePath, identityFile)
+	buf, err := s.wrap(path, pk.Bytes())
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(filepath.Join(s.basePath, identityFile), buf, 0o600)
+	return writeFileAtomic(path, buf)
 }
 
 func (s *Store) loadIdentity() (*ecdh.PrivateKey, error) {
-	raw, err := os.ReadFile(filepath.Join(s.basePath, identityFile))
+	path := filepath.Join(s.basePath, identityFile)
+	raw, err := os.ReadFile(path)
 	if errors.Is(err, fs.ErrNotExist) {
 		return nil, ErrNoIdentity
 	} else if err != nil {
 		return nil, err
 	}
 
-	plain, err := s.unwrap(raw)
+	plain, err := s.unwrap(path, raw)
 	if err != nil {
 		return nil, err
 	}
@@ -101,6 +160,80 @@ func (s *Store) EnsureIdentity() (*ecdh.PrivateKey, error) {
 	return id, err
 }
 
+func (s *Store) SavePreKeys(ks *preKeySet) error {
+	pp := persistPreKeys{Version: 1, NextID: ks.nextID}
+	for _, spk := range ks.signed {
+		ps := persistSignedPreKey{
+			ID:      spk.id,
+			Priv:    spk.priv.Bytes(),
+			Sig:     spk.sig,
+			Created: spk.created,
+		}
+		if spk.kem != nil {
+			ps.KEMSeed, ps.KEMSig = spk.kem.Bytes(), spk.kemSig
+		}
+		pp.Signed = append(pp.Signed, ps)
+	}
+	for id, opk := range ks.oneTime {
+		pp.OneTime = append(pp.OneTime, persistOneTimePreKey{ID: id, Priv: opk.Bytes()})
+	}
+
+	raw, _ := json.Marshal(pp)
+	path := filepath.Join(s.basePath, preKeysFile)
+	buf, err := s.wrap(path, raw)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, buf)
+}
+
+func (s *Store) LoadPreKeys() (*preKeySet, error) {
+	path := filepath.Join(s.basePath, preKeysFile)
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNoPreKeys
+	} else if err != nil {
+		return nil, err
+	}
+
+	plain, err := s.unwrap(path, raw)
+	if err != nil {
+		return nil, err
+	}
+	var pp persistPreKeys
+	if err := json.Unmarshal(plain, &pp); err != nil {
+		return nil, err
+	}
+	if pp.Version != 1 || len(pp.Signed) == 0 {
+		return nil, errors.New("unsupported prekey version")
+	}
+
+	curve := ecdh.X25519()
+	ks := &preKeySet{oneTime: map[uint32]*ecdh.PrivateKey{}, nextID: pp.NextID}
+	for _, spk := range pp.Signed {
+		priv, err := curve.NewPrivateKey(spk.Priv)
+		if err != nil {
+			return nil, err
+		}
+		sp := &signedPreKey{id: spk.ID, priv: priv, sig: spk.Sig, created: spk.Created}
+		if len(spk.KEMSeed) > 0 {
+			if sp.kem, err = mlkem.NewDecapsulationKey768(spk.KEMSeed); err != nil {
+				return nil, err
+			}
+			sp.kemSig = spk.KEMSig
+		}
+		ks.signed = append(ks.signed, sp)
+	}
+	for _, opk := range pp.OneTime {
+		priv, err := curve.NewPrivateKey(opk.Priv)
+		if err != nil {
+			return nil, err
+		}
+		ks.oneTime[opk.ID] = priv
+	}
+	return ks, nil
+}
+
 func (s *Store) SaveContact(c *Contact) error {
 	dir := filepath.Join(s.basePath, contactsDir)
 	if err := os.MkdirAll(dir, 0o700); err != nil {
@@ -108,23 +241,25 @@ func (s *Store) SaveContact(c *Contact) error {
 	}
 
 	raw, _ := json.Marshal(c)
-	buf, err := s.wrap(raw)
+	path := filepath.Join(dir, b64Name(c.IDPub)+".json")
+	buf, err := s.wrap(path, raw)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(filepath.Join(dir, b64Name(c.IDPub)+".json"), buf, 0o600)
+	return writeFileAtomic(path, buf)
 }
 
 func (s *Store) LoadContact(idPub []byte) (*Contact, error) {
-	raw, err := os.ReadFile(filepath.Join(s.basePath, contactsDir, b64Name(idPub)+".json"))
+	path := filepath.Join(s.basePath, contactsDir, b64Name(idPub)+".json")
+	raw, err := os.ReadFile(path)
 	if errors.Is(err, fs.ErrNotExist) {
 		return nil, ErrNoContact
 	} else if err != nil {
 		return nil, err
 	}
 
-	plain, err := s.unwrap(raw)
+	plain, err := s.unwrap(path, raw)
 	if err != nil {
 		return nil, err
 	}
@@ -151,6 +286,91 @@ func (s *Store) AddContactIfMissing(name string, idPub []byte) error {
 	return s.SaveContact(c)
 }
 
+// FindContactByName sucht einen Kontakt über den Anzeigenamen.
+func (s *Store) FindContactByName(name string) (*Contact, error) {
+	list, err := s.ListContacts()
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range list {
+		if c.Name == name {
+			return c, nil
+		}
+	}
+	return nil, ErrNoContact
+}
+
+// ReplaceContactKey zieht einen Kontakt auf einen neuen Identity-Key um.
+// Der alte Key landet in der Historie, die Verifikation verfällt, der
+// Verlauf wandert mit, die alte Session wird verworfen. Nur nach
+// ausdrücklicher Bestätigung durch den Nutzer aufrufen.
+func (s *Store) ReplaceContactKey(oldID, newID []byte) (*Contact, error) {
+	c, err := s.LoadContact(oldID)
+	if err != nil {
+		return nil, err
+	}
+	c.KeyHistory = append(c.KeyHistory, KeyRecord{
+		IDPub:    oldID,
+		Replaced: time.Now().UTC(),
+		Verified: c.Verified,
+	})
+	c.IDPub = newID
+	c.Verified = false
+	c.VerifiedAt = time.Time{}
+	c.KeyChanged, c.PendingKey = false, nil
+	c.Devices, c.DeviceVersion, c.DeviceKey = nil, 0, nil // gehörten zum alten Key
+	if err := s.SaveContact(c); err != nil {
+		return nil, err
+	}
+
+	if err := s.moveLog(oldID, newID); err != nil {
+		return nil, err
+	}
+	// Kontaktdatei, Session und Ausgang des alten Keys fallen mit weg
+	if err := s.ShredContact(oldID); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// moveLog schreibt den Verlauf von oldID für newID neu. Pfad und
+// Kontakt-Key stecken in jedem Frame, ein Umbenennen reicht nicht. Was
+// unter newID schon angekommen ist, bleibt dahinter erhalten.
+func (s *Store) moveLog(oldID, newID []byte) error {
+	oldLog := filepath.Join(s.basePath, msgDir, b64Name(oldID)+".log")
+	newLog := filepath.Join(s.basePath, msgDir, b64Name(newID)+".log")
+
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	data, err := os.ReadFile(oldLog)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var out []byte
+	for _, f := range splitFrames(data) {
+		rec, err := s.record(oldLog, f)
+		if err != nil {
+			continue
+		}
+		frame, err := s.frame(newLog, rec)
+		if err != nil {
+			return err
+		}
+		out = append(out, frame...)
+	}
+	if since, err := os.ReadFile(newLog); err == nil {
+		for _, f := range splitFrames(since) {
+			out = append(out, f...)
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	s.dropIndex(newLog)
+	return writeFileAtomic(newLog, out)
+}
+
 func (s *Store) ListContacts() ([]*Contact, error) {
 	dir := filepath.Join(s.basePath, contactsDir)
 	ents, err := os.ReadDir(dir)
@@ -165,8 +385,9 @@ func (s *Store) ListContacts() ([]*Contact, error) {
 		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
 			continue
 		}
-		raw, _ := os.ReadFile(filepath.Join(dir, e.Name()))
-		plain, err := s.unwrap(raw)
+		path := filepath.Join(dir, e.Name())
+		raw, _ := os.ReadFile(path)
+		plain, err := s.unwrap(path, raw)
 		if err != nil {
 			return nil, err
 		}
@@ -179,8 +400,11 @@ func (s *Store) ListContacts() ([]*Contact, error) {
 	return list, nil
 }
 
-func (s *Store) wrap(plain []byte) ([]byte, error) {
-	nonce, ct, err := s.encrypt(plain)
+// wrapWith ist das alte Blob-Format: u16 Nonce-Länge ‖ Nonce ‖
+// Ciphertext, direkt mit dem Master-Key und ohne AD. Nur noch für die
+// Migration, siehe subkey.go.
+func wrapWith(key, plain []byte) ([]byte, error) {
+	nonce, ct, err := encrypt(key, plain, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -191,8 +415,7 @@ func (s *Store) wrap(plain []byte) ([]byte, error) {
 	return buf, nil
 }
 
-func (s *Store) unwrap(buf []byte) ([]byte, error) {
-	log.Printf("[Store] unwrap len=%d", len(buf))
+func unwrapWith(key, buf []byte) ([]byte, error) {
 	if len(buf) < 2 {
 		return nil, errors.New("blob too short")
 	}
@@ -200,19 +423,15 @@ func (s *Store) unwrap(buf []byte) ([]byte, error) {
 	if len(buf) < 2+n {
 		return nil, errors.New("invalid nonce length")
 	}
-	p, err := s.decrypt(buf[2:2+n], buf[2+n:])
-	if err != nil {
-		log.Println("  decrypt-error:", err)
-	}
-	return p, err
+	return decrypt(key, buf[2:2+n], buf[2+n:], nil)
 }
 
 func b64Name(b []byte) string {
 	return base64.RawURLEncoding.EncodeToString(b)
 }
 
-func (s *Store) encrypt(plain []byte) (nonce, ct []byte, err error) {
-	block, err := aes.NewCipher(s.masterKey)
+func encrypt(key, plain, ad []byte) (nonce, ct []byte, err error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return
 	}
@@ -224,12 +443,12 @@ func (s *Store) encrypt(plain []byte) (nonce, ct []byte, err error) {
 	if _, err = rand.Read(nonce); err != nil {
 		return
 	}
-	ct = gcm.Seal(nil, nonce, plain, nil)
+	ct = gcm.Seal(nil, nonce, plain, ad)
 	return
 }
 
-func (s *Store) decrypt(nonce, ct []byte) ([]byte, error) {
-	block, err := aes.NewCipher(s.masterKey)
+func decrypt(key, nonce, ct, ad []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
@@ -237,33 +456,82 @@ func (s *Store) decrypt(nonce, ct []byte) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
-	return gcm.Open(nil, nonce, ct, nil)
+	return gcm.Open(nil, nonce, ct, ad)
 }
 
+const (
+	sessionFile        = "state.bin"
+	pendingSessionFile = "pending.bin" // Handshake, der sich noch nicht bewiesen hat
+)
+
 func (s *Store) SaveSession(id []byte, st *sessionState) error {
-	dir := filepath.Join(s.basePath, "sessions", b64Name(id))
+	return s.saveState(id, sessionFile, st)
+}
+
+// SavePendingSession sichert den State eines noch unbestätigten Handshakes
+// neben der laufenden Session; nil löscht ihn.
+func (s *Store) SavePendingSession(id []byte, st *sessionState) error {
+	if st == nil {
+		err := os.Remove(filepath.Join(s.basePath, sessionsDir, b64Name(id), pendingSessionFile))
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return s.saveState(id, pendingSessionFile, st)
+}
+
+func (s *Store) saveState(id []byte, file string, st *sessionState) error {
+	dir := filepath.Join(s.basePath, sessionsDir, b64Name(id))
 	if err := os.MkdirAll(dir, 0o700); err != nil {
 		return err
 	}
 	ps := persistState{
-		Version: 1,
+		Version: persistVersion,
 		RootKey: st.rootKey,
 		DHSPriv: st.dhSendPrivKey.Bytes(),
 		DHRPub:  st.dhRecvPubKey.Bytes(),
 		SendCK:  st.sendCK(),
 		RecvCK:  st.recvCK(),
+		Proto:   st.version,
+		Suite:   st.suite,
+		HS:      st.handshake,
+		KDF:     st.kdf,
+		AD:      st.ad,
+		Ns:      st.ns,
+		Nr:      st.nr,
+		PN:      st.pn,
+		HKs:     st.hks,
+		HKr:     st.hkr,
+		NHKs:    st.nhks,
+		NHKr:    st.nhkr,
+
+		Unconfirmed: st.unconfirmed,
+	}
+	for _, sk := range st.skipped {
+		ps.Skipped = append(ps.Skipped, persistSkipped{HK: sk.hk, N: sk.n, MK: sk.mk})
 	}
 	raw, _ := json.Marshal(ps)
-	buf, err := s.wrap(raw)
+	path := filepath.Join(dir, file)
+	buf, err := s.wrap(path, raw)
 	if err != nil {
 		return err
 	}
 
-	return os.WriteFile(filepath.Join(dir, "state.bin"), buf, 0o600)
+	return writeFileAtomic(path, buf)
 }
 
 func (s *Store) LoadSession(id []byte) (*sessionState, error) {
-	path := filepath.Join(s.basePath, "sessions", b64Name(id), "state.bin")
+	return s.loadState(id, sessionFile)
+}
+
+// LoadPendingSession lädt den State eines unbestätigten Handshakes.
+func (s *Store) LoadPendingSession(id []byte) (*sessionState, error) {
+	return s.loadState(id, pendingSessionFile)
+}
+
+func (s *Store) loadState(id []byte, file string) (*sessionState, error) {
+	path := filepath.Join(s.basePath, sessionsDir, b64Name(id), file)
 
 	raw, err := os.ReadFile(path)
 	if errors.Is(err, fs.ErrNotExist) {
@@ -272,12 +540,16 @@ func (s *Store) LoadSession(id []byte) (*sessionState, error) {
 	if err != nil {
 		return nil, err
 	}
-	plain, _ := s.unwrap(raw)
+	// vernichteter Schlüssel, vertauschte oder manipulierte Datei
+	plain, err := s.unwrap(path, raw)
+	if err != nil {
+		return nil, err
+	}
 	var ps persistState
 	if err := json.Unmarshal(plain, &ps); err != nil {
 		return nil, err
 	}
-	if ps.Version != 1 {
+	if ps.Version < 1 || ps.Version > persistVersion {
 		return nil, errors.New("unsupported version")
 	}
 
@@ -285,59 +557,186 @@ func (s *Store) LoadSession(id []byte) (*sessionState, error) {
 	dhs, _ := curve.NewPrivateKey(ps.DHSPriv)
 	dhr, _ := curve.NewPublicKey(ps.DHRPub)
 
-	return &sessionState{
+	st := &sessionState{
 		rootKey:       ps.RootKey,
 		dhSendPrivKey: dhs,
 		dhRecvPubKey:  dhr,
 		sendChain:     maybeRatchet(ps.SendCK),
 		recvChain:     maybeRatchet(ps.RecvCK),
-	}, nil
+		version:       cmp.Or(ps.Proto, protocolV1),
+		suite:         cmp.Or(ps.Suite, suiteAES256GCM),
+		handshake:     ps.HS,
+		kdf:           cmp.Or(ps.KDF, kdfV1), // bis v2 immer die Alt-KDF
+		ad:            ps.AD,
+		ns:            ps.Ns,
+		nr:            ps.Nr,
+		pn:            ps.PN,
+		hks:           ps.HKs,
+		hkr:           ps.HKr,
+		nhks:          ps.NHKs,
+		nhkr:          ps.NHKr,
+		unconfirmed:   ps.Unconfirmed,
+	}
+
+	// v1 → v2: Header-Keys nachrüsten. Die alten Skipped-Keys gehören zu
+	// Nachrichten mit Klartext-Header und werden verworfen.
+	if ps.Version == 1 {
+		log.Printf("[Store] migrating session %s to v%d (dropping %d skipped keys)",
+			b64Name(id)[:8], persistVersion, len(ps.Skipped))
+		if err := st.migrateHeaderKeys(); err != nil {
+			return nil, err
+		}
+		return st, nil
+	}
+	for _, sk := range ps.Skipped {
+		st.skipped = append(st.skipped, skippedKey{hk: sk.HK, n: sk.N, mk: sk.MK})
+	}
+	return st, nil
 }
 
 // Test helper
-func (s *Store) MasterKey() []byte { return s.masterKey }
+func (s *Store) MasterKey() []byte {
+	s.keyMu.RLock()
+	defer s.keyMu.RUnlock()
+	return s.masterKey
+}
 
-func (s *Store) AppendMessage(id []byte, msg CipherMessage, out bool, plain []byte) error {
+// msgID ist die stabile ID eines Log-Eintrags; Alt-Einträge ohne
+// Umschlag werden über Header und Nonce identifiziert.
+func (r *CipherMessageWithMeta) msgID() string {
+	return cmp.Or(r.MsgID, messageID(r.CipherMessage))
+}
+
+func (s *Store) AppendMessage(id []byte, msg CipherMessage, out bool, msgID string, plain []byte) error {
 	log.Printf("[Store] AppendMessage id=%s hdr=%dB non=%dB ct=%dB out=%v",
 		b64Name(id)[:8], len(msg.Header), len(msg.Nonce), len(msg.Cipher), out)
-	dir := filepath.Join(s.basePath, msgDir)
-	if err := os.MkdirAll(dir, 0o700); err != nil {
-		return err
-	}
-
 	rec := CipherMessageWithMeta{
 		CipherMessage: msg,
 		TS:            time.Now().UTC(),
 		Out:           out,
+		MsgID:         msgID,
 		Plain:         string(plain),
 	}
+	rec.Expiry = expiryOf(rec.TS, plain)
+	if err := s.appendRecord(id, rec); err != nil {
+		return err
+	}
+	s.adoptOrphans(id, rec.msgID())
+	return nil
+}
 
-	raw, _ := json.Marshal(rec) // JSON-Zeile
-	blob, err := s.wrap(raw)    // symmetrisch verschlüsseln
-	if err != nil {
-		log.Println("  wrap-error:", err)
+// SetMessageStatus hängt einen Status-Eintrag an das Log. LoadMessages
+// rechnet ihn in die referenzierten Nachrichten ein; der Status steigt
+// dabei nur (delivered → read).
+func (s *Store) SetMessageStatus(id []byte, out bool, status string, refs ...string) error {
+	log.Printf("[Store] SetMessageStatus id=%s out=%v status=%s n=%d",
+		b64Name(id)[:8], out, status, len(refs))
+	return s.appendRecord(id, CipherMessageWithMeta{
+		TS:     time.Now().UTC(),
+		Out:    out,
+		Status: status,
+		Refs:   refs,
+	})
+}
+
+func (s *Store) appendRecord(id []byte, rec CipherMessageWithMeta) error {
+	return s.appendLog(filepath.Join(s.basePath, msgDir, b64Name(id)+".log"), rec)
+}
+
+// appendLog hängt einen verschlüsselten Eintrag an ein Nachrichten-Log
+// (1:1-Verlauf oder Gruppe).
+func (s *Store) appendLog(file string, rec CipherMessageWithMeta) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
 		return err
 	}
-	log.Printf("  frameLen=%d", len(blob))
-	frame := make([]byte, 4+len(blob))
-	binary.BigEndian.PutUint32(frame[:4], uint32(len(blob)))
-	copy(frame[4:], blob)
 
-	file := filepath.Join(dir, b64Name(id)+".log")
+	s.logMu.Lock()
+	defer s.logMu.Unlock()
+	if err := s.repairTail(file); err != nil {
+		return err
+	}
+	// ohne Index geht es trotzdem, die Nummer vergibt dann der Neuaufbau
+	ix, err := s.logIndex(file)
+	if err != nil {
+		log.Printf("[Store] !! index %s: %v", filepath.Base(file), err)
+	} else if len(rec.Refs) == 0 {
+		rec.Seq = ix.seq + 1
+	}
+	frame, err := s.frame(file, rec)
+	if err != nil {
+		return err
+	}
 	f, err := os.OpenFile(file,
 		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.Write(frame); err != nil {
+		f.Truncate(st.Size()) // keinen halben Frame stehen lassen
+		return err
+	}
+	if ix != nil {
+		s.indexRecord(file, ix, &rec, st.Size(), len(frame))
+	}
+	switch s.logSync {
+	case SyncNone:
+	case SyncBatch:
+		if s.unsynced == nil {
+			s.unsynced = map[string]bool{}
+		}
+		s.unsynced[file] = true
+	default:
+		return f.Sync()
+	}
+	return nil
+}
+
+// frame verschlüsselt einen Log-Eintrag für das Log file:
+// Länge ‖ Prüfsumme ‖ wrap(JSON), siehe durable.go.
+func (s *Store) frame(file string, rec CipherMessageWithMeta) ([]byte, error) {
+	raw, _ := json.Marshal(rec)    // JSON-Zeile
+	blob, err := s.wrap(file, raw) // symmetrisch verschlüsseln
+	if err != nil {
+		log.Println("  wrap-error:", err)
+		return nil, err
+	}
+	log.Printf("  frameLen=%d", len(blob))
+	return lengthPrefixed(blob), nil
+}
+
+// record entschlüsselt einen Frame aus splitFrames des Logs file.
+func (s *Store) record(file string, frame []byte) (CipherMessageWithMeta, error) {
+	var rec CipherMessageWithMeta
+	plain, err := s.unwrap(file, frameBlob(frame))
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(plain, &rec); err != nil {
+		log.Println("  json-error:", err)
+		return rec, err
+	}
+	return rec, nil
+}
 
-	_, err = f.Write(frame)
-	return err
+func (r *CipherMessageWithMeta) expired(now time.Time) bool {
+	return !r.Expiry.IsZero() && !now.Before(r.Expiry)
 }
 
 func (s *Store) LoadMessages(id []byte, since time.Time) ([]CipherMessageWithMeta, error) {
-	path := filepath.Join(s.basePath, msgDir, b64Name(id)+".log")
 	log.Printf("[Store] LoadMessages id=%s since=%s", b64Name(id)[:8], since)
+	return s.loadLog(filepath.Join(s.basePath, msgDir, b64Name(id)+".log"), since)
+}
+
+func (s *Store) loadLog(path string, since time.Time) ([]CipherMessageWithMeta, error) {
+	if s.Locked() {
+		return nil, ErrLocked // sonst fielen alle Frames als unlesbar weg
+	}
 	data, err := os.ReadFile(path)
 	if errors.Is(err, fs.ErrNotExist) {
 		log.Println("  no file → 0 frames")
@@ -348,36 +747,60 @@ func (s *Store) LoadMessages(id []byte, since time.Time) ([]CipherMessageWithMet
 		return nil, err
 	}
 	log.Printf("  fileSize=%d", len(data))
-	var out []CipherMessageWithMeta
-	for len(data) >= 4 {
-		ln := int(binary.BigEndian.Uint32(data[:4]))
-		if len(data) < 4+ln {
-			log.Println("  truncated frame, abort")
-			break
-		}
-		cipherFrame := data[4 : 4+ln]
-		data = data[4+ln:]
-
-		plain, err := s.unwrap(cipherFrame)
+	var out, side []CipherMessageWithMeta
+	now := time.Now()
+	for _, frame := range splitFrames(data) {
+		rec, err := s.record(path, frame)
 		if err != nil {
 			continue
 		}
-
-		var rec CipherMessageWithMeta
-		if err := json.Unmarshal(plain, &rec); err != nil {
-			log.Println("  json-error:", err)
+		if len(rec.Refs) > 0 {
+			side = append(side, rec)
 			continue
 		}
-
 		if !since.IsZero() && rec.TS.Before(since) {
 			continue
 		}
+		if rec.expired(now) {
+			continue // der Sweeper hat es nur noch nicht gelöscht
+		}
 		out = append(out, rec)
 	}
+	attachSide(out, side)
+	log.Printf("  returning %d frames", len(out))
+	return out, nil
+}
+
+// attachSide trägt Quittungen und Änderungen (Einträge mit Refs, in
+// Log-Reihenfolge) in die Nachrichten ein und sortiert sie nach Zeit.
+func attachSide(out, side []CipherMessageWithMeta) {
+	status := map[bool]map[string]string{true: {}, false: {}}
+	changes := map[string][]CipherMessageWithMeta{}
+	for _, rec := range side {
+		if rec.Change != "" && len(rec.Refs) == 1 {
+			changes[rec.Refs[0]] = append(changes[rec.Refs[0]], rec)
+			continue
+		}
+		for _, ref := range rec.Refs {
+			if statusRank(rec.Status) > statusRank(status[rec.Out][ref]) {
+				status[rec.Out][ref] = rec.Status
+			}
+		}
+	}
+
+	for i := range out {
+		if st, ok := status[out[i].Out][out[i].msgID()]; ok {
+			out[i].Status = st
+		}
+		// Edits und Löschungen nur vom Absender, Reaktionen von beiden
+		for _, c := range changes[out[i].msgID()] {
+			if c.Change == ChangeReaction || c.Out == out[i].Out {
+				out[i].changes = append(out[i].changes, c)
+			}
+		}
+	}
 
 	slices.SortFunc(out, func(a, b CipherMessageWithMeta) int {
 		return cmp.Compare(a.TS.UnixNano(), b.TS.UnixNano())
 	})
-	log.Printf("  returning %d frames", len(out))
-	return out, nil
 }
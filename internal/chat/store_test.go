@@ -3,7 +3,7 @@ package chat
 import (
 	"crypto/ecdh"
 	"crypto/rand"
-	"encoding/binary"
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"time"
@@ -60,8 +60,8 @@ var _ = Describe("Store.EnsureIdentity", func() {
 		raw, err := os.ReadFile(filepath.Join(tmpDir, "identity.id"))
 		Expect(err).NotTo(HaveOccurred())
 
-		nonceLen := binary.BigEndian.Uint16(raw[:2])
-		ciphertext := raw[2+nonceLen:] // Header + Nonce überspringen
+		Expect(raw[0]).To(Equal(byte(blobMagic)))
+		ciphertext := raw[2+12:] // Magic, Version, Nonce überspringen
 
 		// Der verschlüsselte Teil darf NICHT dem Klartext entsprechen
 		Expect(ciphertext).NotTo(Equal(key1.Bytes()))
@@ -112,6 +112,96 @@ var _ = Describe("Store.SaveSession / LoadSession", func() {
 	})
 })
 
+var _ = Describe("Store.SaveSession – skipped message keys", func() {
+
+	It("überlebt einen Neustart mit offenen Lücken in der Recv-Chain", func() {
+		tmp, _ := os.MkdirTemp("", "store_skip_*")
+		defer os.RemoveAll(tmp)
+
+		store, _ := NewStore(tmp)
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		aliceID := alice.IdentityPublicKey()
+		bobID := bob.IdentityPublicKey()
+
+		handshake(alice, bob)
+
+		h0, n0, ct0, _ := alice.Encrypt(bobID, []byte("late"))
+		h1, n1, ct1, _ := alice.Encrypt(bobID, []byte("early"))
+		plain, _ := bob.Decrypt(aliceID, h1, n1, ct1)
+		Expect(string(plain)).To(Equal("early"))
+
+		Expect(store.SaveSession(aliceID, bob.state(aliceID))).To(Succeed())
+
+		// „Neustart“: Bob mit frisch geladenem State
+		st, err := store.LoadSession(aliceID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(st.skipped).To(HaveLen(1))
+		Expect(st.nr).To(Equal(uint32(2)))
+
+		bob2 := NewPeer("Bob")
+		bob2.sess[keyOf(aliceID)] = st
+		plain, _ = bob2.Decrypt(aliceID, h0, n0, ct0)
+		Expect(string(plain)).To(Equal("late"))
+	})
+})
+
+var _ = Describe("Store.LoadSession – Migration von v1", func() {
+
+	It("rüstet Header-Keys nach, sodass beide Seiten weiter chatten können", func() {
+		tmp := GinkgoT().TempDir()
+		store, _ := NewStore(tmp)
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		aliceID, bobID := alice.IdentityPublicKey(), bob.IdentityPublicKey()
+
+		handshake(alice, bob)
+		h, n, ct, _ := alice.Encrypt(bobID, []byte("vor dem Upgrade"))
+		bob.Decrypt(aliceID, h, n, ct)
+
+		// beide States im alten v1-Format (ohne Header-Keys) ablegen
+		saveV1 := func(id []byte, st *sessionState) {
+			raw, _ := json.Marshal(persistState{
+				Version: 1,
+				RootKey: st.rootKey,
+				DHSPriv: st.dhSendPrivKey.Bytes(),
+				DHRPub:  st.dhRecvPubKey.Bytes(),
+				SendCK:  st.sendCK(),
+				RecvCK:  st.recvCK(),
+			})
+			dir := filepath.Join(tmp, sessionsDir, b64Name(id))
+			buf, err := store.wrap(filepath.Join(dir, "state.bin"), raw)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(os.MkdirAll(dir, 0o700)).To(Succeed())
+			Expect(os.WriteFile(filepath.Join(dir, "state.bin"), buf, 0o600)).To(Succeed())
+		}
+		saveV1(bobID, alice.state(bobID))
+		saveV1(aliceID, bob.state(aliceID))
+
+		stA, err := store.LoadSession(bobID)
+		Expect(err).NotTo(HaveOccurred())
+		stB, err := store.LoadSession(aliceID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stA.kdf).To(Equal(kdfV1)) // Alt-Sessions behalten ihre KDF
+		Expect(stA.hks).To(Equal(stB.hkr))
+		Expect(stA.nhks).To(Equal(stB.nhkr))
+
+		alice.sess[keyOf(bobID)] = stA
+		bob.sess[keyOf(aliceID)] = stB
+
+		for _, msg := range []string{"gleiche Chain", "noch eine"} {
+			h, n, ct, _ := alice.Encrypt(bobID, []byte(msg))
+			plain, _ := bob.Decrypt(aliceID, h, n, ct)
+			Expect(string(plain)).To(Equal(msg))
+		}
+		h, n, ct, _ = bob.Encrypt(aliceID, []byte("Antwort nach Upgrade"))
+		plain, _ := alice.Decrypt(bobID, h, n, ct)
+		Expect(string(plain)).To(Equal("Antwort nach Upgrade"))
+
+		Expect(store.SaveSession(bobID, alice.state(bobID))).To(Succeed())
+		stA, _ = store.LoadSession(bobID)
+		Expect(stA.hkr).NotTo(BeEmpty())
+	})
+})
+
 var _ = Describe("Store.AppendMessage / LoadMessages", func() {
 
 	It("appends, retrieves & keeps messages encrypted on disk", func() {
@@ -126,9 +216,9 @@ var _ = Describe("Store.AppendMessage / LoadMessages", func() {
 		m1 := CipherMessage{Header: []byte("hdr-1"), Nonce: []byte("n1"), Cipher: []byte("cipher-1")}
 		m2 := CipherMessage{Header: []byte("hdr-2"), Nonce: []byte("n2"), Cipher: []byte("cipher-2")}
 
-		Expect(store.AppendMessage(remoteID, m1, true, []byte("cipher-1"))).To(Succeed())  // outgoing
+		Expect(store.AppendMessage(remoteID, m1, true, "", []byte("cipher-1"))).To(Succeed())  // outgoing
 		time.Sleep(10 * time.Millisecond)                               // klarer TS-Abstand
-		Expect(store.AppendMessage(remoteID, m2, false, []byte("cipher-2"))).To(Succeed()) // incoming
+		Expect(store.AppendMessage(remoteID, m2, false, "", []byte("cipher-2"))).To(Succeed()) // incoming
 
 		// ─── Laden ohne Filter ───────────────────────────────
 		msgs, err := store.LoadMessages(remoteID, time.Time{})
@@ -0,0 +1,262 @@
+package chat
+
+import (
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Schlüsselhierarchie im Store: nichts wird direkt mit dem Master-Key
+// verschlüsselt. Jede Datei bekommt einen per HKDF abgeleiteten Subkey
+// für ihre Art (identity, sessions, msgs …), und ihr Pfad relativ zum
+// Store steckt als Associated Data im AEAD. Vertauschte oder umbenannte
+// Dateien lassen sich so nicht mehr entschlüsseln.
+//
+// Dateien eines Kontakts (contacts/, sessions/, msgs/, outbox/) hängen
+// nicht am Master-Key, sondern an einem zufälligen Kontakt-Key in
+// keys/<id>.key. Wer ihn löscht, macht den ganzen Verlauf unlesbar, auch
+// wenn noch Kopien der Dateien herumliegen.
+//
+// Blob-Format: 'Z' ‖ Version ‖ Nonce ‖ Ciphertext. Alte Blobs (u16
+// Nonce-Länge, erstes Byte 0) liest nur ein noch nicht migrierter Store.
+const (
+	storeFormatFile = "format"
+	storeFormat     = 2
+	blobMagic       = 'Z'
+	keysDir         = "keys"
+)
+
+var ErrShredded = errors.New("contact key deleted")
+
+// ownedDirs sind die Verzeichnisse, deren Dateien nach dem Kontakt
+// benannt sind, dem sie gehören.
+var ownedDirs = map[string]bool{contactsDir: true, sessionsDir: true, msgDir: true, outboxDir: true}
+
+// scope liefert Art und Besitzer einer Datei (rel mit "/").
+func scope(rel string) (kind, owner string) {
+	dir, rest, nested := strings.Cut(rel, "/")
+	if !nested {
+		return rel, ""
+	}
+	if !ownedDirs[dir] {
+		return dir, ""
+	}
+	name, _, _ := strings.Cut(rest, "/")
+	return dir, strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// relPath ist der Pfad von file relativ zum Store, wie er in die AD geht.
+func (s *Store) relPath(file string) string {
+	rel, err := filepath.Rel(s.basePath, file)
+	if err != nil {
+		return filepath.ToSlash(file)
+	}
+	return filepath.ToSlash(rel)
+}
+
+func (s *Store) wrap(file string, plain []byte) ([]byte, error) {
+	s.keyMu.RLock()
+	defer s.keyMu.RUnlock()
+	if s.masterKey == nil {
+		return nil, ErrLocked
+	}
+	return s.seal(s.relPath(file), plain)
+}
+
+func (s *Store) unwrap(file string, buf []byte) ([]byte, error) {
+	log.Printf("[Store] unwrap len=%d", len(buf))
+	s.keyMu.RLock()
+	defer s.keyMu.RUnlock()
+	if s.masterKey == nil {
+		return nil, ErrLocked
+	}
+	p, err := s.open(s.relPath(file), buf)
+	if err != nil {
+		log.Println("  decrypt-error:", err)
+	}
+	return p, err
+}
+
+// seal und open setzen voraus, dass der Aufrufer keyMu hält.
+func (s *Store) seal(rel string, plain []byte) ([]byte, error) {
+	key, err := s.subkey(rel, true)
+	if err != nil {
+		return nil, err
+	}
+	return sealWith(key, rel, plain)
+}
+
+func (s *Store) open(rel string, buf []byte) ([]byte, error) {
+	if s.legacy && len(buf) > 0 && buf[0] == 0 {
+		return unwrapWith(s.masterKey, buf)
+	}
+	key, err := s.subkey(rel, false)
+	if err != nil {
+		return nil, err
+	}
+	return openWith(key, rel, buf)
+}
+
+// subkey leitet den Schlüssel für rel ab; create legt einen fehlenden
+// Kontakt-Key an (nur beim Schreiben).
+func (s *Store) subkey(rel string, create bool) ([]byte, error) {
+	kind, owner := scope(rel)
+	root := s.masterKey
+	if owner != "" {
+		var err error
+		if root, err = s.contactKey(owner, create); err != nil {
+			return nil, err
+		}
+	}
+	return hkdf.Key(sha256.New, root, nil, "zero store "+kind, 32)
+}
+
+// contactKey lädt den Kontakt-Key von owner aus keys/ (gecacht).
+func (s *Store) contactKey(owner string, create bool) ([]byte, error) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	if key, ok := s.subKeys[owner]; ok {
+		return key, nil
+	}
+
+	rel := keysDir + "/" + owner + ".key"
+	path := filepath.Join(s.basePath, filepath.FromSlash(rel))
+	raw, err := os.ReadFile(path)
+	var key []byte
+	switch {
+	case err == nil:
+		if key, err = s.open(rel, raw); err != nil {
+			return nil, fmt.Errorf("contact key %.8s: %w", owner, err)
+		}
+	case errors.Is(err, fs.ErrNotExist) && create:
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		buf, err := s.seal(rel, key)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(path, buf); err != nil {
+			return nil, err
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		return nil, ErrShredded
+	default:
+		return nil, err
+	}
+
+	if s.subKeys == nil {
+		s.subKeys = map[string][]byte{}
+	}
+	s.subKeys[owner] = key
+	return key, nil
+}
+
+// shredded sagt, ob rel einem Kontakt gehört, dessen Key gelöscht ist.
+// Ein Store im alten Format hat noch gar keine Kontakt-Keys.
+func (s *Store) shredded(rel string) bool {
+	_, owner := scope(rel)
+	if owner == "" || s.legacy {
+		return false
+	}
+	_, err := s.contactKey(owner, false)
+	return errors.Is(err, ErrShredded)
+}
+
+// forgetSubkeys überschreibt die gecachten Kontakt-Keys.
+func (s *Store) forgetSubkeys() {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	for _, k := range s.subKeys {
+		clear(k)
+	}
+	s.subKeys = nil
+}
+
+// ShredContact löscht den Kontakt-Key von id und damit unwiderruflich
+// alles, was an ihm hängt: Kontakt, Session, Verlauf und Ausgang. Die
+// Dateien werden danach nur noch aufgeräumt.
+func (s *Store) ShredContact(id []byte) error {
+	name := b64Name(id)
+	s.subMu.Lock()
+	clear(s.subKeys[name])
+	delete(s.subKeys, name)
+	err := os.Remove(filepath.Join(s.basePath, keysDir, name+".key"))
+	s.subMu.Unlock()
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	for _, p := range []string{
+		filepath.Join(contactsDir, name+".json"),
+		filepath.Join(sessionsDir, name),
+		filepath.Join(msgDir, name+".log"),
+		filepath.Join(msgDir, name+".idx"),
+		filepath.Join(msgDir, name+orphanExt),
+		filepath.Join(outboxDir, name+".bin"),
+	} {
+		if err := os.RemoveAll(filepath.Join(s.basePath, p)); err != nil {
+			log.Printf("[Store] !! shred %s: %v", p, err)
+		}
+	}
+	s.logMu.Lock()
+	delete(s.indexes, filepath.Join(s.basePath, msgDir, name+".log"))
+	s.logMu.Unlock()
+	log.Printf("[Store] shredded contact %.8s", name)
+	return nil
+}
+
+// sealWith verschlüsselt plain für rel mit einem bestimmten Subkey.
+func sealWith(key []byte, rel string, plain []byte) ([]byte, error) {
+	nonce, ct, err := encrypt(key, plain, []byte(rel))
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 0, 2+len(nonce)+len(ct))
+	buf = append(buf, blobMagic, storeFormat)
+	buf = append(buf, nonce...)
+	return append(buf, ct...), nil
+}
+
+func openWith(key []byte, rel string, buf []byte) ([]byte, error) {
+	const nonceSize = 12
+	if len(buf) < 2+nonceSize || buf[0] != blobMagic {
+		return nil, errors.New("not a store blob")
+	}
+	if buf[1] != storeFormat {
+		return nil, fmt.Errorf("unsupported blob version %d", buf[1])
+	}
+	return decrypt(key, buf[2:2+nonceSize], buf[2+nonceSize:], []byte(rel))
+}
+
+// loadFormat sagt, ob der Store noch im alten Format (ein Key für alles,
+// keine AD) vorliegt.
+func loadFormat(base string) (legacy bool, err error) {
+	raw, err := os.ReadFile(filepath.Join(base, storeFormatFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil || v > storeFormat {
+		return false, fmt.Errorf("unsupported store format %q", raw)
+	}
+	return v < storeFormat, nil
+}
+
+func formatBytes() []byte {
+	return []byte(strconv.Itoa(storeFormat) + "\n")
+}
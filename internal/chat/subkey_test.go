@@ -0,0 +1,162 @@
+package chat
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Subkeys", func() {
+	var (
+		tmp      string
+		st       *Store
+		bob, eve []byte
+	)
+
+	BeforeEach(func() {
+		var err error
+		tmp, err = os.MkdirTemp("", "subkey_*")
+		Expect(err).NotTo(HaveOccurred())
+		st, err = NewStore(tmp)
+		Expect(err).NotTo(HaveOccurred())
+
+		bob = []byte("bob-identity-key-000000000000000")
+		eve = []byte("eve-identity-key-000000000000000")
+		for _, id := range [][]byte{bob, eve} {
+			Expect(st.AddContactIfMissing(string(id[:3]), id)).To(Succeed())
+			Expect(st.AppendMessage(id, CipherMessage{}, true, "m1", []byte("an "+string(id[:3])))).To(Succeed())
+		}
+	})
+	AfterEach(func() { os.RemoveAll(tmp) })
+
+	logOf := func(id []byte) string { return filepath.Join(tmp, msgDir, b64Name(id)+".log") }
+
+	It("lässt sich nicht durch vertauschte Dateien täuschen", func() {
+		bobLog, _ := os.ReadFile(logOf(bob))
+		Expect(os.WriteFile(logOf(eve), bobLog, 0o600)).To(Succeed())
+		recs, err := st.LoadMessages(eve, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recs).To(BeEmpty())
+
+		// auch eine Datei desselben Kontakts unter anderem Namen passt nicht
+		bobPath := filepath.Join(tmp, contactsDir, b64Name(bob)+".json")
+		raw, _ := os.ReadFile(bobPath)
+		_, err = st.unwrap(filepath.Join(tmp, sessionsDir, b64Name(bob), "state.bin"), raw)
+		Expect(err).To(HaveOccurred())
+		_, err = st.unwrap(bobPath, raw)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("vernichtet mit dem Kontakt-Key den ganzen Verlauf", func() {
+		backup, _ := os.ReadFile(logOf(bob))
+		Expect(st.ShredContact(bob)).To(Succeed())
+		_, err := st.LoadContact(bob)
+		Expect(err).To(MatchError(ErrNoContact))
+
+		// eine zurückgespielte Kopie bleibt unlesbar, auch nach Neustart
+		Expect(os.WriteFile(logOf(bob), backup, 0o600)).To(Succeed())
+		st2, err := NewStore(tmp)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = st2.unwrap(logOf(bob), frameBlob(splitFrames(backup)[0]))
+		Expect(err).To(MatchError(ErrShredded))
+		recs, err := st2.LoadMessages(bob, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recs).To(BeEmpty())
+
+		recs, err = st2.LoadMessages(eve, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recs).To(ConsistOf(HaveField("Plain", "an eve")))
+
+		// Rekey räumt die Reste weg
+		Expect(st2.Rekey("", KDFParams{}, nil)).To(Succeed())
+		Expect(logOf(bob)).NotTo(BeAnExistingFile())
+	})
+
+	It("meldet vertauschte und vernichtete Session-States", func() {
+		stateOf := func(id []byte) string { return filepath.Join(tmp, sessionsDir, b64Name(id), sessionFile) }
+		for _, id := range [][]byte{bob, eve} {
+			dh, err := ecdh.X25519().GenerateKey(rand.Reader)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(st.SaveSession(id, &sessionState{rootKey: rand32(), dhSendPrivKey: dh, dhRecvPubKey: dh.PublicKey()})).To(Succeed())
+		}
+
+		bobState, _ := os.ReadFile(stateOf(bob))
+		Expect(os.WriteFile(stateOf(eve), bobState, 0o600)).To(Succeed())
+		_, err := st.LoadSession(eve)
+		Expect(err).To(MatchError(ContainSubstring("authentication failed")))
+
+		Expect(st.ShredContact(bob)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Dir(stateOf(bob)), 0o700)).To(Succeed())
+		Expect(os.WriteFile(stateOf(bob), bobState, 0o600)).To(Succeed())
+		_, err = st.LoadSession(bob)
+		Expect(err).To(MatchError(ErrShredded))
+	})
+
+	It("migriert einen Store im alten Format", func() {
+		// alten Store nachbauen: alles direkt mit dem Master-Key, ohne AD
+		key := st.MasterKey()
+		Expect(os.RemoveAll(tmp)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(tmp, contactsDir), 0o700)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(tmp, msgDir), 0o700)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(tmp, masterKeyFile), key, 0o600)).To(Succeed())
+
+		c, _ := json.Marshal(Contact{Name: "Bob", IDPub: bob})
+		blob, err := wrapWith(key, c)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(filepath.Join(tmp, contactsDir, b64Name(bob)+".json"), blob, 0o600)).To(Succeed())
+		rec, _ := json.Marshal(CipherMessageWithMeta{Out: true, Plain: "alt", MsgID: "m0"})
+		blob, err = wrapWith(key, rec)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.WriteFile(logOf(bob), lengthPrefixed(blob), 0o600)).To(Succeed())
+
+		st2, err := NewStore(tmp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filepath.Join(tmp, storeFormatFile)).To(BeAnExistingFile())
+		Expect(filepath.Join(tmp, keysDir, b64Name(bob)+".key")).To(BeAnExistingFile())
+		Expect(st2.MasterKey()).To(Equal(key))
+
+		got, err := st2.LoadContact(bob)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got.Name).To(Equal("Bob"))
+		recs, err := st2.LoadMessages(bob, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recs).To(ConsistOf(HaveField("Plain", "alt")))
+
+		// alte Blobs werden danach nicht mehr angenommen
+		raw, _ := os.ReadFile(logOf(bob))
+		Expect(frameBlob(raw)[0]).To(Equal(byte(blobMagic)))
+		Expect(os.WriteFile(logOf(bob), lengthPrefixed(blob), 0o600)).To(Succeed())
+		recs, err = st2.LoadMessages(bob, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recs).To(BeEmpty())
+	})
+})
+
+var _ = Describe("Manager.DeleteContact", func() {
+	It("vergisst Session und Verlauf", func() {
+		tmp, err := os.MkdirTemp("", "delete_*")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(tmp)
+
+		mgr, err := NewManager(tmp, "Alice")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mgr.Initialise()).To(Succeed())
+		list, _ := mgr.Contacts()
+		bobID := list[0].ID
+		Expect(mgr.Send(bobID, "weg damit")).To(Succeed())
+
+		Expect(mgr.DeleteContact(bobID)).To(Succeed())
+		Expect(mgr.sessions).NotTo(HaveKey(bobID))
+		list, err = mgr.Contacts()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(list).To(BeEmpty())
+		Expect(filepath.Join(tmp, keysDir, bobID+".key")).NotTo(BeAnExistingFile())
+		Expect(mgr.DeleteContact(bobID)).To(MatchError(ErrNoContact))
+	})
+})
@@ -5,8 +5,9 @@ import (
 	"crypto/rand"
 	"fmt"
 	"log"
-	"net/http"
+	"net"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/cretz/bine/tor"
@@ -14,9 +15,8 @@ import (
 )
 
 const (
-	dataDir  = "./tor-data"          // bleibt zwischen Starts bestehen
-	keyPath  = "./onion_ed25519.key" // 64-Byte-Datei für feste Adresse
-	timeout  = 2 * time.Minute       // Wartezeit für Bootstrap + Descriptor-Upload
+	torPort    = 80              // virtueller Port des Onion-Services
+	torTimeout = 2 * time.Minute // Wartezeit für Bootstrap + Descriptor-Upload
 )
 
 func loadOrCreateKey(path string) (ed25519.KeyPair, error) {
@@ -32,46 +32,93 @@ func loadOrCreateKey(path string) (ed25519.KeyPair, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := os.WriteFile(path, key.PrivateKey(), 0o600); err != nil {
+	if err := writeFileAtomic(path, key.PrivateKey()); err != nil {
 		return nil, err
 	}
 	return key, nil
 }
 
-func main() {
-	t, err := tor.Start(nil, &tor.StartConf{DataDir: dataDir})
+// TorNetwork ist die Network-Implementierung über einen eigenen Tor-Prozess:
+// ein persistenter v3-Onion-Service zum Empfangen, Tors SOCKS-Proxy zum
+// Wählen. Adressen sind Onion-IDs ohne ".onion".
+type TorNetwork struct {
+	dataDir string // bleibt zwischen Starts bestehen
+	keyPath string // 64-Byte-Datei für feste Adresse
+
+	mu     sync.Mutex
+	tor    *tor.Tor
+	dialer *tor.Dialer
+}
+
+func NewTorNetwork(dataDir, keyPath string) *TorNetwork {
+	return &TorNetwork{dataDir: dataDir, keyPath: keyPath}
+}
+
+func (n *TorNetwork) start(ctx context.Context) (*tor.Tor, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.tor != nil {
+		return n.tor, nil
+	}
+	t, err := tor.Start(ctx, &tor.StartConf{DataDir: n.dataDir})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	defer t.Close()
+	n.tor = t
+	return t, nil
+}
 
-	key, err := loadOrCreateKey(keyPath)
+func (n *TorNetwork) Listen(ctx context.Context) (net.Listener, string, error) {
+	t, err := n.start(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	key, err := loadOrCreateKey(n.keyPath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", err
 	}
 
 	// auf Bootstrap + Descriptor-Upload warten
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, torTimeout)
 	defer cancel()
 
 	onion, err := t.Listen(ctx, &tor.ListenConf{
 		Version3:    true,
 		Key:         key,
-		RemotePorts: []int{80}, // von außen Port 80, intern beliebig
+		RemotePorts: []int{torPort}, // von außen torPort, intern beliebig
 	})
 	if err != nil {
-		log.Fatal(err)
+		return nil, "", err
 	}
-	defer onion.Close()
-
-	fmt.Printf("Onion-Adresse:  http://%s.onion\n", onion.ID)
+	log.Printf("[Tor] onion service up: %s.onion", onion.ID)
+	return onion, onion.ID, nil
+}
 
-	// minimaler Handler mit statischer Antwort
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "Hello from your persistent Go Onion service!")
-	})
+func (n *TorNetwork) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	t, err := n.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	if n.dialer == nil {
+		if n.dialer, err = t.Dialer(ctx, nil); err != nil {
+			n.mu.Unlock()
+			return nil, err
+		}
+	}
+	d := n.dialer
+	n.mu.Unlock()
 
-	// HTTP-Server über Onion-Listener starten
-	log.Fatal(http.Serve(onion, handler))
+	return d.DialContext(ctx, "tcp", fmt.Sprintf("%s.onion:%d", addr, torPort))
 }
 
+func (n *TorNetwork) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.tor == nil {
+		return nil
+	}
+	err := n.tor.Close()
+	n.tor, n.dialer = nil, nil
+	return err
+}
@@ -0,0 +1,348 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Network ist die austauschbare Schicht unter dem TorTransport:
+// TorNetwork im Betrieb, LoopbackNetwork in Tests.
+type Network interface {
+	// Listen öffnet den eigenen Empfangspunkt und liefert dessen Adresse.
+	Listen(ctx context.Context) (net.Listener, string, error)
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+const ioTimeout = 90 * time.Second // Tor-Circuits sind langsam
+
+var ErrNoRoute = errors.New("no route to peer")
+
+// errPaused: der Empfänger ist gesperrt. Die Verbindung endet ohne Ack,
+// der Absender hält die Nachricht im Ausgang statt sie aufzugeben.
+var errPaused = errors.New("transport paused")
+
+// TorTransport stellt Init-, Cipher-, Chunk- und Group-Frames über ein
+// Network zu.
+// Frames im Leitungsformat aus wire.go. Jede Nachricht läuft über eine
+// eigene Verbindung und wird mit einem Ack-Frame quittiert,
+// Fehler beim Empfänger kommen also beim Sender an.
+type TorTransport struct {
+	net Network
+
+	mu       sync.Mutex
+	self     []byte            // eigener Identity-Key (aus Register)
+	addr     string            // eigene Adresse (nach Start)
+	routes   map[string]string // b64(IK) → Adresse
+	sessions []*Session
+	accept   func(from []byte) *Session // neue Session für unbekannte Absender
+	reach    func(id []byte)            // Peer hat sich gemeldet
+	ln       net.Listener
+
+	dispatch sync.Mutex // Sessions sind nicht nebenläufig
+	paused   bool       // unter dispatch: keine Zustellung an Sessions
+
+	delivering bool     // unter mu: eine Zustellung läuft
+	deferred   []func() // unter mu: Antworten, die nach ihr rausgehen
+}
+
+func NewTorTransport(n Network) *TorTransport {
+	return &TorTransport{net: n, routes: map[string]string{}}
+}
+
+// Start öffnet den Listener und nimmt im Hintergrund Verbindungen an.
+func (t *TorTransport) Start(ctx context.Context) error {
+	ln, addr, err := t.net.Listen(ctx)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.ln, t.addr = ln, addr
+	t.mu.Unlock()
+
+	go t.serve(ln)
+	return nil
+}
+
+func (t *TorTransport) Close() error {
+	t.mu.Lock()
+	ln := t.ln
+	t.ln = nil
+	t.mu.Unlock()
+
+	var err error
+	if ln != nil {
+		err = ln.Close()
+	}
+	if c, ok := t.net.(io.Closer); ok {
+		err = errors.Join(err, c.Close())
+	}
+	return err
+}
+
+func (t *TorTransport) Address() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.addr
+}
+
+// AddPeer hinterlegt die Adresse eines Kontakts. Absender eingehender
+// Frames werden automatisch gelernt, sobald der Frame authentisiert ist.
+func (t *TorTransport) AddPeer(id []byte, addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.routes[b64(id)] = addr
+}
+
+// SetAcceptor legt fest, wer Sessions für Inits unbekannter Absender baut.
+func (t *TorTransport) SetAcceptor(fn func(from []byte) *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.accept = fn
+}
+
+// OnReachable meldet Absender eingehender Frames als erreichbar.
+func (t *TorTransport) OnReachable(fn func(id []byte)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reach = fn
+}
+
+func (t *TorTransport) Register(s *Session) {
+	log.Printf("[Tor] Register   key=%s", b64(s.LocalPeer().IdentityPublicKey()))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.self = s.LocalPeer().IdentityPublicKey()
+	t.sessions = append(t.sessions, s)
+}
+
+// SetPaused hält die Zustellung an (Manager gesperrt) oder gibt sie
+// wieder frei. Laufende Zustellungen sind danach abgeschlossen.
+func (t *TorTransport) SetPaused(paused bool) {
+	t.dispatch.Lock()
+	defer t.dispatch.Unlock()
+	t.paused = paused
+}
+
+func (t *TorTransport) SendInit(toID []byte, m InitMessage) error {
+	return t.send(toID, Frame{Type: FrameInit, Init: &m})
+}
+
+func (t *TorTransport) SendCipher(toID []byte, m CipherMessage) error {
+	return t.send(toID, Frame{Type: FrameCipher, Cipher: &m})
+}
+
+func (t *TorTransport) SendChunk(toID []byte, c Chunk) error {
+	return t.send(toID, Frame{Type: FrameChunk, Chunk: &c})
+}
+
+func (t *TorTransport) SendGroup(toID []byte, m GroupMessage) error {
+	return t.send(toID, Frame{Type: FrameGroup, Group: &m})
+}
+
+func (t *TorTransport) send(toID []byte, f Frame) error {
+	t.mu.Lock()
+	addr, ok := t.routes[b64(toID)]
+	f.Sender, f.ReplyTo = t.self, t.addr
+	t.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w %s", ErrNoRoute, b64(toID))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ioTimeout)
+	defer cancel()
+	conn, err := t.net.Dial(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPeerUnreachable, err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(ioTimeout))
+
+	log.Printf("[Tor] send       → %s (%s)", b64(toID), addr)
+	if err := WriteFrame(conn, f); err != nil {
+		return fmt.Errorf("%w: %v", ErrPeerUnreachable, err)
+	}
+	ack, err := ReadFrame(conn)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrPeerUnreachable, err)
+	}
+	if ack.Type != FrameAck {
+		return fmt.Errorf("%w: expected ack, got type %d", ErrMalformedFrame, ack.Type)
+	}
+	if ack.Err == ErrLocked.Error() {
+		// gesperrt nimmt der Empfänger nichts an, entsperrt schon
+		return fmt.Errorf("%w: %s", ErrPeerUnreachable, ack.Err)
+	}
+	if ack.Err != "" {
+		return fmt.Errorf("%w: %s", ErrRejected, ack.Err)
+	}
+	return nil
+}
+
+func (t *TorTransport) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("[Tor] listener closed: %v", err)
+			return
+		}
+		go t.handle(conn)
+	}
+}
+
+func (t *TorTransport) handle(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(ioTimeout))
+
+	ack := Frame{Type: FrameAck}
+	f, err := ReadFrame(conn)
+	if err == nil {
+		err = t.deliver(f)
+	}
+	if errors.Is(err, errPaused) {
+		return
+	}
+	if err != nil {
+		log.Printf("[Tor] !! inbound frame from %s rejected: %v", b64(f.Sender), err)
+		ack.Err = err.Error()
+	}
+	_ = WriteFrame(conn, ack)
+}
+
+// deliver reicht einen Frame an die Session des Absenders weiter.
+func (t *TorTransport) deliver(f Frame) error {
+	payloads := 0
+	for _, set := range []bool{f.Init != nil, f.Cipher != nil, f.Chunk != nil, f.Group != nil} {
+		if set {
+			payloads++
+		}
+	}
+	if len(f.Sender) == 0 || payloads != 1 {
+		return ErrMalformedFrame
+	}
+	if f.Init != nil && !bytes.Equal(f.Init.IdentityPub, f.Sender) {
+		return errors.New("init sender mismatch")
+	}
+	if f.Group != nil && !bytes.Equal(f.Group.Sender, f.Sender) {
+		return errors.New("group sender mismatch")
+	}
+
+	t.dispatch.Lock()
+	if t.paused {
+		t.dispatch.Unlock()
+		return errPaused
+	}
+	t.mu.Lock()
+	t.delivering = true
+	t.mu.Unlock()
+
+	err := t.dispatchFrame(f)
+
+	t.mu.Lock()
+	later := t.deferred
+	t.deferred, t.delivering = nil, false
+	t.mu.Unlock()
+	t.dispatch.Unlock()
+
+	// Quittungen erst ohne dispatch verschicken: schreiben sich zwei Peers
+	// gleichzeitig, warteten sie sonst gegenseitig bis zum Timeout
+	for _, fn := range later {
+		fn()
+	}
+	return err
+}
+
+// later stellt fn bis zum Ende der laufenden Zustellung zurück. Ohne
+// laufende Zustellung läuft fn sofort.
+func (t *TorTransport) later(fn func()) {
+	t.mu.Lock()
+	if t.delivering {
+		t.deferred = append(t.deferred, fn)
+		t.mu.Unlock()
+		return
+	}
+	t.mu.Unlock()
+	fn()
+}
+
+// dispatchFrame übergibt einen geprüften Frame unter dispatch an die
+// Session des Absenders.
+func (t *TorTransport) dispatchFrame(f Frame) error {
+	s := t.sessionFor(f.Sender)
+	var err error
+	switch {
+	case f.Init != nil:
+		err = t.deliverInit(s, f)
+	case s == nil:
+		return ErrNoSession
+	case f.Chunk != nil:
+		err = s.ReceiveChunk(*f.Chunk)
+	case f.Group != nil:
+		err = s.ReceiveGroup(*f.Group)
+	default:
+		err = s.Receive(*f.Cipher)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Route erst lernen, wenn der Frame sich als vom Absender stammend
+	// erwiesen hat; sonst könnte jeder fremde Routen umbiegen. Ein Init
+	// beweist das nicht (IdentityPub kann jeder eintragen), erst die
+	// erste Nachricht unter dem neuen State.
+	if f.ReplyTo != "" && f.Init == nil {
+		t.AddPeer(f.Sender, f.ReplyTo)
+		t.mu.Lock()
+		reach := t.reach
+		t.mu.Unlock()
+		if reach != nil {
+			reach(f.Sender)
+		}
+	}
+	return nil
+}
+
+// deliverInit nimmt einen Handshake an. Eine für einen unbekannten
+// Absender angelegte Session bleibt nur, wenn der Init gültig ist.
+func (t *TorTransport) deliverInit(s *Session, f Frame) error {
+	if s != nil {
+		return s.HandleInit(*f.Init)
+	}
+	t.mu.Lock()
+	accept := t.accept
+	t.mu.Unlock()
+	if accept == nil {
+		return fmt.Errorf("unknown peer(init)")
+	}
+	s = accept(f.Sender)
+	if err := s.HandleInit(*f.Init); err != nil {
+		t.unregister(s)
+		return err
+	}
+	return nil
+}
+
+// unregister vergisst eine Session wieder.
+func (t *TorTransport) unregister(s *Session) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.sessions = slices.DeleteFunc(t.sessions, func(x *Session) bool { return x == s })
+}
+
+func (t *TorTransport) sessionFor(remoteID []byte) *Session {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.sessions {
+		if bytes.Equal(s.RemoteID(), remoteID) {
+			return s
+		}
+	}
+	return nil
+}
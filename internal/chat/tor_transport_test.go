@@ -0,0 +1,205 @@
+package chat
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("TorTransport über Loopback", func() {
+	var (
+		network      *LoopbackNetwork
+		aliceT, bobT *TorTransport
+	)
+
+	BeforeEach(func() {
+		network = NewLoopbackNetwork()
+		aliceT, bobT = NewTorTransport(network), NewTorTransport(network)
+		Expect(aliceT.Start(context.Background())).To(Succeed())
+		Expect(bobT.Start(context.Background())).To(Succeed())
+	})
+	AfterEach(func() {
+		aliceT.Close()
+		bobT.Close()
+	})
+
+	It("stellt Handshake und Nachrichten in beide Richtungen zu", func() {
+		aliceStore, _ := NewStore(GinkgoT().TempDir())
+		bobStore, _ := NewStore(GinkgoT().TempDir())
+		alice := NewSessionFromPeer(NewPeer("Alice"), aliceT, aliceStore)
+		bobPeer := NewPeer("Bob")
+
+		var bob *Session
+		bobT.SetAcceptor(func([]byte) *Session {
+			bob = NewSessionFromPeer(bobPeer, bobT, bobStore)
+			bob.OnError = func(_ []byte, err error) { Fail(err.Error()) }
+			return bob
+		})
+
+		aliceT.AddPeer(bobPeer.IdentityPublicKey(), bobT.Address())
+		Expect(alice.StartHandshake(bobPeer.Bundle())).To(Succeed())
+		Expect(bob).NotTo(BeNil())
+		aliceID := alice.LocalPeer().IdentityPublicKey()
+		Expect(bob.RemoteID()).To(Equal(aliceID))
+
+		Expect(alice.Send([]byte("über Tor"))).To(Succeed())
+		// Bob hat Alices Adresse aus dem Frame gelernt und antwortet
+		Expect(bob.Send([]byte("zurück"))).To(Succeed())
+
+		msgs, err := bob.LoadPlainMessages(aliceID, time.Time{})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(msgs).To(HaveLen(2))
+		Expect(msgs[0].Text).To(Equal("über Tor"))
+
+		msgs, _ = alice.LoadPlainMessages(bobPeer.IdentityPublicKey(), time.Time{})
+		Expect(msgs).To(HaveLen(2))
+		Expect(msgs[1].Text).To(Equal("zurück"))
+
+		// Anhänge laufen als Chunk-Frames über dieselbe Strecke
+		file := bytes.Repeat([]byte("zero"), attachmentChunkSize/2)
+		Expect(alice.SendAttachment("datei.txt", "text/plain", file)).To(Succeed())
+		msgs, _ = bob.LoadPlainMessages(aliceID, time.Time{})
+		Expect(msgs).To(HaveLen(3))
+		Expect(msgs[2].Attachment.State).To(Equal(AttachmentComplete))
+		_, got, err := bobStore.OpenAttachment(msgs[2].Attachment.ID)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(got).To(Equal(file))
+	})
+
+	It("quittiert erst nach der Zustellung, wenn beide gleichzeitig senden", func() {
+		aliceStore, _ := NewStore(GinkgoT().TempDir())
+		bobStore, _ := NewStore(GinkgoT().TempDir())
+		alice := NewSessionFromPeer(NewPeer("Alice"), aliceT, aliceStore)
+		bobPeer := NewPeer("Bob")
+		var bob *Session
+		bobT.SetAcceptor(func([]byte) *Session {
+			bob = NewSessionFromPeer(bobPeer, bobT, bobStore)
+			return bob
+		})
+		aliceT.AddPeer(bobPeer.IdentityPublicKey(), bobT.Address())
+		Expect(alice.StartHandshake(bobPeer.Bundle())).To(Succeed())
+		Expect(alice.Send([]byte("hallo"))).To(Succeed())
+		Expect(bob.Send([]byte("hallo zurück"))).To(Succeed())
+
+		// jede Zustellung quittiert an den Absender, der gerade selbst
+		// zustellt – unter dispatch hingen beide bis zum ioTimeout
+		done := make(chan error, 2)
+		go func() { done <- alice.Send([]byte("gleichzeitig A")) }()
+		go func() { done <- bob.Send([]byte("gleichzeitig B")) }()
+		for range 2 {
+			Eventually(done, 10*time.Second).Should(Receive(BeNil()))
+		}
+
+		msgs, _ := alice.LoadPlainMessages(bobPeer.IdentityPublicKey(), time.Time{})
+		Expect(msgs).To(HaveLen(4))
+		for _, m := range msgs {
+			if m.Out {
+				Expect(m.Status).To(Equal(StatusDelivered))
+			}
+		}
+	})
+
+	It("lässt einen Init in fremdem Namen neben der bestehenden Session warten", func() {
+		aliceStore, _ := NewStore(GinkgoT().TempDir())
+		bobStore, _ := NewStore(GinkgoT().TempDir())
+		alice := NewSessionFromPeer(NewPeer("Alice"), aliceT, aliceStore)
+		bobPeer := NewPeer("Bob")
+		var bob *Session
+		bobT.SetAcceptor(func([]byte) *Session {
+			bob = NewSessionFromPeer(bobPeer, bobT, bobStore)
+			return bob
+		})
+		aliceT.AddPeer(bobPeer.IdentityPublicKey(), bobT.Address())
+		Expect(alice.StartHandshake(bobPeer.Bundle())).To(Succeed())
+		Expect(alice.Send([]byte("hallo"))).To(Succeed())
+		Expect(bob.Send([]byte("hallo zurück"))).To(Succeed())
+		aliceID := alice.LocalPeer().IdentityPublicKey()
+
+		// Eve trägt Alices Identity-Key ein und will die Antworten umleiten
+		forged, err := NewPeer("Eve").InitiateSession(bobPeer.Bundle())
+		Expect(err).NotTo(HaveOccurred())
+		forged.IdentityPub = aliceID
+		f := Frame{Type: FrameInit, Sender: aliceID, ReplyTo: "evil.onion", Init: &forged}
+		Expect(bobT.deliver(f)).To(Succeed())
+		Expect(bobT.routes).To(HaveKeyWithValue(b64(aliceID), aliceT.Address()))
+		Expect(bobPeer.pendingState(aliceID)).NotTo(BeNil())
+
+		// die alte Session trägt weiter in beide Richtungen
+		Expect(alice.Send([]byte("noch da"))).To(Succeed())
+		Expect(bob.Send([]byte("ich auch"))).To(Succeed())
+		msgs, _ := alice.LoadPlainMessages(bobPeer.IdentityPublicKey(), time.Time{})
+		Expect(msgs).To(HaveLen(4))
+		Expect(msgs[3].Text).To(Equal("ich auch"))
+
+		// ein echter neuer Handshake gilt, sobald seine erste Nachricht ankommt
+		Expect(alice.StartHandshake(bobPeer.Bundle())).To(Succeed())
+		Expect(alice.Send([]byte("neu"))).To(Succeed())
+		Expect(bobPeer.pendingState(aliceID)).To(BeNil())
+		Expect(bob.Send([]byte("angekommen"))).To(Succeed())
+		msgs, _ = alice.LoadPlainMessages(bobPeer.IdentityPublicKey(), time.Time{})
+		Expect(msgs).To(HaveLen(6))
+		Expect(msgs[5].Text).To(Equal("angekommen"))
+	})
+
+	It("meldet fehlende Routen und abgelehnte Nachrichten", func() {
+		store, _ := NewStore(GinkgoT().TempDir())
+		alice := NewSessionFromPeer(NewPeer("Alice"), aliceT, store)
+		bobPeer := NewPeer("Bob")
+
+		Expect(alice.StartHandshake(bobPeer.Bundle())).To(MatchError(ErrNoRoute))
+
+		// Route bekannt, aber Bob nimmt keine unbekannten Inits an
+		aliceT.AddPeer(bobPeer.IdentityPublicKey(), bobT.Address())
+		err := alice.StartHandshake(bobPeer.Bundle())
+		Expect(err).To(MatchError(ContainSubstring("unknown peer")))
+	})
+
+	It("lehnt Frames mit gefälschtem Absender ab", func() {
+		initMsg, err := NewPeer("Mallory").InitiateSession(NewPeer("Bob").Bundle())
+		Expect(err).NotTo(HaveOccurred())
+		f := Frame{Type: FrameInit, Sender: []byte("jemand anderes"), Init: &initMsg}
+		Expect(bobT.deliver(f)).To(MatchError(ContainSubstring("sender mismatch")))
+		Expect(bobT.deliver(Frame{Sender: []byte("x")})).To(MatchError(ErrMalformedFrame))
+	})
+
+	It("lernt Routen nur aus authentisierten Frames", func() {
+		aliceStore, _ := NewStore(GinkgoT().TempDir())
+		bobStore, _ := NewStore(GinkgoT().TempDir())
+		alice := NewSessionFromPeer(NewPeer("Alice"), aliceT, aliceStore)
+		bobPeer := NewPeer("Bob")
+		bobT.SetAcceptor(func([]byte) *Session { return NewSessionFromPeer(bobPeer, bobT, bobStore) })
+		var reached int
+		bobT.OnReachable(func([]byte) { reached++ })
+
+		aliceT.AddPeer(bobPeer.IdentityPublicKey(), bobT.Address())
+		Expect(alice.StartHandshake(bobPeer.Bundle())).To(Succeed())
+		aliceID := alice.LocalPeer().IdentityPublicKey()
+		// den Init kann jeder in Alices Namen schicken
+		Expect(bobT.routes).NotTo(HaveKey(b64(aliceID)))
+		Expect(reached).To(BeZero())
+
+		Expect(alice.Send([]byte("hallo"))).To(Succeed())
+		Expect(bobT.routes).To(HaveKeyWithValue(b64(aliceID), aliceT.Address()))
+		Expect(reached).To(Equal(1))
+
+		// gefälschter Cipher-Frame in Alices Namen biegt die Route nicht um
+		spoof := Frame{Type: FrameCipher, Sender: aliceID, ReplyTo: "evil.onion",
+			Cipher: &CipherMessage{Header: []byte("h"), Nonce: make([]byte, 12), Cipher: []byte("x")}}
+		Expect(bobT.deliver(spoof)).NotTo(Succeed())
+		Expect(bobT.routes).To(HaveKeyWithValue(b64(aliceID), aliceT.Address()))
+		Expect(reached).To(Equal(1))
+
+		// ungültiger Init eines Unbekannten hinterlässt keine Session
+		mallory := NewPeer("Mallory")
+		initMsg, err := mallory.InitiateSession(NewPeer("Carol").Bundle())
+		Expect(err).NotTo(HaveOccurred())
+		sessions := len(bobT.sessions)
+		bogus := Frame{Type: FrameInit, Sender: mallory.IdentityPublicKey(), ReplyTo: "evil.onion", Init: &initMsg}
+		Expect(bobT.deliver(bogus)).NotTo(Succeed())
+		Expect(bobT.sessions).To(HaveLen(sessions))
+		Expect(bobT.routes).NotTo(HaveKey(b64(mallory.IdentityPublicKey())))
+	})
+})
@@ -1,6 +1,7 @@
 package chat
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"sync"
@@ -8,29 +9,84 @@ import (
 
 // Payload‐Typen ----------------------------------------------------------------
 
-// InitMessage wird beim X3DH-Handshake verschickt.
-type InitMessage map[string][]byte // (EKa, IK_a usw.)
+// InitMessage wird beim X3DH-/PQXDH-Handshake verschickt. Versions und
+// Suites sind das Angebot des Initiators, Version und Suite die Wahl, die
+// er mit dem Bundle des Responders getroffen hat.
+type InitMessage struct {
+	Version  byte   `json:"v"`
+	Versions []byte `json:"vs"`
+	Suite    byte   `json:"suite"`
+	Suites   []byte `json:"suites"`
+
+	Name string `json:"name,omitempty"` // Anzeigename des Absenders
+
+	IdentityPub     []byte `json:"ik"`
+	EphemeralPub    []byte `json:"ek"`
+	SignedPreKeyID  uint32 `json:"spk"`
+	OneTimePreKeyID uint32 `json:"opk,omitempty"` // 0 = ohne OPK
+	KEMCiphertext   []byte `json:"kem,omitempty"` // nur PQXDH
+
+	Handshake byte `json:"hs"`  // 0 = vor PQXDH (X3DH)
+	KDF       byte `json:"kdf"` // 0 = vor KDF v2
+}
 
 // CipherMessage ist eine verschlüsselte Ratchet‐Nachricht.
 type CipherMessage struct {
-	Header []byte `json:"hdr"`
-	Nonce  []byte `json:"non"`
-	Cipher []byte `json:"ct"`
+	Version byte   `json:"v,omitempty"` // Protokollversion der Session (0 = v1)
+	Header  []byte `json:"hdr"`
+	Nonce   []byte `json:"non"`
+	Cipher  []byte `json:"ct"`
 }
 
 // Transport-Interface ---------------------------------------------------------
 
+// ErrPeerUnreachable: der Peer ist gerade nicht erreichbar; die Nachricht
+// bleibt im Ausgang und wird später erneut versucht.
+var ErrPeerUnreachable = errors.New("peer unreachable")
+
+// ErrRejected: der Peer hat die Nachricht erhalten, aber abgelehnt;
+// ein erneuter Versuch ändert daran nichts.
+var ErrRejected = errors.New("peer rejected message")
+
+// retryable meldet Fehler, nach denen ein späterer Versuch gelingen kann:
+// der Peer ist (noch) nicht erreichbar. Alles andere ist endgültig.
+func retryable(err error) bool {
+	return errors.Is(err, ErrPeerUnreachable) || errors.Is(err, ErrNoRoute)
+}
+
 // Transport sorgt NUR für die Zustellung.  Er weiß nichts von Schlüsseln.
 type Transport interface {
 	SendInit(toID []byte, msg InitMessage) error
 	SendCipher(toID []byte, msg CipherMessage) error
 }
 
+// registrar sind Transports, die eingehende Nachrichten selbst an
+// Sessions verteilen (DummyTransport, TorTransport).
+type registrar interface {
+	Register(s *Session)
+}
+
+// reachability sind Transports, die melden, wenn ein Peer (wieder)
+// erreichbar ist – Anlass für den Ausgang, es sofort erneut zu versuchen.
+type reachability interface {
+	OnReachable(fn func(id []byte))
+}
+
+// deferrer sind Transports, die Antworten auf einen eingehenden Frame
+// erst nach dessen Zustellung verschicken (TorTransport): wer während der
+// Zustellung selbst sendet, wartet sonst auf einen Peer, der gerade
+// dasselbe tut.
+type deferrer interface {
+	later(fn func())
+}
+
 // DummyTransport leitet alles direkt an registrierte Sessions weiter.
 // Später ersetzt du das durch eine Tor-Implementierung.
 type DummyTransport struct {
     mu   sync.Mutex
     peers map[string]*Session
+
+    onReachable func(id []byte)
 }
 
 func NewDummyTransport() *DummyTransport {
@@ -40,8 +96,19 @@ func NewDummyTransport() *DummyTransport {
 func (dt *DummyTransport) Register(s *Session) {
     key := string(s.LocalPeer().IdentityPublicKey())
     log.Printf("[TP] Register   key=%s", b64(s.LocalPeer().IdentityPublicKey()))
-    dt.mu.Lock(); defer dt.mu.Unlock()
+    dt.mu.Lock()
     dt.peers[key] = s
+    notify := dt.onReachable
+    dt.mu.Unlock()
+
+    if notify != nil {
+        notify(s.LocalPeer().IdentityPublicKey())
+    }
+}
+
+func (dt *DummyTransport) OnReachable(fn func(id []byte)) {
+    dt.mu.Lock(); defer dt.mu.Unlock()
+    dt.onReachable = fn
 }
 
 func (dt *DummyTransport) SendInit(id []byte, m InitMessage) error {
@@ -61,11 +128,47 @@ func (dt *DummyTransport) SendCipher(id []byte, m CipherMessage) error {
     dt.mu.Unlock()
 
     if peer != nil {
-        // Peer läuft im selben Prozess → direkt zustellen
-        return peer.Receive(m)
+        // Peer läuft im selben Prozess → direkt zustellen; wie beim Ack
+        // über Tor lehnt der Empfänger ab, außer er ist nur gesperrt
+        err := peer.Receive(m)
+        switch {
+        case err == nil:
+            return nil
+        case errors.Is(err, ErrLocked):
+            return fmt.Errorf("%w: %v", ErrPeerUnreachable, err)
+        }
+        return fmt.Errorf("%w: %v", ErrRejected, err)
     }
 
-    // Peer ist offline/extern → Nachricht als „gesendet“ akzeptieren
+    // Peer ist offline/extern → Aufrufer legt die Nachricht in den Ausgang
+    return fmt.Errorf("%w %s", ErrPeerUnreachable, b64(id))
+}
+
+func (dt *DummyTransport) SendChunk(id []byte, c Chunk) error {
+    dt.mu.Lock()
+    peer := dt.peers[string(id)]
+    dt.mu.Unlock()
+
+    if peer == nil {
+        return fmt.Errorf("%w %s", ErrPeerUnreachable, b64(id))
+    }
+    if err := peer.ReceiveChunk(c); err != nil {
+        return fmt.Errorf("%w: %v", ErrRejected, err)
+    }
+    return nil
+}
+
+func (dt *DummyTransport) SendGroup(id []byte, m GroupMessage) error {
+    dt.mu.Lock()
+    peer := dt.peers[string(id)]
+    dt.mu.Unlock()
+
+    if peer == nil {
+        return fmt.Errorf("%w %s", ErrPeerUnreachable, b64(id))
+    }
+    if err := peer.ReceiveGroup(m); err != nil {
+        return fmt.Errorf("%w: %v", ErrRejected, err)
+    }
     return nil
 }
 
@@ -0,0 +1,388 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Binäres Leitungsformat, das alle echten Transports (Tor, LAN, Relay)
+// teilen. Alle Zahlen Big Endian.
+//
+//	Frame
+//	  u32  L      Länge des Rests (≤ maxFrameLen)
+//	  u8          Typ (1 Init, 2 Cipher, 3 Ack, 4 Chunk, 5 Group)
+//	  u8          Wire-Version (wireVersion)
+//	  u8   S      Länge des Absenders (32; bei Ack auch 0)
+//	  S           Identity-Key des Absenders
+//	  u8   A      Länge der Rückadresse (≤ maxAddrLen)
+//	  A           Rückadresse, transport-spezifisch (z. B. Onion-ID)
+//	  …           Payload je Typ
+//
+//	Init-Payload
+//	  u8 Version, u8 Suite, u8 n, n × Version, u8 m, m × Suite,
+//	  u8 Handshake, u8 KDF, 32 IK, 32 EK, u32 SPK-ID, u32 OPK-ID,
+//	  u16 Länge + KEM-Ciphertext, u8 Länge + Name
+//
+//	Cipher-Payload
+//	  u8 Version, u16 Länge + Header, u8 Länge + Nonce, Rest = Ciphertext
+//
+//	Ack-Payload
+//	  u16 Länge + Fehlertext (leer = zugestellt)
+//
+//	Chunk-Payload (Anhang, außerhalb des Ratchets)
+//	  u8 Länge + Blob-ID, u32 Index, u32 Anzahl, Rest = verschlüsselter Chunk
+//
+//	Group-Payload (Sender-Key-Nachricht, Absender = Frame-Absender)
+//	  u8 Länge + Gruppen-ID, u32 Epoche, u32 n, u8 Länge + Signatur,
+//	  Rest = Ciphertext
+//
+// Decode prüft jede Länge gegen die Obergrenzen und lehnt überzählige
+// Bytes ab; kaputte Frames liefern ErrMalformedFrame, nie eine Panic.
+const wireVersion = 1
+
+type FrameType byte
+
+const (
+	FrameInit   FrameType = 1
+	FrameCipher FrameType = 2
+	FrameAck    FrameType = 3
+	FrameChunk  FrameType = 4
+	FrameGroup  FrameType = 5
+)
+
+const (
+	maxFrameLen  = 1 << 20 // Obergrenze für einen Frame (ohne Längenfeld)
+	maxAddrLen   = 128
+	maxListLen   = 16 // Versionen / Suites im Angebot
+	maxNameLen   = 64
+	maxHeaderLen = 256
+	maxNonceLen  = 32
+	maxErrLen    = 1024
+	maxBlobIDLen = 36 // UUID
+	maxChunkLen  = attachmentChunkSize + 16
+	maxSigLen    = 64 // Ed25519
+	keyLen       = 32 // X25519
+)
+
+var (
+	ErrMalformedFrame = errors.New("malformed frame")
+	ErrFrameTooLarge  = errors.New("frame too large")
+)
+
+// Frame ist eine Nachricht auf der Leitung. Je nach Typ ist genau eines
+// von Init, Cipher, Chunk, Group oder Err belegt.
+type Frame struct {
+	Type    FrameType
+	Sender  []byte // Identity-Key des Absenders
+	ReplyTo string // Rückadresse (optional)
+
+	Init   *InitMessage
+	Cipher *CipherMessage
+	Chunk  *Chunk
+	Group  *GroupMessage // Sender wird nicht doppelt übertragen
+	Err    string        // nur FrameAck
+}
+
+// Encode serialisiert den Frame inklusive Längenfeld.
+func (f Frame) Encode() ([]byte, error) {
+	if len(f.ReplyTo) > maxAddrLen {
+		return nil, fmt.Errorf("%w: reply address too long", ErrMalformedFrame)
+	}
+	if len(f.Sender) != keyLen && !(f.Type == FrameAck && len(f.Sender) == 0) {
+		return nil, fmt.Errorf("%w: sender must be %d bytes", ErrMalformedFrame, keyLen)
+	}
+
+	w := wireWriter{buf: make([]byte, 4, 256)}
+	w.u8(byte(f.Type))
+	w.u8(wireVersion)
+	w.bytes8(f.Sender)
+	w.bytes8([]byte(f.ReplyTo))
+
+	switch f.Type {
+	case FrameInit:
+		if f.Init == nil {
+			return nil, fmt.Errorf("%w: init payload missing", ErrMalformedFrame)
+		}
+		if err := w.init(f.Init); err != nil {
+			return nil, err
+		}
+	case FrameCipher:
+		m := f.Cipher
+		if m == nil {
+			return nil, fmt.Errorf("%w: cipher payload missing", ErrMalformedFrame)
+		}
+		if len(m.Header) > maxHeaderLen || len(m.Nonce) > maxNonceLen {
+			return nil, fmt.Errorf("%w: header or nonce too long", ErrMalformedFrame)
+		}
+		w.u8(m.Version)
+		w.bytes16(m.Header)
+		w.bytes8(m.Nonce)
+		w.buf = append(w.buf, m.Cipher...)
+	case FrameChunk:
+		c := f.Chunk
+		if c == nil {
+			return nil, fmt.Errorf("%w: chunk payload missing", ErrMalformedFrame)
+		}
+		if len(c.Blob) > maxBlobIDLen || len(c.Data) > maxChunkLen {
+			return nil, fmt.Errorf("%w: blob ID or chunk too long", ErrMalformedFrame)
+		}
+		w.bytes8([]byte(c.Blob))
+		w.u32(c.Index)
+		w.u32(c.Total)
+		w.buf = append(w.buf, c.Data...)
+	case FrameGroup:
+		m := f.Group
+		if m == nil {
+			return nil, fmt.Errorf("%w: group payload missing", ErrMalformedFrame)
+		}
+		if len(m.Group) > maxBlobIDLen || len(m.Sig) > maxSigLen {
+			return nil, fmt.Errorf("%w: group ID or signature too long", ErrMalformedFrame)
+		}
+		if !bytes.Equal(m.Sender, f.Sender) {
+			return nil, fmt.Errorf("%w: group sender differs from frame sender", ErrMalformedFrame)
+		}
+		w.bytes8([]byte(m.Group))
+		w.u32(m.Epoch)
+		w.u32(m.N)
+		w.bytes8(m.Sig)
+		w.buf = append(w.buf, m.Cipher...)
+	case FrameAck:
+		if len(f.Err) > maxErrLen {
+			f.Err = f.Err[:maxErrLen]
+		}
+		w.bytes16([]byte(f.Err))
+	default:
+		return nil, fmt.Errorf("%w: unknown type %d", ErrMalformedFrame, f.Type)
+	}
+
+	n := len(w.buf) - 4
+	if n > maxFrameLen {
+		return nil, fmt.Errorf("%w (%d bytes)", ErrFrameTooLarge, n)
+	}
+	binary.BigEndian.PutUint32(w.buf, uint32(n))
+	return w.buf, nil
+}
+
+func (w *wireWriter) init(m *InitMessage) error {
+	switch {
+	case len(m.Versions) > maxListLen || len(m.Suites) > maxListLen:
+		return fmt.Errorf("%w: offer too long", ErrMalformedFrame)
+	case len(m.IdentityPub) != keyLen || len(m.EphemeralPub) != keyLen:
+		return fmt.Errorf("%w: bad key length", ErrMalformedFrame)
+	case len(m.KEMCiphertext) > mlkem.CiphertextSize768:
+		return fmt.Errorf("%w: KEM ciphertext too long", ErrMalformedFrame)
+	case len(m.Name) > maxNameLen:
+		return fmt.Errorf("%w: name too long", ErrMalformedFrame)
+	}
+	w.u8(m.Version)
+	w.u8(m.Suite)
+	w.bytes8(m.Versions)
+	w.bytes8(m.Suites)
+	w.u8(m.Handshake)
+	w.u8(m.KDF)
+	w.buf = append(w.buf, m.IdentityPub...)
+	w.buf = append(w.buf, m.EphemeralPub...)
+	w.u32(m.SignedPreKeyID)
+	w.u32(m.OneTimePreKeyID)
+	w.bytes16(m.KEMCiphertext)
+	w.bytes8([]byte(m.Name))
+	return nil
+}
+
+// Decode liest genau einen Frame (inklusive Längenfeld) aus b.
+func Decode(b []byte) (Frame, error) {
+	if len(b) < 4 {
+		return Frame{}, fmt.Errorf("%w: short frame", ErrMalformedFrame)
+	}
+	n := binary.BigEndian.Uint32(b)
+	if n > maxFrameLen {
+		return Frame{}, fmt.Errorf("%w (%d bytes)", ErrFrameTooLarge, n)
+	}
+	if uint32(len(b)-4) != n {
+		return Frame{}, fmt.Errorf("%w: length %d, have %d", ErrMalformedFrame, n, len(b)-4)
+	}
+	return decodeBody(b[4:])
+}
+
+func decodeBody(b []byte) (Frame, error) {
+	r := wireReader{buf: b}
+	f := Frame{Type: FrameType(r.u8())}
+	if v := r.u8(); r.err == nil && v != wireVersion {
+		return Frame{}, fmt.Errorf("%w: wire v%d", ErrUnsupportedVersion, v)
+	}
+	f.Sender = r.bytes8(keyLen)
+	f.ReplyTo = string(r.bytes8(maxAddrLen))
+	if r.err != nil {
+		return Frame{}, r.err
+	}
+	if len(f.Sender) != keyLen && !(f.Type == FrameAck && len(f.Sender) == 0) {
+		return Frame{}, fmt.Errorf("%w: sender must be %d bytes", ErrMalformedFrame, keyLen)
+	}
+
+	switch f.Type {
+	case FrameInit:
+		m := &InitMessage{
+			Version:  r.u8(),
+			Suite:    r.u8(),
+			Versions: r.bytes8(maxListLen),
+			Suites:   r.bytes8(maxListLen),
+		}
+		m.Handshake = r.u8()
+		m.KDF = r.u8()
+		m.IdentityPub = r.fixed(keyLen)
+		m.EphemeralPub = r.fixed(keyLen)
+		m.SignedPreKeyID = r.u32()
+		m.OneTimePreKeyID = r.u32()
+		m.KEMCiphertext = r.bytes16(mlkem.CiphertextSize768)
+		m.Name = string(r.bytes8(maxNameLen))
+		f.Init = m
+	case FrameCipher:
+		m := &CipherMessage{Version: r.u8()}
+		m.Header = r.bytes16(maxHeaderLen)
+		m.Nonce = r.bytes8(maxNonceLen)
+		m.Cipher = r.rest()
+		f.Cipher = m
+	case FrameChunk:
+		c := &Chunk{Blob: string(r.bytes8(maxBlobIDLen))}
+		c.Index = r.u32()
+		c.Total = r.u32()
+		c.Data = r.rest()
+		if r.err == nil && len(c.Data) > maxChunkLen {
+			r.err = fmt.Errorf("%w: chunk of %d bytes", ErrMalformedFrame, len(c.Data))
+		}
+		f.Chunk = c
+	case FrameGroup:
+		m := &GroupMessage{Group: string(r.bytes8(maxBlobIDLen)), Sender: f.Sender}
+		m.Epoch = r.u32()
+		m.N = r.u32()
+		m.Sig = r.bytes8(maxSigLen)
+		m.Cipher = r.rest()
+		f.Group = m
+	case FrameAck:
+		f.Err = string(r.bytes16(maxErrLen))
+	default:
+		return Frame{}, fmt.Errorf("%w: unknown type %d", ErrMalformedFrame, f.Type)
+	}
+	if r.err == nil && len(r.buf) > 0 {
+		r.err = fmt.Errorf("%w: %d trailing bytes", ErrMalformedFrame, len(r.buf))
+	}
+	if r.err != nil {
+		return Frame{}, r.err
+	}
+	return f, nil
+}
+
+// WriteFrame kodiert f und schreibt es in einem Stück.
+func WriteFrame(w io.Writer, f Frame) error {
+	buf, err := f.Encode()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(buf)
+	return err
+}
+
+// ReadFrame liest einen Frame; die Länge wird vor dem Allozieren geprüft.
+func ReadFrame(r io.Reader) (Frame, error) {
+	var hdr [4]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return Frame{}, err
+	}
+	n := binary.BigEndian.Uint32(hdr[:])
+	if n > maxFrameLen {
+		return Frame{}, fmt.Errorf("%w (%d bytes)", ErrFrameTooLarge, n)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return Frame{}, err
+	}
+	return decodeBody(body)
+}
+
+// ───────────────────────── Hilfstypen ────────────────────────────
+
+type wireWriter struct{ buf []byte }
+
+func (w *wireWriter) u8(v byte)    { w.buf = append(w.buf, v) }
+func (w *wireWriter) u32(v uint32) { w.buf = binary.BigEndian.AppendUint32(w.buf, v) }
+func (w *wireWriter) bytes8(b []byte) {
+	w.u8(byte(len(b)))
+	w.buf = append(w.buf, b...)
+}
+func (w *wireWriter) bytes16(b []byte) {
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// wireReader merkt sich den ersten Fehler; danach liefern alle Lesezugriffe
+// Nullwerte, sodass Decode linear bleibt.
+type wireReader struct {
+	buf []byte
+	err error
+}
+
+func (r *wireReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.buf) {
+		r.err = fmt.Errorf("%w: truncated", ErrMalformedFrame)
+		return nil
+	}
+	out := r.buf[:n:n]
+	r.buf = r.buf[n:]
+	return out
+}
+
+func (r *wireReader) u8() byte {
+	if b := r.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *wireReader) u32() uint32 {
+	if b := r.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *wireReader) fixed(n int) []byte {
+	return bytes.Clone(r.take(n))
+}
+
+func (r *wireReader) bytes8(limit int) []byte {
+	return r.limited(int(r.u8()), limit)
+}
+
+func (r *wireReader) bytes16(limit int) []byte {
+	b := r.take(2)
+	if b == nil {
+		return nil
+	}
+	return r.limited(int(binary.BigEndian.Uint16(b)), limit)
+}
+
+func (r *wireReader) limited(n, limit int) []byte {
+	if r.err == nil && n > limit {
+		r.err = fmt.Errorf("%w: field of %d bytes exceeds %d", ErrMalformedFrame, n, limit)
+	}
+	if n == 0 {
+		return nil
+	}
+	return bytes.Clone(r.take(n))
+}
+
+func (r *wireReader) rest() []byte {
+	if r.err != nil {
+		return nil
+	}
+	out := bytes.Clone(r.buf)
+	r.buf = nil
+	return out
+}
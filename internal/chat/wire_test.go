@@ -0,0 +1,175 @@
+package chat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"math/rand/v2"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// Golden Vectors: ändern sie sich, ist das Leitungsformat gebrochen.
+var (
+	goldenIK = bytes.Repeat([]byte{0x11}, 32)
+	goldenEK = bytes.Repeat([]byte{0x22}, 32)
+
+	goldenInit = Frame{Type: FrameInit, Sender: goldenIK, ReplyTo: "abc", Init: &InitMessage{
+		Version: protocolV2, Suite: suiteAES256GCM,
+		Versions: []byte{2, 1}, Suites: []byte{1, 2},
+		Handshake: handshakePQXDH, KDF: kdfV2,
+		IdentityPub: goldenIK, EphemeralPub: goldenEK,
+		SignedPreKeyID: 7, OneTimePreKeyID: 42,
+		KEMCiphertext: []byte{0xaa, 0xbb}, Name: "Bob",
+	}}
+	goldenInitHex = strings.Join([]string{
+		"00000081", "01", "01", // Länge, Typ, Wire-Version
+		"20" + strings.Repeat("11", 32), // Absender
+		"03616263",                      // Rückadresse "abc"
+		"02", "01", "020201", "020102",  // Version, Suite, Angebot
+		"02", "02", // Handshake, KDF
+		strings.Repeat("11", 32), strings.Repeat("22", 32),
+		"00000007", "0000002a", // SPK-ID, OPK-ID
+		"0002aabb", "03426f62", // KEM-Ciphertext, Name "Bob"
+	}, "")
+
+	goldenCipher = Frame{Type: FrameCipher, Sender: goldenIK, Cipher: &CipherMessage{
+		Version: protocolV2, Header: []byte{1, 2, 3}, Cipher: []byte("hi"),
+	}}
+	goldenCipherHex = strings.Join([]string{
+		"0000002d", "02", "01",
+		"20" + strings.Repeat("11", 32),
+		"00",                     // keine Rückadresse
+		"02", "0003010203", "00", // Version, Header, leere Nonce
+		"6869", // Ciphertext "hi"
+	}, "")
+
+	goldenChunk = Frame{Type: FrameChunk, Sender: goldenIK, Chunk: &Chunk{
+		Blob: "b1", Index: 2, Total: 3, Data: []byte{0xde, 0xad},
+	}}
+	goldenChunkHex = strings.Join([]string{
+		"00000031", "04", "01",
+		"20" + strings.Repeat("11", 32),
+		"00",                         // keine Rückadresse
+		"026231", "00000002", "00000003", // Blob "b1", Index, Anzahl
+		"dead",
+	}, "")
+
+	goldenGroup = Frame{Type: FrameGroup, Sender: goldenIK, Group: &GroupMessage{
+		Group: "g1", Sender: goldenIK, Epoch: 1, N: 2, Sig: []byte{0x51, 0x9a}, Cipher: []byte("hi"),
+	}}
+	goldenGroupHex = strings.Join([]string{
+		"00000034", "05", "01",
+		"20" + strings.Repeat("11", 32),
+		"00",                             // keine Rückadresse
+		"026731", "00000001", "00000002", // Gruppe "g1", Epoche, n
+		"02519a", "6869", // Signatur, Ciphertext "hi"
+	}, "")
+
+	goldenAck    = Frame{Type: FrameAck, Err: "nope"}
+	goldenAckHex = "0000000a" + "03" + "01" + "00" + "00" + "00046e6f7065"
+)
+
+var _ = Describe("Leitungsformat", func() {
+
+	DescribeTable("kodiert exakt die Golden Vectors",
+		func(f Frame, want string) {
+			b, err := f.Encode()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(hex.EncodeToString(b)).To(Equal(want))
+
+			back, err := Decode(b)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(back).To(Equal(f))
+		},
+		Entry("Init", goldenInit, goldenInitHex),
+		Entry("Cipher", goldenCipher, goldenCipherHex),
+		Entry("Ack", goldenAck, goldenAckHex),
+		Entry("Chunk", goldenChunk, goldenChunkHex),
+		Entry("Group", goldenGroup, goldenGroupHex),
+	)
+
+	It("transportiert einen echten Handshake", func() {
+		alice, bob := NewPeer("Alice"), NewPeer("Bob")
+		initMsg, err := alice.InitiateSession(bob.Bundle())
+		Expect(err).NotTo(HaveOccurred())
+
+		var buf bytes.Buffer
+		Expect(WriteFrame(&buf, Frame{Type: FrameInit, Sender: alice.IdentityPublicKey(), Init: &initMsg})).To(Succeed())
+		f, err := ReadFrame(&buf)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(bob.AcceptSession(*f.Init)).To(Succeed())
+	})
+
+	It("lehnt jede Verkürzung und überzählige Bytes ab", func() {
+		full, _ := goldenInit.Encode()
+		for n := range len(full) {
+			_, err := Decode(full[:n])
+			Expect(err).To(HaveOccurred(), "Länge %d", n)
+		}
+
+		// Längenfeld passt, aber ein Byte zu viel im Payload
+		long := append(bytes.Clone(full), 0)
+		binary.BigEndian.PutUint32(long, uint32(len(long)-4))
+		_, err := Decode(long)
+		Expect(err).To(MatchError(ErrMalformedFrame))
+	})
+
+	It("prüft Obergrenzen und Versionen", func() {
+		_, err := ReadFrame(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+		Expect(err).To(MatchError(ErrFrameTooLarge))
+
+		b, _ := goldenCipher.Encode()
+		b[5] = 9 // Wire-Version
+		_, err = Decode(b)
+		Expect(err).To(MatchError(ErrUnsupportedVersion))
+
+		b, _ = goldenCipher.Encode()
+		b[4] = 77 // Typ
+		_, err = Decode(b)
+		Expect(err).To(MatchError(ErrMalformedFrame))
+
+		tooLong := goldenInit
+		tooLong.Init = &InitMessage{IdentityPub: goldenIK, EphemeralPub: goldenEK, Name: strings.Repeat("x", maxNameLen+1)}
+		_, err = tooLong.Encode()
+		Expect(err).To(MatchError(ErrMalformedFrame))
+
+		_, err = Frame{Type: FrameCipher, Sender: []byte("kurz"), Cipher: &CipherMessage{}}.Encode()
+		Expect(err).To(MatchError(ErrMalformedFrame))
+	})
+
+	It("übersteht zufällig verfälschte Frames ohne Panic", func() {
+		r := rand.New(rand.NewPCG(1, 2))
+		for _, f := range []Frame{goldenInit, goldenCipher, goldenAck, goldenChunk, goldenGroup} {
+			orig, _ := f.Encode()
+			for range 2000 {
+				b := bytes.Clone(orig)
+				for range 1 + r.IntN(4) {
+					b[r.IntN(len(b))] = byte(r.Uint32())
+				}
+				Expect(func() { _, _ = Decode(b) }).NotTo(Panic())
+			}
+		}
+	})
+})
+
+func FuzzDecode(f *testing.F) {
+	for _, fr := range []Frame{goldenInit, goldenCipher, goldenAck, goldenChunk, goldenGroup} {
+		b, _ := fr.Encode()
+		f.Add(b)
+	}
+	f.Fuzz(func(t *testing.T, b []byte) {
+		fr, err := Decode(b)
+		if err != nil {
+			return
+		}
+		// was dekodiert, muss sich wieder identisch kodieren lassen
+		again, err := fr.Encode()
+		if err != nil || !bytes.Equal(again, b) {
+			t.Fatalf("re-encode mismatch: %x vs %x (%v)", again, b, err)
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package chat
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+
+	"filippo.io/edwards25519"
+	"filippo.io/edwards25519/field"
+)
+
+// XEdDSA (wie Signal): Pre-Keys werden mit dem X25519-Identity-Key selbst
+// signiert. Aus dessen Montgomery-u folgt der Edwards-Punkt mit
+// Vorzeichenbit 0; gegen ihn prüft ein gewöhnliches Ed25519-Verify. Einen
+// eigenen Signaturschlüssel, den ein Bundle beliebig mitbringen könnte,
+// gibt es damit nicht.
+
+// hash1 aus der XEdDSA-Spezifikation: 2^256 − 2 als Präfix trennt die
+// Nonce-Ableitung von allen Ed25519-Hashes.
+var xeddsaPrefix = append([]byte{0xfe}, bytes.Repeat([]byte{0xff}, 31)...)
+
+// xeddsaSign signiert msg mit dem Identity-Key.
+func xeddsaSign(priv *ecdh.PrivateKey, msg []byte) ([]byte, error) {
+	a, err := edwards25519.NewScalar().SetBytesWithClamping(priv.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	A := new(edwards25519.Point).ScalarBaseMult(a)
+	if A.Bytes()[31]&0x80 != 0 {
+		// der Verifizierer kennt nur u, also gilt der Punkt mit x ≥ 0
+		a.Negate(a)
+		A.Negate(A)
+	}
+
+	z := make([]byte, 64)
+	if _, err := rand.Read(z); err != nil {
+		return nil, err
+	}
+	h := sha512.New()
+	h.Write(xeddsaPrefix)
+	h.Write(a.Bytes())
+	h.Write(msg)
+	h.Write(z)
+	r, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	R := new(edwards25519.Point).ScalarBaseMult(r).Bytes()
+
+	h.Reset()
+	h.Write(R)
+	h.Write(A.Bytes())
+	h.Write(msg)
+	c, err := edwards25519.NewScalar().SetUniformBytes(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	s := edwards25519.NewScalar().MultiplyAdd(c, a, r)
+	return append(R, s.Bytes()...), nil
+}
+
+// xeddsaVerify prüft eine Signatur gegen den X25519-Identity-Key idPub.
+func xeddsaVerify(idPub, msg, sig []byte) bool {
+	pub, ok := edwardsFromMontgomery(idPub)
+	return ok && len(sig) == ed25519.SignatureSize && ed25519.Verify(pub, msg, sig)
+}
+
+// edwardsFromMontgomery bildet u auf y = (u − 1) / (u + 1) ab, mit
+// Vorzeichenbit 0. Nur kanonische u < p werden angenommen.
+func edwardsFromMontgomery(u []byte) (ed25519.PublicKey, bool) {
+	if len(u) != 32 {
+		return nil, false
+	}
+	x, err := new(field.Element).SetBytes(u)
+	if err != nil || !bytes.Equal(x.Bytes(), u) {
+		return nil, false
+	}
+	one := new(field.Element).One()
+	num := new(field.Element).Subtract(x, one)
+	den := new(field.Element).Add(x, one)
+	y := new(field.Element).Multiply(num, den.Invert(den))
+	return y.Bytes(), true
+}